@@ -0,0 +1,212 @@
+package machineutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+)
+
+var ErrBusTimeout error = errors.New("bus call timed out")
+
+// CallTimeout bounds every bus call, 0 waits forever
+var CallTimeout = time.Minute
+
+// SlowCallTimeout bounds the calls copying or removing whole images, machined only answers once it is done
+var SlowCallTimeout = 30 * time.Minute
+
+// ReconnectAttempts is how often a call is retried on a new connection after the bus went away
+var ReconnectAttempts = 3
+
+// ReconnectDelay is waited before the first reconnect, doubling with every further attempt
+var ReconnectDelay = time.Second
+
+var slowCalls = []string{
+	machinedDbusInterface + ".CloneImage",
+	machinedDbusInterface + ".RemoveImage",
+	machinedDbusInterface + ".CleanPool",
+	machinedDbusMachineInterface + ".CopyTo",
+	machinedDbusMachineInterface + ".CopyToWithFlags",
+}
+
+func callTimeout(method string) time.Duration {
+	if CallTimeout > 0 && slices.Contains(slowCalls, method) {
+		return SlowCallTimeout
+	}
+	return CallTimeout
+}
+
+// connect opens a private system bus connection subscribed to systemd, JobRemoved is only emitted to subscribers
+func connect() (*dbus.Conn, error) {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, err
+	}
+	methods := []dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}
+	err = conn.Auth(methods)
+	if err == nil {
+		err = conn.Hello()
+	}
+	if err == nil {
+		err = conn.Object(systemdDbusService, systemdDbusPath).Call(systemdDbusInterface+".Subscribe", 0).Err
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bus returns the current connection, it changes when the old one died
+func (c *machineUtil) bus() *dbus.Conn {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.conn
+}
+
+// Close shuts the bus connection down, the manager can't be used anymore afterwards
+func (c *machineUtil) Close() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *machineUtil) isClosed() bool {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.closed
+}
+
+// reconnect replaces the dead connection old, unless another caller already did
+func (c *machineUtil) reconnect(old *dbus.Conn) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		return dbus.ErrClosed
+	}
+	if c.conn != old {
+		return nil
+	}
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
+	slog.Info("Reconnected to the system bus")
+	old.Close()
+	c.conn = conn
+	return nil
+}
+
+// busObject is a bus object that survives reconnects, every call goes to the current connection
+type busObject struct {
+	c    *machineUtil
+	dest string
+	path dbus.ObjectPath
+}
+
+var _ dbus.BusObject = (*busObject)(nil)
+
+func (c *machineUtil) object(dest string, path dbus.ObjectPath) dbus.BusObject {
+	return &busObject{c, dest, path}
+}
+
+func (o *busObject) current() dbus.BusObject {
+	return o.c.bus().Object(o.dest, o.path)
+}
+
+func (o *busObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	return o.CallWithContext(context.Background(), method, flags, args...)
+}
+
+// CallWithContext times the call out after callTimeout and retries it on a new connection when the bus went away.
+// Calls failing on a live connection are never retried, they may have had an effect.
+func (o *busObject) CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	span := util.Trace(method, "rpc.system", "dbus", "rpc.service", o.dest, "dbus.path", string(o.path))
+	call := o.call(ctx, method, flags, args...)
+	span.End(call.Err)
+	return call
+}
+
+func (o *busObject) call(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	delay := ReconnectDelay
+	for attempt := 0; ; attempt++ {
+		conn := o.c.bus()
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := callTimeout(method); timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		call := conn.Object(o.dest, o.path).CallWithContext(callCtx, method, flags, args...)
+		cancel()
+		if errors.Is(call.Err, context.DeadlineExceeded) && ctx.Err() == nil {
+			call.Err = fmt.Errorf("%s: %w", method, ErrBusTimeout)
+		}
+		if call.Err == nil || conn.Connected() || attempt >= ReconnectAttempts || ctx.Err() != nil || o.c.isClosed() {
+			return call
+		}
+		slog.Warn("Lost the system bus connection, reconnecting", "method", method, "error", call.Err)
+		time.Sleep(delay)
+		delay *= 2
+		if err := o.c.reconnect(conn); err != nil {
+			slog.Warn("Reconnecting to the system bus", "error", err)
+		}
+	}
+}
+
+func (o *busObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return o.current().Go(method, flags, ch, args...)
+}
+
+func (o *busObject) GoWithContext(ctx context.Context, method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return o.current().GoWithContext(ctx, method, flags, ch, args...)
+}
+
+func (o *busObject) AddMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return o.current().AddMatchSignal(iface, member, options...)
+}
+
+func (o *busObject) RemoveMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return o.current().RemoveMatchSignal(iface, member, options...)
+}
+
+func (o *busObject) GetProperty(p string) (dbus.Variant, error) {
+	var result dbus.Variant
+	err := o.StoreProperty(p, &result)
+	return result, err
+}
+
+// splitProperty splits a property like org.freedesktop.machine1.Machine.State into its interface and name
+func splitProperty(p string) (string, string, error) {
+	idx := strings.LastIndex(p, ".")
+	if idx < 0 {
+		return "", "", fmt.Errorf("invalid property %q", p)
+	}
+	return p[:idx], p[idx+1:], nil
+}
+
+func (o *busObject) StoreProperty(p string, value interface{}) error {
+	iface, name, err := splitProperty(p)
+	if err != nil {
+		return err
+	}
+	return o.Call("org.freedesktop.DBus.Properties.Get", 0, iface, name).Store(value)
+}
+
+func (o *busObject) SetProperty(p string, v interface{}) error {
+	iface, name, err := splitProperty(p)
+	if err != nil {
+		return err
+	}
+	return o.Call("org.freedesktop.DBus.Properties.Set", 0, iface, name, dbus.MakeVariant(v)).Err
+}
+
+func (o *busObject) Destination() string   { return o.dest }
+func (o *busObject) Path() dbus.ObjectPath { return o.path }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,576 +12,2028 @@ import (
 	"net/netip"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/coreos/go-systemd/unit"
 	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/reconcile"
 	"github.com/eax255/systemd-containers/machineutil/util"
 	"gopkg.in/yaml.v3"
 )
 
-type MountPoint struct {
-	Name         string
-	Device       string
-	Target       string
-	MountPoint   string
-	FS           string
-	AutoFs       bool
-	Options      string
-	MountOptions []*unit.UnitOption
-}
-
-func (m *MountPoint) Normalize() {
-	if m.MountPoint == "" {
-		m.MountPoint = "/var/lib/machines/" + m.Name
-	}
-	if m.FS != "" {
-		m.MountOptions = append(m.MountOptions, &unit.UnitOption{
-			Section: "Mount",
-			Name:    "Type",
-			Value:   m.FS,
-		})
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type Options struct {
+	ConfigFiles stringList
+	Debug       bool
+	SkipChecks  bool
+	ReportFile  string
+	Instance    string
+	Runtime     bool
+	Rollback    bool
+	ResetFailed bool
+	Force       bool
+	AuditLog    string
+	OTLP        string
+	Quiet       bool
+	Progress    bool
+	Color       string
+	DryRun      bool
+	// progress draws the -progress line, set up by SetupLogging
+	progress *progressPrinter
+}
+
+func (o *Options) Configs() []string {
+	if len(o.ConfigFiles) == 0 {
+		return []string{"-"}
 	}
-	if m.AutoFs {
-		if m.Options != "" {
-			m.Options += ",x-systemd.makefs,x-systemd.growfs"
-		} else {
-			m.Options = "x-systemd.makefs,x-systemd.growfs"
+	return o.ConfigFiles
+}
+
+// RegisterCommon adds the flags shared by every config consuming subcommand
+func (o *Options) RegisterCommon(fs *flag.FlagSet) {
+	fs.Var(&o.ConfigFiles, "config", "Config file to use, may be repeated to layer files (default \"-\")")
+	fs.BoolVar(&o.Debug, "debug", false, "Enable debug log")
+	fs.BoolVar(&o.Quiet, "quiet", false, "Only log errors")
+	fs.StringVar(&o.Color, "color", util.ColorAuto, "Color plans and summaries: auto colors them on a terminal, always or never")
+	fs.StringVar(&o.Instance, "instance", "", "Suffix appended to every machine name to run an isolated copy of the config")
+	fs.StringVar(&o.Instance, "suffix", "", "Alias for -instance")
+	fs.BoolVar(&util.ShowSecrets, "show-secrets", false, "Don't redact secret vars and the input and output of Sensitive commands from logs and reports")
+	fs.BoolVar(&reconcile.StrictConfig, "strict", reconcile.StrictConfig, "Reject unknown fields in config files, -strict=false ignores them")
+	fs.DurationVar(&machineutil.CallTimeout, "bus-timeout", machineutil.CallTimeout, "Give up on machined and systemd calls taking longer, 0 waits forever")
+	fs.DurationVar(&machineutil.Poll.Interval, "poll-interval", machineutil.Poll.Interval, "First wait between polls for machines, units, jobs and probes")
+	fs.DurationVar(&machineutil.Poll.Max, "poll-max-interval", machineutil.Poll.Max, "Longest wait between polls, the wait grows up to it with every poll")
+	fs.Float64Var(&machineutil.Poll.Jitter, "poll-jitter", machineutil.Poll.Jitter, "Randomize every wait between polls by up to this fraction")
+	fs.Func("clone-margin", "Space to keep free on top of the template size when cloning, e.g. 2G (default "+util.FormatBytes(machineutil.CloneMargin)+")", func(s string) error {
+		if s == "0" {
+			machineutil.CloneMargin = 0
+			return nil
 		}
+		size, err := util.ParseSize(s)
+		machineutil.CloneMargin = size
+		return err
+	})
+}
+
+// LoadConfig loads the configured files for the selected instance
+func (o *Options) LoadConfig() (*reconcile.Config, error) {
+	return reconcile.LoadConfig(o.Configs(), o.Instance)
+}
+
+func (o *Options) Register(fs *flag.FlagSet) {
+	o.RegisterCommon(fs)
+	fs.BoolVar(&o.SkipChecks, "skip-checks", false, "Skip host prerequisite checks")
+	fs.StringVar(&o.ReportFile, "report", "", "Write a JSON report of the run to this file")
+	fs.BoolVar(&o.Runtime, "runtime", false, "Write generated units and zone networks under /run instead of /etc so they vanish on reboot")
+	fs.BoolVar(&o.Force, "force", false, "Take over existing unit and settings files that weren't generated by machineutil")
+	fs.BoolVar(&o.ResetFailed, "reset-failed", false, "Reset machine units in failed state before starting them")
+	fs.StringVar(&o.AuditLog, "audit-log", "", "Append every change made to this file, \"journal\" logs to the journal as "+util.AuditIdentifier)
+	fs.BoolVar(&o.Rollback, "rollback", false, "Restore the previous files, image and state of a machine when creating or updating it fails")
+	fs.BoolVar(&o.Progress, "progress", false, "Show a line per machine with its progress instead of the log, warnings and errors are still logged")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "Run against in-memory copies of the images, units and files of the host and print the changes and commands instead of making them")
+	fs.StringVar(&o.OTLP, "otlp-endpoint", util.OTLPEndpoint(), "Export a trace of the run to this OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+}
+
+func SetupLogging(debug bool) {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
 	}
-	if m.Options != "" {
-		found := false
-		for _, mnt := range m.MountOptions {
-			if mnt.Section != "Mount" {
-				continue
-			}
-			if mnt.Name != "Options" {
-				continue
-			}
-			found = true
-			mnt.Value += "," + m.Options
-			break
-		}
-		if !found {
-			m.MountOptions = append(m.MountOptions, &unit.UnitOption{
-				Section: "Mount",
-				Name:    "Options",
-				Value:   m.Options,
-			})
-		}
+	setupLog(os.Stderr, level)
+}
+
+func setupLog(w io.Writer, level slog.Level) {
+	log_options := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: util.RedactAttr,
 	}
+	slog.SetDefault(
+		slog.New(
+			slog.NewTextHandler(
+				w,
+				log_options,
+			),
+		),
+	)
 }
 
-func (m *MountPoint) GetNspawn() []*unit.UnitOption {
-	return []*unit.UnitOption{
-		&unit.UnitOption{
-			Section: "Files",
-			Name:    "Bind",
-			Value:   m.MountPoint + ":" + m.Target + ":idmap",
-		},
+// SetupLogging picks the log level of the output mode, -debug wins over -quiet and -progress.
+// With -progress the log is written above the progress line. -color applies to standard output.
+func (o *Options) SetupLogging() {
+	level := slog.LevelInfo
+	switch {
+	case o.Debug:
+		level = slog.LevelDebug
+	case o.Quiet:
+		level = slog.LevelError
+	case o.Progress:
+		level = slog.LevelWarn
+	}
+	var w io.Writer = os.Stderr
+	if o.Progress && !o.Quiet {
+		o.progress = newProgressPrinter(os.Stderr)
+		w = o.progress
+	}
+	setupLog(w, level)
+	var err error
+	if util.Color, err = util.ColorEnabled(o.Color, os.Stdout); err != nil {
+		slog.Warn("Ignoring -color", "error", err)
 	}
 }
 
-func (m *MountPoint) Unit() string {
-	return unit.UnitNamePathEscape(m.MountPoint) + ".mount"
+// spinnerFrames animate the progress line of the machine being reconciled
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// progressPrinter prints a line per finished machine. On a terminal the line of the current machine is redrawn
+// with a spinner and its phase, log output is written above it.
+type progressPrinter struct {
+	w       io.Writer
+	tty     bool
+	mu      sync.Mutex
+	i       int
+	total   int
+	fqdn    string
+	phase   string
+	started time.Time
+	frame   int
+	stop    chan struct{}
 }
 
-func (m *MountPoint) CreateMount(log *slog.Logger) (bool, error) {
-	opts := []*unit.UnitOption{
-		&unit.UnitOption{
-			Section: "Unit",
-			Name:    "Description",
-			Value:   "Machineutil mountpoint " + m.Name,
-		},
-		&unit.UnitOption{
-			Section: "Unit",
-			Name:    "After",
-			Value:   "blockdev@" + unit.UnitNamePathEscape(m.Device),
-		},
-		&unit.UnitOption{
-			Section: "Mount",
-			Name:    "What",
-			Value:   m.Device,
-		},
-		&unit.UnitOption{
-			Section: "Mount",
-			Name:    "Where",
-			Value:   m.MountPoint,
-		},
+var _ reconcile.Progress = (*progressPrinter)(nil)
+
+func newProgressPrinter(f *os.File) *progressPrinter {
+	return &progressPrinter{w: f, tty: util.IsTerminal(int(f.Fd()))}
+}
+
+func (p *progressPrinter) Start(i, total int, fqdn string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.i, p.total, p.fqdn, p.phase, p.started = i, total, fqdn, "detecting", time.Now()
+	p.draw()
+	if p.tty && p.stop == nil {
+		p.stop = make(chan struct{})
+		go p.spin(p.stop)
 	}
-	mount_unit := "/etc/systemd/system/" + m.Unit()
-	opts = append(opts, m.MountOptions...)
-	return util.EnsureUnit(log, mount_unit, opts)
 }
 
-func (m *MountPoint) RemoveMount(log *slog.Logger) (bool, error) {
-	opts := []*unit.UnitOption{}
-	mount_unit := "/etc/systemd/system/" + m.Unit()
-	return util.EnsureUnit(log, mount_unit, opts)
+func (p *progressPrinter) Phase(fqdn, phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	p.draw()
 }
 
-func (m *MountPoint) GetOverride() []*unit.UnitOption {
-	return []*unit.UnitOption{
-		&unit.UnitOption{
-			Section: "Unit",
-			Name:    "RequiresMountsFor",
-			Value:   m.MountPoint,
-		},
+func (p *progressPrinter) Done(report *reconcile.MachineReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintf(p.w, "[%d/%d] %3d%% %s %s %s\n", p.i, p.total, 100*p.i/p.total, report.Fqdn, report.Result(), report.Duration.Round(100*time.Millisecond))
+	p.fqdn = ""
+}
+
+// Close stops the spinner, the run is over
+func (p *progressPrinter) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
 	}
+	p.clear()
+	p.fqdn = ""
 }
 
-type CommandDescription struct {
-	Command           []string
-	WrapperParameters []string
-	AppendFqdn        bool
-	AppendAddr        bool
-	Local             bool
-	Stdin             string
-	StdinFile         string
-	StdoutFile        string
-	StdoutAppend      bool
-	StderrFile        string
-	StderrAppend      bool
-	Mode              os.FileMode
-}
-
-func (cmd *CommandDescription) Run(fqdn string, addrs []netip.Addr) (err error) {
-	if cmd.Mode == 0 {
-		cmd.Mode = 0600
-	}
-	args := []string{}
-	var wrapper *exec.Cmd
-	if !cmd.Local {
-		args = append(args, "systemd-run", "-M", fqdn, "-P")
-		args = append(args, cmd.WrapperParameters...)
-		args = append(args, "--")
-		args = append(args, cmd.Command...)
-	} else {
-		args = append(args, cmd.Command...)
+func (p *progressPrinter) spin(stop chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.frame++
+			p.draw()
+			p.mu.Unlock()
+		}
 	}
-	if cmd.AppendFqdn {
-		args = append(args, fqdn)
+}
+
+// draw redraws the line of the current machine, only on a terminal
+func (p *progressPrinter) draw() {
+	if !p.tty || p.fqdn == "" {
+		return
 	}
-	if cmd.AppendAddr {
-		for _, addr := range addrs {
-			args = append(args, addr.String())
-		}
+	fmt.Fprintf(p.w, "\r\033[K%s [%d/%d] %3d%% %s %s %s", spinnerFrames[p.frame%len(spinnerFrames)], p.i, p.total,
+		100*(p.i-1)/p.total, p.fqdn, p.phase, time.Since(p.started).Round(time.Second))
+}
+
+func (p *progressPrinter) clear() {
+	if p.tty && p.fqdn != "" {
+		fmt.Fprint(p.w, "\r\033[K")
 	}
-	slog.Debug("Running command", "command", args)
-	wrapper = exec.Command(args[0], args[1:]...)
-	var stdin *os.File
-	var stdout *os.File
-	var stderr *os.File
-	defer func() {
-		if stdin != nil {
-			stdin.Close()
+}
+
+// Write puts log output above the progress line
+func (p *progressPrinter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
+}
+
+// startAudit routes files, commands and machine manager calls through the audit log, the returned function undoes it
+func startAudit(target string, config *reconcile.Config) (func(), error) {
+	audit, err := util.OpenAuditLog(target, config.Hash())
+	if err != nil {
+		return nil, err
+	}
+	files, commands := util.Files, reconcile.Commands
+	util.Audit = audit
+	util.Files = util.AuditedFileSystem{FileSystem: files}
+	reconcile.Commands = reconcile.AuditedRunner{Runner: commands}
+	return func() {
+		util.Files, reconcile.Commands = files, commands
+		util.Audit = nil
+		audit.Close()
+	}, nil
+}
+
+// startDryRun seeds a Fake with the templates, images, unit states and addresses of the configured machines and
+// swaps the files and commands for in-memory ones. The returned function prints what the run did and undoes the swap.
+func startDryRun(config *reconcile.Config, w io.Writer) (*machineutil.Fake, func(), error) {
+	host, err := machineutil.NewMachineUtil()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer host.Close()
+	fake := machineutil.NewFake()
+	templates, err := host.ListTemplates(config.DefaultTemplate)
+	if err != nil {
+		return nil, nil, err
+	}
+	if all, ok := templates.(*machineutil.Templates); ok {
+		for _, versions := range all.Templates {
+			for _, template := range versions {
+				fake.AddImage(template.Image())
+			}
 		}
-		if stdout != nil {
-			stdout.Close()
+	}
+	// machines without an address get one from TEST-NET-1 so the run doesn't wait for DHCP
+	placeholder := netip.MustParseAddr("192.0.2.1")
+	for _, m := range config.Machines {
+		_, err := host.GetImage(m.Fqdn)
+		if err != nil && !errors.Is(err, machineutil.ErrNoSuchImage) {
+			return nil, nil, err
 		}
-		if stderr != nil {
-			stderr.Close()
+		if err == nil {
+			fake.AddImage(m.Fqdn)
 		}
-	}()
-	if cmd.StdinFile != "" {
-		slog.Debug("Using stdin", "file", cmd.StdinFile)
-		stdin, err = os.Open(cmd.StdinFile)
+		unit := machineutil.MachineUnit(m.Class, m.Fqdn)
+		state, err := host.UnitState(unit)
 		if err != nil {
-			return
+			return nil, nil, err
+		}
+		fake.AddUnit(unit, state.ActiveState)
+		var addrs []netip.Addr
+		if machine, err := host.GetMachine(m.Fqdn); err == nil && state.ActiveState == "active" {
+			addrs, _ = machine.UsableAddresses()
+		}
+		if len(addrs) == 0 {
+			addrs = []netip.Addr{placeholder}
+			placeholder = placeholder.Next()
+		}
+		fake.Addresses[m.Fqdn] = addrs
+	}
+	files, commands := util.Files, reconcile.Commands
+	mem := util.NewMemFileSystem()
+	mem.Lower = files
+	runner := &reconcile.RecordingRunner{}
+	util.Files, reconcile.Commands = mem, runner
+	return fake, func() {
+		util.Files, reconcile.Commands = files, commands
+		for _, call := range fake.Calls {
+			fmt.Fprintln(w, "call:", util.Redact(call))
+		}
+		for _, name := range mem.Names() {
+			fmt.Fprintln(w, "write:", name)
+		}
+		for _, name := range mem.Removed() {
+			fmt.Fprintln(w, "remove:", name)
+		}
+		for _, c := range runner.Commands() {
+			args := strings.Join(util.RedactAll(c.Args), " ")
+			if c.Machine != "" {
+				args = c.Machine + ": " + args
+			}
+			fmt.Fprintln(w, "run:", args)
+		}
+	}, nil
+}
+
+// startTracing traces the run to endpoint, the returned function exports the spans
+func startTracing(endpoint string) (func(), error) {
+	tracer, err := util.NewTracer(endpoint, machineutil.GetBuildInfo().Version)
+	if err != nil {
+		return nil, err
+	}
+	util.Tracing = tracer
+	return func() {
+		util.Tracing = nil
+		if err := tracer.Flush(); err != nil {
+			slog.Warn("Exporting trace", "endpoint", endpoint, "error", err)
 		}
-		wrapper.Stdin = stdin
-	} else if cmd.Stdin != "" {
-		slog.Debug("Using stdin", "static", cmd.Stdin)
-		wrapper.Stdin = bytes.NewReader([]byte(cmd.Stdin))
+	}, nil
+}
+
+// Reconcile runs one of the machine lifecycle modes (create, start, stop, destroy) over the whole config
+func Reconcile(opts *Options, mode string) int {
+	slog.Info("Starting with mode", "mode", mode)
+	config, err := opts.LoadConfig()
+	if err != nil {
+		slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+		return 1
 	}
-	if cmd.StdoutFile != "" {
-		slog.Debug("Using stdout", "file", cmd.StdoutFile, "append", cmd.StdoutAppend)
-		if cmd.StdoutAppend {
-			stdout, err = os.OpenFile(cmd.StdoutFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, cmd.Mode)
-		} else {
-			stdout, err = os.OpenFile(cmd.StdoutFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cmd.Mode)
+	util.Force = opts.Force
+	var manager machineutil.MachineUtil
+	if opts.DryRun {
+		if opts.AuditLog != "" {
+			slog.Error("-dry-run doesn't change anything to audit, drop -audit-log")
+			return 1
 		}
+		fake, stop, err := startDryRun(config, os.Stdout)
 		if err != nil {
-			return
+			slog.Error("Error reading the host state for the dry run", "error", err)
+			return 1
 		}
-		wrapper.Stdout = stdout
+		defer stop()
+		manager = fake
 	}
-	if cmd.StderrFile != "" {
-		slog.Debug("Using stderr", "file", cmd.StderrFile, "append", cmd.StderrAppend)
-		if cmd.StderrAppend {
-			stderr, err = os.OpenFile(cmd.StderrFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, cmd.Mode)
-		} else {
-			stderr, err = os.OpenFile(cmd.StderrFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cmd.Mode)
+	if opts.AuditLog != "" {
+		stop, err := startAudit(opts.AuditLog, config)
+		if err != nil {
+			slog.Error("Error opening audit log", "error", err)
+			return 1
 		}
+		defer stop()
+	}
+	if opts.OTLP != "" {
+		stop, err := startTracing(opts.OTLP)
 		if err != nil {
-			return
+			slog.Error("Error starting trace", "error", err)
+			return 1
+		}
+		defer stop()
+	}
+	reconcileOpts := reconcile.Options{
+		SkipChecks:  opts.SkipChecks,
+		Runtime:     opts.Runtime,
+		Rollback:    opts.Rollback,
+		ResetFailed: opts.ResetFailed,
+		Manager:     manager,
+		DryRun:      opts.DryRun,
+	}
+	if !opts.Quiet {
+		reconcileOpts.Summary = os.Stdout
+	}
+	if opts.progress != nil {
+		reconcileOpts.Progress = opts.progress
+		defer opts.progress.Close()
+	}
+	r, err := reconcile.New(config, reconcileOpts)
+	if err != nil {
+		slog.Error("Error creating state", "error", err)
+		return 1
+	}
+	defer r.Close()
+	report, err := r.Run(mode)
+	if report != nil {
+		if err := report.Write(opts.ReportFile); err != nil {
+			slog.Error("Writing report", "file", opts.ReportFile, "error", err)
 		}
-		wrapper.Stderr = stderr
 	}
-	err = wrapper.Run()
-	return
+	if err != nil {
+		return 1
+	}
+	// destroy only cleans up what the config still declares
+	if orphans, err := r.Orphans(); err != nil {
+		slog.Warn("Looking for orphaned files", "error", err)
+	} else if len(orphans) > 0 {
+		slog.Warn("Found generated files without a machine, remove them with gc", "files", len(orphans))
+	}
+	return 0
 }
 
-type Machine struct {
-	Template     string
-	Fqdn         string
-	Options      []*unit.UnitOption
-	Overrides    []*unit.UnitOption
-	Mounts       []*MountPoint
-	Creation     []*CommandDescription
-	CreationPost []*CommandDescription
-	Startup      []*CommandDescription
-	CommandsPre  []*CommandDescription
-	Commands     []*CommandDescription
-	runCreation  bool
-	runStartup   bool
+type Subcommand struct {
+	Name        string
+	Usage       string
+	Description string
+	Flags       *flag.FlagSet
+	Run         func(args []string) int
+	Subcommands []*Subcommand
 }
 
-func (m *Machine) Normalize() error {
-	for _, mnt := range m.Mounts {
-		mnt.Normalize()
-		m.Options = append(m.Options, mnt.GetNspawn()...)
-		m.Overrides = append(m.Overrides, mnt.GetOverride()...)
+func (c *Subcommand) Find(name string) *Subcommand {
+	for _, sub := range c.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
 	}
 	return nil
 }
 
-func (m *Machine) EnsureMounts(log *slog.Logger) (changed bool, err error) {
-	changed = false
-	var c bool
-	for _, mnt := range m.Mounts {
-		c, err = mnt.CreateMount(log)
-		if err != nil {
-			return
+func (c *Subcommand) PrintUsage(prefix string) {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %s %s\n", prefix, c.Usage)
+	if c.Description != "" {
+		fmt.Fprintf(out, "\n%s\n", c.Description)
+	}
+	if len(c.Subcommands) > 0 {
+		fmt.Fprintf(out, "\nCommands:\n")
+		for _, sub := range c.Subcommands {
+			fmt.Fprintf(out, "  %-12s %s\n", sub.Name, sub.Description)
+		}
+	}
+	if c.Flags != nil {
+		fmt.Fprintf(out, "\nFlags:\n")
+		c.Flags.SetOutput(out)
+		c.Flags.PrintDefaults()
+	}
+}
+
+// Execute dispatches args to the matching nested subcommand
+func (c *Subcommand) Execute(prefix string, args []string) int {
+	if len(c.Subcommands) > 0 {
+		if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help" {
+			c.PrintUsage(prefix)
+			if len(args) == 0 {
+				return 2
+			}
+			return 0
+		}
+		sub := c.Find(args[0])
+		if sub == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+			c.PrintUsage(prefix)
+			return 2
 		}
-		if c {
-			changed = true
+		return sub.Execute(prefix+" "+sub.Name, args[1:])
+	}
+	if c.Flags != nil {
+		c.Flags.Usage = func() { c.PrintUsage(prefix) }
+		if err := c.Flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
 		}
+		args = c.Flags.Args()
 	}
-	return
+	return c.Run(args)
 }
 
-func (m *Machine) RunCommands(addr []netip.Addr) error {
-	cmds := []*CommandDescription{}
-	cmds = append(cmds, m.CommandsPre...)
-	if m.runCreation {
-		cmds = append(cmds, m.Creation...)
+func newReconcileCommand(name, description string) *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	opts.Register(fs)
+	mode := name
+	if name == "apply" {
+		mode = "create"
 	}
-	if m.runStartup {
-		cmds = append(cmds, m.Startup...)
+	return &Subcommand{
+		Name:        name,
+		Usage:       "[flags]",
+		Description: description,
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			return Reconcile(opts, mode)
+		},
 	}
-	if m.runCreation {
-		cmds = append(cmds, m.CreationPost...)
+}
+
+func newPlanCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	fs.BoolVar(&opts.Runtime, "runtime", false, "Plan for units generated under /run instead of /etc")
+	mode := fs.String("mode", "create", "Mode to plan: create, start, stop, destroy")
+	jsonOutput := fs.Bool("json", false, "Print the plan as JSON")
+	out := fs.String("out", "", "Also write the JSON plan to this file")
+	detailed := fs.Bool("detailed-exitcode", false, "Exit with 2 instead of 0 when the plan has changes")
+	return &Subcommand{
+		Name:        "plan",
+		Usage:       "[flags]",
+		Description: "Show what a run would change without changing anything",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			r, err := reconcile.New(config, reconcile.Options{Runtime: opts.Runtime})
+			if err != nil {
+				slog.Error("Error creating state", "error", err)
+				return 1
+			}
+			defer r.Close()
+			plan, err := r.Plan(*mode)
+			if err != nil {
+				slog.Error("Planning", "error", err)
+				return 1
+			}
+			if *out != "" {
+				var b bytes.Buffer
+				if err := plan.WriteJSON(&b); err != nil {
+					slog.Error("Encoding plan", "error", err)
+					return 1
+				}
+				if err := os.WriteFile(*out, b.Bytes(), 0644); err != nil {
+					slog.Error("Writing plan", "file", *out, "error", err)
+					return 1
+				}
+			}
+			if *jsonOutput {
+				err = plan.WriteJSON(os.Stdout)
+			} else {
+				err = plan.WriteText(os.Stdout)
+			}
+			if err != nil {
+				slog.Error("Printing plan", "error", err)
+				return 1
+			}
+			if *detailed && plan.HasChanges() {
+				return 2
+			}
+			return 0
+		},
 	}
-	cmds = append(cmds, m.Commands...)
-	for _, cmd := range cmds {
-		err := cmd.Run(m.Fqdn, addr)
-		if err != nil {
-			return err
+}
+
+// drain discards events that queued up while reconciling, they were caused by or are covered by that run
+func drain(chans ...<-chan string) {
+	for _, ch := range chans {
+		for {
+			select {
+			case _, ok := <-ch:
+				if ok {
+					continue
+				}
+			default:
+			}
+			break
 		}
 	}
-	return nil
 }
 
-func (m *Machine) RemoveMounts(log *slog.Logger) (changed bool, err error) {
-	for _, mnt := range m.Mounts {
-		var c bool
-		c, err = mnt.RemoveMount(log)
+func newDaemonCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	opts.Register(fs)
+	interval := fs.Duration("interval", 5*time.Minute, "Reconcile at least this often even without changes, 0 disables the timer")
+	settle := fs.Duration("settle", time.Second, "Wait for changes to settle before reconciling")
+	return &Subcommand{
+		Name:        "daemon",
+		Usage:       "[flags]",
+		Description: "Keep running and re-apply the config whenever it or the machines change",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			if slices.Contains(opts.Configs(), "-") {
+				slog.Error("Daemon mode needs config files, stdin can't be watched")
+				return 1
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			configChanges, err := util.WatchFiles(ctx, opts.Configs())
+			if err != nil {
+				slog.Error("Error watching config files", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			removed, err := manager.WatchMachines(ctx)
+			if err != nil {
+				slog.Error("Error subscribing to machined signals", "error", err)
+				return 1
+			}
+			// USBDevices are looked up again whenever one of them comes or goes, the watch follows the config
+			var usb <-chan string
+			var usbIDs []string
+			stopUSB := func() {}
+			defer func() { stopUSB() }()
+			for {
+				if ret := Reconcile(opts, "create"); ret != 0 {
+					slog.Warn("Reconcile failed, retrying on the next change", "status", ret)
+				}
+				if config, err := opts.LoadConfig(); err == nil && !slices.Equal(config.USBIDs(), usbIDs) {
+					stopUSB()
+					usb, usbIDs, stopUSB = nil, config.USBIDs(), func() {}
+					if len(usbIDs) > 0 {
+						usbCtx, cancel := context.WithCancel(ctx)
+						if usb, err = util.WatchUSB(usbCtx, usbIDs); err != nil {
+							cancel()
+							slog.Error("Error subscribing to USB events", "error", err)
+							return 1
+						}
+						stopUSB = cancel
+					}
+				}
+				drain(configChanges, removed, usb)
+				var tick <-chan time.Time
+				if *interval > 0 {
+					tick = time.After(*interval)
+				}
+				select {
+				case <-ctx.Done():
+					slog.Info("Daemon stopping")
+					return 0
+				case file, ok := <-configChanges:
+					if !ok {
+						slog.Error("Config watch stopped")
+						return 1
+					}
+					slog.Info("Config changed", "file", file)
+				case name, ok := <-removed:
+					if !ok {
+						slog.Error("Machined signal subscription stopped")
+						return 1
+					}
+					slog.Info("Machine removed", "machine", name)
+				case event, ok := <-usb:
+					if !ok {
+						slog.Error("USB event subscription stopped")
+						return 1
+					}
+					slog.Info("USB device changed", "event", event)
+				case <-tick:
+					slog.Debug("Periodic reconcile")
+				}
+				// editors and machined tend to produce bursts of events
+				select {
+				case <-ctx.Done():
+					return 0
+				case <-time.After(*settle):
+				}
+				drain(configChanges, removed, usb)
+			}
+		},
+	}
+}
+
+// newFreezeCommand builds pause and resume, they act on running machines only and leave the rest alone
+func newFreezeCommand(name, description string, freeze bool) *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	return &Subcommand{
+		Name:        name,
+		Usage:       "[flags] [machine...]",
+		Description: description,
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			names := []string{}
+			for _, m := range config.Machines {
+				if len(args) == 0 || slices.Contains(args, m.Fqdn) {
+					names = append(names, m.Fqdn)
+				}
+			}
+			for _, arg := range args {
+				if !slices.Contains(names, arg) {
+					fmt.Fprintf(os.Stderr, "%s is not a configured machine\n", arg)
+					return 2
+				}
+			}
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			ret := 0
+			for _, name := range names {
+				log := slog.With("machine", name)
+				machine, err := manager.GetMachine(name)
+				if errors.Is(err, machineutil.ErrNoSuchImage) {
+					log.Info("Missing, skipping")
+					continue
+				}
+				if err != nil {
+					log.Error("Fetching machine", "error", err)
+					ret = 1
+					continue
+				}
+				if !machine.Running() {
+					log.Info("Not running, skipping")
+					continue
+				}
+				if machine.Frozen() == freeze {
+					log.Info("Nothing to do", "paused", freeze)
+					continue
+				}
+				if freeze {
+					log.Info("Pausing")
+					err = machine.Freeze()
+				} else {
+					log.Info("Resuming")
+					err = machine.Thaw()
+				}
+				if err != nil {
+					log.Error("Failed", "error", err)
+					ret = 1
+				}
+			}
+			return ret
+		},
+	}
+}
+
+func newGCCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	dryRun := fs.Bool("n", false, "Only list the orphaned files and the images -clean-pool would remove")
+	cleanPool := fs.String("clean-pool", "", "Also have machined remove the hidden images, or with all every image no machine runs from, templates included. All is refused while configured machines are stopped")
+	return &Subcommand{
+		Name:        "gc",
+		Usage:       "[flags]",
+		Description: "Remove generated units and settings whose machine is neither configured nor exists",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			if *cleanPool != "" && !slices.Contains(machineutil.CleanPoolModes, *cleanPool) {
+				fmt.Fprintf(os.Stderr, "Unsupported -clean-pool %q, expected %s\n", *cleanPool, strings.Join(machineutil.CleanPoolModes, " or "))
+				return 2
+			}
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			r, err := reconcile.New(config, reconcile.Options{})
+			if err != nil {
+				slog.Error("Error creating state", "error", err)
+				return 1
+			}
+			defer r.Close()
+			orphans, err := r.Orphans()
+			if err != nil {
+				slog.Error("Looking for orphaned files", "error", err)
+				return 1
+			}
+			for _, orphan := range orphans {
+				owner := orphan.Owner
+				if owner == "" {
+					owner = "-"
+				}
+				if len(orphan.Labels) > 0 {
+					fmt.Printf("%-40s %s %s\n", owner, orphan.Path, formatLabels(orphan.Labels))
+					continue
+				}
+				fmt.Printf("%-40s %s\n", owner, orphan.Path)
+			}
+			if *dryRun {
+				if *cleanPool != "" {
+					return previewCleanPool(r.State.Manager, *cleanPool)
+				}
+				return 0
+			}
+			if *cleanPool == machineutil.CleanPoolAll {
+				stopped, err := stoppedMachines(r)
+				if err != nil {
+					slog.Error("Checking configured machines", "error", err)
+					return 1
+				}
+				if len(stopped) > 0 {
+					slog.Error("Refusing -clean-pool all, it would remove the images of stopped machines", "machines", stopped)
+					return 1
+				}
+			}
+			if err := r.CollectGarbage(orphans); err != nil {
+				slog.Error("Removing orphaned files", "error", err)
+				return 1
+			}
+			if *cleanPool != "" {
+				return cleanImagePool(r.State.Manager, *cleanPool)
+			}
+			return 0
+		},
+	}
+}
+
+// stoppedMachines returns the configured machines whose image exists but that aren't running
+func stoppedMachines(r *reconcile.Reconciler) ([]string, error) {
+	stopped := []string{}
+	for _, m := range r.Config.Machines {
+		machine, err := r.State.Manager.GetMachine(m.Fqdn)
+		if errors.Is(err, machineutil.ErrNoSuchImage) {
+			continue
+		}
 		if err != nil {
-			return
+			return nil, err
 		}
-		if c {
-			changed = true
+		if !machine.Running() {
+			stopped = append(stopped, m.Fqdn)
 		}
 	}
-	return
+	return stopped, nil
 }
 
-func (m *Machine) Unmount(manager machineutil.MachineUtil) error {
-	for _, mnt := range m.Mounts {
-		job, err := manager.Stop(mnt.Unit())
-		if err != nil {
-			return err
+// previewCleanPool lists the images cleanImagePool would remove
+func previewCleanPool(manager machineutil.MachineUtil, mode string) int {
+	images, err := machineutil.CleanPoolPreview(manager, mode)
+	if err != nil {
+		slog.Error("Listing image pool", "mode", mode, "error", err)
+		return 1
+	}
+	var total uint64
+	for _, image := range images {
+		size := "-"
+		if image.Usage > 0 {
+			size = util.FormatBytes(image.Usage)
 		}
-		err = job.Wait()
-		if err != nil {
-			return err
+		total += image.Usage
+		fmt.Printf("%-40s %s\n", image.Name, size)
+	}
+	slog.Info("Image pool would be cleaned", "mode", mode, "images", len(images), "frees", util.FormatBytes(total))
+	return 0
+}
+
+// cleanImagePool runs machined's CleanPool and lists what it removed
+func cleanImagePool(manager machineutil.MachineUtil, mode string) int {
+	slog.Info("Cleaning image pool", "mode", mode)
+	cleaned, err := manager.CleanPool(mode)
+	if err != nil {
+		slog.Error("Cleaning image pool", "mode", mode, "error", err)
+		return 1
+	}
+	var total uint64
+	for _, image := range cleaned {
+		size := "-"
+		if image.Usage > 0 {
+			size = util.FormatBytes(image.Usage)
 		}
+		total += image.Usage
+		fmt.Printf("%-40s %s\n", image.Name, size)
+	}
+	slog.Info("Cleaned image pool", "images", len(cleaned), "freed", util.FormatBytes(total))
+	return 0
+}
+
+func newSchemaCommand() *Subcommand {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	format := fs.String("format", "yaml", "Config format the schema validates: yaml or json")
+	return &Subcommand{
+		Name:        "schema",
+		Usage:       "[flags]",
+		Description: "Print a JSON Schema of the config files for editors and CI",
+		Flags:       fs,
+		Run: func(args []string) int {
+			if *format != "yaml" && *format != "json" {
+				fmt.Fprintf(os.Stderr, "Unsupported format %q\n", *format)
+				return 2
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(reconcile.Schema(*format == "yaml")); err != nil {
+				slog.Error("Encoding schema", "error", err)
+				return 1
+			}
+			return 0
+		},
 	}
-	return nil
 }
 
-type Config struct {
-	DefaultTemplate string
-	Machines        []*Machine
+func newStatusCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	asJson := fs.Bool("json", false, "Print the status as JSON")
+	return &Subcommand{
+		Name:        "status",
+		Usage:       "[flags]",
+		Description: "Show the state of all configured machines",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			reports := []*reconcile.MachineReport{}
+			ret := 0
+			for _, m := range config.Machines {
+				report, err := reconcile.MachineStatus(manager, m.Fqdn)
+				if err != nil {
+					report = &reconcile.MachineReport{Fqdn: m.Fqdn, State: "error", Error: err.Error()}
+				}
+				if report.Error != "" {
+					slog.Error("Fetching machine", "machine", m.Fqdn, "error", report.Error)
+					ret = 1
+				}
+				reports = append(reports, report)
+			}
+			if *asJson {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(reports); err != nil {
+					slog.Error("Encoding status", "error", err)
+					return 1
+				}
+				return ret
+			}
+			fmt.Printf("%-40s %-10s %-30s %-8s %-10s %-10s %-10s %-20s %s\n", "MACHINE", "STATE", "UNIT", "RESTARTS", "CPU", "MEMORY", "IO", "DISK", "ADDRESSES")
+			for _, r := range reports {
+				cpu, memory, io, disk := "-", "-", "-", "-"
+				if r.DiskUsage > 0 {
+					disk = util.FormatBytes(r.DiskUsage)
+				}
+				if r.DiskLimit > 0 {
+					disk += "/" + util.FormatBytes(r.DiskLimit)
+				}
+				if r.Usage != nil {
+					cpu = (time.Duration(r.Usage.CPUUsageNSec) * time.Nanosecond).Round(time.Second).String()
+					memory = util.FormatBytes(r.Usage.MemoryCurrent)
+					io = util.FormatBytes(r.Usage.IOReadBytes + r.Usage.IOWriteBytes)
+				}
+				fmt.Printf("%-40s %-10s %-30s %-8d %-10s %-10s %-10s %-20s %s\n", r.Fqdn, r.State, r.Unit, r.Restarts, cpu, memory, io, disk, util.FormatAddresses(r.Addresses))
+			}
+			return ret
+		},
+	}
 }
 
-type ConfigDecoder interface {
-	Decode(interface{}) error
+func newTopCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	return &Subcommand{
+		Name:        "top",
+		Usage:       "[flags]",
+		Description: "Continuously show state and resource usage of all configured machines",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			previous := make(map[string]uint64)
+			last := time.Now()
+			for {
+				// machines may come and go with machinectl between refreshes
+				if err := manager.Refresh(); err != nil {
+					slog.Warn("Refreshing machines", "error", err)
+				}
+				reports := []*reconcile.MachineReport{}
+				for _, m := range config.Machines {
+					report, err := reconcile.MachineStatus(manager, m.Fqdn)
+					if err != nil {
+						report = &reconcile.MachineReport{Fqdn: m.Fqdn, State: "error", Error: err.Error()}
+					}
+					reports = append(reports, report)
+				}
+				now := time.Now()
+				elapsed := now.Sub(last)
+				last = now
+				var b strings.Builder
+				b.WriteString("\033[H\033[2J")
+				fmt.Fprintf(&b, "machineutil top - %s - %d machines\n\n", now.Format(time.TimeOnly), len(reports))
+				fmt.Fprintf(&b, "%-40s %-10s %-12s %-7s %-10s %s\n", "MACHINE", "STATE", "UPTIME", "CPU%", "MEMORY", "ADDRESSES")
+				for _, r := range reports {
+					uptime, cpu, memory := "-", "-", "-"
+					if !r.Started.IsZero() {
+						uptime = now.Sub(r.Started).Round(time.Second).String()
+					}
+					if r.Usage != nil {
+						if prev, ok := previous[r.Fqdn]; ok && r.Usage.CPUUsageNSec >= prev && elapsed > 0 {
+							cpu = fmt.Sprintf("%.1f", float64(r.Usage.CPUUsageNSec-prev)*100/float64(elapsed.Nanoseconds()))
+						}
+						previous[r.Fqdn] = r.Usage.CPUUsageNSec
+						memory = util.FormatBytes(r.Usage.MemoryCurrent)
+					} else {
+						delete(previous, r.Fqdn)
+					}
+					fmt.Fprintf(&b, "%-40s %-10s %-12s %-7s %-10s %s\n", r.Fqdn, r.State, uptime, cpu, memory, util.FormatAddresses(r.Addresses))
+				}
+				os.Stdout.WriteString(b.String())
+				time.Sleep(*interval)
+			}
+		},
+	}
 }
 
-type State struct {
-	Manager   machineutil.MachineUtil
-	Machines  map[string]*machineutil.Machine
-	Templates machineutil.TemplateCollection
+// sanitizeGroup turns arbitrary label text into a valid Ansible group name
+func sanitizeGroup(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
 }
 
-func NewState(config *Config) (retval *State, err error) {
-	retval = &State{
-		Machines: make(map[string]*machineutil.Machine),
+// formatLabels lists labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := []string{}
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
 	}
-	retval.Manager, err = machineutil.NewMachineUtil()
-	if err != nil {
-		return
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Inventory builds an Ansible inventory in the JSON format used by dynamic inventory scripts.
+// Labels recorded on the host are used where the config doesn't set them.
+func Inventory(manager machineutil.MachineUtil, config *reconcile.Config) (map[string]interface{}, error) {
+	hostvars := make(map[string]interface{})
+	groups := make(map[string][]string)
+	for _, m := range config.Machines {
+		vars := make(map[string]interface{})
+		status, err := reconcile.MachineStatus(manager, m.Fqdn)
+		if err != nil {
+			status = &reconcile.MachineReport{Fqdn: m.Fqdn, State: "error", Error: err.Error()}
+		}
+		vars["machineutil_state"] = status.State
+		if status.Error != "" {
+			vars["machineutil_error"] = status.Error
+		}
+		if status.DiskUsage > 0 {
+			vars["machineutil_disk_usage"] = status.DiskUsage
+		}
+		if status.DiskLimit > 0 {
+			vars["machineutil_disk_limit"] = status.DiskLimit
+		}
+		if len(status.Addresses) > 0 {
+			vars["ansible_host"] = status.Addresses[0].String()
+			vars["machineutil_addresses"] = strings.Split(util.FormatAddresses(status.Addresses), ",")
+		} else if m.StaticAddress().IsValid() {
+			vars["ansible_host"] = m.StaticAddress().Addr().String()
+		}
+		labels := status.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		for k, v := range labels {
+			vars["machineutil_label_"+sanitizeGroup(k)] = v
+			group := sanitizeGroup(k + "_" + v)
+			groups[group] = append(groups[group], m.Fqdn)
+		}
+		if m.Group != "" {
+			group := sanitizeGroup(m.Group)
+			groups[group] = append(groups[group], m.Fqdn)
+		}
+		for k, v := range m.InventoryVars {
+			vars[k] = v
+		}
+		hostvars[m.Fqdn] = vars
+		groups["machineutil"] = append(groups["machineutil"], m.Fqdn)
+	}
+	retval := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": hostvars},
 	}
-	retval.Templates, err = retval.Manager.ListTemplates(config.DefaultTemplate)
-	return
+	children := []string{}
+	for name, hosts := range groups {
+		retval[name] = map[string]interface{}{"hosts": hosts}
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	retval["all"] = map[string]interface{}{"children": children}
+	return retval, nil
 }
 
-func (s *State) DiscoverTemplate(config *Machine) (*machineutil.Template, error) {
-	var template *machineutil.Template
-	if config.Template == "" {
-		template = s.Templates.Template()
-	} else {
-		template = s.Templates.Get(config.Template)
+// inventoryYaml converts the dynamic inventory into the static YAML inventory layout
+func inventoryYaml(inventory map[string]interface{}) map[string]interface{} {
+	hostvars := inventory["_meta"].(map[string]interface{})["hostvars"].(map[string]interface{})
+	children := make(map[string]interface{})
+	for _, name := range inventory["all"].(map[string]interface{})["children"].([]string) {
+		hosts := make(map[string]interface{})
+		for _, host := range inventory[name].(map[string]interface{})["hosts"].([]string) {
+			hosts[host] = nil
+		}
+		children[name] = map[string]interface{}{"hosts": hosts}
 	}
-	if template == nil {
-		return nil, fmt.Errorf("Missing template(%s) creating %s", config.Template, config.Fqdn)
+	return map[string]interface{}{
+		"all": map[string]interface{}{
+			"hosts":    hostvars,
+			"children": children,
+		},
 	}
-	return template, nil
 }
 
-func (s *State) EnsureMachine(log *slog.Logger, config *Machine, template *machineutil.Template) (machine *machineutil.Machine, changed bool, reload bool, err error) {
-	changed = false
-	reload = false
-	var ok bool
-	machine, ok = s.Machines[config.Fqdn]
-	if ok {
-		log.Debug("Already found")
-		return
+func newInventoryCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	format := fs.String("format", "json", "Output format: json or yaml")
+	return &Subcommand{
+		Name:        "inventory",
+		Usage:       "[flags]",
+		Description: "Print the configured machines as an Ansible inventory",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			inventory, err := Inventory(manager, config)
+			if err != nil {
+				slog.Error("Building inventory", "error", err)
+				return 1
+			}
+			switch *format {
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(inventory)
+			case "yaml":
+				enc := yaml.NewEncoder(os.Stdout)
+				err = enc.Encode(inventoryYaml(inventory))
+				enc.Close()
+			default:
+				fmt.Fprintf(os.Stderr, "Unsupported format %q\n", *format)
+				return 2
+			}
+			if err != nil {
+				slog.Error("Encoding inventory", "error", err)
+				return 1
+			}
+			return 0
+		},
 	}
-	log.Debug("Fetching machine")
-	machine, err = s.Manager.GetMachine(config.Fqdn)
-	if err != nil && !errors.Is(err, machineutil.ErrNoSuchImage) {
-		return
+}
+
+func newExecCommand() *Subcommand {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	debug := fs.Bool("debug", false, "Enable debug log")
+	return &Subcommand{
+		Name:        "exec",
+		Usage:       "[flags] <machine> [--] <command> [args...]",
+		Description: "Run a command inside a machine",
+		Flags:       fs,
+		Run: func(args []string) int {
+			SetupLogging(*debug)
+			if len(args) > 1 && args[1] == "--" {
+				args = append(args[:1], args[2:]...)
+			}
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "exec requires a machine and a command")
+				return 2
+			}
+			cmdArgs := append([]string{"-M", args[0], "-P", "-q", "--"}, args[1:]...)
+			if term, err := os.Stdin.Stat(); err == nil && term.Mode()&os.ModeCharDevice != 0 {
+				cmdArgs = append([]string{"-t"}, cmdArgs...)
+			}
+			return runAttached("systemd-run", cmdArgs...)
+		},
 	}
-	if errors.Is(err, machineutil.ErrNoSuchImage) && template != nil {
-		log.Info("Creating machine")
-		machine, err = template.Create(config.Fqdn)
-		config.runCreation = true
-		changed = true
+}
+
+func newLogsCommand() *Subcommand {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	machine := fs.String("machine", "", "Machine to show the journal of")
+	follow := fs.Bool("f", false, "Follow the journal")
+	lines := fs.Int("n", -1, "Number of journal lines to show")
+	host := fs.Bool("host", false, "Show the host side systemd-nspawn unit log instead of the guest journal")
+	return &Subcommand{
+		Name:        "logs",
+		Usage:       "[flags] [machine]",
+		Description: "Show the journal of a machine",
+		Flags:       fs,
+		Run: func(args []string) int {
+			name := *machine
+			if name == "" && len(args) == 1 {
+				name = args[0]
+				args = nil
+			}
+			if name == "" || len(args) > 0 {
+				fmt.Fprintln(os.Stderr, "logs requires exactly one machine")
+				return 2
+			}
+			cmdArgs := []string{}
+			if *host {
+				cmdArgs = append(cmdArgs, "-u", reconcile.DependencyUnit(name))
+			} else {
+				cmdArgs = append(cmdArgs, "-M", name)
+			}
+			if *follow {
+				cmdArgs = append(cmdArgs, "-f")
+			}
+			if *lines >= 0 {
+				cmdArgs = append(cmdArgs, "-n", strconv.Itoa(*lines))
+			}
+			return runAttached("journalctl", cmdArgs...)
+		},
 	}
-	if err != nil {
-		return
+}
+
+// consoleEscape is ^], pressing it three times within a second detaches like machinectl login
+const consoleEscape = 0x1d
+
+func newConsoleCommand() *Subcommand {
+	fs := flag.NewFlagSet("console", flag.ContinueOnError)
+	machine := fs.String("machine", "", "Machine to attach to")
+	debug := fs.Bool("debug", false, "Enable debug log")
+	return &Subcommand{
+		Name:        "console",
+		Usage:       "[flags] [machine]",
+		Description: "Attach to the login console of a machine, press ^] three times within a second to detach",
+		Flags:       fs,
+		Run: func(args []string) int {
+			SetupLogging(*debug)
+			name := *machine
+			if name == "" && len(args) == 1 {
+				name = args[0]
+				args = nil
+			}
+			if name == "" || len(args) > 0 {
+				fmt.Fprintln(os.Stderr, "console requires exactly one machine")
+				return 2
+			}
+			manager, err := machineutil.NewMachineUtil()
+			if err != nil {
+				slog.Error("Error connecting to machined", "error", err)
+				return 1
+			}
+			defer manager.Close()
+			m, err := manager.GetMachine(name)
+			if err != nil {
+				slog.Error("Error finding machine", "machine", name, "error", err)
+				return 1
+			}
+			pty, ptyName, err := m.OpenLogin()
+			if err != nil {
+				slog.Error("Error opening console", "machine", name, "error", err)
+				return 1
+			}
+			defer pty.Close()
+			if err := attachConsole(pty, name, ptyName); err != nil {
+				slog.Error("Console", "machine", name, "error", err)
+				return 1
+			}
+			return 0
+		},
 	}
-	s.Machines[config.Fqdn] = machine
-	if template != nil {
-		log.Info("Checking machine config")
-		ok, err = machine.EnsureOptions(log, config.Options)
-		if err != nil {
-			return
-		}
-		changed = changed || ok
-		ok, err = machine.EnsureOverride(log, config.Overrides)
-		if err != nil {
-			return
-		}
-		changed = changed || ok
-		reload = reload || ok
-		var mounts_changed bool
-		mounts_changed, err = config.EnsureMounts(log)
+}
+
+func attachConsole(pty *os.File, name, ptyName string) error {
+	fmt.Fprintf(os.Stderr, "Connected to machine %s on %s. Press ^] three times within 1s to exit session.\n", name, ptyName)
+	if util.IsTerminal(int(os.Stdin.Fd())) {
+		restore, err := util.MakeRaw(int(os.Stdin.Fd()))
 		if err != nil {
-			return
+			return err
 		}
-		changed = changed || mounts_changed
-		reload = reload || mounts_changed
-		if changed {
-			err = machine.Stop()
-			if err != nil {
+		defer restore()
+	}
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, pty)
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		escapes := 0
+		var first time.Time
+		for {
+			n, err := os.Stdin.Read(buf)
+			for _, c := range buf[:n] {
+				if c != consoleEscape {
+					escapes = 0
+					continue
+				}
+				if escapes == 0 || time.Since(first) > time.Second {
+					escapes = 0
+					first = time.Now()
+				}
+				escapes++
+				if escapes == 3 {
+					done <- nil
+					return
+				}
+			}
+			if _, werr := pty.Write(buf[:n]); werr != nil {
+				done <- werr
 				return
 			}
-		}
-		if mounts_changed {
-			err = config.Unmount(s.Manager)
 			if err != nil {
+				done <- err
 				return
 			}
 		}
+	}()
+	err := <-done
+	fmt.Fprintf(os.Stderr, "\r\nConnection to machine %s terminated.\r\n", name)
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.EIO) {
+		// EIO is how a PTY reports the guest side being closed
+		return nil
+	}
+	return err
+}
+
+func newShellCommand() *Subcommand {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	user := fs.String("user", "root", "User to open the shell as")
+	return &Subcommand{
+		Name:        "shell",
+		Usage:       "[flags] <machine>",
+		Description: "Open an interactive shell inside a machine",
+		Flags:       fs,
+		Run: func(args []string) int {
+			if len(args) != 1 {
+				fmt.Fprintln(os.Stderr, "shell requires exactly one machine")
+				return 2
+			}
+			return runAttached("machinectl", "shell", *user+"@"+args[0])
+		},
+	}
+}
+
+func newTemplateCommand() *Subcommand {
+	listFlags := flag.NewFlagSet("template list", flag.ContinueOnError)
+	listDebug := listFlags.Bool("debug", false, "Enable debug log")
+	buildOpts := &Options{}
+	buildFlags := flag.NewFlagSet("template build", flag.ContinueOnError)
+	buildOpts.RegisterCommon(buildFlags)
+	buildDir := buildFlags.String("C", ".", "mkosi configuration directory")
+	buildProfile := buildFlags.String("profile", "", "mkosi profile to build")
+	buildSkipValidation := buildFlags.Bool("skip-validation", false, "Don't boot new templates to run their TemplateTests")
+	importOpts := &Options{}
+	importFlags := flag.NewFlagSet("template import", flag.ContinueOnError)
+	importOpts.RegisterCommon(importFlags)
+	importName := importFlags.String("name", "", "Template name to register the image as")
+	importVersion := importFlags.Int("version", -1, "Template version, defaults to the next free one")
+	importForce := importFlags.Bool("force", false, "Replace an existing image of the same name")
+	importReadOnly := importFlags.Bool("read-only", false, "Mark the imported image read-only")
+	importSkipValidation := importFlags.Bool("skip-validation", false, "Don't boot the template to run its TemplateTests")
+	createOpts := &Options{}
+	createFlags := flag.NewFlagSet("template create", flag.ContinueOnError)
+	createOpts.RegisterCommon(createFlags)
+	createVersion := createFlags.Int("version", -1, "Template version, defaults to the next free one")
+	createForce := createFlags.Bool("force", false, "Replace an existing image of the same name")
+	createSkipValidation := createFlags.Bool("skip-validation", false, "Don't boot the template to run its TemplateTests")
+	promoteOpts := &Options{}
+	promoteFlags := flag.NewFlagSet("template promote", flag.ContinueOnError)
+	promoteOpts.Register(promoteFlags)
+	promoteChannel := promoteFlags.String("channel", reconcile.ChannelStable, "Channel to promote to: stable or testing")
+	promoteOnly := promoteFlags.Bool("n", false, "Only record the promotion, upgrade the machines with the next apply")
+	return &Subcommand{
+		Name:        "template",
+		Usage:       "<command>",
+		Description: "Manage machine templates",
+		Subcommands: []*Subcommand{
+			{
+				Name:        "import",
+				Usage:       "[flags] <directory|tarball>",
+				Description: "Register a root filesystem tree or tarball as a template",
+				Flags:       importFlags,
+				Run: func(args []string) int {
+					importOpts.SetupLogging()
+					if len(args) != 1 || *importName == "" {
+						fmt.Fprintln(os.Stderr, "import requires -name and exactly one source")
+						return 2
+					}
+					tests, err := templateTests(importOpts, *importName, *importSkipValidation)
+					if err != nil {
+						slog.Error("Error loading config file", "files", importOpts.Configs(), "error", err)
+						return 1
+					}
+					return importTemplate(args[0], *importName, *importVersion, *importForce, *importReadOnly, tests)
+				},
+			},
+			{
+				Name:        "create",
+				Usage:       "[flags] <name>",
+				Description: "Produce a template from its configured TemplateSources entry",
+				Flags:       createFlags,
+				Run: func(args []string) int {
+					createOpts.SetupLogging()
+					if len(args) != 1 {
+						fmt.Fprintln(os.Stderr, "create requires exactly one template name")
+						return 2
+					}
+					config, err := createOpts.LoadConfig()
+					if err != nil {
+						slog.Error("Error loading config file", "files", createOpts.Configs(), "error", err)
+						return 1
+					}
+					return createTemplate(config, args[0], *createVersion, *createForce, *createSkipValidation)
+				},
+			},
+			{
+				Name:        "list",
+				Usage:       "[flags]",
+				Description: "List discovered templates",
+				Flags:       listFlags,
+				Run: func(args []string) int {
+					SetupLogging(*listDebug)
+					manager, err := machineutil.NewMachineUtil()
+					if err != nil {
+						slog.Error("Error connecting to machined", "error", err)
+						return 1
+					}
+					defer manager.Close()
+					templates, err := manager.ListTemplates("")
+					if err != nil {
+						slog.Error("Listing templates", "error", err)
+						return 1
+					}
+					names := []string{}
+					all := templates.(*machineutil.Templates).Templates
+					for name := range all {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					for _, name := range names {
+						for _, tmpl := range all[name] {
+							arch := tmpl.Arch
+							if arch == "" {
+								arch = "-"
+							}
+							fmt.Printf("%-30s %-8d %s\n", tmpl.Name, tmpl.Version, arch)
+						}
+					}
+					return 0
+				},
+			},
+			{
+				Name:        "promote",
+				Usage:       "[flags] <name@version>",
+				Description: "Promote a template version to a channel and upgrade the machines following it",
+				Flags:       promoteFlags,
+				Run: func(args []string) int {
+					promoteOpts.SetupLogging()
+					if len(args) != 1 {
+						fmt.Fprintln(os.Stderr, "promote requires exactly one template version")
+						return 2
+					}
+					if code := promoteTemplate(args[0], *promoteChannel); code != 0 || *promoteOnly {
+						return code
+					}
+					return Reconcile(promoteOpts, reconcile.ModeCreate)
+				},
+			},
+			{
+				Name:        "build",
+				Usage:       "[flags] [mkosi args...]",
+				Description: "Build templates with mkosi into /var/lib/machines",
+				Flags:       buildFlags,
+				Run: func(args []string) int {
+					buildOpts.SetupLogging()
+					var config *reconcile.Config
+					if len(buildOpts.ConfigFiles) > 0 && !*buildSkipValidation {
+						var err error
+						config, err = buildOpts.LoadConfig()
+						if err != nil {
+							slog.Error("Error loading config file", "files", buildOpts.Configs(), "error", err)
+							return 1
+						}
+					}
+					cmdArgs := []string{"-C", *buildDir}
+					if *buildProfile != "" {
+						cmdArgs = append(cmdArgs, "--profile", *buildProfile)
+					}
+					cmdArgs = append(cmdArgs, args...)
+					cmdArgs = append(cmdArgs, "build")
+					if config == nil {
+						return runAttached("mkosi", cmdArgs...)
+					}
+					return buildTemplates(config, cmdArgs)
+				},
+			},
+		},
+	}
+}
+
+// newTemplatesCommand lists the catalog, every template version with its size and the machines using it
+func newTemplatesCommand() *Subcommand {
+	opts := &Options{}
+	fs := flag.NewFlagSet("templates", flag.ContinueOnError)
+	opts.RegisterCommon(fs)
+	asJson := fs.Bool("json", false, "Print the catalog as JSON")
+	return &Subcommand{
+		Name:        "templates",
+		Usage:       "[flags]",
+		Description: "List all template versions with their size and the configured machines using them",
+		Flags:       fs,
+		Run: func(args []string) int {
+			opts.SetupLogging()
+			config, err := opts.LoadConfig()
+			if err != nil {
+				slog.Error("Error loading config file", "files", opts.Configs(), "error", err)
+				return 1
+			}
+			r, err := reconcile.New(config, reconcile.Options{})
+			if err != nil {
+				slog.Error("Error creating state", "error", err)
+				return 1
+			}
+			defer r.Close()
+			catalog := r.State.Catalog(r.Config)
+			if *asJson {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(catalog); err != nil {
+					slog.Error("Encoding catalog", "error", err)
+					return 1
+				}
+				return 0
+			}
+			fmt.Printf("%-30s %-8s %-8s %-8s %-15s %-10s %-20s %s\n", "TEMPLATE", "VERSION", "ARCH", "SELECTED", "CHANNELS", "SIZE", "CREATED", "MACHINES")
+			for _, e := range catalog {
+				arch, selected, channels, size, created, machines := "-", "", "-", "-", "-", "-"
+				if e.Arch != "" {
+					arch = e.Arch
+				}
+				if e.Selected {
+					selected = "*"
+				}
+				if len(e.Channels) > 0 {
+					channels = strings.Join(e.Channels, ",")
+				}
+				if e.Usage > 0 {
+					size = util.FormatBytes(e.Usage)
+				}
+				if !e.Created.IsZero() {
+					created = e.Created.Format(time.DateTime)
+				}
+				if len(e.Machines) > 0 {
+					machines = strings.Join(e.Machines, ",")
+				}
+				fmt.Printf("%-30s %-8d %-8s %-8s %-15s %-10s %-20s %s\n", e.Name, e.Version, arch, selected, channels, size, created, machines)
+			}
+			return 0
+		},
+	}
+}
+
+// promoteTemplate records ref, which must name an existing version, as the version of channel
+func promoteTemplate(ref, channel string) int {
+	name, version, err := reconcile.ParseTemplateRef(ref)
+	if err == nil && version < 0 {
+		err = fmt.Errorf("%q has no version", ref)
+	}
+	if err != nil {
+		slog.Error("Invalid template", "error", err)
+		return 2
+	}
+	manager, err := machineutil.NewMachineUtil()
+	if err != nil {
+		slog.Error("Error connecting to machined", "error", err)
+		return 1
+	}
+	defer manager.Close()
+	templates, err := manager.ListTemplates(name)
+	if err != nil {
+		slog.Error("Listing templates", "error", err)
+		return 1
+	}
+	if templates.GetVersion(name, version) == nil {
+		slog.Error("No such template", "template", name, "version", version)
+		return 1
 	}
+	channels, err := reconcile.LoadChannels()
 	if err == nil {
-		s.Machines[config.Fqdn] = machine
-		return
+		err = channels.Promote(name, channel, version)
+	}
+	if err == nil {
+		err = channels.Save()
+	}
+	if err != nil {
+		slog.Error("Recording promotion", "file", reconcile.ChannelsFile, "error", err)
+		return 1
 	}
-	return
+	slog.Info("Promoted template", "template", name, "version", version, "channel", channel)
+	return 0
 }
 
-func (s *State) RemoveMachine(log *slog.Logger, config *Machine) error {
-	machine, _, _, err := s.EnsureMachine(log, config, nil)
-	if errors.Is(err, machineutil.ErrNoSuchImage) {
-		return nil
+// templateTests loads the smoke tests for template name, no config means no validation
+func templateTests(opts *Options, name string, skip bool) ([]*reconcile.CommandDescription, error) {
+	if skip || len(opts.ConfigFiles) == 0 {
+		return nil, nil
+	}
+	config, err := opts.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.TemplateTests[name], nil
+}
+
+// ValidateTemplate boots a throwaway clone of image and runs the smoke tests inside it
+func ValidateTemplate(manager machineutil.MachineUtil, image string, tests []*reconcile.CommandDescription) (err error) {
+	clone := "machineutil-validate-" + image
+	log := slog.With("image", image, "machine", clone)
+	log.Info("Validating template")
+	machine, err := manager.Clone(image, clone)
+	if errors.Is(err, machineutil.ErrAlreadyExists) {
+		log.Warn("Reusing leftover validation machine")
+		err = nil
 	}
-	delete(s.Machines, config.Fqdn)
-	err = machine.Remove()
 	if err != nil {
 		return err
 	}
-	err = config.Unmount(s.Manager)
+	defer func() {
+		log.Debug("Removing validation machine")
+		if rmErr := manager.Remove(clone); rmErr != nil {
+			log.Error("Removing validation machine", "error", rmErr)
+			if err == nil {
+				err = rmErr
+			}
+		}
+	}()
+	err = machine.Start()
 	if err != nil {
 		return err
 	}
-	c, err := config.RemoveMounts(log)
+	addrs, err := machine.WaitForAddress()
 	if err != nil {
 		return err
 	}
-	if c {
-		return s.Manager.DaemonReload()
+	env := &reconcile.CommandEnv{
+		Machine: machine,
+		Addrs:   addrs,
 	}
+	for _, cmd := range tests {
+		err = cmd.Run(env)
+		if err != nil {
+			return fmt.Errorf("template test %v: %w", cmd.Command, err)
+		}
+	}
+	log.Info("Template validated")
 	return nil
 }
 
-func main() {
-	configFile := flag.String("config", "-", "Config file to use")
-	mode := flag.String("mode", "create", "Mode to use: create, start, stop, destroy")
-	debug := flag.Bool("debug", false, "Enable debug log")
-	flag.Parse()
-	var err error
-	log_options := &slog.HandlerOptions{
-		Level: slog.LevelInfo,
+func importTemplate(source, name string, version int, force, readOnly bool, tests []*reconcile.CommandDescription) int {
+	info, err := os.Stat(source)
+	if err != nil {
+		slog.Error("Reading import source", "source", source, "error", err)
+		return 1
 	}
-	if *debug {
-		log_options.Level = slog.LevelDebug
+	manager, err := machineutil.NewMachineUtil()
+	if err != nil {
+		slog.Error("Error connecting to machined", "error", err)
+		return 1
 	}
-	slog.SetDefault(
-		slog.New(
-			slog.NewTextHandler(
-				os.Stderr,
-				log_options,
-			),
-		),
-	)
-	switch *mode {
-	case "create", "start", "stop", "destroy":
-	default:
-		slog.Error("Invalid mode", "mode", *mode)
-		slog.Info("Try: create, start, stop, destroy")
-		os.Exit(1)
-	}
-	slog.Info("Starting with mode", "mode", *mode)
-	var configReader io.Reader
-	switch *configFile {
-	case "-":
-		slog.Info("Reading config from stdin")
-		configReader = os.Stdin
-	default:
-		slog.Info("Reading config from", "file", *configFile)
-		configReader, err = os.Open(*configFile)
+	defer manager.Close()
+	if version < 0 {
+		templates, err := manager.ListTemplates(name)
 		if err != nil {
-			slog.Error("Error opening config file", "file", *configFile, "error", err)
-			os.Exit(1)
+			slog.Error("Listing templates", "error", err)
+			return 1
 		}
+		version = templates.(*machineutil.Templates).NextVersion(name)
 	}
-	var configDecoder ConfigDecoder
-	switch path.Ext(*configFile) {
-	case "json":
-		slog.Info("Using json decoder")
-		configDecoder = json.NewDecoder(configReader)
-	default:
-		slog.Info("Using yaml decoder")
-		configDecoder = yaml.NewDecoder(configReader)
+	image := machineutil.TemplateImage(name, version)
+	// untested images are staged under a name ListTemplates ignores
+	target := image
+	if len(tests) > 0 {
+		target = name + "-staging_" + strconv.Itoa(version)
 	}
-	config := &Config{}
-	slog.Info("Decoding config")
-	err = configDecoder.Decode(&config)
-	if err != nil {
-		slog.Error("Error decoding config file", "file", *configFile, "error", err)
-		os.Exit(1)
+	log := slog.With("source", source, "image", target)
+	log.Info("Importing template")
+	if info.IsDir() {
+		err = manager.ImportFileSystem(source, target, force, readOnly)
+	} else {
+		err = manager.ImportTar(source, target, force, readOnly)
 	}
-	slog.Info("Creating state")
-	state, err := NewState(config)
 	if err != nil {
-		slog.Error("Error creating state", "error", err)
-		os.Exit(1)
+		log.Error("Importing template", "error", err)
+		return 1
 	}
-	base_log := slog.Default().With("mode", *mode)
-	base_log.Info("Starting execution")
-	for _, m := range config.Machines {
-		log := base_log.With("machine", m.Fqdn)
-		err := m.Normalize()
+	if len(tests) > 0 {
+		err = ValidateTemplate(manager, target, tests)
 		if err != nil {
-			log.Error("Normalizing config", "error", err)
-			os.Exit(1)
-		}
-		if *mode == "destroy" {
-			log.Info("Removing")
-			err := state.RemoveMachine(log, m)
-			if err != nil {
-				log.Error("Removing", "error", err)
-				os.Exit(1)
+			log.Error("Template validation failed, discarding import", "error", err)
+			if rmErr := manager.Remove(target); rmErr != nil {
+				log.Error("Removing staged image", "error", rmErr)
 			}
-			continue
+			return 1
 		}
-		var template *machineutil.Template
-		if *mode == "create" {
-			template, err = state.DiscoverTemplate(m)
-			if err != nil {
-				log.Error("Discovering template", "error", err)
-				os.Exit(1)
-			}
+		err = manager.Rename(target, image)
+		if err != nil {
+			log.Error("Promoting template", "error", err)
+			return 1
 		}
-		log.Info("Detecting machine")
-		machine, _, reload, err := state.EnsureMachine(log, m, template)
-		if *mode == "stop" {
-			if errors.Is(err, machineutil.ErrNoSuchImage) {
-				log.Warn("Missing")
-				continue
-			}
+	}
+	log.Info("Imported", "template", image)
+	return 0
+}
+
+// createTemplate builds the root filesystem of a configured template source and imports it like template import
+func createTemplate(config *reconcile.Config, name string, version int, force, skipValidation bool) int {
+	source, ok := config.TemplateSources[name]
+	if !ok {
+		slog.Error("No template source configured", "template", name)
+		return 1
+	}
+	// on disk, a root filesystem easily outgrows a tmpfs /tmp
+	root, err := os.MkdirTemp("/var/tmp", "machineutil-"+name+"-")
+	if err != nil {
+		slog.Error("Creating build directory", "error", err)
+		return 1
+	}
+	defer os.RemoveAll(root)
+	// the directory becomes / of the template
+	if err := os.Chmod(root, 0755); err != nil {
+		slog.Error("Creating build directory", "error", err)
+		return 1
+	}
+	log := slog.With("template", name, "root", root)
+	log.Info("Building template")
+	if err := source.Build(log, root); err != nil {
+		log.Error("Building template", "error", err)
+		return 1
+	}
+	var tests []*reconcile.CommandDescription
+	if !skipValidation {
+		tests = config.TemplateTests[name]
+	}
+	return importTemplate(root, name, version, force, false, tests)
+}
+
+// buildTemplates runs mkosi and validates every template version it produced,
+// versions failing their tests are renamed away so Template() never selects them
+func buildTemplates(config *reconcile.Config, mkosiArgs []string) int {
+	manager, err := machineutil.NewMachineUtil()
+	if err != nil {
+		slog.Error("Error connecting to machined", "error", err)
+		return 1
+	}
+	defer manager.Close()
+	existing := make(map[string]bool)
+	before, err := manager.ListTemplates("")
+	if err != nil {
+		slog.Error("Listing templates", "error", err)
+		return 1
+	}
+	for _, versions := range before.(*machineutil.Templates).Templates {
+		for _, tmpl := range versions {
+			existing[tmpl.Image()] = true
 		}
-		if err != nil {
-			log.Error("Detecting", "error", err)
-			os.Exit(1)
+	}
+	if code := runAttached("mkosi", mkosiArgs...); code != 0 {
+		return code
+	}
+	after, err := manager.ListTemplates("")
+	if err != nil {
+		slog.Error("Listing templates", "error", err)
+		return 1
+	}
+	retval := 0
+	for name, versions := range after.(*machineutil.Templates).Templates {
+		tests := config.TemplateTests[name]
+		if len(tests) == 0 {
+			continue
 		}
-		log.Info("Found")
-		if *mode == "stop" {
-			log.Info("Stopping")
-			err = machine.Stop()
-			if err != nil {
-				log.Error("Stopping", "error", err)
-				os.Exit(1)
+		for _, tmpl := range versions {
+			if existing[tmpl.Image()] {
+				continue
 			}
-			err = m.Unmount(state.Manager)
-			if err != nil {
-				log.Error("Unmounting failed", "error", err)
-				os.Exit(1)
+			err = ValidateTemplate(manager, tmpl.Image(), tests)
+			if err == nil {
+				continue
 			}
-			continue
-		}
-		if reload {
-			err := state.Manager.DaemonReload()
-			if err != nil {
-				log.Error("Failed to reload daemon", "error", err)
-				os.Exit(1)
+			retval = 1
+			failed := name + "-failed_" + strconv.Itoa(tmpl.Version)
+			slog.Error("Template validation failed", "image", tmpl.Image(), "renamed", failed, "error", err)
+			if err := manager.Rename(tmpl.Image(), failed); err != nil {
+				slog.Error("Renaming failed template", "image", tmpl.Image(), "error", err)
 			}
 		}
-		if !machine.Running() {
-			log.Info("Starting")
-			err = machine.Start()
-			m.runStartup = true
-			if err != nil {
-				log.Error("Starting", "error", err)
-				os.Exit(1)
+	}
+	return retval
+}
+
+func newCompletionCommand(root *Subcommand) *Subcommand {
+	return &Subcommand{
+		Name:        "completion",
+		Usage:       "<bash|zsh>",
+		Description: "Generate a shell completion script",
+		Run: func(args []string) int {
+			if len(args) != 1 {
+				fmt.Fprintln(os.Stderr, "completion requires a shell: bash or zsh")
+				return 2
 			}
+			switch args[0] {
+			case "bash":
+				fmt.Print(bashCompletion(root))
+			case "zsh":
+				fmt.Print("autoload -U +X bashcompinit && bashcompinit\n" + bashCompletion(root))
+			default:
+				fmt.Fprintf(os.Stderr, "Unsupported shell %q\n", args[0])
+				return 2
+			}
+			return 0
+		},
+	}
+}
+
+func commandWords(c *Subcommand) []string {
+	words := []string{}
+	for _, sub := range c.Subcommands {
+		words = append(words, sub.Name)
+	}
+	if c.Flags != nil {
+		c.Flags.VisitAll(func(f *flag.Flag) {
+			words = append(words, "-"+f.Name)
+		})
+	}
+	return words
+}
+
+func bashCompletion(root *Subcommand) string {
+	var b strings.Builder
+	b.WriteString("_machineutil() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" words=\"\"\n")
+	b.WriteString("\tcase \"${COMP_WORDS[1]} ${COMP_WORDS[2]}\" in\n")
+	for _, sub := range root.Subcommands {
+		for _, nested := range sub.Subcommands {
+			fmt.Fprintf(&b, "\t\"%s %s\"*) words=\"%s\" ;;\n", sub.Name, nested.Name, strings.Join(commandWords(nested), " "))
 		}
-		log.Info("Waiting for address")
-		addr, err := machine.WaitForAddress()
-		if err != nil {
-			log.Error("Wait address", "error", err)
-			os.Exit(1)
+	}
+	for _, sub := range root.Subcommands {
+		fmt.Fprintf(&b, "\t\"%s \"*) words=\"%s\" ;;\n", sub.Name, strings.Join(commandWords(sub), " "))
+	}
+	fmt.Fprintf(&b, "\t*) words=\"%s\" ;;\n", strings.Join(commandWords(root), " "))
+	b.WriteString("\tesac\n")
+	b.WriteString("\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o default -F _machineutil machineutil\n")
+	return b.String()
+}
+
+func runAttached(name string, args ...string) int {
+	slog.Debug("Running command", "command", append([]string{name}, args...))
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := reconcile.Commands.Run(cmd, nil, nil)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func newRootCommand() *Subcommand {
+	root := &Subcommand{
+		Name:        "machineutil",
+		Usage:       "<command> [flags]",
+		Description: "Declarative systemd-nspawn machine management",
+		Subcommands: []*Subcommand{
+			newReconcileCommand("apply", "Create, configure and start all configured machines"),
+			newReconcileCommand("start", "Start existing machines and run their commands"),
+			newReconcileCommand("stop", "Stop all configured machines"),
+			newReconcileCommand("destroy", "Remove all configured machines and their mounts"),
+			newFreezeCommand("pause", "Freeze running machines in place, e.g. during host backups", true),
+			newFreezeCommand("resume", "Thaw paused machines", false),
+			newStatusCommand(),
+			newGCCommand(),
+			newPlanCommand(),
+			newDaemonCommand(),
+			newTopCommand(),
+			newInventoryCommand(),
+			newExecCommand(),
+			newShellCommand(),
+			newConsoleCommand(),
+			newLogsCommand(),
+			newTemplateCommand(),
+			newTemplatesCommand(),
+			newSchemaCommand(),
+			{
+				Name:        "version",
+				Usage:       "",
+				Description: "Print version information",
+				Run: func(args []string) int {
+					build := machineutil.GetBuildInfo()
+					fmt.Println(build)
+					fmt.Println("minimum systemd version", build.MinimumSystemdVersion)
+					return 0
+				},
+			},
+		},
+	}
+	root.Subcommands = append(root.Subcommands, newCompletionCommand(root))
+	return root
+}
+
+// legacyModeArgs extracts -mode from args when it names a subcommand other than the reconcile modes
+func legacyModeArgs(root *Subcommand, args []string) (*Subcommand, []string) {
+	for i, arg := range args {
+		var mode string
+		rest := []string{}
+		switch {
+		case arg == "-mode" || arg == "--mode":
+			if i+1 >= len(args) {
+				return nil, nil
+			}
+			mode = args[i+1]
+			rest = append(rest, args[:i]...)
+			rest = append(rest, args[i+2:]...)
+		case strings.HasPrefix(arg, "-mode=") || strings.HasPrefix(arg, "--mode="):
+			_, mode, _ = strings.Cut(arg, "=")
+			rest = append(rest, args[:i]...)
+			rest = append(rest, args[i+1:]...)
+		default:
+			continue
 		}
-		err = m.RunCommands(addr)
-		if err != nil {
-			log.Error("Startup commands failed", "error", err)
-			os.Exit(1)
+		switch mode {
+		case "create", "start", "stop", "destroy":
+			return nil, nil
 		}
+		return root.Find(mode), rest
+	}
+	return nil, nil
+}
+
+// legacyMain keeps the original flat -mode interface working
+func legacyMain(args []string) int {
+	root := newRootCommand()
+	if sub, rest := legacyModeArgs(root, args); sub != nil {
+		return sub.Execute("machineutil "+sub.Name, rest)
+	}
+	fs := flag.NewFlagSet("machineutil", flag.ContinueOnError)
+	opts := &Options{}
+	opts.Register(fs)
+	mode := fs.String("mode", "create", "Mode to use: create, start, stop, destroy")
+	version := fs.Bool("version", false, "Print version information and exit")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *version {
+		return root.Find("version").Run(nil)
+	}
+	opts.SetupLogging()
+	switch *mode {
+	case "create", "start", "stop", "destroy":
+	default:
+		slog.Error("Invalid mode", "mode", *mode)
+		slog.Info("Try: create, start, stop, destroy")
+		return 1
+	}
+	return Reconcile(opts, *mode)
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" && args[0] != "--help") {
+		os.Exit(legacyMain(args))
 	}
-	base_log.Info("Done.")
+	os.Exit(newRootCommand().Execute("machineutil", args))
 }
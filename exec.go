@@ -0,0 +1,278 @@
+package machineutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	systemdDbusUnitInterface    = "org.freedesktop.systemd1.Unit"
+	systemdDbusServiceInterface = "org.freedesktop.systemd1.Service"
+)
+
+var ErrCommandFailed error = errors.New("command failed")
+
+type ExecResult struct {
+	Unit   string
+	Result string
+	Code   int32
+	Status int32
+	Stdout []byte
+	Stderr []byte
+}
+
+func (r *ExecResult) Err() error {
+	if r.Result == "success" && r.Status == 0 {
+		return nil
+	}
+	return &ExitError{r}
+}
+
+// cldExited is the siginfo code systemd reports in ExecMainCode for a normal exit
+const cldExited = 1
+
+type ExitError struct {
+	Result *ExecResult
+}
+
+func (e *ExitError) Error() string {
+	r := e.Result
+	return fmt.Sprintf("%s: %s result=%s code=%d status=%d", ErrCommandFailed, r.Unit, r.Result, r.Code, r.Status)
+}
+
+func (e *ExitError) Unwrap() error { return ErrCommandFailed }
+
+// ExitCode mirrors exec.ExitError, -1 is returned when the command didn't exit normally
+func (e *ExitError) ExitCode() int {
+	if e.Result.Code != cldExited {
+		return -1
+	}
+	return int(e.Result.Status)
+}
+
+type execStart struct {
+	Path          string
+	Argv          []string
+	IgnoreFailure bool
+}
+
+type unitProperty struct {
+	Name  string
+	Value dbus.Variant
+}
+
+func (m *Machine) Leader() (uint32, error) {
+	var result uint32
+	err := m.object.Call("org.freedesktop.DBus.Properties.Get", 0, machinedDbusMachineInterface, "Leader").Store(&result)
+	return result, err
+}
+
+// RootPath returns a host path through which the root directory of the machine is reachable
+func (m *Machine) RootPath() (string, error) {
+	// the image directory is shared with the VM as is
+	if m.IsVM() {
+		return m.manager.ImagePath(m.Name)
+	}
+	leader, err := m.Leader()
+	if err != nil {
+		return "", err
+	}
+	return "/proc/" + strconv.FormatUint(uint64(leader), 10) + "/root", nil
+}
+
+// UIDShift returns the host uid the root user of the machine maps to, 0 without a user namespace
+func (m *Machine) UIDShift() (int, error) {
+	if m.IsVM() {
+		return 0, nil
+	}
+	leader, err := m.Leader()
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile("/proc/" + strconv.FormatUint(uint64(leader), 10) + "/uid_map")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "0" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("no mapping for root in the uid map of %s", m.Name)
+}
+
+// OpenBus connects to the private systemd bus of the machine, no dbus-daemon is required inside the guest.
+// systemd only serves the root user of the machine there. Behind a user namespace the host root shows up as
+// nobody, so the socket is connected from a thread running as the host uid the guest root maps to.
+// Entering the user namespace instead isn't possible, setns refuses that to multithreaded processes.
+func (m *Machine) OpenBus() (*dbus.Conn, error) {
+	root, err := m.RootPath()
+	if err != nil {
+		return nil, err
+	}
+	shift, err := m.UIDShift()
+	if err != nil {
+		return nil, err
+	}
+	socket := root + "/run/systemd/private"
+	if shift == 0 {
+		return dialBus("unix:path="+socket, os.Getuid())
+	}
+	// opened while still root, the thread running as shift may not look into the machine through /proc
+	fd, err := unix.Open(socket, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	type result struct {
+		conn *dbus.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// the thread is never unlocked, it is torn down with the goroutine instead of running others as shift.
+		// The raw calls only change this thread, syscall.Setresuid changes every thread of the process.
+		runtime.LockOSThread()
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESGID, uintptr(shift), uintptr(shift), 0); errno != 0 {
+			done <- result{nil, fmt.Errorf("switching to gid %d: %w", shift, errno)}
+			return
+		}
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, uintptr(shift), uintptr(shift), 0); errno != 0 {
+			done <- result{nil, fmt.Errorf("switching to uid %d: %w", shift, errno)}
+			return
+		}
+		// the guest sees the credentials of this thread as its root
+		conn, err := dialBus("unix:path=/proc/thread-self/fd/"+strconv.Itoa(fd), 0)
+		done <- result{conn, err}
+	}()
+	res := <-done
+	return res.conn, res.err
+}
+
+// dialBus connects to address and authenticates as uid, the credentials are sent from the calling thread
+func dialBus(address string, uid int) (*dbus.Conn, error) {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	methods := []dbus.Auth{dbus.AuthExternal(strconv.Itoa(uid))}
+	err = conn.Auth(methods)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Exec runs argv as a transient service inside the machine and collects its result.
+// Output is written to files under the guest /run and copied back once the unit has finished.
+// The unit is stopped when ctx is done before it finished.
+func (m *Machine) Exec(ctx context.Context, argv []string, stdin io.Reader) (*ExecResult, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	root, err := m.RootPath()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := m.OpenBus()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	systemd := conn.Object(systemdDbusService, systemdDbusPath)
+	id := "machineutil-run-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	stdout := "/run/" + id + ".stdout"
+	stderr := "/run/" + id + ".stderr"
+	// the guest controls its /run, a symlink planted there must not reach host files
+	defer util.RemoveInRoot(root, stdout)
+	defer util.RemoveInRoot(root, stderr)
+	result := &ExecResult{Unit: id + ".service"}
+	props := []unitProperty{
+		{"Description", dbus.MakeVariant("machineutil: " + strings.Join(argv, " "))},
+		{"AddRef", dbus.MakeVariant(true)},
+		{"Type", dbus.MakeVariant("exec")},
+		{"ExecStart", dbus.MakeVariant([]execStart{{argv[0], argv, false}})},
+		{"StandardOutput", dbus.MakeVariant("file:" + stdout)},
+		{"StandardError", dbus.MakeVariant("file:" + stderr)},
+	}
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props,
+			unitProperty{"StandardInput", dbus.MakeVariant("data")},
+			unitProperty{"StandardInputData", dbus.MakeVariant(data)},
+		)
+	}
+	var job dbus.ObjectPath
+	err = systemd.Call(systemdDbusInterface+".StartTransientUnit", 0, result.Unit, "fail", props, []struct {
+		Name       string
+		Properties []unitProperty
+	}{}).Store(&job)
+	if err != nil {
+		return nil, err
+	}
+	// abort stops the unit, its result doesn't matter anymore
+	abort := func(err error) error {
+		systemd.Call(systemdDbusInterface+".StopUnit", 0, result.Unit, "replace")
+		return fmt.Errorf("%s: %w", result.Unit, err)
+	}
+	poller := Poll.Poller()
+	for (&Job{object: conn.Object(systemdDbusService, job)}).exists() {
+		if err := poller.Wait(ctx); err != nil {
+			return nil, abort(err)
+		}
+	}
+	var unitPath dbus.ObjectPath
+	err = systemd.Call(systemdDbusInterface+".GetUnit", 0, result.Unit).Store(&unitPath)
+	if err != nil {
+		return nil, err
+	}
+	unitObject := conn.Object(systemdDbusService, unitPath)
+	defer unitObject.Call(systemdDbusUnitInterface+".Unref", 0)
+	defer systemd.Call(systemdDbusInterface+".ResetFailedUnit", 0, result.Unit)
+	poller = Poll.Poller()
+	for {
+		var state string
+		err = unitObject.Call("org.freedesktop.DBus.Properties.Get", 0, systemdDbusUnitInterface, "ActiveState").Store(&state)
+		if err != nil {
+			return nil, err
+		}
+		if state == "inactive" || state == "failed" {
+			break
+		}
+		if err := poller.Wait(ctx); err != nil {
+			return nil, abort(err)
+		}
+	}
+	err = unitObject.Call("org.freedesktop.DBus.Properties.Get", 0, systemdDbusServiceInterface, "Result").Store(&result.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = unitObject.Call("org.freedesktop.DBus.Properties.Get", 0, systemdDbusServiceInterface, "ExecMainCode").Store(&result.Code)
+	if err != nil {
+		return nil, err
+	}
+	err = unitObject.Call("org.freedesktop.DBus.Properties.Get", 0, systemdDbusServiceInterface, "ExecMainStatus").Store(&result.Status)
+	if err != nil {
+		return nil, err
+	}
+	// missing files just mean no output was produced
+	result.Stdout, _ = util.ReadFileInRoot(root, stdout)
+	result.Stderr, _ = util.ReadFileInRoot(root, stderr)
+	return result, nil
+}
@@ -0,0 +1,594 @@
+package machineutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+)
+
+// Fake is an in-memory MachineUtil for tests and dry runs, nothing outside of it and util.Files is touched.
+// Images only exist as names and machines run as soon as their unit is started.
+// Every mutating call is appended to Calls, e.g. "Clone web-template_1 web.example.com".
+type Fake struct {
+	// Root is what ImagePath places images under
+	Root string
+	// Version is returned by SystemdVersion
+	Version int
+	// Addresses are reported by running machines
+	Addresses map[string][]netip.Addr
+	// Free is what PoolSpace reports, plenty unless set
+	Free  uint64
+	Calls []string
+
+	mu       sync.Mutex
+	images   map[string]bool
+	units    map[string]string
+	enabled  map[string]bool
+	started  map[string]time.Time
+	frozen   map[string]bool
+	machines map[string]*Machine
+	watchers []chan string
+}
+
+var _ MachineUtil = (*Fake)(nil)
+
+func NewFake() *Fake {
+	return &Fake{
+		Root:      "/var/lib/machines",
+		Version:   MinimumSystemdVersion,
+		Addresses: make(map[string][]netip.Addr),
+		Free:      math.MaxUint64,
+		images:    make(map[string]bool),
+		units:     make(map[string]string),
+		enabled:   make(map[string]bool),
+		started:   make(map[string]time.Time),
+		frozen:    make(map[string]bool),
+		machines:  make(map[string]*Machine),
+	}
+}
+
+// AddImage registers an image without recording a call, use it to set up the initial state
+func (f *Fake) AddImage(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[name] = true
+}
+
+// AddUnit puts unit into state without recording a call, an active machine unit counts as a running machine
+func (f *Fake) AddUnit(unit, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name, ok := machineName(unit); ok && state == "active" {
+		f.started[name] = time.Now()
+	}
+	f.units[unit] = state
+}
+
+// Images returns the names of all images in lexical order
+func (f *Fake) Images() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sortedImages()
+}
+
+func (f *Fake) sortedImages() []string {
+	names := make([]string, 0, len(f.images))
+	for name := range f.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnitState reports the state of unit, units never started are inactive
+func (f *Fake) UnitState(unit string) (*UnitState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch state := f.unitState(unit); state {
+	case "active":
+		freezer := "running"
+		if f.frozen[unit] {
+			freezer = "frozen"
+		}
+		return &UnitState{ActiveState: state, SubState: "running", Result: "success", FreezerState: freezer}, nil
+	case "failed":
+		return &UnitState{ActiveState: state, SubState: "failed", Result: "exit-code"}, nil
+	default:
+		return &UnitState{ActiveState: state, SubState: "dead", Result: "success"}, nil
+	}
+}
+
+// FailUnit puts unit into the failed state, starting it fails until ResetFailed is called
+func (f *Fake) FailUnit(unit string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name, ok := machineName(unit); ok {
+		delete(f.started, name)
+	}
+	f.units[unit] = "failed"
+}
+
+func (f *Fake) unitState(unit string) string {
+	if state, ok := f.units[unit]; ok {
+		return state
+	}
+	return "inactive"
+}
+
+func (f *Fake) record(format string, args ...interface{}) {
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func noSuchImage(name string) error {
+	return fmt.Errorf("%w: No image '%s' known", ErrNoSuchImage, name)
+}
+
+func (f *Fake) machine(name string) *Machine {
+	if m, ok := f.machines[name]; ok {
+		return m
+	}
+	m := &Machine{Name: name, manager: f}
+	m.object = &fakeObject{fake: f, machine: name}
+	f.machines[name] = m
+	return m
+}
+
+func (f *Fake) ListTemplates(defaultTemplate string) (TemplateCollection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	retval := make(map[string]TemplateVersions)
+	for image := range f.images {
+		name, arch, version, ok := ParseTemplateImage(image)
+		if !ok {
+			continue
+		}
+		retval[name] = append(retval[name], &Template{Name: name, Version: version, Arch: arch, manager: f})
+	}
+	for _, imglst := range retval {
+		sort.Sort(imglst)
+	}
+	return &Templates{Default: defaultTemplate, Arch: HostArch(), Templates: retval}, nil
+}
+
+func (f *Fake) Clone(src, dst string) (*Machine, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.images[dst] {
+		return f.machine(dst), ErrAlreadyExists
+	}
+	if !f.images[src] {
+		return nil, noSuchImage(src)
+	}
+	f.record("Clone %s %s", src, dst)
+	f.images[dst] = true
+	return f.machine(dst), nil
+}
+
+// machineName maps systemd-nspawn@<name>.service and systemd-vmspawn@<name>.service back to the machine name
+func machineName(unit string) (string, bool) {
+	for _, prefix := range []string{"systemd-nspawn@", "systemd-vmspawn@"} {
+		if name, found := strings.CutPrefix(unit, prefix); found {
+			return strings.CutSuffix(name, ".service")
+		}
+	}
+	return "", false
+}
+
+func (f *Fake) Start(unit string) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name, ok := machineName(unit); ok {
+		if !f.images[name] {
+			return nil, noSuchImage(name)
+		}
+	}
+	if f.unitState(unit) == "failed" {
+		return nil, fmt.Errorf("Unit %s failed and hit its start limit", unit)
+	}
+	if name, ok := machineName(unit); ok {
+		f.started[name] = time.Now()
+	}
+	f.record("StartUnit %s", unit)
+	f.units[unit] = "active"
+	return &Job{object: &fakeObject{fake: f}, Unit: unit}, nil
+}
+
+func (f *Fake) Stop(unit string) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stop(unit)
+	return &Job{object: &fakeObject{fake: f}, Unit: unit}, nil
+}
+
+func (f *Fake) stop(unit string) {
+	if name, ok := machineName(unit); ok {
+		delete(f.started, name)
+	}
+	f.record("StopUnit %s", unit)
+	delete(f.frozen, unit)
+	f.units[unit] = "inactive"
+}
+
+func (f *Fake) ResetFailed(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("ResetFailed %s", unit)
+	if f.unitState(unit) == "failed" {
+		f.units[unit] = "inactive"
+	}
+	return nil
+}
+
+func (f *Fake) Remove(image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[image] {
+		return noSuchImage(image)
+	}
+	for _, class := range []string{ClassContainer, ClassVM} {
+		if unit := MachineUnit(class, image); f.unitState(unit) == "active" {
+			f.stop(unit)
+		}
+	}
+	f.record("RemoveImage %s", image)
+	// machined removes the settings file along with the image
+	for _, dir := range []string{"/etc/systemd/nspawn", "/run/systemd/nspawn"} {
+		if err := util.Files.Remove(dir + "/" + image + ".nspawn"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	delete(f.images, image)
+	delete(f.machines, image)
+	for _, w := range f.watchers {
+		select {
+		case w <- image:
+		default:
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Rename(image, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[image] {
+		return noSuchImage(image)
+	}
+	f.record("RenameImage %s %s", image, name)
+	delete(f.images, image)
+	delete(f.machines, image)
+	f.images[name] = true
+	return nil
+}
+
+func (f *Fake) GetImage(name string) (Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[name] {
+		return Image{}, noSuchImage(name)
+	}
+	return Image{Name: name, Path: dbus.ObjectPath("/org/freedesktop/machine1/image/" + name)}, nil
+}
+
+func (f *Fake) ListImages() ([]Image, error) {
+	retval := []Image{}
+	for _, name := range f.Images() {
+		retval = append(retval, Image{Name: name, Path: dbus.ObjectPath("/org/freedesktop/machine1/image/" + name)})
+	}
+	return retval, nil
+}
+
+func (f *Fake) ImagePath(name string) (string, error) {
+	if _, err := f.GetImage(name); err != nil {
+		return "", err
+	}
+	return f.Root + "/" + name, nil
+}
+
+func (f *Fake) ImageLimit(name string) (uint64, error) {
+	if _, err := f.GetImage(name); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// CleanPool removes the hidden images or every image without a running machine, they used no space
+func (f *Fake) CleanPool(mode string) ([]CleanedImage, error) {
+	if !slices.Contains(CleanPoolModes, mode) {
+		return nil, fmt.Errorf("invalid clean mode %q", mode)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("CleanPool %s", mode)
+	retval := []CleanedImage{}
+	for _, image := range f.sortedImages() {
+		if mode == CleanPoolHidden && !strings.HasPrefix(image, ".") {
+			continue
+		}
+		if f.unitState(MachineUnit(ClassContainer, image)) == "active" || f.unitState(MachineUnit(ClassVM, image)) == "active" {
+			continue
+		}
+		delete(f.images, image)
+		delete(f.machines, image)
+		retval = append(retval, CleanedImage{Name: image})
+	}
+	return retval, nil
+}
+
+func (f *Fake) PoolSpace() (*PoolSpace, error) {
+	return &PoolSpace{Path: f.Root, Free: f.Free}, nil
+}
+
+func (f *Fake) GetMachine(name string) (*Machine, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[name] {
+		return nil, noSuchImage(name)
+	}
+	return f.machine(name), nil
+}
+
+func (f *Fake) DaemonReload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Reload")
+	return nil
+}
+
+func (f *Fake) NetworkdReload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("NetworkdReload")
+	return nil
+}
+
+func (f *Fake) UnitProperty(unit, iface, property string, value interface{}) error {
+	props, err := f.UnitProperties(unit, iface)
+	if err != nil {
+		return err
+	}
+	prop, ok := props[property]
+	if !ok {
+		return fmt.Errorf("unknown property %s.%s", iface, property)
+	}
+	return dbus.Store([]interface{}{prop.Value()}, value)
+}
+
+func (f *Fake) UnitProperties(unit, iface string) (map[string]dbus.Variant, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch iface {
+	case systemdDbusUnitInterface:
+		return map[string]dbus.Variant{"ActiveState": dbus.MakeVariant(f.unitState(unit))}, nil
+	case systemdDbusServiceInterface:
+		return map[string]dbus.Variant{
+			"NRestarts":     dbus.MakeVariant(uint32(0)),
+			"CPUUsageNSec":  dbus.MakeVariant(usageUnset),
+			"MemoryCurrent": dbus.MakeVariant(usageUnset),
+			"IOReadBytes":   dbus.MakeVariant(usageUnset),
+			"IOWriteBytes":  dbus.MakeVariant(usageUnset),
+			"TasksCurrent":  dbus.MakeVariant(usageUnset),
+		}, nil
+	}
+	return map[string]dbus.Variant{}, nil
+}
+
+func (f *Fake) SetUnitProperties(unit string, runtime bool, props map[string]dbus.Variant) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(props))
+	for name, value := range props {
+		names = append(names, name+"="+value.String())
+	}
+	sort.Strings(names)
+	f.record("SetUnitProperties %s %s", unit, strings.Join(names, " "))
+	return nil
+}
+
+func (f *Fake) FreezeUnit(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unitState(unit) != "active" {
+		return fmt.Errorf("Unit %s is not active", unit)
+	}
+	f.record("FreezeUnit %s", unit)
+	f.frozen[unit] = true
+	return nil
+}
+
+func (f *Fake) ThawUnit(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unitState(unit) != "active" {
+		return fmt.Errorf("Unit %s is not active", unit)
+	}
+	f.record("ThawUnit %s", unit)
+	delete(f.frozen, unit)
+	return nil
+}
+
+func (f *Fake) EnableUnit(unit string, runtime bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.enabled[unit] {
+		return false, nil
+	}
+	f.record("EnableUnitFiles %s runtime=%t", unit, runtime)
+	f.enabled[unit] = true
+	return true, nil
+}
+
+func (f *Fake) DisableUnit(unit string, runtime bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled[unit] {
+		return false, nil
+	}
+	f.record("DisableUnitFiles %s runtime=%t", unit, runtime)
+	delete(f.enabled, unit)
+	return true, nil
+}
+
+func (f *Fake) SystemdVersion() (int, error) { return f.Version, nil }
+
+func (f *Fake) Ping() error { return nil }
+
+func (f *Fake) Refresh() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Refresh")
+	f.machines = make(map[string]*Machine)
+	return nil
+}
+
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Close")
+	return nil
+}
+
+func (f *Fake) ImportTar(file, name string, force, readOnly bool) error {
+	return f.importImage("ImportTar", file, name, force)
+}
+
+func (f *Fake) ImportFileSystem(dir, name string, force, readOnly bool) error {
+	return f.importImage("ImportFileSystem", dir, name, force)
+}
+
+func (f *Fake) importImage(method, source, name string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.images[name] && !force {
+		return ErrAlreadyExists
+	}
+	f.record("%s %s %s", method, source, name)
+	f.images[name] = true
+	return nil
+}
+
+func (f *Fake) WatchMachines(ctx context.Context) (<-chan string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make(chan string, 16)
+	f.watchers = append(f.watchers, names)
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, w := range f.watchers {
+			if w == names {
+				f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+				break
+			}
+		}
+		close(names)
+	}()
+	return names, nil
+}
+
+var errFakeUnsupported = errors.New("not supported by the fake machine manager")
+
+// fakeObject answers the machined Machine calls for machine, or acts as an already finished job when machine is empty
+type fakeObject struct {
+	fake    *Fake
+	machine string
+}
+
+var _ dbus.BusObject = (*fakeObject)(nil)
+
+func (o *fakeObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	call := &dbus.Call{Method: method, Args: args}
+	if o.machine == "" {
+		// jobs are done the moment they are queued
+		call.Err = fmt.Errorf("unknown job")
+		return call
+	}
+	f := o.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	started, running := f.started[o.machine]
+	if !running {
+		// machined drops the object as soon as the machine is gone
+		call.Err = fmt.Errorf("No machine '%s' known", o.machine)
+		return call
+	}
+	switch method {
+	case "org.freedesktop.DBus.Properties.Get":
+		property, _ := args[1].(string)
+		switch property {
+		case "State":
+			call.Body = []interface{}{"running"}
+		case "Timestamp":
+			call.Body = []interface{}{uint64(started.UnixMicro())}
+		default:
+			call.Err = fmt.Errorf("%s: %w", property, errFakeUnsupported)
+		}
+	case machinedDbusMachineInterface + ".GetAddresses":
+		addrs := [][]interface{}{}
+		for _, addr := range f.Addresses[o.machine] {
+			family := int32(2)
+			if addr.Is6() {
+				family = 10
+			}
+			addrs = append(addrs, []interface{}{family, addr.AsSlice()})
+		}
+		call.Body = []interface{}{addrs}
+	case machinedDbusMachineInterface + ".CopyTo":
+		f.record("CopyTo %s %v %v", o.machine, args[0], args[1])
+	case machinedDbusMachineInterface + ".CopyToWithFlags":
+		f.record("CopyTo %s %v %v replace", o.machine, args[0], args[1])
+	default:
+		call.Err = fmt.Errorf("%s: %w", method, errFakeUnsupported)
+	}
+	return call
+}
+
+func (o *fakeObject) CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	return o.Call(method, flags, args...)
+}
+
+func (o *fakeObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	call := o.Call(method, flags, args...)
+	if ch != nil {
+		ch <- call
+	}
+	return call
+}
+
+func (o *fakeObject) GoWithContext(ctx context.Context, method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return o.Go(method, flags, ch, args...)
+}
+
+func (o *fakeObject) AddMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return &dbus.Call{}
+}
+
+func (o *fakeObject) RemoveMatchSignal(iface, member string, options ...dbus.MatchOption) *dbus.Call {
+	return &dbus.Call{}
+}
+
+func (o *fakeObject) GetProperty(p string) (dbus.Variant, error) {
+	return dbus.Variant{}, errFakeUnsupported
+}
+
+func (o *fakeObject) StoreProperty(p string, value interface{}) error { return errFakeUnsupported }
+
+func (o *fakeObject) SetProperty(p string, v interface{}) error { return errFakeUnsupported }
+
+func (o *fakeObject) Destination() string { return machinedDbusService }
+
+func (o *fakeObject) Path() dbus.ObjectPath {
+	return dbus.ObjectPath("/org/freedesktop/machine1/machine/" + o.machine)
+}
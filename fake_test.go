@@ -0,0 +1,29 @@
+package machineutil
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+func TestFakeRemoveStopsRunningMachine(t *testing.T) {
+	files := util.Files
+	util.Files = util.NewMemFileSystem()
+	t.Cleanup(func() { util.Files = files })
+	for _, class := range []string{ClassContainer, ClassVM} {
+		fake := NewFake()
+		fake.AddImage("web.example.com")
+		unit := MachineUnit(class, "web.example.com")
+		fake.AddUnit(unit, "active")
+		if err := fake.Remove("web.example.com"); err != nil {
+			t.Fatalf("%s: %v", class, err)
+		}
+		if state, _ := fake.UnitState(unit); state.ActiveState != "inactive" {
+			t.Errorf("%s: removing the image left %s %s", class, unit, state.ActiveState)
+		}
+		if !slices.Contains(fake.Calls, "StopUnit "+unit) {
+			t.Errorf("%s: removing the image didn't stop %s, calls %v", class, unit, fake.Calls)
+		}
+	}
+}
@@ -7,4 +7,5 @@ require gopkg.in/yaml.v3 v3.0.1
 require (
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf
 	github.com/godbus/dbus/v5 v5.0.4
+	golang.org/x/sys v0.25.0
 )
@@ -0,0 +1,78 @@
+package machineutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	importDbusService   = "org.freedesktop.import1"
+	importDbusInterface = "org.freedesktop.import1.Manager"
+	importDbusPath      = "/org/freedesktop/import1"
+)
+
+var ErrTransferFailed error = errors.New("transfer failed")
+
+// ImportTar registers the tarball at file as image name
+func (c *machineUtil) ImportTar(file, name string, force, readOnly bool) error {
+	return c.importImage("ImportTar", file, name, force, readOnly)
+}
+
+// ImportFileSystem copies the directory tree at dir into the image pool as image name
+func (c *machineUtil) ImportFileSystem(dir, name string, force, readOnly bool) error {
+	return c.importImage("ImportFileSystem", dir, name, force, readOnly)
+}
+
+func (c *machineUtil) importImage(method, source, name string, force, readOnly bool) error {
+	err := c.transferImage(method, source, name, force, readOnly)
+	util.Record("image.import", name, err, "source", source)
+	c.invalidateImages()
+	return err
+}
+
+func (c *machineUtil) transferImage(method, source, name string, force, readOnly bool) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the transfer is tracked by signals on this connection, it isn't moved to a new one
+	conn := c.bus()
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	defer conn.RemoveSignal(signals)
+	match := []dbus.MatchOption{
+		dbus.WithMatchInterface(importDbusInterface),
+		dbus.WithMatchMember("TransferRemoved"),
+	}
+	err = conn.AddMatchSignal(match...)
+	if err != nil {
+		return err
+	}
+	defer conn.RemoveMatchSignal(match...)
+	var id uint32
+	var transfer dbus.ObjectPath
+	importer := conn.Object(importDbusService, importDbusPath)
+	err = importer.Call(importDbusInterface+"."+method, 0, dbus.UnixFD(f.Fd()), name, force, readOnly).Store(&id, &transfer)
+	if err != nil {
+		return err
+	}
+	for signal := range signals {
+		if signal.Name != importDbusInterface+".TransferRemoved" || len(signal.Body) < 3 {
+			continue
+		}
+		if signalId, ok := signal.Body[0].(uint32); !ok || signalId != id {
+			continue
+		}
+		result, _ := signal.Body[2].(string)
+		if result != "done" {
+			return fmt.Errorf("%w: importing %s as %s: %s", ErrTransferFailed, source, name, result)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: connection closed while importing %s", ErrTransferFailed, source)
+}
@@ -1,23 +1,138 @@
 package machineutil
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/godbus/dbus/v5"
 )
 
+var ErrJobFailed error = errors.New("job failed")
+
 type Job struct {
 	object dbus.BusObject
+	// Unit the job was queued for, empty for jobs that aren't tracked
+	Unit string
+	// results receives JobRemoved signals, subscribed before the job was queued so none is missed
+	results chan *dbus.Signal
+	release func()
+	manager MachineUtil
+}
+
+// watchJobs subscribes to JobRemoved, release has to be called once the job is done
+func (c *machineUtil) watchJobs() (chan *dbus.Signal, func(), error) {
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(systemdDbusPath),
+		dbus.WithMatchInterface(systemdDbusInterface),
+		dbus.WithMatchMember("JobRemoved"),
+	}
+	conn := c.bus()
+	err := conn.AddMatchSignal(match...)
+	if err != nil {
+		return nil, nil, err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	return signals, func() {
+		conn.RemoveSignal(signals)
+		conn.RemoveMatchSignal(match...)
+	}, nil
+}
+
+// queueJob calls method of the systemd manager for unit and tracks the resulting job
+func (c *machineUtil) queueJob(method, unit string) (*Job, error) {
+	signals, release, err := c.watchJobs()
+	if err != nil {
+		return nil, err
+	}
+	var path dbus.ObjectPath
+	err = c.systemd.Call(systemdDbusInterface+"."+method, 0, unit, "fail").Store(&path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &Job{
+		object:  c.object(systemdDbusService, path),
+		Unit:    unit,
+		results: signals,
+		release: release,
+		manager: c,
+	}, nil
+}
+
+// result returns the result of the JobRemoved signal for this job
+func (j *Job) result(signal *dbus.Signal) (string, bool) {
+	if signal.Name != systemdDbusInterface+".JobRemoved" || len(signal.Body) < 4 {
+		return "", false
+	}
+	path, _ := signal.Body[1].(dbus.ObjectPath)
+	result, _ := signal.Body[3].(string)
+	return result, path == j.object.Path()
 }
 
+func (j *Job) exists() bool {
+	var state string
+	return j.object.Call("org.freedesktop.DBus.Properties.Get", 0, "org.freedesktop.systemd1.Job", "State").Store(&state) == nil
+}
+
+// check turns a job result other than done or skipped into an error carrying the Result of the unit
+func (j *Job) check(result string) error {
+	if result == "done" || result == "skipped" {
+		return nil
+	}
+	// targets and slices have no Result, the job result has to do for them
+	state, err := j.manager.UnitState(j.Unit)
+	if err != nil || state.Result == "" || state.Result == "success" {
+		return fmt.Errorf("%w: %s: %s", ErrJobFailed, j.Unit, result)
+	}
+	return fmt.Errorf("%w: %s: %s, unit result %s", ErrJobFailed, j.Unit, result, state.Result)
+}
+
+// poll waits for the job to vanish without learning its result
+func (j *Job) poll() error {
+	poller := Poll.Poller()
+	for j.exists() {
+		poller.Sleep()
+	}
+	return nil
+}
+
+// Wait blocks until systemd removed the job and fails unless the job finished successfully
 func (j *Job) Wait() error {
+	if j.results == nil {
+		return j.poll()
+	}
+	defer j.release()
+	poller := Poll.Poller()
 	for {
-		var state string
-		err := j.object.Call("org.freedesktop.DBus.Properties.Get", 0, "org.freedesktop.systemd1.Job", "State").Store(&state)
-		if err != nil {
-			break
+		select {
+		case signal, ok := <-j.results:
+			if !ok {
+				// the connection went away, a new one doesn't see the signal of a job queued before
+				return j.poll()
+			}
+			if result, ok := j.result(signal); ok {
+				return j.check(result)
+			}
+		case <-time.After(poller.Next()):
+			if j.exists() {
+				continue
+			}
+			// the signal was sent before the job object vanished, it may still be queued
+			for {
+				select {
+				case signal, ok := <-j.results:
+					if !ok {
+						return nil
+					}
+					if result, ok := j.result(signal); ok {
+						return j.check(result)
+					}
+				case <-time.After(time.Second):
+					return nil
+				}
+			}
 		}
-		time.Sleep(time.Second)
 	}
-	return nil
 }
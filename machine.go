@@ -1,9 +1,15 @@
 package machineutil
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-systemd/unit"
@@ -12,9 +18,28 @@ import (
 )
 
 type Machine struct {
-	Name    string
-	object  dbus.BusObject
-	manager MachineUtil
+	Name string
+	// Class is ClassContainer or ClassVM, empty looks for a generated vmspawn unit
+	Class string
+	// Runtime places generated files under /run so they vanish on reboot
+	Runtime bool
+	// ResetFailed clears a failed unit before starting it, a unit that hit its start limit refuses to start otherwise
+	ResetFailed bool
+	// AddressOrder orders and filters the usable addresses, see OrderAddresses
+	AddressOrder string
+	object       dbus.BusObject
+	manager      MachineUtil
+}
+
+func (m *Machine) ConfigDir() string {
+	if m.Runtime {
+		return "/run/systemd"
+	}
+	return "/etc/systemd"
+}
+
+func (m *Machine) Unit() string {
+	return MachineUnit(m.class(), m.Name)
 }
 
 func (m *Machine) Status() (string, error) {
@@ -23,25 +48,171 @@ func (m *Machine) Status() (string, error) {
 	return result, err
 }
 
+// Started returns when the machine was registered with machined
+func (m *Machine) Started() (time.Time, error) {
+	var usec uint64
+	err := m.object.Call("org.freedesktop.DBus.Properties.Get", 0, machinedDbusMachineInterface, "Timestamp").Store(&usec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMicro(int64(usec)), nil
+}
+
+// OpenLogin allocates a PTY inside the machine with a getty attached to it, the same console machinectl login uses.
+// A bare OpenPTY would have nothing listening on the guest side.
+func (m *Machine) OpenLogin() (*os.File, string, error) {
+	var fd dbus.UnixFD
+	var name string
+	err := m.object.Call(machinedDbusMachineInterface+".OpenLogin", 0).Store(&fd, &name)
+	if err != nil {
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), name), name, nil
+}
+
+// Running reports whether machined has the machine running and its unit didn't fail, machined may keep a failed machine registered
 func (m *Machine) Running() bool {
 	result, err := m.Status()
-	if err != nil {
+	if err != nil || result != "running" {
 		return false
 	}
-	return result == "running"
+	return !m.UnitFailed()
+}
+
+// UnitState reports the state of the systemd-nspawn unit of the machine
+func (m *Machine) UnitState() (*UnitState, error) {
+	return m.manager.UnitState(m.Unit())
+}
+
+// UnitActive reports whether the systemd-nspawn unit of the machine is active
+func (m *Machine) UnitActive() bool {
+	state, err := m.UnitState()
+	return err == nil && state.Active()
+}
+
+// UnitFailed reports whether the systemd-nspawn unit of the machine is in failed state
+func (m *Machine) UnitFailed() bool {
+	state, err := m.UnitState()
+	return err == nil && state.Failed()
+}
+
+// OptionsPath is the settings file of a container, VMs have no settings files and get a unit of their own instead
+func (m *Machine) OptionsPath() string {
+	if m.IsVM() {
+		return m.ConfigDir() + "/system/" + m.Unit()
+	}
+	return m.ConfigDir() + "/nspawn/" + m.Name + ".nspawn"
+}
+
+// Labels reads the labels machineutil recorded in the settings of the machine, the config isn't needed
+func (m *Machine) Labels() (map[string]string, error) {
+	opts, err := util.ReadUnit(m.OptionsPath(), false)
+	if err != nil {
+		return nil, err
+	}
+	return util.ParseLabels(opts), nil
+}
+
+// CreatedFrom reads the template image recorded when the machine was cloned, empty if it predates the record
+func (m *Machine) CreatedFrom() (string, error) {
+	opts, err := util.ReadUnit(m.OptionsPath(), false)
+	if err != nil {
+		return "", err
+	}
+	image := ""
+	for _, opt := range opts {
+		if opt.Name == util.TemplateOption {
+			image = opt.Value
+		}
+	}
+	return image, nil
+}
+
+func (m *Machine) OverridePath() string {
+	return m.ConfigDir() + "/system/" + m.Unit() + ".d/machineutil.conf"
 }
 
+// ResourcesPath is a drop-in of its own, resource limits change on a running machine without touching the override
+func (m *Machine) ResourcesPath() string {
+	return m.ConfigDir() + "/system/" + m.Unit() + ".d/resources.conf"
+}
+
+// EnsureOptions takes over settings from before the Marker only when they are what would be written,
+// the settings file of a machine may just as well be written by hand
 func (m *Machine) EnsureOptions(log *slog.Logger, opts []*unit.UnitOption) (bool, error) {
-	file_path := "/etc/systemd/nspawn/" + m.Name + ".nspawn"
-	return util.EnsureUnit(log, file_path, opts)
+	return util.EnsureMatchingUnit(log, m.OptionsPath(), opts)
 }
 
+// EnsureOverride takes over overrides from before the Marker, the drop-in is named after machineutil
 func (m *Machine) EnsureOverride(log *slog.Logger, opts []*unit.UnitOption) (bool, error) {
-	file_path := "/etc/systemd/system/systemd-nspawn@" + m.Name + ".service.d/machineutil.conf"
-	return util.EnsureUnit(log, file_path, opts)
+	return util.EnsureOwnedUnit(log, m.OverridePath(), opts)
+}
+
+func (m *Machine) EnsureResources(log *slog.Logger, opts []*unit.UnitOption) (bool, error) {
+	return util.EnsureUnit(log, m.ResourcesPath(), opts)
+}
+
+// SetRuntimeProperties changes properties of the running unit until the next reboot, the unit files are left alone.
+// systemd keeps them as drop-ins outranking the unit files, ClearRuntimeProperties removes those.
+func (m *Machine) SetRuntimeProperties(props map[string]dbus.Variant) error {
+	return m.manager.SetUnitProperties(m.Unit(), true, props)
+}
+
+// RuntimeControlDir is where systemd writes the drop-ins of runtime properties of the unit
+func (m *Machine) RuntimeControlDir() string {
+	return "/run/systemd/system.control/" + m.Unit() + ".d"
+}
+
+// ClearRuntimeProperties removes the drop-ins left by SetRuntimeProperties for the settings names, e.g. MemoryMax.
+// The unit files apply again after the next daemon reload, it reports whether anything was removed.
+func (m *Machine) ClearRuntimeProperties(names []string) (bool, error) {
+	removed := false
+	for _, name := range names {
+		err := util.Files.Remove(m.RuntimeControlDir() + "/50-" + name + ".conf")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
+
+func (m *Machine) CopyTo(src, dst string) error {
+	if m.IsVM() {
+		return fmt.Errorf("%s: machined can't copy files into VMs", m.Name)
+	}
+	err := m.object.Call(machinedDbusMachineInterface+".CopyTo", 0, src, dst).Err
+	util.Record("machine.copy", m.Name, err, "source", src, "destination", dst)
+	return err
+}
+
+// ErrNoCopyReplace is returned by CopyToReplace when machined predates CopyToWithFlags, added in systemd 252
+var ErrNoCopyReplace error = errors.New("machined can't replace files")
+
+// machineCopyReplace is the flag of CopyToWithFlags overwriting an existing destination
+const machineCopyReplace = uint64(1)
+
+// CopyToReplace is CopyTo overwriting dst if it exists, CopyTo fails on existing files
+func (m *Machine) CopyToReplace(src, dst string) error {
+	if m.IsVM() {
+		return fmt.Errorf("%s: machined can't copy files into VMs", m.Name)
+	}
+	err := m.object.Call(machinedDbusMachineInterface+".CopyToWithFlags", 0, src, dst, machineCopyReplace).Err
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.UnknownMethod" {
+		return ErrNoCopyReplace
+	}
+	util.Record("machine.copy", m.Name, err, "source", src, "destination", dst, "replace", "true")
+	return err
 }
 
 func (m *Machine) Addresses() ([]netip.Addr, error) {
+	if m.IsVM() {
+		return m.neighbourAddresses()
+	}
 	var result []struct {
 		Version int
 		Addr    []byte
@@ -61,30 +232,79 @@ func (m *Machine) Addresses() ([]netip.Addr, error) {
 	return retval, nil
 }
 
+// UsableAddresses returns the current addresses of the machine that can be reached from the host
+func (m *Machine) UsableAddresses() ([]netip.Addr, error) {
+	addrs, err := m.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	var result []netip.Addr
+	for _, addr := range addrs {
+		switch {
+		case !addr.IsValid():
+		case addr.IsUnspecified():
+		case addr.IsLoopback():
+		case addr.IsLinkLocalUnicast():
+		case addr.IsLinkLocalMulticast():
+		case addr.IsInterfaceLocalMulticast():
+		case addr.IsMulticast():
+		default:
+			result = append(result, addr)
+		}
+	}
+	return OrderAddresses(result, m.AddressOrder), nil
+}
+
+const (
+	// AddressesIPv4 keeps only the IPv4 addresses unless there are none
+	AddressesIPv4 = "ipv4"
+	// AddressesIPv6 keeps only the IPv6 addresses unless there are none
+	AddressesIPv6 = "ipv6"
+	// AddressesBoth keeps every address, IPv4 ones first
+	AddressesBoth = "both"
+)
+
+var AddressOrders = []string{AddressesIPv4, AddressesIPv6, AddressesBoth}
+
+// OrderAddresses applies order to addrs, an empty order keeps them as machined reports them.
+// The order within each family is kept.
+func OrderAddresses(addrs []netip.Addr, order string) []netip.Addr {
+	if order == "" {
+		return addrs
+	}
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	switch {
+	case order == AddressesIPv4 && len(v4) > 0:
+		return v4
+	case order == AddressesIPv6 && len(v6) > 0:
+		return v6
+	case order == AddressesIPv6:
+		return v4
+	}
+	return append(v4, v6...)
+}
+
+// Poll paces the loops waiting for machines, units and jobs to change state
+var Poll = util.Backoff{Interval: 100 * time.Millisecond, Max: 5 * time.Second, Factor: 1.5, Jitter: 0.2}
+
 func (m *Machine) WaitForAddress() ([]netip.Addr, error) {
+	poller := Poll.Poller()
 	for {
-		addrs, err := m.Addresses()
+		result, err := m.UsableAddresses()
 		if err != nil {
 			return nil, err
 		}
-		var result []netip.Addr
-		for _, addr := range addrs {
-			switch {
-			case !addr.IsValid():
-			case addr.IsUnspecified():
-			case addr.IsLoopback():
-			case addr.IsLinkLocalUnicast():
-			case addr.IsLinkLocalMulticast():
-			case addr.IsInterfaceLocalMulticast():
-			case addr.IsMulticast():
-			default:
-				result = append(result, addr)
-			}
-		}
 		if len(result) > 0 {
 			return result, nil
 		}
-		time.Sleep(1)
+		poller.Sleep()
 	}
 }
 
@@ -93,26 +313,42 @@ func (m *Machine) Start() error {
 		return nil
 	}
 	log := slog.With("machine", m.Name)
+	failed := m.UnitFailed()
+	if failed && m.ResetFailed {
+		log.Info("Resetting failed unit")
+		if err := m.manager.ResetFailed(m.Unit()); err != nil {
+			return err
+		}
+		failed = false
+	}
 	log.Debug("Starting machine job")
-	job, err := m.manager.Start("systemd-nspawn@" + m.Name + ".service")
-	if err != nil {
-		return err
+	job, err := m.manager.Start(m.Unit())
+	if err == nil {
+		err = job.Wait()
+	}
+	if err != nil && failed {
+		return fmt.Errorf("%s is in failed state and wasn't reset: %w", m.Unit(), err)
 	}
-	err = job.Wait()
 	if err != nil {
 		return err
 	}
 	log.Debug("Job completed, waiting for unit")
+	poller := Poll.Poller()
 	for {
-		result, err := m.Status()
+		state, err := m.UnitState()
 		if err != nil {
 			log.Error("Unexpected error", "error", err)
 			return err
 		}
-		if result == "running" {
+		// the job is done once the unit left activating, a unit that stopped right away never registers
+		if !state.Active() && state.ActiveState != "activating" {
+			return fmt.Errorf("%s stopped while starting: %s", m.Unit(), state)
+		}
+		result, err := m.Status()
+		if err == nil && result == "running" {
 			break
 		}
-		time.Sleep(time.Second)
+		poller.Sleep()
 	}
 	return nil
 }
@@ -121,7 +357,7 @@ func (m *Machine) Stop() error {
 	if !m.Running() {
 		return nil
 	}
-	job, err := m.manager.Stop("systemd-nspawn@" + m.Name + ".service")
+	job, err := m.manager.Stop(m.Unit())
 	if err != nil {
 		return err
 	}
@@ -129,10 +365,132 @@ func (m *Machine) Stop() error {
 	if err != nil {
 		return err
 	}
-	for m.Running() {
-		time.Sleep(time.Second)
+	poller := Poll.Poller()
+	for {
+		state, err := m.UnitState()
+		if err != nil {
+			return err
+		}
+		// a unit failing on the way down is stopped as well, the failure stays visible in its state
+		if state.ActiveState == "inactive" || state.Failed() {
+			if status, err := m.Status(); err != nil || status != "running" {
+				return nil
+			}
+		}
+		poller.Sleep()
 	}
-	return nil
+}
+
+// Freeze suspends the machine in place, memory and open connections survive until Thaw
+func (m *Machine) Freeze() error {
+	return m.manager.FreezeUnit(m.Unit())
+}
+
+func (m *Machine) Thaw() error {
+	return m.manager.ThawUnit(m.Unit())
+}
+
+// Frozen reports whether the machine is frozen or on its way there
+func (m *Machine) Frozen() bool {
+	state, err := m.UnitState()
+	return err == nil && state.Frozen()
+}
+
+// Restarts returns how often systemd automatically restarted the machine since the unit was loaded
+func (m *Machine) Restarts() (uint32, error) {
+	var result uint32
+	err := m.manager.UnitProperty(m.Unit(), systemdDbusServiceInterface, "NRestarts", &result)
+	return result, err
+}
+
+// usageUnset is what systemd reports for accounting values that aren't available
+const usageUnset = ^uint64(0)
+
+// ResourceUsage holds the cgroup accounting of the machine unit, unavailable values are 0
+type ResourceUsage struct {
+	CPUUsageNSec  uint64
+	MemoryCurrent uint64
+	IOReadBytes   uint64
+	IOWriteBytes  uint64
+	TasksCurrent  uint64
+}
+
+// DiskUsage reports the space the image of the machine takes and its limit, 0 when unknown or unlimited
+func (m *Machine) DiskUsage() (usage, limit uint64, err error) {
+	image, err := m.manager.GetImage(m.Name)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err = m.manager.ImageLimit(m.Name)
+	return image.Usage, limit, err
+}
+
+func (m *Machine) ResourceUsage() (*ResourceUsage, error) {
+	props, err := m.manager.UnitProperties(m.Unit(), systemdDbusServiceInterface)
+	if err != nil {
+		return nil, err
+	}
+	get := func(name string) uint64 {
+		value, ok := props[name].Value().(uint64)
+		if !ok || value == usageUnset {
+			return 0
+		}
+		return value
+	}
+	return &ResourceUsage{
+		CPUUsageNSec:  get("CPUUsageNSec"),
+		MemoryCurrent: get("MemoryCurrent"),
+		IOReadBytes:   get("IOReadBytes"),
+		IOWriteBytes:  get("IOWriteBytes"),
+		TasksCurrent:  get("TasksCurrent"),
+	}, nil
+}
+
+// Enable makes the machine start with machines.target on boot
+func (m *Machine) Enable() (bool, error) {
+	return m.manager.EnableUnit(m.Unit(), m.Runtime)
+}
+
+func (m *Machine) Disable() (bool, error) {
+	return m.manager.DisableUnit(m.Unit(), m.Runtime)
+}
+
+// HostKeys returns the public SSH host keys of the running machine
+func (m *Machine) HostKeys() ([]string, error) {
+	root, err := m.RootPath()
+	if err != nil {
+		return nil, err
+	}
+	// everything is resolved inside the machine, a guest symlink must not feed host files into known_hosts
+	dir, err := util.OpenInRoot(root, "etc/ssh")
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	keys := []string{}
+	for _, name := range names {
+		if ok, _ := filepath.Match("ssh_host_*_key.pub", name); !ok {
+			continue
+		}
+		data, err := util.ReadFileInRoot(root, "etc/ssh/"+name)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 2 {
+			continue
+		}
+		keys = append(keys, fields[0]+" "+fields[1])
+	}
+	return keys, nil
 }
 
 func (m *Machine) Exists() bool {
@@ -1,13 +1,17 @@
 package machineutil
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/eax255/systemd-containers/machineutil/util"
 	"github.com/godbus/dbus/v5"
 )
 
@@ -15,10 +19,14 @@ const (
 	machinedDbusService          = "org.freedesktop.machine1"
 	machinedDbusInterface        = "org.freedesktop.machine1.Manager"
 	machinedDbusMachineInterface = "org.freedesktop.machine1.Machine"
+	machinedDbusImageInterface   = "org.freedesktop.machine1.Image"
 	machinedDbusPath             = "/org/freedesktop/machine1"
 	systemdDbusService           = "org.freedesktop.systemd1"
 	systemdDbusInterface         = "org.freedesktop.systemd1.Manager"
 	systemdDbusPath              = "/org/freedesktop/systemd1"
+	networkdDbusService          = "org.freedesktop.network1"
+	networkdDbusInterface        = "org.freedesktop.network1.Manager"
+	networkdDbusPath             = "/org/freedesktop/network1"
 )
 
 var ErrAlreadyExists error = errors.New("image already exist")
@@ -29,72 +37,286 @@ type MachineUtil interface {
 	Clone(string, string) (*Machine, error)
 	Start(string) (*Job, error)
 	Stop(string) (*Job, error)
+	ResetFailed(string) error
 	Remove(string) error
+	Rename(string, string) error
 	GetImage(string) (Image, error)
+	ImagePath(string) (string, error)
+	ImageLimit(string) (uint64, error)
+	PoolSpace() (*PoolSpace, error)
+	CleanPool(string) ([]CleanedImage, error)
+	ListImages() ([]Image, error)
 	GetMachine(string) (*Machine, error)
 	DaemonReload() error
+	NetworkdReload() error
+	UnitProperty(string, string, string, interface{}) error
+	UnitProperties(string, string) (map[string]dbus.Variant, error)
+	UnitState(string) (*UnitState, error)
+	SetUnitProperties(string, bool, map[string]dbus.Variant) error
+	FreezeUnit(string) error
+	ThawUnit(string) error
+	EnableUnit(string, bool) (bool, error)
+	DisableUnit(string, bool) (bool, error)
+	SystemdVersion() (int, error)
+	Ping() error
+	ImportTar(string, string, bool, bool) error
+	ImportFileSystem(string, string, bool, bool) error
+	WatchMachines(context.Context) (<-chan string, error)
+	Refresh() error
+	Close() error
 }
 
 type machineUtil struct {
-	conn      *dbus.Conn
-	machined  dbus.BusObject
-	systemd   dbus.BusObject
+	// conn is replaced when the bus goes away, it is only read through bus
+	conn     *dbus.Conn
+	connMu   sync.RWMutex
+	closed   bool
+	machined dbus.BusObject
+	systemd  dbus.BusObject
+	// mu guards the caches, they are shared by everyone holding the manager
+	mu        sync.Mutex
 	machines  map[string]*Machine
 	templates map[string]*Template
+	// images is the last ListImages, a single call instead of one per image
+	images       map[string]Image
+	imagesListed time.Time
+	imagePaths   map[string]string
 }
 
+// ImageCacheTTL is how long a listing of the images answers GetImage, changes made through the manager invalidate it at once
+var ImageCacheTTL = 10 * time.Second
+
 func NewMachineUtil() (ret MachineUtil, err error) {
 	ret = nil
 	c := &machineUtil{
-		machines:  make(map[string]*Machine),
-		templates: make(map[string]*Template),
-	}
-	c.conn, err = dbus.SystemBusPrivate()
-	if err != nil {
-		return
-	}
-	methods := []dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}
-	err = c.conn.Auth(methods)
-	if err != nil {
-		return
+		machines:   make(map[string]*Machine),
+		templates:  make(map[string]*Template),
+		imagePaths: make(map[string]string),
 	}
-	err = c.conn.Hello()
+	c.conn, err = connect()
 	if err != nil {
-		c.conn.Close()
 		return
 	}
-	c.machined = c.conn.Object(machinedDbusService, machinedDbusPath)
-	c.systemd = c.conn.Object(systemdDbusService, systemdDbusPath)
+	c.machined = c.object(machinedDbusService, machinedDbusPath)
+	c.systemd = c.object(systemdDbusService, systemdDbusPath)
 	ret = c
 	return
 }
 
 func (c *machineUtil) DaemonReload() error {
-	return c.systemd.Call(systemdDbusInterface+".Reload", 0).Err
+	err := c.systemd.Call(systemdDbusInterface+".Reload", 0).Err
+	util.Record("daemon.reload", "systemd", err)
+	return err
 }
 
-func (c *machineUtil) Start(unit string) (*Job, error) {
-	var retval dbus.ObjectPath
-	err := c.systemd.Call(systemdDbusInterface+".StartUnit", 0, unit, "fail").Store(&retval)
+// NetworkdReload makes systemd-networkd pick up changed .network and .netdev files
+func (c *machineUtil) NetworkdReload() error {
+	err := c.object(networkdDbusService, networkdDbusPath).Call(networkdDbusInterface+".Reload", 0).Err
+	util.Record("daemon.reload", "systemd-networkd", err)
+	return err
+}
+
+// UnitProperty stores the property of interface iface on unit into value, loading the unit if needed
+func (c *machineUtil) UnitProperty(unit, iface, property string, value interface{}) error {
+	var path dbus.ObjectPath
+	err := c.systemd.Call(systemdDbusInterface+".LoadUnit", 0, unit).Store(&path)
+	if err != nil {
+		return err
+	}
+	return c.object(systemdDbusService, path).Call("org.freedesktop.DBus.Properties.Get", 0, iface, property).Store(value)
+}
+
+// UnitProperties returns all properties of interface iface on unit
+func (c *machineUtil) UnitProperties(unit, iface string) (map[string]dbus.Variant, error) {
+	var path dbus.ObjectPath
+	err := c.systemd.Call(systemdDbusInterface+".LoadUnit", 0, unit).Store(&path)
 	if err != nil {
 		return nil, err
 	}
-	return &Job{c.conn.Object(systemdDbusService, retval)}, nil
+	result := make(map[string]dbus.Variant)
+	err = c.object(systemdDbusService, path).Call("org.freedesktop.DBus.Properties.GetAll", 0, iface).Store(&result)
+	return result, err
 }
 
-func (c *machineUtil) Stop(unit string) (*Job, error) {
-	var retval dbus.ObjectPath
-	err := c.systemd.Call(systemdDbusInterface+".StopUnit", 0, unit, "fail").Store(&retval)
+// UnitState is what systemd reports about a unit, units that aren't loaded are inactive and dead
+type UnitState struct {
+	ActiveState string
+	SubState    string
+	// Result is empty for unit types without one, e.g. targets and slices
+	Result string
+	// FreezerState is running unless the unit is (being) frozen
+	FreezerState string
+}
+
+func (s *UnitState) Active() bool { return s.ActiveState == "active" || s.ActiveState == "reloading" }
+func (s *UnitState) Failed() bool { return s.ActiveState == "failed" }
+
+func (s *UnitState) Frozen() bool { return s.FreezerState != "" && s.FreezerState != "running" }
+
+func (s *UnitState) String() string {
+	details := s.SubState
+	if s.Result != "" && s.Result != "success" {
+		details += ", " + s.Result
+	}
+	if s.Frozen() {
+		details += ", " + s.FreezerState
+	}
+	return s.ActiveState + " (" + details + ")"
+}
+
+// UnitState looks unit up without loading it, so inspecting a unit doesn't keep it around
+func (c *machineUtil) UnitState(unit string) (*UnitState, error) {
+	var path dbus.ObjectPath
+	err := c.systemd.Call(systemdDbusInterface+".GetUnit", 0, unit).Store(&path)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.NoSuchUnit" {
+		return &UnitState{ActiveState: "inactive", SubState: "dead"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// an empty interface gets the properties of every interface, Result of the unit type included, in a single call
+	props := make(map[string]dbus.Variant)
+	err = c.object(systemdDbusService, path).Call("org.freedesktop.DBus.Properties.GetAll", 0, "").Store(&props)
+	if err != nil {
+		return nil, err
+	}
+	state := &UnitState{}
+	err = dbus.Store([]interface{}{props["ActiveState"].Value(), props["SubState"].Value()}, &state.ActiveState, &state.SubState)
 	if err != nil {
 		return nil, err
 	}
-	return &Job{c.conn.Object(systemdDbusService, retval)}, nil
+	// FreezerState is missing before systemd 246
+	if freezer, ok := props["FreezerState"].Value().(string); ok {
+		state.FreezerState = freezer
+	}
+	// targets and slices have no Result
+	if result, ok := props["Result"].Value().(string); ok {
+		state.Result = result
+	}
+	return state, nil
+}
+
+// SetUnitProperties changes properties of a loaded unit, runtime changes are gone after a reboot
+func (c *machineUtil) SetUnitProperties(unit string, runtime bool, props map[string]dbus.Variant) error {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	properties := make([]unitProperty, len(names))
+	for i, name := range names {
+		properties[i] = unitProperty{name, props[name]}
+	}
+	err := c.systemd.Call(systemdDbusInterface+".SetUnitProperties", 0, unit, runtime, properties).Err
+	util.Record("unit.set-properties", unit, err, "properties", strings.Join(names, ","), "runtime", strconv.FormatBool(runtime))
+	return err
+}
+
+// FreezeUnit suspends all processes of unit through the cgroup freezer, it returns once they are frozen
+func (c *machineUtil) FreezeUnit(unit string) error {
+	err := c.systemd.Call(systemdDbusInterface+".FreezeUnit", 0, unit).Err
+	util.Record("unit.freeze", unit, err)
+	return err
+}
+
+func (c *machineUtil) ThawUnit(unit string) error {
+	err := c.systemd.Call(systemdDbusInterface+".ThawUnit", 0, unit).Err
+	util.Record("unit.thaw", unit, err)
+	return err
+}
+
+type unitFileChange struct {
+	Type        string
+	Destination string
+	Source      string
+}
+
+// EnableUnit enables unit according to its [Install] section, reporting if anything changed.
+// Runtime enablement only lasts until the next reboot.
+func (c *machineUtil) EnableUnit(unit string, runtime bool) (bool, error) {
+	var state string
+	err := c.systemd.Call(systemdDbusInterface+".GetUnitFileState", 0, unit).Store(&state)
+	if err != nil {
+		return false, err
+	}
+	if state == "enabled" || (runtime && state == "enabled-runtime") {
+		return false, nil
+	}
+	var carriesInstallInfo bool
+	var changes []unitFileChange
+	err = c.systemd.Call(systemdDbusInterface+".EnableUnitFiles", 0, []string{unit}, runtime, false).Store(&carriesInstallInfo, &changes)
+	util.Record("unit.enable", unit, err, "runtime", strconv.FormatBool(runtime))
+	if err != nil {
+		return false, err
+	}
+	return len(changes) > 0, nil
+}
+
+// DisableUnit removes the symlinks created by EnableUnit, reporting if anything changed
+func (c *machineUtil) DisableUnit(unit string, runtime bool) (bool, error) {
+	var changes []unitFileChange
+	err := c.systemd.Call(systemdDbusInterface+".DisableUnitFiles", 0, []string{unit}, runtime).Store(&changes)
+	util.Record("unit.disable", unit, err, "runtime", strconv.FormatBool(runtime))
+	if err != nil {
+		return false, err
+	}
+	return len(changes) > 0, nil
+}
+
+// SystemdVersion returns the major version of the host systemd
+func (c *machineUtil) SystemdVersion() (int, error) {
+	var version string
+	err := c.systemd.Call("org.freedesktop.DBus.Properties.Get", 0, systemdDbusInterface, "Version").Store(&version)
+	if err != nil {
+		return 0, err
+	}
+	// Version is usually something like "255.4-1-arch", only the leading number matters
+	major := strings.TrimLeftFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if i := strings.IndexFunc(major, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		major = major[:i]
+	}
+	ver, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse systemd version %q: %w", version, err)
+	}
+	return ver, nil
+}
+
+// Ping checks that systemd-machined is reachable, activating it if needed
+func (c *machineUtil) Ping() error {
+	return c.machined.Call("org.freedesktop.DBus.Peer.Ping", 0).Err
+}
+
+func (c *machineUtil) Start(unit string) (*Job, error) {
+	job, err := c.queueJob("StartUnit", unit)
+	util.Record("unit.start", unit, err)
+	return job, err
+}
+
+func (c *machineUtil) Stop(unit string) (*Job, error) {
+	job, err := c.queueJob("StopUnit", unit)
+	util.Record("unit.stop", unit, err)
+	return job, err
+}
+
+// ResetFailed clears the failed state and start rate limit of unit
+func (c *machineUtil) ResetFailed(unit string) error {
+	err := c.systemd.Call(systemdDbusInterface+".ResetFailedUnit", 0, unit).Err
+	util.Record("unit.reset-failed", unit, err)
+	return err
 }
 
 func (c *machineUtil) AddMachine(image Image) (*Machine, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a concurrent caller may have added it in the meantime, there is only ever one Machine per image
+	if machine, ok := c.machines[image.Name]; ok {
+		return machine, nil
+	}
 	machine := &Machine{
 		Name: image.Name,
-		object: c.conn.Object(
+		object: c.object(
 			machinedDbusService,
 			dbus.ObjectPath(strings.Replace(
 				string(image.Path),
@@ -110,7 +332,10 @@ func (c *machineUtil) AddMachine(image Image) (*Machine, error) {
 }
 
 func (c *machineUtil) GetMachineFromImage(image Image) (*Machine, error) {
-	if res, ok := c.machines[image.Name]; ok {
+	c.mu.Lock()
+	res, ok := c.machines[image.Name]
+	c.mu.Unlock()
+	if ok {
 		return res, nil
 	}
 	return c.AddMachine(image)
@@ -132,12 +357,69 @@ func (c *machineUtil) GetMachine(fqdn string) (*Machine, error) {
 	return machine, nil
 }
 
+// GetImage answers from a recent listing of all images, looking up a fleet takes a single call that way.
+// Images missing from the listing are asked for individually, they may have been created since.
 func (c *machineUtil) GetImage(name string) (retval Image, err error) {
+	c.mu.Lock()
+	fresh := time.Since(c.imagesListed) < ImageCacheTTL
+	c.mu.Unlock()
+	if !fresh {
+		if _, err := c.listImages(); err != nil {
+			return retval, err
+		}
+	}
+	c.mu.Lock()
+	image, ok := c.images[name]
+	c.mu.Unlock()
+	if ok {
+		return image, nil
+	}
 	retval.Name = name
 	err = c.machined.Call(machinedDbusInterface+".GetImage", 0, name).Store(&retval.Path)
 	return
 }
 
+// ListImages returns every image of the pool, templates and hidden images included
+func (c *machineUtil) ListImages() ([]Image, error) {
+	return c.listImages()
+}
+
+// ImagePath returns the host path of the image, for directory images this is the root file system
+func (c *machineUtil) ImagePath(name string) (string, error) {
+	c.mu.Lock()
+	result, ok := c.imagePaths[name]
+	c.mu.Unlock()
+	if ok {
+		return result, nil
+	}
+	image, err := c.GetImage(name)
+	if err != nil {
+		return "", err
+	}
+	err = c.object(machinedDbusService, image.Path).Call("org.freedesktop.DBus.Properties.Get", 0, machinedDbusImageInterface, "Path").Store(&result)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.imagePaths[name] = result
+	c.mu.Unlock()
+	return result, nil
+}
+
+// ImageLimit returns the size limit of the image, 0 when it has none. ListImages doesn't carry it.
+func (c *machineUtil) ImageLimit(name string) (uint64, error) {
+	image, err := c.GetImage(name)
+	if err != nil {
+		return 0, err
+	}
+	var limit uint64
+	err = c.object(machinedDbusService, image.Path).Call("org.freedesktop.DBus.Properties.Get", 0, machinedDbusImageInterface, "Limit").Store(&limit)
+	if err != nil || limit == math.MaxUint64 {
+		return 0, err
+	}
+	return limit, nil
+}
+
 func (c *machineUtil) Clone(src, dst string) (*Machine, error) {
 	image, err := c.GetImage(dst)
 	if err == nil {
@@ -148,31 +430,82 @@ func (c *machineUtil) Clone(src, dst string) (*Machine, error) {
 		return machine, ErrAlreadyExists
 	}
 	call := c.machined.Call(machinedDbusInterface+".CloneImage", 0, src, dst, false)
+	util.Record("image.clone", dst, call.Err, "source", src)
+	c.invalidateImages()
 	if call.Err != nil {
 		return nil, call.Err
 	}
 	return c.GetMachine(dst)
 }
 
+// Refresh drops everything cached and lists the images again, picking up changes made with machinectl
+func (c *machineUtil) Refresh() error {
+	c.mu.Lock()
+	c.machines = make(map[string]*Machine)
+	c.templates = make(map[string]*Template)
+	c.imagePaths = make(map[string]string)
+	c.imagesListed = time.Time{}
+	c.mu.Unlock()
+	_, err := c.listImages()
+	return err
+}
+
+// invalidateImages makes the next lookup list the images again
+func (c *machineUtil) invalidateImages() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.imagesListed = time.Time{}
+}
+
+// forget drops image from the caches after it was removed or renamed
+func (c *machineUtil) forget(image string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.machines, image)
+	delete(c.templates, image)
+	delete(c.imagePaths, image)
+	c.imagesListed = time.Time{}
+}
+
 func (c *machineUtil) Remove(image string) error {
-	if machine, ok := c.machines[image]; ok {
+	c.mu.Lock()
+	machine, ok := c.machines[image]
+	c.mu.Unlock()
+	if ok {
 		err := machine.Stop()
 		if err != nil {
 			return err
 		}
 	}
 	call := c.machined.Call(machinedDbusInterface+".RemoveImage", 0, image)
+	util.Record("image.remove", image, call.Err)
 	if call.Err != nil {
 		return call.Err
 	}
-	delete(c.machines, image)
-	delete(c.templates, image)
+	c.forget(image)
+	return nil
+}
+
+func (c *machineUtil) Rename(image, name string) error {
+	call := c.machined.Call(machinedDbusInterface+".RenameImage", 0, image, name)
+	util.Record("image.rename", image, call.Err, "name", name)
+	if call.Err != nil {
+		return call.Err
+	}
+	c.forget(image)
 	return nil
 }
 
 type Image struct {
 	Name string
 	Path dbus.ObjectPath
+	// Type is directory, subvolume, raw or block
+	Type     string
+	ReadOnly bool
+	// Created and Modified are zero and Usage 0 when the backing filesystem doesn't tell
+	Created  time.Time
+	Modified time.Time
+	Usage    uint64
 }
 
 func (c *machineUtil) listImages() ([]Image, error) {
@@ -183,7 +516,7 @@ func (c *machineUtil) listImages() ([]Image, error) {
 	retval := []Image{}
 	for _, i := range result {
 		if len(i) < 7 {
-			return nil, fmt.Errorf("invalid number of image fields: %s", len(i))
+			return nil, fmt.Errorf("invalid number of image fields: %d", len(i))
 		}
 		name, ok := i[0].(string)
 		if !ok {
@@ -193,8 +526,29 @@ func (c *machineUtil) listImages() ([]Image, error) {
 		if !ok {
 			return nil, fmt.Errorf("failed to typecast image field 6 to dbus.ObjectPath")
 		}
-		retval = append(retval, Image{name, path})
+		image := Image{Name: name, Path: path}
+		image.Type, _ = i[1].(string)
+		image.ReadOnly, _ = i[2].(bool)
+		// timestamps in µs and disk usage, 0 or UINT64_MAX when unknown
+		timestamp := func(field interface{}) time.Time {
+			if t, ok := field.(uint64); ok && t > 0 && t != math.MaxUint64 {
+				return time.UnixMicro(int64(t))
+			}
+			return time.Time{}
+		}
+		image.Created, image.Modified = timestamp(i[3]), timestamp(i[4])
+		if usage, ok := i[5].(uint64); ok && usage != math.MaxUint64 {
+			image.Usage = usage
+		}
+		retval = append(retval, image)
+	}
+	images := make(map[string]Image, len(retval))
+	for _, image := range retval {
+		images[image.Name] = image
 	}
+	c.mu.Lock()
+	c.images, c.imagesListed = images, time.Now()
+	c.mu.Unlock()
 	return retval, nil
 }
 
@@ -204,28 +558,29 @@ func (c *machineUtil) ListTemplates(defaultTemplate string) (TemplateCollection,
 		return nil, err
 	}
 	retval := make(map[string]TemplateVersions)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, image := range images {
-		name, version, found := strings.Cut(image.Name, "-template_")
-		if found {
-			ver, err := strconv.Atoi(version)
-			if err != nil {
-				continue
-			}
-			tmpl, ok := c.templates[image.Name]
-			if !ok {
-				tmpl = &Template{
-					Name:    name,
-					Version: ver,
-					object:  c.conn.Object(machinedDbusService, image.Path),
-					manager: c,
-				}
-				c.templates[image.Name] = tmpl
+		name, arch, version, found := ParseTemplateImage(image.Name)
+		if !found {
+			continue
+		}
+		tmpl, ok := c.templates[image.Name]
+		if !ok {
+			tmpl = &Template{
+				Name:    name,
+				Version: version,
+				Arch:    arch,
+				object:  c.object(machinedDbusService, image.Path),
+				manager: c,
 			}
-			retval[name] = append(retval[name], tmpl)
+			c.templates[image.Name] = tmpl
 		}
+		tmpl.Created, tmpl.Usage = image.Created, image.Usage
+		retval[name] = append(retval[name], tmpl)
 	}
 	for _, imglst := range retval {
 		sort.Sort(imglst)
 	}
-	return &Templates{defaultTemplate, retval}, nil
+	return &Templates{Default: defaultTemplate, Arch: HostArch(), Templates: retval}, nil
 }
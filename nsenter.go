@@ -0,0 +1,71 @@
+package machineutil
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const nsenterPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// lookPathIn resolves file against PATH as seen from root
+func lookPathIn(root, file string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range strings.Split(nsenterPath, ":") {
+		path := dir + "/" + file
+		if info, err := os.Stat(root + path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", file, exec.ErrNotFound)
+}
+
+// Nsenter runs cmd inside the namespaces of the machine leader without going through the guest service manager.
+// cmd.Path is resolved inside the machine when it has no slash, cmd.Dir is a path inside the machine and cmd.Env
+// is added to PATH, HOME and TERM. The command runs as the guest root unless the Credential of cmd.SysProcAttr
+// names other ids, as seen inside the machine.
+// A multithreaded process can't join a user namespace, so the namespaces are entered by the host nsenter.
+func (m *Machine) Nsenter(cmd *exec.Cmd) error {
+	leader, err := m.Leader()
+	if err != nil {
+		return err
+	}
+	target := strconv.FormatUint(uint64(leader), 10)
+	path, err := lookPathIn("/proc/"+target+"/root", cmd.Path)
+	if err != nil {
+		return err
+	}
+	shift, err := m.UIDShift()
+	if err != nil {
+		return err
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		dir = "/"
+	}
+	args := []string{"nsenter", "--target", target, "--mount", "--uts", "--ipc", "--net", "--pid", "--cgroup", "--root", "--wd=" + dir}
+	if shift != 0 {
+		// nsenter switches to uid and gid 0 of the namespace, which is the guest root, the unmapped host root
+		// kept with --preserve-credentials would own every file the command creates
+		args = append(args, "--user")
+	}
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		credential := cmd.SysProcAttr.Credential
+		args = append(args, "--setuid", strconv.FormatUint(uint64(credential.Uid), 10), "--setgid", strconv.FormatUint(uint64(credential.Gid), 10))
+		// nsenter itself has to start as root to enter the namespaces
+		cmd.SysProcAttr.Credential = nil
+	}
+	args = append(append(args, "--", path), cmd.Args[1:]...)
+	cmd.Path, err = exec.LookPath("nsenter")
+	if err != nil {
+		return err
+	}
+	cmd.Args = args
+	cmd.Dir = ""
+	cmd.Env = append([]string{"PATH=" + nsenterPath, "HOME=/root", "TERM=dumb"}, cmd.Env...)
+	return cmd.Run()
+}
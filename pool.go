@@ -0,0 +1,152 @@
+package machineutil
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+var ErrNoSpace error = errors.New("not enough space")
+
+// CloneMargin is kept free on top of the size of a template when cloning it, the clone grows once it runs
+var CloneMargin uint64 = 512 << 20
+
+// PoolSpace is what is left of the storage machined keeps images in
+type PoolSpace struct {
+	Path string
+	// Free is the smaller of the room below the pool limit and the free space of the filesystem
+	Free uint64
+	// CopyOnWrite is set when clones share their blocks with the template, btrfs snapshots cost next to nothing
+	CopyOnWrite bool
+}
+
+func (c *machineUtil) PoolSpace() (*PoolSpace, error) {
+	props := make(map[string]dbus.Variant)
+	if err := c.machined.Call("org.freedesktop.DBus.Properties.GetAll", 0, machinedDbusInterface).Store(&props); err != nil {
+		return nil, err
+	}
+	retval := &PoolSpace{Path: "/var/lib/machines", Free: math.MaxUint64}
+	if v, ok := props["PoolPath"].Value().(string); ok && v != "" {
+		retval.Path = v
+	}
+	// both are UINT64_MAX when unknown or unlimited
+	usage, _ := props["PoolUsage"].Value().(uint64)
+	limit, _ := props["PoolLimit"].Value().(uint64)
+	if limit != 0 && limit != math.MaxUint64 && usage != math.MaxUint64 {
+		retval.Free = limit - min(usage, limit)
+	}
+	var stat unix.Statfs_t
+	dir := retval.Path
+	err := unix.Statfs(dir, &stat)
+	// machined creates the pool lazily, the parent is where it will end up
+	for errors.Is(err, unix.ENOENT) && dir != "/" {
+		dir = path.Dir(dir)
+		err = unix.Statfs(dir, &stat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("checking free space of %s: %w", retval.Path, err)
+	}
+	retval.Free = min(retval.Free, stat.Bavail*uint64(stat.Bsize))
+	retval.CopyOnWrite = stat.Type == unix.BTRFS_SUPER_MAGIC
+	return retval, nil
+}
+
+// checkSpace fails when the pool can't take a copy of t plus CloneMargin
+func (t *Template) checkSpace() error {
+	pool, err := t.manager.PoolSpace()
+	if err != nil {
+		return err
+	}
+	need := CloneMargin
+	if !pool.CopyOnWrite {
+		if t.Usage == 0 {
+			slog.Debug("Template size unknown, only checking the margin", "template", t.Image())
+		}
+		need += t.Usage
+	}
+	if pool.Free < need {
+		return fmt.Errorf("%w: cloning %s needs %s, %s has %s free", ErrNoSpace, t.Image(), util.FormatBytes(need), pool.Path, util.FormatBytes(pool.Free))
+	}
+	return nil
+}
+
+// CleanPool modes, hidden images are those whose name starts with a dot
+const (
+	CleanPoolHidden = "hidden"
+	CleanPoolAll    = "all"
+)
+
+var CleanPoolModes = []string{CleanPoolHidden, CleanPoolAll}
+
+// CleanedImage is an image CleanPool removed and the space it took
+type CleanedImage struct {
+	Name  string
+	Usage uint64
+}
+
+// CleanPoolPreview lists the images CleanPool would remove in mode without removing anything
+func CleanPoolPreview(manager MachineUtil, mode string) ([]Image, error) {
+	if !slices.Contains(CleanPoolModes, mode) {
+		return nil, fmt.Errorf("invalid clean mode %q, expected %s or %s", mode, CleanPoolHidden, CleanPoolAll)
+	}
+	images, err := manager.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	retval := []Image{}
+	for _, image := range images {
+		if mode == CleanPoolHidden && !strings.HasPrefix(image.Name, ".") {
+			continue
+		}
+		machine, err := manager.GetMachine(image.Name)
+		if err != nil {
+			return nil, err
+		}
+		// machined keeps the images it can't remove because a machine runs from them
+		if machine.Running() {
+			continue
+		}
+		retval = append(retval, image)
+	}
+	return retval, nil
+}
+
+// CleanPool has machined remove the hidden images, or with CleanPoolAll every image no machine is running from.
+// All includes the templates.
+func (c *machineUtil) CleanPool(mode string) ([]CleanedImage, error) {
+	if !slices.Contains(CleanPoolModes, mode) {
+		return nil, fmt.Errorf("invalid clean mode %q, expected %s or %s", mode, CleanPoolHidden, CleanPoolAll)
+	}
+	result := make([][]interface{}, 0)
+	call := c.machined.Call(machinedDbusInterface+".CleanPool", 0, mode)
+	util.Record("pool.clean", mode, call.Err)
+	c.invalidateImages()
+	if call.Err != nil {
+		return nil, call.Err
+	}
+	if err := call.Store(&result); err != nil {
+		return nil, err
+	}
+	retval := []CleanedImage{}
+	for _, i := range result {
+		if len(i) < 2 {
+			return nil, fmt.Errorf("invalid number of cleaned image fields: %d", len(i))
+		}
+		name, _ := i[0].(string)
+		usage, _ := i[1].(uint64)
+		if usage == math.MaxUint64 {
+			usage = 0
+		}
+		c.forget(name)
+		retval = append(retval, CleanedImage{Name: name, Usage: usage})
+	}
+	return retval, nil
+}
@@ -0,0 +1,172 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+var ErrNotReady error = errors.New("not ready")
+
+// Probe is a single readiness check, Check returns nil once the target is ready
+type Probe interface {
+	Check(ctx context.Context) error
+	String() string
+}
+
+// Func adapts a plain function into a Probe
+type Func struct {
+	Name string
+	Fn   func(ctx context.Context) error
+}
+
+func (f *Func) Check(ctx context.Context) error { return f.Fn(ctx) }
+func (f *Func) String() string                  { return f.Name }
+
+type TCP struct {
+	Address string
+}
+
+func (p *TCP) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *TCP) String() string { return "tcp " + p.Address }
+
+// HTTP succeeds on any 2xx or 3xx response unless Status asks for a specific code
+type HTTP struct {
+	URL    string
+	Status int
+}
+
+func (p *HTTP) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		// a redirect is an answer, following it could leave the machine
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if p.Status != 0 && resp.StatusCode != p.Status {
+		return fmt.Errorf("%w: %s returned %s", ErrNotReady, p.URL, resp.Status)
+	}
+	if p.Status == 0 && resp.StatusCode >= 400 {
+		return fmt.Errorf("%w: %s returned %s", ErrNotReady, p.URL, resp.Status)
+	}
+	return nil
+}
+
+func (p *HTTP) String() string { return "http " + p.URL }
+
+// DNS resolves Name, through Server when one is given instead of the host resolver
+type DNS struct {
+	Name   string
+	Server string
+}
+
+func (p *DNS) Check(ctx context.Context) error {
+	resolver := net.DefaultResolver
+	if p.Server != "" {
+		server := p.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	addrs, err := resolver.LookupHost(ctx, p.Name)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w: %s has no addresses", ErrNotReady, p.Name)
+	}
+	return nil
+}
+
+func (p *DNS) String() string { return "dns " + p.Name }
+
+type File struct {
+	Path string
+}
+
+func (p *File) Check(ctx context.Context) error {
+	_, err := os.Stat(p.Path)
+	return err
+}
+
+func (p *File) String() string { return "file " + p.Path }
+
+// Options are the retry semantics shared by every probe
+type Options struct {
+	// Interval between attempts, defaults to one second
+	Interval time.Duration
+	// MaxInterval lets the interval grow by Backoff after every failed attempt
+	MaxInterval time.Duration
+	// Backoff is the factor the interval grows by, defaults to doubling once MaxInterval is set
+	Backoff float64
+	// Jitter randomizes every interval by up to this fraction so probes started together spread out
+	Jitter float64
+	// Timeout for a single attempt, defaults to the longest interval
+	AttemptTimeout time.Duration
+	// Timeout for the whole wait, zero waits until ctx is done
+	Timeout time.Duration
+}
+
+func (o *Options) defaults() Options {
+	opts := *o
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 2
+	}
+	if opts.AttemptTimeout <= 0 {
+		opts.AttemptTimeout = max(opts.Interval, opts.MaxInterval)
+	}
+	return opts
+}
+
+// Wait retries p until it succeeds, the last probe error is returned when the timeout expires
+func Wait(ctx context.Context, p Probe, options Options) error {
+	opts := options.defaults()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	poller := util.Backoff{Interval: opts.Interval, Max: opts.MaxInterval, Factor: opts.Backoff, Jitter: opts.Jitter}.Poller()
+	for {
+		attempt, cancel := context.WithTimeout(ctx, opts.AttemptTimeout)
+		err := p.Check(attempt)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if poller.Wait(ctx) != nil {
+			return fmt.Errorf("%s: %w: %w", p, ctx.Err(), err)
+		}
+	}
+}
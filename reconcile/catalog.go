@@ -0,0 +1,69 @@
+package reconcile
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil"
+)
+
+// CatalogEntry is one template version found on the host
+type CatalogEntry struct {
+	Name    string
+	Version int
+	Arch    string
+	Image   string
+	Created time.Time
+	Usage   uint64
+	// Selected is the version machines referencing Name without a version or Architecture are created from
+	Selected bool
+	// Channels the version is promoted to
+	Channels []string
+	// Machines are the configured machines that would be created from this version
+	Machines []string
+}
+
+// Catalog lists every discovered template version, grouped by name and ordered by version,
+// along with the configured machines referencing it
+func (s *State) Catalog(config *Config) []*CatalogEntry {
+	all, ok := s.Templates.(*machineutil.Templates)
+	if !ok {
+		return nil
+	}
+	users := make(map[string][]string)
+	for _, m := range config.Machines {
+		template, err := s.DiscoverTemplate(m)
+		if err != nil {
+			slog.Warn("Machine references no discovered template", "machine", m.Fqdn, "template", m.Template)
+			continue
+		}
+		users[template.Image()] = append(users[template.Image()], m.Fqdn)
+	}
+	names := []string{}
+	for name := range all.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	retval := []*CatalogEntry{}
+	for _, name := range names {
+		versions := all.Templates[name]
+		selected := versions.ForArch(all.Arch).Template()
+		for _, tmpl := range versions {
+			machines := users[tmpl.Image()]
+			sort.Strings(machines)
+			retval = append(retval, &CatalogEntry{
+				Name:     tmpl.Name,
+				Version:  tmpl.Version,
+				Arch:     tmpl.Arch,
+				Image:    tmpl.Image(),
+				Created:  tmpl.Created,
+				Usage:    tmpl.Usage,
+				Selected: tmpl == selected,
+				Channels: s.Channels.Of(tmpl.Name, tmpl.Version),
+				Machines: machines,
+			})
+		}
+	}
+	return retval
+}
@@ -0,0 +1,89 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+const (
+	ChannelStable  = "stable"
+	ChannelTesting = "testing"
+)
+
+var TemplateChannels = []string{ChannelStable, ChannelTesting}
+
+// ChannelsFile records the template version promoted to every channel, it is host state the config doesn't carry
+var ChannelsFile = "/var/lib/machineutil/channels.json"
+
+// Channels maps template names to the version promoted to each of their channels
+type Channels map[string]map[string]int
+
+// LoadChannels reads ChannelsFile, nothing was promoted yet when it is missing
+func LoadChannels() (Channels, error) {
+	retval := Channels{}
+	data, err := util.Files.ReadFile(ChannelsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return retval, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &retval); err != nil {
+		return nil, fmt.Errorf("%s: %w", ChannelsFile, err)
+	}
+	return retval, nil
+}
+
+func (c Channels) Save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.Files.MkdirAll(filepath.Dir(ChannelsFile), 0755); err != nil {
+		return err
+	}
+	return util.Files.WriteFile(ChannelsFile, append(data, '\n'), 0644)
+}
+
+// Promote moves channel of the template name to version
+func (c Channels) Promote(name, channel string, version int) error {
+	if !slices.Contains(TemplateChannels, channel) {
+		return fmt.Errorf("invalid channel %q, expected %s or %s", channel, ChannelStable, ChannelTesting)
+	}
+	if c[name] == nil {
+		c[name] = make(map[string]int)
+	}
+	c[name][channel] = version
+	return nil
+}
+
+// Version returns the version channel of the template name selects, testing follows the newest version until
+// something is promoted to it while stable has to be promoted first
+func (c Channels) Version(name, channel string) (int, error) {
+	if version, ok := c[name][channel]; ok {
+		return version, nil
+	}
+	if channel == ChannelTesting {
+		return -1, nil
+	}
+	return 0, fmt.Errorf("template %s has no version promoted to %s", name, channel)
+}
+
+// Of lists the channels version of the template name is promoted to
+func (c Channels) Of(name string, version int) []string {
+	retval := []string{}
+	for channel, v := range c[name] {
+		if v == version {
+			retval = append(retval, channel)
+		}
+	}
+	sort.Strings(retval)
+	return retval
+}
@@ -0,0 +1,813 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([a-z0-9_]+)\s*\}\}`)
+
+var placeholderNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// builtinPlaceholders can't be registered or used as Vars, the builtin values would hide them
+var builtinPlaceholders = []string{"fqdn", "mode", "report", "addr", "addr4", "addr6", "template", "template_version", "event", "error"}
+
+// Registry holds the outputs of commands with Register, shared by the machines of a run
+type Registry struct {
+	// Secrets are the names whose values are redacted once registered
+	Secrets []string
+	mu      sync.Mutex
+	values  map[string]string
+}
+
+func (r *Registry) Set(name, value string) {
+	if slices.Contains(r.Secrets, name) {
+		util.AddSecret(value)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = make(map[string]string)
+	}
+	r.values[name] = value
+}
+
+// Values returns a copy of the registered values
+func (r *Registry) Values() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.values)
+}
+
+type CommandEnv struct {
+	Machine   *machineutil.Machine
+	Addrs     []netip.Addr
+	Template  *machineutil.Template
+	Transport string
+	SSH       *SSHConfig
+	NoInit    bool
+	Mode      string
+	Report    string
+	Extra     map[string]string
+	// Vars are the variables of the machine, registered outputs take precedence
+	Vars map[string]string
+	// Registry receives the outputs of commands with Register, a registry of its own is created when unset
+	Registry *Registry
+	Ran      int
+	// Context bounds the commands, they are stopped once it is done. Nil runs them to completion.
+	Context context.Context
+}
+
+func (env *CommandEnv) context() context.Context {
+	if env.Context == nil {
+		return context.Background()
+	}
+	return env.Context
+}
+
+func (env *CommandEnv) Placeholders() map[string][]string {
+	values := map[string][]string{}
+	for name, value := range env.Vars {
+		values[name] = []string{value}
+	}
+	if env.Registry != nil {
+		for name, value := range env.Registry.Values() {
+			values[name] = []string{value}
+		}
+	}
+	if env.Machine != nil {
+		values["fqdn"] = []string{env.Machine.Name}
+	}
+	if env.Mode != "" {
+		values["mode"] = []string{env.Mode}
+	}
+	if env.Report != "" {
+		values["report"] = []string{env.Report}
+	}
+	for name, value := range env.Extra {
+		values[name] = []string{value}
+	}
+	var addrs, addrs4, addrs6 []string
+	for _, addr := range env.Addrs {
+		addrs = append(addrs, addr.String())
+		if addr.Unmap().Is4() {
+			addrs4 = append(addrs4, addr.Unmap().String())
+		} else {
+			addrs6 = append(addrs6, addr.String())
+		}
+	}
+	values["addr"] = addrs
+	values["addr4"] = addrs4
+	values["addr6"] = addrs6
+	if env.Template != nil {
+		values["template"] = []string{env.Template.Name}
+		values["template_version"] = []string{strconv.Itoa(env.Template.Version)}
+	}
+	return values
+}
+
+// Expand replaces placeholders inside s, multi valued placeholders are joined with a space
+func (env *CommandEnv) Expand(s string) string {
+	values := env.Placeholders()
+	return placeholderPattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		value, ok := values[name]
+		if !ok {
+			return match
+		}
+		return strings.Join(value, " ")
+	})
+}
+
+// ExpandArgs expands placeholders in every argument, an argument consisting of a
+// single multi valued placeholder (e.g. {{addr}}) expands into one argument per value
+func (env *CommandEnv) ExpandArgs(args []string) []string {
+	values := env.Placeholders()
+	retval := make([]string, 0, len(args))
+	for _, arg := range args {
+		if match := placeholderPattern.FindStringSubmatch(arg); match != nil && match[0] == arg {
+			if value, ok := values[match[1]]; ok {
+				retval = append(retval, value...)
+				continue
+			}
+		}
+		retval = append(retval, env.Expand(arg))
+	}
+	return retval
+}
+
+type CommandDescription struct {
+	Command           []string
+	WrapperParameters []string
+	AppendFqdn        bool
+	AppendAddr        bool
+	Local             bool
+	Stdin             string
+	StdinFile         string
+	StdoutFile        string
+	StdoutAppend      bool
+	StderrFile        string
+	StderrAppend      bool
+	Mode              os.FileMode
+	Native            bool
+	Stream            bool
+	OnlyIf            *CommandDescription
+	Unless            *CommandDescription
+	ExitCode          int
+	Dir               string
+	User              string
+	Umask             *os.FileMode
+	Transport         string
+	// Register stores the stdout of the command under this name, later commands use it as a placeholder
+	Register string
+	// Pipe receives the stdout of the command as its stdin, it may run on the other side of the machine boundary
+	Pipe *CommandDescription
+	// Script is run by Interpreter, /bin/sh -e by default, with Command as its arguments
+	Script      string
+	Interpreter []string
+	// Sensitive marks Stdin, its lines of at least 8 characters and the registered output as secrets, they are
+	// redacted from logs, the audit log and reports
+	Sensitive bool
+}
+
+// register stores the output of cmd once it succeeded, the trailing newline most tools print is dropped
+func (cmd *CommandDescription) register(env *CommandEnv, stdout []byte) {
+	if env.Registry == nil {
+		env.Registry = &Registry{}
+	}
+	slog.Debug("Registering command output", "command", cmd.Command, "name", cmd.Register, "bytes", len(stdout))
+	value := strings.TrimRight(string(stdout), "\r\n")
+	if cmd.Sensitive {
+		util.AddSecret(value)
+	}
+	env.Registry.Set(cmd.Register, value)
+}
+
+// minSecretLine is the shortest line of sensitive input redacted on its own, answers such as y, yes or root
+// would otherwise be hidden in every log line from then on
+const minSecretLine = 8
+
+// stdin expands Stdin, sensitive input is redacted from then on as a whole and by its lines that are long enough
+func (cmd *CommandDescription) stdin(env *CommandEnv) string {
+	retval := env.Expand(cmd.Stdin)
+	if cmd.Sensitive {
+		util.AddSecret(strings.TrimSpace(retval))
+		for _, line := range strings.Split(retval, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minSecretLine {
+				util.AddSecret(line)
+			}
+		}
+	}
+	return retval
+}
+
+// validate checks the settings of a single command
+func (cmd *CommandDescription) validate() error {
+	if len(cmd.Interpreter) > 0 && cmd.Script == "" {
+		return fmt.Errorf("command %v has an Interpreter without Script", cmd.Command)
+	}
+	if cmd.Native && !cmd.Local && len(cmd.WrapperParameters) > 0 {
+		return fmt.Errorf("command %v is Native, WrapperParameters are systemd-run options it doesn't use", cmd.Command)
+	}
+	if cmd.Register == "" {
+		return nil
+	}
+	if err := validatePlaceholderName(cmd.Register); err != nil {
+		return fmt.Errorf("invalid Register: %w", err)
+	}
+	return nil
+}
+
+// validatePlaceholderName checks a name Register or Vars define a placeholder with
+func validatePlaceholderName(name string) error {
+	if !placeholderNamePattern.MatchString(name) {
+		return fmt.Errorf("%q has characters other than lowercase letters, digits and _", name)
+	}
+	if slices.Contains(builtinPlaceholders, name) {
+		return fmt.Errorf("%q is a builtin placeholder", name)
+	}
+	return nil
+}
+
+// exitCode runs a guard command and reports its exit code, only failures to run the command are errors
+func (cmd *CommandDescription) exitCode(env *CommandEnv) (int, error) {
+	// guards don't count as commands that ran
+	defer func(ran int) { env.Ran = ran }(env.Ran)
+	err := cmd.Run(env)
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, err
+}
+
+func (cmd *CommandDescription) shouldRun(env *CommandEnv) (bool, error) {
+	if cmd.OnlyIf != nil {
+		code, err := cmd.OnlyIf.exitCode(env)
+		if err != nil {
+			return false, err
+		}
+		if code != cmd.OnlyIf.ExitCode {
+			slog.Debug("Skipping command, only_if guard not met", "command", cmd.Command, "exitcode", code)
+			return false, nil
+		}
+	}
+	if cmd.Unless != nil {
+		code, err := cmd.Unless.exitCode(env)
+		if err != nil {
+			return false, err
+		}
+		if code == cmd.Unless.ExitCode {
+			slog.Debug("Skipping command, unless guard met", "command", cmd.Command, "exitcode", code)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+const (
+	TransportSystemdRun = "systemd-run"
+	TransportSSH        = "ssh"
+)
+
+var transports = []string{"", TransportSystemdRun, TransportSSH}
+
+// transport returns the transport for commands running inside the machine, the machine default applies when unset
+func (cmd *CommandDescription) transport(env *CommandEnv) string {
+	if cmd.Transport != "" {
+		return cmd.Transport
+	}
+	if env.Transport != "" {
+		return env.Transport
+	}
+	return TransportSystemdRun
+}
+
+// shellQuote quotes s for the remote shell ssh passes the command to
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// systemdQuote quotes s as one word of a command line in a systemd configuration file,
+// systemd splits words itself and doesn't know the quote escapes of a shell
+func systemdQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,@%+$", r))
+	}) < 0 {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// execQuote quotes s as one word of an Exec line of a unit, specifiers and variables are escaped as well
+func execQuote(s string) string {
+	return systemdQuote(strings.NewReplacer("%", "%%", "$", "$$").Replace(s))
+}
+
+func sshArgs(env *CommandEnv, params []string, command []string) ([]string, error) {
+	if len(env.Addrs) == 0 {
+		return nil, fmt.Errorf("ssh transport requires an address for %s", env.Machine.Name)
+	}
+	user := "root"
+	args := []string{"ssh", "-o", "BatchMode=yes"}
+	if c := env.SSH; c != nil {
+		if c.User != "" {
+			user = c.User
+		}
+		if c.IdentityFile != "" {
+			args = append(args, "-i", c.IdentityFile)
+		}
+		if c.ProxyJump != "" {
+			args = append(args, "-J", c.ProxyJump)
+		}
+		if c.KnownHostsFile != "" {
+			args = append(args, "-o", "UserKnownHostsFile="+c.KnownHostsFile)
+		}
+	}
+	// freshly created machines have unknown host keys, they are recorded on first use
+	args = append(args, "-o", "StrictHostKeyChecking=accept-new", "-l", user)
+	args = append(args, params...)
+	args = append(args, env.Addrs[0].String(), "--")
+	for _, arg := range command {
+		args = append(args, shellQuote(arg))
+	}
+	return args, nil
+}
+
+func (cmd *CommandDescription) Run(env *CommandEnv) (err error) {
+	span := util.Trace("command", "command", strings.Join(cmd.Command, " "))
+	if env.Machine != nil {
+		span.Set("machine", env.Machine.Name)
+	}
+	defer func() { span.End(err) }()
+	run, err := cmd.shouldRun(env)
+	if err != nil || !run {
+		return err
+	}
+	return cmd.runPiped(env, nil)
+}
+
+// stages returns cmd followed by every command its output is piped into
+func (cmd *CommandDescription) stages() []*CommandDescription {
+	retval := []*CommandDescription{}
+	for ; cmd != nil; cmd = cmd.Pipe {
+		retval = append(retval, cmd)
+	}
+	return retval
+}
+
+// validatePipe rejects inputs of piped commands the pipe would override, guards only apply to the whole pipeline
+func (cmd *CommandDescription) validatePipe() error {
+	for _, stage := range cmd.stages()[1:] {
+		switch {
+		case stage.Stdin != "" || stage.StdinFile != "":
+			return fmt.Errorf("piped command %v reads the output of the previous command, it can't have Stdin or StdinFile", stage.Command)
+		case stage.OnlyIf != nil || stage.Unless != nil:
+			return fmt.Errorf("piped command %v can't have OnlyIf or Unless, guard the first command instead", stage.Command)
+		}
+	}
+	return nil
+}
+
+// brokenPipe reports whether err comes from writing to a pipe whose reader is gone
+func brokenPipe(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
+	}
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, syscall.EPIPE)
+}
+
+// runPiped runs cmd reading pipeIn, when set, and feeds its stdout to Pipe. All commands of a pipeline run at once.
+// A command exiting early breaks the pipe of the ones writing to it, like in a shell only the failure of the last one counts then.
+func (cmd *CommandDescription) runPiped(env *CommandEnv, pipeIn io.Reader) error {
+	if cmd.Pipe == nil {
+		return cmd.run(env, pipeIn, nil)
+	}
+	if env.Registry == nil {
+		env.Registry = &Registry{}
+	}
+	reader, writer := io.Pipe()
+	pipeEnv := *env
+	pipeEnv.Ran = 0
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Pipe.runPiped(&pipeEnv, reader)
+		reader.CloseWithError(io.ErrClosedPipe)
+		done <- err
+	}()
+	err := cmd.run(env, pipeIn, writer)
+	writer.Close()
+	pipeErr := <-done
+	env.Ran += pipeEnv.Ran
+	if pipeErr == nil && brokenPipe(err) {
+		err = nil
+	}
+	return errors.Join(err, pipeErr)
+}
+
+func (cmd *CommandDescription) run(env *CommandEnv, pipeIn io.Reader, pipeOut io.Writer) (err error) {
+	if cmd.Script != "" {
+		return cmd.runScript(env, pipeIn, pipeOut)
+	}
+	if cmd.Mode == 0 {
+		cmd.Mode = 0600
+	}
+	env.Ran++
+	machine := env.Machine
+	if machine == nil && !cmd.Local {
+		return fmt.Errorf("command %v has no machine to run in, it must be Local", cmd.Command)
+	}
+	fqdn := ""
+	if machine != nil {
+		fqdn = machine.Name
+	}
+	args := []string{}
+	var wrapper *exec.Cmd
+	nsenter := false
+	systemdRun := false
+	if !cmd.Local && !cmd.Native && cmd.transport(env) == TransportSSH {
+		args, err = sshArgs(env, env.ExpandArgs(cmd.WrapperParameters), env.ExpandArgs(cmd.Command))
+		if err != nil {
+			return
+		}
+	} else if !cmd.Local && !cmd.Native && env.NoInit {
+		// without systemd in the guest there is nothing for systemd-run -M to talk to
+		nsenter = true
+		args = append(args, env.ExpandArgs(cmd.Command)...)
+	} else if !cmd.Local && !cmd.Native {
+		systemdRun = true
+		args = append(args, "systemd-run", "-M", fqdn, "-P")
+		args = append(args, env.ExpandArgs(cmd.WrapperParameters)...)
+		args = append(args, "--")
+		args = append(args, env.ExpandArgs(cmd.Command)...)
+	} else {
+		args = append(args, env.ExpandArgs(cmd.Command)...)
+	}
+	// AppendFqdn and AppendAddr predate placeholders and are kept for existing configs
+	if cmd.AppendFqdn {
+		args = append(args, fqdn)
+	}
+	if cmd.AppendAddr {
+		for _, addr := range env.Addrs {
+			args = append(args, addr.String())
+		}
+	}
+	stdinData := cmd.stdin(env)
+	if cmd.Native && !cmd.Local {
+		return cmd.runNative(env, args, stdinData, pipeIn, pipeOut)
+	}
+	slog.Debug("Running command", "command", args, "nsenter", nsenter)
+	wrapper = exec.CommandContext(env.context(), args[0], args[1:]...)
+	if nsenter {
+		// resolved inside the machine by Nsenter, not on the host
+		wrapper.Path, wrapper.Err = args[0], nil
+	}
+	if cmd.Local {
+		err = cmd.setupLocal(wrapper)
+		if err != nil {
+			return
+		}
+	}
+	if nsenter {
+		err = setupNsenter(wrapper, machine, env.ExpandArgs(cmd.WrapperParameters))
+		if err != nil {
+			return
+		}
+	}
+	var stdin *os.File
+	var stdout io.WriteCloser
+	var stderr io.WriteCloser
+	defer func() {
+		if stdin != nil {
+			stdin.Close()
+		}
+		if stdout != nil {
+			stdout.Close()
+		}
+		if stderr != nil {
+			stderr.Close()
+		}
+	}()
+	if pipeIn != nil {
+		wrapper.Stdin = pipeIn
+	} else if cmd.StdinFile != "" {
+		slog.Debug("Using stdin", "file", cmd.StdinFile)
+		stdin, err = os.Open(cmd.StdinFile)
+		if err != nil {
+			return
+		}
+		wrapper.Stdin = stdin
+	} else if stdinData != "" {
+		slog.Debug("Using stdin", "static", stdinData)
+		wrapper.Stdin = bytes.NewReader([]byte(stdinData))
+	}
+	stdout, err = cmd.openOutput(cmd.StdoutFile, cmd.StdoutAppend)
+	if err != nil {
+		return
+	}
+	if stdout != nil {
+		slog.Debug("Using stdout", "file", cmd.StdoutFile, "append", cmd.StdoutAppend)
+		wrapper.Stdout = stdout
+	}
+	stderr, err = cmd.openOutput(cmd.StderrFile, cmd.StderrAppend)
+	if err != nil {
+		return
+	}
+	if stderr != nil {
+		slog.Debug("Using stderr", "file", cmd.StderrFile, "append", cmd.StderrAppend)
+		wrapper.Stderr = stderr
+	}
+	if cmd.Stream {
+		stdoutLog, stderrLog := cmd.streamLoggers(fqdn)
+		defer stdoutLog.Flush()
+		defer stderrLog.Flush()
+		wrapper.Stdout = teeWriter(wrapper.Stdout, stdoutLog)
+		wrapper.Stderr = teeWriter(wrapper.Stderr, stderrLog)
+	}
+	var captured *bytes.Buffer
+	if cmd.Register != "" {
+		captured = &bytes.Buffer{}
+		wrapper.Stdout = teeWriter(wrapper.Stdout, captured)
+	}
+	if pipeOut != nil {
+		wrapper.Stdout = teeWriter(wrapper.Stdout, pipeOut)
+	}
+	busErr := &busErrors{}
+	if systemdRun {
+		wrapper.Stderr = teeWriter(wrapper.Stderr, busErr)
+	}
+	var umask *os.FileMode
+	if cmd.Local {
+		umask = cmd.Umask
+	}
+	if nsenter {
+		err = Commands.Run(wrapper, machine, nil)
+	} else {
+		err = Commands.Run(wrapper, nil, umask)
+	}
+	// early in boot or without a bus in the guest systemd-run fails before running anything, piped input is gone though
+	if systemdRun && err != nil && busErr.unavailable() && pipeIn == nil {
+		slog.Warn("Guest bus unavailable, entering machine namespaces directly", "machine", fqdn, "error", busErr.firstLine())
+		// the retry opens the files again
+		if stdin != nil {
+			stdin.Close()
+			stdin = nil
+		}
+		if stdout != nil {
+			stdout.Close()
+			stdout = nil
+		}
+		if stderr != nil {
+			stderr.Close()
+			stderr = nil
+		}
+		fallback := *env
+		fallback.NoInit = true
+		err = cmd.run(&fallback, nil, pipeOut)
+		env.Registry = fallback.Registry
+		return
+	}
+	if err == nil && captured != nil {
+		cmd.register(env, captured.Bytes())
+	}
+	return
+}
+
+// setupLocal applies Dir and User, they are ignored for commands running inside the machine
+func (cmd *CommandDescription) setupLocal(wrapper *exec.Cmd) error {
+	wrapper.Dir = cmd.Dir
+	if cmd.User == "" {
+		return nil
+	}
+	usr, err := user.Lookup(cmd.User)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	groupIds, err := usr.GroupIds()
+	if err != nil {
+		return err
+	}
+	groups := make([]uint32, 0, len(groupIds))
+	for _, g := range groupIds {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, uint32(id))
+	}
+	slog.Debug("Running as user", "user", cmd.User, "uid", uid, "gid", gid)
+	wrapper.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    uint32(uid),
+			Gid:    uint32(gid),
+			Groups: groups,
+		},
+	}
+	wrapper.Env = append(os.Environ(), "HOME="+usr.HomeDir, "USER="+usr.Username, "LOGNAME="+usr.Username)
+	return nil
+}
+
+func (cmd *CommandDescription) streamLoggers(fqdn string) (stdout, stderr *util.LogWriter) {
+	log := slog.With("machine", fqdn, "command", cmd.Command)
+	stdout = util.NewLogWriter(log, slog.LevelInfo, "stdout")
+	stderr = util.NewLogWriter(log, slog.LevelWarn, "stderr")
+	return
+}
+
+// busErrors keeps the start of the stderr of systemd-run, enough to tell its own bus errors from the command output
+type busErrors struct {
+	buf bytes.Buffer
+}
+
+func (e *busErrors) Write(p []byte) (int, error) {
+	if room := 4096 - e.buf.Len(); room > 0 {
+		e.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (e *busErrors) firstLine() string {
+	line, _, _ := strings.Cut(e.buf.String(), "\n")
+	return line
+}
+
+// unavailable reports whether systemd-run failed to connect to the machine, the command didn't run then.
+// Older versions report "Failed to create bus connection", newer ones name the transport after "Failed to connect to".
+func (e *busErrors) unavailable() bool {
+	line := e.firstLine()
+	return strings.HasPrefix(line, "Failed to create bus connection") ||
+		(strings.HasPrefix(line, "Failed to connect to") && strings.Contains(line, "bus"))
+}
+
+// systemdRunReporting are systemd-run flags that only change how it waits and reports, nothing the command sees
+var systemdRunReporting = []string{"-q", "--quiet", "-G", "--collect", "--wait", "-P", "--pipe"}
+
+// setupNsenter applies the systemd-run options of WrapperParameters that mean the same when entering the namespaces
+// of machine directly, the others are rejected instead of being dropped
+func setupNsenter(wrapper *exec.Cmd, machine *machineutil.Machine, params []string) error {
+	var credential *syscall.Credential
+	for i := 0; i < len(params); i++ {
+		param := params[i]
+		if slices.Contains(systemdRunReporting, param) {
+			continue
+		}
+		name, value, found := strings.Cut(param, "=")
+		if !strings.HasPrefix(name, "--") || !found {
+			name = param
+			if i+1 == len(params) {
+				return fmt.Errorf("WrapperParameters: %s needs a value", param)
+			}
+			i++
+			value = params[i]
+		}
+		switch name {
+		case "-E", "--setenv":
+			wrapper.Env = append(wrapper.Env, value)
+		case "--working-directory":
+			wrapper.Dir = value
+		case "--uid", "--gid":
+			root, err := machine.RootPath()
+			if err != nil {
+				return err
+			}
+			if credential == nil {
+				credential = &syscall.Credential{}
+			}
+			if name == "--uid" {
+				id, err := lookupID(root, "passwd", value)
+				if err != nil {
+					return err
+				}
+				credential.Uid = uint32(id)
+			} else {
+				id, err := lookupID(root, "group", value)
+				if err != nil {
+					return err
+				}
+				credential.Gid = uint32(id)
+			}
+		default:
+			return fmt.Errorf("WrapperParameters: systemd-run option %s has no equivalent when entering the machine namespaces", param)
+		}
+	}
+	if credential != nil {
+		wrapper.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	return nil
+}
+
+// teeWriter adds extra to the writers w already writes to
+func teeWriter(w io.Writer, extra io.Writer) io.Writer {
+	if w == nil {
+		return extra
+	}
+	return io.MultiWriter(w, extra)
+}
+
+func (cmd *CommandDescription) openOutput(file string, appendOutput bool) (io.WriteCloser, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if appendOutput {
+		return util.Files.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, cmd.Mode)
+	}
+	return util.Files.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cmd.Mode)
+}
+
+func (cmd *CommandDescription) writeOutput(file string, appendOutput bool, data []byte) error {
+	f, err := cmd.openOutput(file, appendOutput)
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func (cmd *CommandDescription) runNative(env *CommandEnv, args []string, stdinData string, pipeIn io.Reader, pipeOut io.Writer) error {
+	machine := env.Machine
+	slog.Debug("Running native command", "machine", machine.Name, "command", args)
+	var stdin io.Reader
+	if pipeIn != nil {
+		stdin = pipeIn
+	} else if cmd.StdinFile != "" {
+		f, err := os.Open(cmd.StdinFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stdin = f
+	} else if stdinData != "" {
+		stdin = bytes.NewReader([]byte(stdinData))
+	}
+	result, err := Commands.Exec(env.context(), machine, args, stdin)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Native command finished", "machine", machine.Name, "unit", result.Unit, "result", result.Result, "status", result.Status)
+	if cmd.Stream {
+		// the guest output only becomes available once the unit finished
+		stdoutLog, stderrLog := cmd.streamLoggers(machine.Name)
+		stdoutLog.Write(result.Stdout)
+		stdoutLog.Flush()
+		stderrLog.Write(result.Stderr)
+		stderrLog.Flush()
+	}
+	err = cmd.writeOutput(cmd.StdoutFile, cmd.StdoutAppend, result.Stdout)
+	if err != nil {
+		return err
+	}
+	err = cmd.writeOutput(cmd.StderrFile, cmd.StderrAppend, result.Stderr)
+	if err != nil {
+		return err
+	}
+	if err := result.Err(); err != nil {
+		return err
+	}
+	if cmd.Register != "" {
+		cmd.register(env, result.Stdout)
+	}
+	if pipeOut != nil {
+		// the output of a transient service is only known once it finished
+		if _, err := pipeOut.Write(result.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,716 @@
+package reconcile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"gopkg.in/yaml.v3"
+)
+
+var instancePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// instanceName adds the instance suffix to the host label of fqdn, web.example.com becomes web-ci42.example.com
+func instanceName(fqdn, instance string) string {
+	host, domain, found := strings.Cut(fqdn, ".")
+	if !found {
+		return host + "-" + instance
+	}
+	return host + "-" + instance + "." + domain
+}
+
+// ApplyInstance renames every machine, the dependencies between them and the host storage of their mounts
+// so the same config can run side by side. Mounts of a volume are renamed alike and stay shared within the instance.
+func (c *Config) ApplyInstance(instance string) error {
+	if instance == "" {
+		return nil
+	}
+	if !instancePattern.MatchString(instance) {
+		return fmt.Errorf("invalid instance %q, only lowercase letters, digits and dashes are allowed", instance)
+	}
+	// the pool hashes the suffixed names, parallel instances would still collide with each other
+	if c.AddressPool != "" {
+		return fmt.Errorf("AddressPool can't be used with an instance, instances don't know each other's addresses")
+	}
+	renamed := make(map[string]string, len(c.Machines))
+	for _, m := range c.Machines {
+		renamed[m.Fqdn] = instanceName(m.Fqdn, instance)
+	}
+	rename := func(names []string) {
+		for i, name := range names {
+			if n, ok := renamed[name]; ok {
+				names[i] = n
+			}
+		}
+	}
+	for _, m := range c.Machines {
+		// host resources can't be suffixed, every instance would claim the same address or port
+		if m.Address != "" {
+			return fmt.Errorf("machine %s: an explicit Address can't be used with an instance", m.Fqdn)
+		}
+		if len(m.Ports) > 0 || len(m.ProxySockets) > 0 {
+			return fmt.Errorf("machine %s: host Ports and ProxySockets can't be used with an instance", m.Fqdn)
+		}
+		if m.ZFS != nil {
+			m.ZFS.Dataset += "-" + instance
+		}
+		for _, mnt := range m.Mounts {
+			if err := mnt.applyInstance(instance); err != nil {
+				return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+			}
+		}
+		m.Fqdn = renamed[m.Fqdn]
+		rename(m.After)
+		rename(m.Before)
+		rename(m.Requires)
+		rename(m.Wants)
+	}
+	return nil
+}
+
+// instancePath adds the instance suffix to the file name of p before its extension, data.img becomes data-ci42.img
+func instancePath(p, instance string) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "-" + instance + ext
+}
+
+type Defaults struct {
+	Options           []*unit.UnitOption
+	Overrides         []*unit.UnitOption
+	Resources         *Resources
+	Zone              string
+	WrapperParameters []string
+	AddressOrder      string
+}
+
+// Apply merges the defaults into m, anything set on the machine itself wins
+func (d *Defaults) Apply(m *Machine) {
+	// Options and Zone are nspawn settings, VMs would reject them
+	if !m.IsVM() {
+		m.Options = append(util.DeepCopy(d.Options), m.Options...)
+	}
+	m.Overrides = append(util.DeepCopy(d.Overrides), m.Overrides...)
+	if d.Resources != nil {
+		resources := util.DeepCopy(d.Resources)
+		if m.Resources != nil {
+			util.Merge(resources, m.Resources)
+		}
+		m.Resources = resources
+	}
+	if m.Zone == "" && !m.IsVM() {
+		m.Zone = d.Zone
+	}
+	if m.AddressOrder == "" {
+		m.AddressOrder = d.AddressOrder
+	}
+	if len(d.WrapperParameters) > 0 {
+		for _, cmd := range m.AllCommands() {
+			if cmd.Local {
+				continue
+			}
+			cmd.WrapperParameters = append(slices.Clone(d.WrapperParameters), cmd.WrapperParameters...)
+		}
+	}
+}
+
+type SSHConfig struct {
+	ConfigFile     string
+	KnownHostsFile string
+	User           string
+	ProxyJump      string
+	IdentityFile   string
+}
+
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	if err := util.Files.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".machineutil-new")
+	util.Files.Remove(tmp)
+	if err := util.Files.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := util.Files.Chmod(tmp, mode); err != nil {
+		util.Files.Remove(tmp)
+		return err
+	}
+	if err := util.Files.Rename(tmp, file); err != nil {
+		util.Files.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Write generates the ssh_config include and known_hosts files for all running machines in the report
+func (c *SSHConfig) Write(machines []*MachineReport) error {
+	var config, knownHosts strings.Builder
+	config.WriteString("# Generated by machineutil, do not edit\n")
+	knownHosts.WriteString("# Generated by machineutil, do not edit\n")
+	for _, m := range machines {
+		if len(m.Addresses) == 0 {
+			continue
+		}
+		fmt.Fprintf(&config, "\nHost %s\n", m.Fqdn)
+		fmt.Fprintf(&config, "\tHostName %s\n", m.Addresses[0])
+		if c.User != "" {
+			fmt.Fprintf(&config, "\tUser %s\n", c.User)
+		}
+		if c.ProxyJump != "" {
+			fmt.Fprintf(&config, "\tProxyJump %s\n", c.ProxyJump)
+		}
+		if c.IdentityFile != "" {
+			fmt.Fprintf(&config, "\tIdentityFile %s\n", c.IdentityFile)
+		}
+		if c.KnownHostsFile != "" {
+			fmt.Fprintf(&config, "\tUserKnownHostsFile %s\n", c.KnownHostsFile)
+		}
+		names := append([]string{m.Fqdn}, strings.Split(util.FormatAddresses(m.Addresses), ",")...)
+		for _, key := range m.HostKeys {
+			fmt.Fprintf(&knownHosts, "%s %s\n", strings.Join(names, ","), key)
+		}
+	}
+	if c.ConfigFile != "" {
+		if err := writeFileAtomic(c.ConfigFile, []byte(config.String()), 0644); err != nil {
+			return err
+		}
+	}
+	if c.KnownHostsFile != "" {
+		if err := writeFileAtomic(c.KnownHostsFile, []byte(knownHosts.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	EventCreated    = "created"
+	EventStarted    = "started"
+	EventStopped    = "stopped"
+	EventDestroyed  = "destroyed"
+	EventFailed     = "failed"
+	EventRolledBack = "rolledback"
+	EventUpgraded   = "upgraded"
+)
+
+var notificationEvents = []string{EventCreated, EventStarted, EventStopped, EventDestroyed, EventFailed, EventRolledBack, EventUpgraded}
+
+type Notification struct {
+	Event   string
+	Machine string
+	Mode    string
+	Error   string `json:",omitempty"`
+	Time    time.Time
+}
+
+// Notifications are delivered as they happen, a failing receiver is logged but never fails the run
+type Notifications struct {
+	Events   []string
+	Webhooks []string
+	Commands []*CommandDescription
+	Timeout  time.Duration
+}
+
+func (n *Notifications) Validate() error {
+	for _, event := range n.Events {
+		if !slices.Contains(notificationEvents, event) {
+			return fmt.Errorf("invalid notification event %q, expected one of %s", event, strings.Join(notificationEvents, ", "))
+		}
+	}
+	return nil
+}
+
+func (n *Notifications) Notify(log *slog.Logger, notification *Notification) {
+	if len(n.Events) > 0 && !slices.Contains(n.Events, notification.Event) {
+		return
+	}
+	redacted := *notification
+	redacted.Error = util.Redact(notification.Error)
+	notification = &redacted
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Warn("Encoding notification", "error", err)
+		return
+	}
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	for _, url := range n.Webhooks {
+		log.Debug("Sending notification", "url", url, "event", notification.Event)
+		resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Warn("Sending notification", "url", url, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Warn("Sending notification", "url", url, "status", resp.Status)
+		}
+	}
+	env := &CommandEnv{
+		Mode: notification.Mode,
+		Extra: map[string]string{
+			"event": notification.Event,
+			"fqdn":  notification.Machine,
+			"error": notification.Error,
+		},
+	}
+	for _, cmd := range n.Commands {
+		c := *cmd
+		if c.Stdin == "" && c.StdinFile == "" {
+			c.Stdin = string(payload)
+		}
+		if err := c.Run(env); err != nil {
+			log.Warn("Running notification command", "command", cmd.Command, "error", err)
+		}
+	}
+}
+
+// ResolveVolumes fills mounts referencing a volume from its definition, consumers only pick Target, ReadOnly and IdMap.
+// Volumes outlive the machines using them, destroying or stopping a machine leaves them mounted.
+func (c *Config) ResolveVolumes() error {
+	writers := map[string][]string{}
+	for _, m := range c.Machines {
+		for _, mnt := range m.Mounts {
+			if mnt.Volume == "" {
+				continue
+			}
+			vol, ok := c.Volumes[mnt.Volume]
+			if !ok {
+				return fmt.Errorf("machine %s: unknown volume %q", m.Fqdn, mnt.Volume)
+			}
+			resolved := *util.DeepCopy(vol)
+			if resolved.Name == "" {
+				resolved.Name = mnt.Volume
+			}
+			resolved.Volume = mnt.Volume
+			resolved.Target = mnt.Target
+			resolved.ReadOnly = mnt.ReadOnly
+			resolved.IdMap = mnt.IdMap
+			resolved.NoIdMap = mnt.NoIdMap
+			*mnt = resolved
+			if !mnt.ReadOnly {
+				writers[mnt.Volume] = append(writers[mnt.Volume], m.Fqdn)
+			}
+		}
+	}
+	// Shared volumes are for filesystems made for concurrent writers, anything else gets one writer at most
+	for name, machines := range writers {
+		if len(machines) > 1 && !c.Volumes[name].Shared {
+			return fmt.Errorf("volume %s is written by %s, mark it Shared or mount it ReadOnly", name, strings.Join(machines, ", "))
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	SSH             *SSHConfig
+	AddressPool     string
+	Gateway         string
+	DNS             []string
+	DefaultTemplate string
+	TemplateAliases map[string]string
+	TemplateTests   map[string][]*CommandDescription
+	TemplateSources map[string]*TemplateSource
+	MinFreeSpace    uint64
+	Defaults        *Defaults
+	Groups          map[string]*Machine
+	PreRun          []*CommandDescription
+	PostRun         []*CommandDescription
+	Notifications   *Notifications
+	Volumes         map[string]*MountPoint
+	Firewall        *Firewall
+	Zones           map[string]*ZoneNetwork
+	// Slices are slice units with the limits shared by the machines placed in them with Slice
+	Slices map[string]*Resources
+	// Vars apply to every machine not setting them itself
+	Vars map[string]string
+	// Secrets name the Vars and registered outputs whose values are redacted from logs, the audit log and reports
+	Secrets  []string
+	Machines []*Machine
+	hash     string
+}
+
+// ApplyVars adds the global Vars to every machine, the names must be usable as placeholders.
+// The values of Secrets are redacted from then on.
+func (c *Config) ApplyVars() error {
+	for name := range c.Vars {
+		if err := validatePlaceholderName(name); err != nil {
+			return fmt.Errorf("invalid Vars: %w", err)
+		}
+	}
+	for _, name := range c.Secrets {
+		if err := validatePlaceholderName(name); err != nil {
+			return fmt.Errorf("invalid Secrets: %w", err)
+		}
+	}
+	util.AddSecret(c.secretValues(c.Vars)...)
+	for _, m := range c.Machines {
+		for name := range m.Vars {
+			if err := validatePlaceholderName(name); err != nil {
+				return fmt.Errorf("machine %s: invalid Vars: %w", m.Fqdn, err)
+			}
+		}
+		util.AddSecret(c.secretValues(m.Vars)...)
+		if len(c.Vars) == 0 {
+			continue
+		}
+		vars := maps.Clone(c.Vars)
+		maps.Copy(vars, m.Vars)
+		m.Vars = vars
+	}
+	return nil
+}
+
+// secretValues returns the values of the vars named in Secrets
+func (c *Config) secretValues(vars map[string]string) []string {
+	retval := []string{}
+	for _, name := range c.Secrets {
+		if value, ok := vars[name]; ok {
+			retval = append(retval, value)
+		}
+	}
+	return retval
+}
+
+// Hash identifies the exact config files a Config was loaded from
+func (c *Config) Hash() string {
+	return c.hash
+}
+
+// AssignAddresses gives every machine a static address, either its explicit Address or
+// one derived from a hash of the fqdn within AddressPool. Collisions are errors.
+func (c *Config) AssignAddresses() error {
+	var pool netip.Prefix
+	if c.AddressPool != "" {
+		var err error
+		pool, err = netip.ParsePrefix(c.AddressPool)
+		if err != nil {
+			return fmt.Errorf("AddressPool: %w", err)
+		}
+		pool = pool.Masked()
+	}
+	used := make(map[netip.Addr]string)
+	reserve := func(addr netip.Addr, owner string) error {
+		if other, ok := used[addr]; ok {
+			return fmt.Errorf("address %s of %s collides with %s", addr, owner, other)
+		}
+		used[addr] = owner
+		return nil
+	}
+	if pool.IsValid() {
+		// the network address and the gateway can never be handed out
+		used[pool.Addr()] = "network address"
+		if c.Gateway != "" {
+			gw, err := netip.ParseAddr(c.Gateway)
+			if err != nil {
+				return fmt.Errorf("Gateway: %w", err)
+			}
+			used[gw] = "gateway"
+		}
+	}
+	for _, m := range c.Machines {
+		if m.Address == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(m.Address)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(m.Address)
+			if addrErr != nil {
+				return fmt.Errorf("machine %s: invalid Address %q", m.Fqdn, m.Address)
+			}
+			if !pool.IsValid() {
+				return fmt.Errorf("machine %s: Address without prefix length requires an AddressPool", m.Fqdn)
+			}
+			prefix = netip.PrefixFrom(addr, pool.Bits())
+		}
+		if err := reserve(prefix.Addr(), m.Fqdn); err != nil {
+			return err
+		}
+		m.address = prefix
+		m.pool = pool
+	}
+	if !pool.IsValid() {
+		return nil
+	}
+	hostBits := pool.Addr().BitLen() - pool.Bits()
+	if hostBits < 2 {
+		return fmt.Errorf("AddressPool %s is too small", pool)
+	}
+	size := uint64(1) << min(hostBits, 63)
+	for _, m := range c.Machines {
+		if m.Address != "" {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(m.Fqdn))
+		start := h.Sum64() % size
+		assigned := false
+		for i := uint64(0); i < size; i++ {
+			addr := addrOffset(pool.Addr(), (start+i)%size)
+			if !pool.Contains(addr) || isBroadcast(pool, addr) {
+				continue
+			}
+			if _, ok := used[addr]; ok {
+				continue
+			}
+			used[addr] = m.Fqdn
+			m.address = netip.PrefixFrom(addr, pool.Bits())
+			assigned = true
+			break
+		}
+		if !assigned {
+			return fmt.Errorf("AddressPool %s is exhausted assigning %s", pool, m.Fqdn)
+		}
+	}
+	return nil
+}
+
+func addrOffset(base netip.Addr, offset uint64) netip.Addr {
+	b := base.AsSlice()
+	for i := len(b) - 1; i >= 0 && offset > 0; i-- {
+		sum := uint64(b[i]) + offset&0xff
+		b[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func isBroadcast(pool netip.Prefix, addr netip.Addr) bool {
+	if !addr.Is4() {
+		return false
+	}
+	next := addr.Next()
+	return !next.IsValid() || !pool.Contains(next)
+}
+
+// resolveGroup returns the fully inherited settings of a group, groups may themselves reference a parent group
+func (c *Config) resolveGroup(name string, seen map[string]bool) (*Machine, error) {
+	if seen[name] {
+		return nil, fmt.Errorf("group %s references itself", name)
+	}
+	seen[name] = true
+	group, ok := c.Groups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %s", name)
+	}
+	if group.Group == "" {
+		return util.DeepCopy(group), nil
+	}
+	retval, err := c.resolveGroup(group.Group, seen)
+	if err != nil {
+		return nil, err
+	}
+	util.Merge(retval, group)
+	return retval, nil
+}
+
+// ApplyGroups merges the settings of the referenced group into every machine, machine settings take precedence
+func (c *Config) ApplyGroups() error {
+	for i, m := range c.Machines {
+		if m.Group == "" {
+			continue
+		}
+		merged, err := c.resolveGroup(m.Group, make(map[string]bool))
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		util.Merge(merged, m)
+		c.Machines[i] = merged
+	}
+	return nil
+}
+
+// Merge layers other on top of c, machines sharing a Fqdn are merged field by field
+func (c *Config) Merge(other *Config) {
+	machines := c.Machines
+	c.Machines = nil
+	util.Merge(c, other)
+	c.Machines = machines
+	for _, m := range other.Machines {
+		found := false
+		for _, existing := range c.Machines {
+			if existing.Fqdn == m.Fqdn {
+				util.Merge(existing, m)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Machines = append(c.Machines, util.DeepCopy(m))
+		}
+	}
+}
+
+type ConfigDecoder interface {
+	Decode(interface{}) error
+}
+
+// StrictConfig rejects unknown fields in config files, a misspelled field would otherwise drop its setting silently
+var StrictConfig = true
+
+// ResolveDependencies points dependencies on configured VMs at their unit, DependencyUnit takes plain names for containers
+func (c *Config) ResolveDependencies() {
+	vms := make(map[string]bool)
+	for _, m := range c.Machines {
+		if m.IsVM() {
+			vms[m.Fqdn] = true
+		}
+	}
+	for _, m := range c.Machines {
+		for _, deps := range [][]string{m.After, m.Before, m.Requires, m.Wants} {
+			for i, dep := range deps {
+				if vms[dep] {
+					deps[i] = machineutil.MachineUnit(machineutil.ClassVM, dep)
+				}
+			}
+		}
+	}
+}
+
+// ParseTemplateRef splits "name@version" template references, a negative version means the newest one
+func ParseTemplateRef(ref string) (string, int, error) {
+	name, version, found := strings.Cut(ref, "@")
+	if !found {
+		return ref, -1, nil
+	}
+	ver, err := strconv.Atoi(version)
+	if err != nil || ver < 0 {
+		return "", 0, fmt.Errorf("invalid template version in %q", ref)
+	}
+	return name, ver, nil
+}
+
+// LoadConfig decodes all files in order, later files override and extend earlier ones
+func LoadConfig(configFiles []string, instance string) (*Config, error) {
+	config := &Config{}
+	hash := sha256.New()
+	for _, file := range configFiles {
+		layer, err := loadConfigFile(file, hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		config.Merge(layer)
+	}
+	config.hash = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if err := config.ApplyGroups(); err != nil {
+		return nil, err
+	}
+	if err := config.ApplyVars(); err != nil {
+		return nil, err
+	}
+	if err := config.ResolveVolumes(); err != nil {
+		return nil, err
+	}
+	// renames the machines before anything refers to them by fqdn
+	if err := config.ApplyInstance(instance); err != nil {
+		return nil, err
+	}
+	if config.Defaults != nil {
+		for _, m := range config.Machines {
+			config.Defaults.Apply(m)
+		}
+	}
+	if err := config.AssignAddresses(); err != nil {
+		return nil, err
+	}
+	config.ResolveDependencies()
+	for name, source := range config.TemplateSources {
+		if err := source.Validate(); err != nil {
+			return nil, fmt.Errorf("template source %s: %w", name, err)
+		}
+	}
+	// hooks and notifications aren't tied to a machine, they always run on the host
+	hooks := append(slices.Clone(config.PreRun), config.PostRun...)
+	if config.Notifications != nil {
+		if err := config.Notifications.Validate(); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, config.Notifications.Commands...)
+	}
+	for _, cmd := range hooks {
+		if err := cmd.validatePipe(); err != nil {
+			return nil, err
+		}
+		for _, stage := range cmd.stages() {
+			stage.Local = true
+			if err := stage.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, m := range config.Machines {
+		m.gateway = config.Gateway
+		m.dns = config.DNS
+		m.ssh = config.SSH
+	}
+	return config, nil
+}
+
+// loadConfigFile decodes a single file, its raw content is added to hash
+func loadConfigFile(configFile string, hash io.Writer) (*Config, error) {
+	var err error
+	var configReader io.Reader
+	switch configFile {
+	case "-":
+		slog.Info("Reading config from stdin")
+		configReader = os.Stdin
+	default:
+		slog.Info("Reading config from", "file", configFile)
+		f, err := os.Open(configFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		configReader = f
+	}
+	data, err := io.ReadAll(configReader)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(data)
+	configReader = bytes.NewReader(data)
+	var configDecoder ConfigDecoder
+	switch path.Ext(configFile) {
+	case ".json":
+		slog.Info("Using json decoder")
+		decoder := json.NewDecoder(configReader)
+		if StrictConfig {
+			decoder.DisallowUnknownFields()
+		}
+		configDecoder = decoder
+	default:
+		slog.Info("Using yaml decoder")
+		decoder := yaml.NewDecoder(configReader)
+		decoder.KnownFields(StrictConfig)
+		configDecoder = decoder
+	}
+	config := &Config{}
+	slog.Info("Decoding config")
+	err = configDecoder.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,247 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"gopkg.in/yaml.v3"
+)
+
+// Device gives the machine access to a host device node. The nspawn unit only allows a few devices,
+// DeviceAllow= in the override and the bind in the settings file have to agree.
+type Device struct {
+	// Path is a node below /dev, or char-<driver> and block-<driver> to allow a whole class without binding
+	Path string
+	// Permissions is a combination of r, w and m (mknod), rw when unset
+	Permissions string
+	// Bind makes the node appear in the machine at the same path, without it the machine has to create the node
+	Bind bool
+}
+
+func (d *Device) Validate() error {
+	class := strings.HasPrefix(d.Path, "char-") || strings.HasPrefix(d.Path, "block-")
+	switch {
+	case !class && (!path.IsAbs(d.Path) || !strings.HasPrefix(path.Clean(d.Path), "/dev/")):
+		return fmt.Errorf("device %q: Path must be below /dev or a char- or block- class", d.Path)
+	case class && d.Bind:
+		return fmt.Errorf("device %s: a class of devices can't be bound", d.Path)
+	case strings.Trim(d.Permissions, "rwm") != "":
+		return fmt.Errorf("device %s: invalid Permissions %q, expected a combination of r, w and m", d.Path, d.Permissions)
+	}
+	return nil
+}
+
+func (d *Device) permissions() string {
+	if d.Permissions == "" {
+		return "rw"
+	}
+	return d.Permissions
+}
+
+// GetNspawn binds the node into the machine, the user namespace leaves it owned by nobody unless mapped
+func (d *Device) GetNspawn() []*unit.UnitOption {
+	if !d.Bind {
+		return nil
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Files",
+			Name:    "Bind",
+			Value:   path.Clean(d.Path),
+		},
+	}
+}
+
+// GetOverride allows the device to the nspawn service, its DevicePolicy is closed
+func (d *Device) GetOverride() []*unit.UnitOption {
+	devicePath := d.Path
+	if path.IsAbs(devicePath) {
+		devicePath = path.Clean(devicePath)
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Service",
+			Name:    "DeviceAllow",
+			Value:   devicePath + " " + d.permissions(),
+		},
+	}
+}
+
+// gpuDir holds the DRM nodes of the host, render nodes are named renderD128 and up
+const gpuDir = "/dev/dri"
+
+// gpuGroup is the group inside the machine that gets access to the render nodes by default, systemd creates it on boot
+const gpuGroup = "render"
+
+// GPU hands render nodes of the host to the machine for compute and transcoding. The config sets it to
+// true for every render node present when the machine is started, to a list of nodes such as renderD128,
+// or to a mapping with those Nodes and the Group inside the machine that gets access, render by default.
+type GPU struct {
+	all   bool
+	nodes []string
+	group string
+}
+
+// gpuSettings is the mapping form of GPU, no Nodes means every render node
+type gpuSettings struct {
+	Nodes []string
+	Group string
+}
+
+func (g *GPU) set(settings gpuSettings) {
+	g.all = len(settings.Nodes) == 0
+	g.nodes = settings.Nodes
+	g.group = settings.Group
+}
+
+func (g *GPU) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Decode(&g.all)
+	case yaml.SequenceNode:
+		return value.Decode(&g.nodes)
+	case yaml.MappingNode:
+		var settings gpuSettings
+		if err := value.Decode(&settings); err != nil {
+			return err
+		}
+		g.set(settings)
+		return nil
+	}
+	return fmt.Errorf("line %d: GPU must be a boolean, a list of render nodes or a mapping", value.Line)
+}
+
+func (g *GPU) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &g.all); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &g.nodes); err == nil {
+		return nil
+	}
+	var settings gpuSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("GPU must be a boolean, a list of render nodes or a mapping")
+	}
+	g.set(settings)
+	return nil
+}
+
+// Enabled is false for GPU: false and an empty list
+func (g *GPU) Enabled() bool {
+	return g.all || len(g.nodes) > 0
+}
+
+// Paths resolves the nodes below /dev/dri, full paths such as /dev/nvidia0 are taken as is
+func (g *GPU) Paths() ([]string, error) {
+	if !g.all {
+		paths := make([]string, 0, len(g.nodes))
+		for _, node := range g.nodes {
+			if !path.IsAbs(node) {
+				node = path.Join(gpuDir, node)
+			}
+			paths = append(paths, path.Clean(node))
+		}
+		return paths, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(gpuDir, "renderD*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no render nodes in %s", gpuDir)
+	}
+	return paths, nil
+}
+
+// Devices binds and allows every node
+func (g *GPU) Devices() ([]*Device, error) {
+	paths, err := g.Paths()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*Device, 0, len(paths))
+	for _, node := range paths {
+		devices = append(devices, &Device{Path: node, Permissions: "rw", Bind: true})
+	}
+	return devices, nil
+}
+
+// GrantAccess maps the render group of a machine with a user namespace onto the nodes with an ACL,
+// the bound nodes keep the host group which shows up as nogroup inside. Without a user namespace the
+// machine sees the host group unchanged and nothing is granted, the guest ids would name host groups.
+func (g *GPU) GrantAccess(log *slog.Logger, machine *machineutil.Machine) error {
+	gid, err := g.hostGroup(log, machine)
+	if err != nil || gid < 0 {
+		return err
+	}
+	return g.setfacl(log, "Granting GPU access", "-m", "g:"+strconv.Itoa(gid)+":rw")
+}
+
+// RevokeAccess removes the ACL entry GrantAccess added. The shift is only known while the machine runs,
+// so it is called before stopping, a machine stopped behind machineutil's back keeps its entry.
+func (g *GPU) RevokeAccess(log *slog.Logger, machine *machineutil.Machine) error {
+	if !machine.Running() {
+		return nil
+	}
+	gid, err := g.hostGroup(log, machine)
+	if err != nil || gid < 0 {
+		return err
+	}
+	return g.setfacl(log, "Revoking GPU access", "-x", "g:"+strconv.Itoa(gid))
+}
+
+// hostGroup is the host gid the render group of the machine maps to, -1 when nothing is granted
+func (g *GPU) hostGroup(log *slog.Logger, machine *machineutil.Machine) (int, error) {
+	if !g.Enabled() {
+		return -1, nil
+	}
+	shift, err := machine.UIDShift()
+	if err != nil || shift == 0 {
+		return -1, err
+	}
+	root, err := machine.RootPath()
+	if err != nil {
+		return -1, err
+	}
+	group := g.group
+	if group == "" {
+		group = gpuGroup
+	}
+	gid, err := lookupID(root, "group", group)
+	if errors.Is(err, errNoSuchID) {
+		log.Warn("No GPU access, the machine has no such group", "group", group)
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return gid + shift, nil
+}
+
+// setfacl applies the ACL change to every node
+func (g *GPU) setfacl(log *slog.Logger, msg string, args ...string) error {
+	paths, err := g.Paths()
+	if err != nil {
+		return err
+	}
+	for _, node := range paths {
+		log.Debug(msg, "node", node, "entry", args[len(args)-1])
+		var stderr bytes.Buffer
+		cmd := exec.Command("setfacl", append(args, node)...)
+		cmd.Stderr = &stderr
+		if err := Commands.Run(cmd, nil, nil); err != nil {
+			return fmt.Errorf("setfacl %s: %w: %s", node, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return nil
+}
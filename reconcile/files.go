@@ -0,0 +1,180 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	FileWhenCreation = "creation"
+	FileWhenAlways   = "always"
+)
+
+var fileWhens = []string{"", FileWhenCreation, FileWhenAlways}
+
+// MachineFile is a file written into the machine with CopyTo
+type MachineFile struct {
+	Path string
+	// Content is written after placeholder expansion, Source names a host file copied as is instead
+	Content string
+	Source  string
+	// Owner is user or user:group as known inside the machine
+	Owner string
+	// Mode defaults to 0644
+	Mode os.FileMode
+	// When is creation, the default, to write the file into new machines only or always to restore it whenever it drifted
+	When string
+}
+
+func (f *MachineFile) Validate() error {
+	switch {
+	case !path.IsAbs(f.Path):
+		return fmt.Errorf("file %q: Path must be absolute", f.Path)
+	case f.Content != "" && f.Source != "":
+		return fmt.Errorf("file %s: both Content and Source configured", f.Path)
+	case !slices.Contains(fileWhens, f.When):
+		return fmt.Errorf("file %s: invalid When %q, expected %s or %s", f.Path, f.When, FileWhenCreation, FileWhenAlways)
+	}
+	return nil
+}
+
+func (f *MachineFile) mode() os.FileMode {
+	if f.Mode == 0 {
+		return 0644
+	}
+	return f.Mode.Perm()
+}
+
+// content returns what the file should contain
+func (f *MachineFile) content(env *CommandEnv) ([]byte, error) {
+	if f.Source != "" {
+		return os.ReadFile(f.Source)
+	}
+	return []byte(env.Expand(f.Content)), nil
+}
+
+// ownerIDs resolves Owner to the ids the file carries on the host, -1 leaves an id unchecked
+func (f *MachineFile) ownerIDs(root string, shift int) (int, int, error) {
+	if f.Owner == "" {
+		return -1, -1, nil
+	}
+	owner, group, found := strings.Cut(f.Owner, ":")
+	uid, err := lookupID(root, "passwd", owner)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid := -1
+	if found {
+		if gid, err = lookupID(root, "group", group); err != nil {
+			return 0, 0, err
+		}
+		gid += shift
+	}
+	return uid + shift, gid, nil
+}
+
+// drifted reports whether the file inside the machine differs from content, Mode or Owner
+func (f *MachineFile) drifted(machine *machineutil.Machine, content []byte) (bool, error) {
+	root, err := machine.RootPath()
+	if err != nil {
+		return false, err
+	}
+	file, err := util.OpenInRoot(root, f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != f.mode() {
+		return true, nil
+	}
+	shift, err := machine.UIDShift()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := f.ownerIDs(root, shift)
+	if err != nil {
+		return false, err
+	}
+	stat := info.Sys().(*unix.Stat_t)
+	if (uid >= 0 && uint32(uid) != stat.Uid) || (gid >= 0 && uint32(gid) != stat.Gid) {
+		return true, nil
+	}
+	current, err := io.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(current, content), nil
+}
+
+// write copies content into the machine and applies Mode and Owner
+func (f *MachineFile) write(env *CommandEnv, content []byte) error {
+	// the helpers don't count as commands that ran, the file is reported as written instead
+	defer func(ran int) { env.Ran = ran }(env.Ran)
+	run := func(args ...string) error {
+		cmd := &CommandDescription{Command: args}
+		return cmd.Run(env)
+	}
+	if err := run("mkdir", "-p", path.Dir(f.Path)); err != nil {
+		return err
+	}
+	if err := copyContent(env, string(content), f.Path); err != nil {
+		return err
+	}
+	if err := run("chmod", strconv.FormatUint(uint64(f.mode()), 8), f.Path); err != nil {
+		return err
+	}
+	if f.Owner != "" {
+		return run("chown", f.Owner, f.Path)
+	}
+	return nil
+}
+
+// ApplyFiles writes the Files due in this run, always files only when they drifted
+func (m *Machine) ApplyFiles(env *CommandEnv, changes *ChangeSet) error {
+	for _, f := range m.Files {
+		if f.When != FileWhenAlways && !m.runCreation {
+			continue
+		}
+		content, err := f.content(env)
+		if err != nil {
+			return fmt.Errorf("file %s: %w", f.Path, err)
+		}
+		if f.When == FileWhenAlways && !m.runCreation {
+			drifted, err := f.drifted(env.Machine, content)
+			if err != nil {
+				return fmt.Errorf("file %s: %w", f.Path, err)
+			}
+			if !drifted {
+				continue
+			}
+			slog.Info("Restoring drifted file", "machine", m.Fqdn, "path", f.Path)
+		} else {
+			slog.Info("Writing file", "machine", m.Fqdn, "path", f.Path)
+		}
+		if err := f.write(env, content); err != nil {
+			return fmt.Errorf("file %s: %w", f.Path, err)
+		}
+		changes.FilesWritten = append(changes.FilesWritten, f.Path)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// gcRoots are searched for generated files, the same for persistent and runtime units
+var gcRoots = []string{"/etc/systemd", "/run/systemd"}
+
+// Orphan is a generated file neither the config nor an existing image accounts for
+type Orphan struct {
+	Path string
+	// Owner is the machine the file was generated for, empty for mounts which can be shared
+	Owner string
+	// Unit is stopped and disabled before the file is removed, empty for drop-ins and settings files
+	Unit string
+	// Labels the owner had, recorded in its settings file or VM unit
+	Labels map[string]string
+}
+
+func (o *Orphan) runtime() bool { return strings.HasPrefix(o.Path, "/run/") }
+
+// generatedFile is a file found on disk carrying the machineutil marker
+type generatedFile struct {
+	Orphan
+	options []*unit.UnitOption
+	// zone is set for the host networkd file of a zone, machines refer to it by their Zone setting
+	zone string
+}
+
+// findGenerated lists every file in root written by machineutil
+func findGenerated(root string) ([]*generatedFile, error) {
+	files := []*generatedFile{}
+	system := filepath.Join(root, "system")
+	names, err := util.Files.ReadDir(system)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range names {
+		path := filepath.Join(system, name)
+		machine, found := strings.CutPrefix(name, "systemd-nspawn@")
+		if !found {
+			machine, found = strings.CutPrefix(name, "systemd-vmspawn@")
+		}
+		if found && strings.HasSuffix(machine, ".service.d") {
+			machine = strings.TrimSuffix(machine, ".service.d")
+			for _, dropIn := range []string{"machineutil.conf", "resources.conf"} {
+				opts, err := util.ReadUnit(filepath.Join(path, dropIn), false)
+				if err != nil {
+					return nil, err
+				}
+				if util.IsGenerated(opts) {
+					files = append(files, &generatedFile{Orphan: Orphan{Path: filepath.Join(path, dropIn), Owner: machine}, options: opts})
+				}
+			}
+			continue
+		}
+		ext := filepath.Ext(name)
+		if ext != ".mount" && ext != ".automount" && ext != ".service" && ext != ".socket" && ext != ".slice" {
+			continue
+		}
+		opts, err := util.ReadUnit(path, false)
+		if err != nil {
+			// hand written units don't have to be readable for us
+			continue
+		}
+		if !util.IsGenerated(opts) {
+			continue
+		}
+		description := ""
+		for _, opt := range opts {
+			if opt.Section == "Unit" && opt.Name == "Description" {
+				description = opt.Value
+			}
+		}
+		file := &generatedFile{Orphan: Orphan{Path: path, Unit: name}, options: opts}
+		if strings.HasPrefix(name, "machineutil-proxy-") {
+			_, file.Owner, _ = strings.Cut(description, " to ")
+		}
+		// the unit of a VM takes the place of the settings file of a container
+		if vm, found := strings.CutPrefix(name, "systemd-vmspawn@"); found {
+			file.Owner = strings.TrimSuffix(vm, ".service")
+		}
+		files = append(files, file)
+	}
+	// the journald.conf of a namespace is named after its machine
+	names, err = util.Files.ReadDir(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range names {
+		machine, found := strings.CutPrefix(name, "journald@")
+		if !found || !strings.HasSuffix(machine, ".conf") {
+			continue
+		}
+		path := filepath.Join(root, name)
+		opts, err := util.ReadUnit(path, false)
+		if err != nil || !util.IsGenerated(opts) {
+			continue
+		}
+		files = append(files, &generatedFile{Orphan: Orphan{Path: path, Owner: strings.TrimSuffix(machine, ".conf")}, options: opts})
+	}
+	nspawn := filepath.Join(root, "nspawn")
+	names, err = util.Files.ReadDir(nspawn)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range names {
+		machine, found := strings.CutSuffix(name, ".nspawn")
+		if !found {
+			continue
+		}
+		path := filepath.Join(nspawn, name)
+		opts, err := util.ReadUnit(path, false)
+		if err != nil || !util.IsGenerated(opts) {
+			continue
+		}
+		files = append(files, &generatedFile{Orphan: Orphan{Path: path, Owner: machine}, options: opts})
+	}
+	network := filepath.Join(root, "network")
+	names, err = util.Files.ReadDir(network)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range names {
+		zone, found := strings.CutPrefix(name, zoneNetworkPrefix)
+		if !found || !strings.HasSuffix(zone, ".network") {
+			continue
+		}
+		path := filepath.Join(network, name)
+		opts, err := util.ReadUnit(path, false)
+		if err != nil || !util.IsGenerated(opts) {
+			continue
+		}
+		files = append(files, &generatedFile{Orphan: Orphan{Path: path}, options: opts, zone: strings.TrimSuffix(zone, ".network")})
+	}
+	return files, nil
+}
+
+// referenced reports whether any of the options names unit or the path it mounts
+func referenced(opts []*unit.UnitOption, file *generatedFile) bool {
+	where := ""
+	for _, opt := range file.options {
+		if opt.Name == "Where" {
+			where = opt.Value
+		}
+	}
+	for _, opt := range opts {
+		for _, value := range strings.Fields(opt.Value) {
+			if value == file.Unit || (where != "" && value == where) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Orphans finds generated files whose machine is neither configured nor has an image anymore.
+// Mounts and slices have no owner, they are orphaned once no kept file refers to them and they aren't active.
+// Zone networks are orphaned once neither this config nor a kept machine names their zone.
+func (r *Reconciler) Orphans() ([]*Orphan, error) {
+	expected := make(map[string]bool)
+	configured := make(map[string]bool)
+	for _, m := range r.Config.Machines {
+		configured[m.Fqdn] = true
+		normalized := util.DeepCopy(m)
+		if err := normalized.Normalize(); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Fqdn, err)
+		}
+		files, err := normalized.UnitFiles()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Fqdn, err)
+		}
+		for _, file := range files {
+			expected[file.Path] = true
+		}
+	}
+	for name := range r.Config.Slices {
+		name, err := sliceName(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range slicePaths(name) {
+			expected[path] = true
+		}
+	}
+	for zone := range r.Config.Zones {
+		for _, path := range zoneNetworkPaths(zone) {
+			expected[path] = true
+		}
+	}
+	found := []*generatedFile{}
+	for _, root := range gcRoots {
+		files, err := findGenerated(root)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, files...)
+	}
+	exists := make(map[string]bool)
+	kept := []*unit.UnitOption{}
+	orphans := []*Orphan{}
+	for _, file := range found {
+		if file.Owner == "" {
+			continue
+		}
+		if _, ok := exists[file.Owner]; !ok {
+			_, err := r.State.Manager.GetImage(file.Owner)
+			if err != nil && !errors.Is(err, machineutil.ErrNoSuchImage) {
+				return nil, err
+			}
+			exists[file.Owner] = err == nil
+		}
+		if configured[file.Owner] || exists[file.Owner] {
+			kept = append(kept, file.options...)
+			continue
+		}
+		if labels := util.ParseLabels(file.options); len(labels) > 0 {
+			file.Labels = labels
+		}
+		orphans = append(orphans, &file.Orphan)
+	}
+	// automounts, mounts and slices are referenced by the machines, encrypted volumes by their mounts.
+	// A slice of another config stays while its machines run in it or name it.
+	for _, kinds := range [][]string{{".automount", ".slice"}, {".mount"}, {".service"}} {
+		keep := []*unit.UnitOption{}
+		for _, file := range found {
+			if file.Owner != "" || !slices.Contains(kinds, filepath.Ext(file.Unit)) {
+				continue
+			}
+			if expected[file.Path] || referenced(kept, file) {
+				keep = append(keep, file.options...)
+				continue
+			}
+			state, err := r.State.Manager.UnitState(file.Unit)
+			if err != nil {
+				return nil, err
+			}
+			if state.ActiveState != "inactive" && !state.Failed() {
+				slog.Warn("Keeping unreferenced unit while it is active", "unit", file.Unit)
+				keep = append(keep, file.options...)
+				continue
+			}
+			orphans = append(orphans, &file.Orphan)
+		}
+		kept = append(kept, keep...)
+	}
+	// the bridge of a zone of another config stays while one of its machines names the zone
+	zones := make(map[string]bool)
+	for _, opt := range kept {
+		if opt.Name == "Zone" {
+			zones[opt.Value] = true
+		}
+	}
+	for _, file := range found {
+		if file.zone != "" && !expected[file.Path] && !zones[file.zone] {
+			orphans = append(orphans, &file.Orphan)
+		}
+	}
+	return orphans, nil
+}
+
+// CollectGarbage stops and removes the orphans, drop-in directories left empty go with them
+func (r *Reconciler) CollectGarbage(orphans []*Orphan) error {
+	manager := r.State.Manager
+	for _, orphan := range orphans {
+		log := slog.With("file", orphan.Path)
+		if orphan.Unit != "" {
+			log.Info("Stopping", "unit", orphan.Unit)
+			job, err := manager.Stop(orphan.Unit)
+			if err == nil {
+				err = job.Wait()
+			}
+			if err != nil {
+				return fmt.Errorf("stopping %s: %w", orphan.Unit, err)
+			}
+			if _, err := manager.DisableUnit(orphan.Unit, orphan.runtime()); err != nil {
+				return fmt.Errorf("disabling %s: %w", orphan.Unit, err)
+			}
+		}
+		log.Info("Removing orphaned file", "machine", orphan.Owner)
+		if err := util.Files.Remove(orphan.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if dir := filepath.Dir(orphan.Path); strings.HasSuffix(dir, ".d") {
+			if names, err := util.Files.ReadDir(dir); err == nil && len(names) == 0 {
+				util.Files.Remove(dir)
+			}
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	if r.Config.Firewall != nil {
+		machines := []string{}
+		for _, orphan := range orphans {
+			if orphan.Owner != "" && !slices.Contains(machines, orphan.Owner) {
+				machines = append(machines, orphan.Owner)
+			}
+		}
+		if err := r.Config.Firewall.RemoveChains(slog.Default(), machines); err != nil {
+			return err
+		}
+	}
+	for _, orphan := range orphans {
+		if strings.HasPrefix(orphan.Path, util.NetworkdDir+"/") || strings.HasPrefix(orphan.Path, util.NetworkdRuntimeDir+"/") {
+			if err := manager.NetworkdReload(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return manager.DaemonReload()
+}
@@ -0,0 +1,90 @@
+package reconcile
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// JournalLimits keeps a chatty machine from flooding the host journal. The limits apply to what reaches the
+// host through the nspawn service, a journal linked with LinkJournal is written by the machine itself.
+type JournalLimits struct {
+	// RateLimitInterval and RateLimitBurst throttle the messages of the machine, e.g. 30s and 1000
+	RateLimitInterval string
+	RateLimitBurst    *int
+	// Namespace logs the machine to a journald namespace named after it, see journalctl --namespace
+	Namespace bool
+	// MaxUse and MaxFileSize bound the disk space of the namespace, e.g. 512M
+	MaxUse      string
+	MaxFileSize string
+}
+
+func (j *JournalLimits) Validate() error {
+	if j.RateLimitBurst != nil && *j.RateLimitBurst < 0 {
+		return errors.New("journal RateLimitBurst can't be negative")
+	}
+	if !j.Namespace && (j.MaxUse != "" || j.MaxFileSize != "") {
+		return errors.New("journal MaxUse and MaxFileSize need a Namespace, the host journal is shared")
+	}
+	return nil
+}
+
+// GetOverride throttles the nspawn service and points it at the namespace
+func (j *JournalLimits) GetOverride(namespace string) []*unit.UnitOption {
+	opts := []*unit.UnitOption{}
+	if j.RateLimitInterval != "" {
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: "LogRateLimitIntervalSec", Value: j.RateLimitInterval})
+	}
+	if j.RateLimitBurst != nil {
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: "LogRateLimitBurst", Value: strconv.Itoa(*j.RateLimitBurst)})
+	}
+	if j.Namespace {
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: "LogNamespace", Value: namespace})
+	}
+	return opts
+}
+
+// namespaceOptions are the journald.conf of the namespace, a namespace without limits needs none
+func (j *JournalLimits) namespaceOptions() []*unit.UnitOption {
+	if j == nil || !j.Namespace {
+		return nil
+	}
+	opts := []*unit.UnitOption{}
+	if j.MaxUse != "" {
+		opts = append(opts, &unit.UnitOption{Section: "Journal", Name: "SystemMaxUse", Value: j.MaxUse})
+	}
+	if j.MaxFileSize != "" {
+		opts = append(opts, &unit.UnitOption{Section: "Journal", Name: "SystemMaxFileSize", Value: j.MaxFileSize})
+	}
+	return opts
+}
+
+// JournalConfPath is the journald.conf of the namespace of m, named after the machine
+func (m *Machine) JournalConfPath() string {
+	dir := "/etc/systemd"
+	if m.Runtime {
+		dir = "/run/systemd"
+	}
+	return filepath.Join(dir, "journald@"+m.Fqdn+".conf")
+}
+
+// EnsureJournalNamespace writes or removes the journald.conf of the namespace. The namespace journald is
+// stopped on changes, its sockets start it again with the new limits.
+func (m *Machine) EnsureJournalNamespace(log *slog.Logger, manager machineutil.MachineUtil, changes *ChangeSet) (bool, error) {
+	file := m.JournalConfPath()
+	changed, err := changes.Track(file, func() (bool, error) { return util.EnsureUnit(log, file, m.Journal.namespaceOptions()) })
+	if err != nil || !changed {
+		return changed, err
+	}
+	log.Info("Restarting journald namespace", "namespace", m.Fqdn)
+	job, err := manager.Stop("systemd-journald@" + m.Fqdn + ".service")
+	if err != nil {
+		return changed, err
+	}
+	return changed, job.Wait()
+}
@@ -0,0 +1,118 @@
+package reconcile
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// timezoneModes are the values of nspawn's Timezone=, anything else names a zone written into the image
+var timezoneModes = []string{"auto", "copy", "bind", "symlink", "delete", "off"}
+
+var (
+	timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	localePattern   = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+)
+
+// localeConf is where systemd and most distributions look for the system locale
+const localeConf = "/etc/locale.conf"
+
+// localtime links to the zone below zoneinfo
+const (
+	localtime = "/etc/localtime"
+	zoneinfo  = "/usr/share/zoneinfo"
+)
+
+// timezoneZone is the zone Timezone names, empty for one of the modes of nspawn
+func (m *Machine) timezoneZone() string {
+	if slices.Contains(timezoneModes, m.Timezone) {
+		return ""
+	}
+	return m.Timezone
+}
+
+// normalizeRegion checks Timezone and Locale and turns the mode of Timezone into the setting of nspawn.
+// nspawn is told to leave /etc/localtime alone for a zone, EnsureRegion writes it into the image.
+func (m *Machine) normalizeRegion() error {
+	if m.Timezone != "" {
+		mode := m.Timezone
+		if zone := m.timezoneZone(); zone != "" {
+			if !timezonePattern.MatchString(zone) || strings.Contains(zone, "..") {
+				return fmt.Errorf("invalid Timezone %q, expected a zone such as Europe/Helsinki or one of %s", zone, strings.Join(timezoneModes, ", "))
+			}
+			mode = "off"
+		}
+		m.Options = append(m.Options, &unit.UnitOption{Section: "Exec", Name: "Timezone", Value: mode})
+	}
+	if m.Locale != "" && !localePattern.MatchString(m.Locale) {
+		return fmt.Errorf("invalid Locale %q, expected a locale such as en_US.UTF-8", m.Locale)
+	}
+	return nil
+}
+
+// EnsureRegion writes the zone of Timezone and the Locale into the image with systemd-firstboot, so they are in
+// place before the first boot and follow later changes. Directory images are only touched when a setting differs,
+// raw images can't be inspected without mounting them and are only written at creation.
+func (m *Machine) EnsureRegion(log *slog.Logger, manager machineutil.MachineUtil) (bool, error) {
+	zone := m.timezoneZone()
+	if zone == "" && m.Locale == "" {
+		return false, nil
+	}
+	image, err := manager.ImagePath(m.Fqdn)
+	if err != nil {
+		return false, err
+	}
+	info, err := util.Files.Stat(image)
+	if err != nil {
+		return false, err
+	}
+	args := []string{"--force"}
+	if info.IsDir() {
+		args = append(args, "--root="+image)
+		if zone != "" {
+			if _, err := util.Files.Stat(filepath.Join(image, zoneinfo, zone)); err != nil {
+				return false, fmt.Errorf("timezone %s isn't installed in the machine: %w", zone, err)
+			}
+			if target, _ := os.Readlink(filepath.Join(image, localtime)); !strings.HasSuffix(target, zoneinfo+"/"+zone) {
+				args = append(args, "--timezone="+zone)
+			}
+		}
+		if m.Locale != "" {
+			if data, _ := util.Files.ReadFile(filepath.Join(image, localeConf)); string(data) != "LANG="+m.Locale+"\n" {
+				args = append(args, "--locale="+m.Locale)
+			}
+		}
+		if len(args) == 2 {
+			return false, nil
+		}
+	} else {
+		if !m.runCreation {
+			return false, nil
+		}
+		args = append(args, "--image="+image)
+		if zone != "" {
+			args = append(args, "--timezone="+zone)
+		}
+		if m.Locale != "" {
+			args = append(args, "--locale="+m.Locale)
+		}
+	}
+	log.Info("Setting timezone and locale", "timezone", zone, "locale", m.Locale)
+	var stderr bytes.Buffer
+	cmd := exec.Command("systemd-firstboot", args...)
+	cmd.Stderr = &stderr
+	if err := Commands.Run(cmd, nil, nil); err != nil {
+		return false, fmt.Errorf("systemd-firstboot: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
@@ -0,0 +1,1506 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/probe"
+	"github.com/eax255/systemd-containers/machineutil/util"
+	"github.com/godbus/dbus/v5"
+)
+
+type Resources struct {
+	CPUQuota   string
+	CPUWeight  string
+	MemoryHigh string
+	MemoryMax  string
+	TasksMax   string
+	IOWeight   string
+}
+
+// GetOverride is written to the resources drop-in, nil removes it
+func (r *Resources) GetOverride() []*unit.UnitOption {
+	return r.options("Service")
+}
+
+// options are the limits as settings of section, Service for machines and Slice for slice units
+func (r *Resources) options(section string) []*unit.UnitOption {
+	if r == nil {
+		return nil
+	}
+	opts := []*unit.UnitOption{}
+	settings := []struct {
+		name  string
+		value string
+	}{
+		{"CPUQuota", r.CPUQuota},
+		{"CPUWeight", r.CPUWeight},
+		{"MemoryHigh", r.MemoryHigh},
+		{"MemoryMax", r.MemoryMax},
+		{"TasksMax", r.TasksMax},
+		{"IOWeight", r.IOWeight},
+	}
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		opts = append(opts, &unit.UnitOption{
+			Section: section,
+			Name:    setting.name,
+			Value:   setting.value,
+		})
+	}
+	return opts
+}
+
+// resourceSettings are the settings of Resources, systemd names the drop-ins of runtime properties after them
+var resourceSettings = []string{"CPUQuota", "CPUWeight", "MemoryHigh", "MemoryMax", "TasksMax", "IOWeight"}
+
+// movesResources reports whether writing opts to the override file only drops the limits now kept in the resources
+// drop-in, as on the first run after upgrading from versions keeping them in the override. The unit stays the same.
+func movesResources(file string, opts, resources []*unit.UnitOption) (bool, error) {
+	old, err := util.ReadUnit(file, true)
+	if err != nil || len(resources) == 0 {
+		return false, err
+	}
+	opts = util.WithMarker(opts)
+	slices.SortFunc(opts, util.CompareOptions)
+	add, _, remove := util.SliceDiffFunc(opts, old, util.CompareOptions)
+	if len(remove) == 0 || slices.ContainsFunc(add, func(opt *unit.UnitOption) bool { return opt.Name != util.Marker }) {
+		return false, nil
+	}
+	for _, opt := range remove {
+		if !slices.ContainsFunc(resources, func(r *unit.UnitOption) bool { return util.CompareOptions(r, opt) == 0 }) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// runtimeUnset is how the D-Bus API spells infinity and "use the default" for all resource properties
+const runtimeUnset = ^uint64(0)
+
+// RuntimeProperties converts the limits into properties of a running unit, unset limits are reset.
+// Percentages of memory and tasks and the idle CPU weight can't be converted without the host values, they need a restart.
+func (r *Resources) RuntimeProperties() (map[string]dbus.Variant, error) {
+	if r == nil {
+		r = &Resources{}
+	}
+	props := make(map[string]dbus.Variant)
+	if r.CPUQuota == "" {
+		props["CPUQuotaPerSecUSec"] = dbus.MakeVariant(runtimeUnset)
+	} else {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(r.CPUQuota, "%"), 64)
+		if err != nil || !strings.HasSuffix(r.CPUQuota, "%") || percent <= 0 {
+			return nil, fmt.Errorf("invalid CPUQuota %q", r.CPUQuota)
+		}
+		props["CPUQuotaPerSecUSec"] = dbus.MakeVariant(uint64(percent * 10000))
+	}
+	values := []struct {
+		name  string
+		value string
+		size  bool
+	}{
+		{"CPUWeight", r.CPUWeight, false},
+		{"MemoryHigh", r.MemoryHigh, true},
+		{"MemoryMax", r.MemoryMax, true},
+		{"TasksMax", r.TasksMax, false},
+		{"IOWeight", r.IOWeight, false},
+	}
+	for _, v := range values {
+		n := runtimeUnset
+		var err error
+		switch {
+		case v.value == "" || v.value == "infinity":
+		case v.size:
+			n, err = util.ParseSize(v.value)
+		default:
+			n, err = strconv.ParseUint(v.value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %q can't be changed at runtime: %w", v.name, v.value, err)
+		}
+		props[v.name] = dbus.MakeVariant(n)
+	}
+	return props, nil
+}
+
+// SystemCallProfiles are predefined nspawn SystemCallFilter= lines, a leading ~ turns a line into a deny list
+var SystemCallProfiles = map[string][]string{
+	"default": {},
+	"strict": {
+		"~@clock @cpu-emulation @debug @module @obsolete @raw-io @reboot @swap",
+		"~add_key keyctl request_key",
+	},
+	"no-new-kernel-keys": {
+		"~add_key keyctl request_key",
+	},
+}
+
+type SystemCalls struct {
+	Profile       string
+	Filter        []string
+	Architectures []string
+}
+
+func (sc *SystemCalls) GetNspawn() ([]*unit.UnitOption, error) {
+	filters := []string{}
+	if sc.Profile != "" {
+		profile, ok := SystemCallProfiles[sc.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown system call profile %q", sc.Profile)
+		}
+		filters = append(filters, profile...)
+	}
+	filters = append(filters, sc.Filter...)
+	opts := []*unit.UnitOption{}
+	for _, filter := range filters {
+		opts = append(opts, &unit.UnitOption{
+			Section: "Exec",
+			Name:    "SystemCallFilter",
+			Value:   filter,
+		})
+	}
+	return opts, nil
+}
+
+// GetOverride restricts the architectures of the nspawn service, nspawn itself has no equivalent setting
+func (sc *SystemCalls) GetOverride() []*unit.UnitOption {
+	if len(sc.Architectures) == 0 {
+		return nil
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Service",
+			Name:    "SystemCallArchitectures",
+			Value:   strings.Join(sc.Architectures, " "),
+		},
+	}
+}
+
+// delegateControllers are the cgroup controllers systemd can delegate
+var delegateControllers = []string{"cpu", "cpuacct", "cpuset", "io", "blkio", "memory", "devices", "pids"}
+
+// Delegation restricts the cgroup controllers handed to the machine, its unit delegates all of them otherwise.
+// Machines running systemd or a container runtime inside need the controllers those manage.
+type Delegation struct {
+	Controllers []string
+	// Subgroup is the cgroup below the delegated one the machine starts in, DelegateSubgroup= needs systemd 254
+	Subgroup string
+}
+
+func (d *Delegation) GetOverride() ([]*unit.UnitOption, error) {
+	opts := []*unit.UnitOption{}
+	for _, controller := range d.Controllers {
+		if !slices.Contains(delegateControllers, controller) {
+			return nil, fmt.Errorf("invalid Delegate controller %q, expected one of %s", controller, strings.Join(delegateControllers, ", "))
+		}
+	}
+	if len(d.Controllers) > 0 {
+		// the empty assignment drops the controllers the unit delegates by default
+		opts = append(opts,
+			&unit.UnitOption{Section: "Service", Name: "Delegate", Value: ""},
+			&unit.UnitOption{Section: "Service", Name: "Delegate", Value: strings.Join(d.Controllers, " ")},
+		)
+	}
+	if d.Subgroup != "" {
+		if strings.Contains(d.Subgroup, "/") || d.Subgroup == "." || d.Subgroup == ".." || strings.HasPrefix(d.Subgroup, "cgroup.") {
+			return nil, fmt.Errorf("invalid Delegate subgroup %q, expected a single cgroup name", d.Subgroup)
+		}
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: "DelegateSubgroup", Value: d.Subgroup})
+	}
+	return opts, nil
+}
+
+// Scheduling policies and IO classes systemd accepts for the nspawn service
+var (
+	cpuSchedulingPolicies = []string{"other", "batch", "idle", "fifo", "rr"}
+	ioSchedulingClasses   = []string{"realtime", "best-effort", "idle"}
+)
+
+var cpuAffinityPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+// Scheduling sets how the machine competes for CPU time and IO with the rest of the host.
+// Everything inside inherits it from nspawn, changes need a restart of the machine.
+type Scheduling struct {
+	// Nice is -20 (first) to 19 (last)
+	Nice *int
+	// CPUSchedulingPolicy is one of other, batch, idle, fifo and rr
+	CPUSchedulingPolicy string
+	// CPUSchedulingPriority is 1 to 99 for fifo and rr
+	CPUSchedulingPriority *int
+	// IOSchedulingClass is one of realtime, best-effort and idle
+	IOSchedulingClass string
+	// IOSchedulingPriority is 0 (first) to 7 (last)
+	IOSchedulingPriority *int
+	// CPUAffinity lists CPUs and ranges such as 0-3
+	CPUAffinity []string
+}
+
+func (s *Scheduling) GetOverride() ([]*unit.UnitOption, error) {
+	opts := []*unit.UnitOption{}
+	add := func(name, value string) {
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: name, Value: value})
+	}
+	if s.Nice != nil {
+		if *s.Nice < -20 || *s.Nice > 19 {
+			return nil, fmt.Errorf("invalid Nice %d, expected -20 to 19", *s.Nice)
+		}
+		add("Nice", strconv.Itoa(*s.Nice))
+	}
+	if s.CPUSchedulingPolicy != "" {
+		if !slices.Contains(cpuSchedulingPolicies, s.CPUSchedulingPolicy) {
+			return nil, fmt.Errorf("invalid CPUSchedulingPolicy %q, expected one of %s", s.CPUSchedulingPolicy, strings.Join(cpuSchedulingPolicies, ", "))
+		}
+		add("CPUSchedulingPolicy", s.CPUSchedulingPolicy)
+	}
+	if s.CPUSchedulingPriority != nil {
+		if s.CPUSchedulingPolicy != "fifo" && s.CPUSchedulingPolicy != "rr" {
+			return nil, errors.New("CPUSchedulingPriority needs CPUSchedulingPolicy fifo or rr")
+		}
+		if *s.CPUSchedulingPriority < 1 || *s.CPUSchedulingPriority > 99 {
+			return nil, fmt.Errorf("invalid CPUSchedulingPriority %d, expected 1 to 99", *s.CPUSchedulingPriority)
+		}
+		add("CPUSchedulingPriority", strconv.Itoa(*s.CPUSchedulingPriority))
+	}
+	if s.IOSchedulingClass != "" {
+		if !slices.Contains(ioSchedulingClasses, s.IOSchedulingClass) {
+			return nil, fmt.Errorf("invalid IOSchedulingClass %q, expected one of %s", s.IOSchedulingClass, strings.Join(ioSchedulingClasses, ", "))
+		}
+		add("IOSchedulingClass", s.IOSchedulingClass)
+	}
+	if s.IOSchedulingPriority != nil {
+		if *s.IOSchedulingPriority < 0 || *s.IOSchedulingPriority > 7 {
+			return nil, fmt.Errorf("invalid IOSchedulingPriority %d, expected 0 to 7", *s.IOSchedulingPriority)
+		}
+		// the idle class has no priorities
+		if s.IOSchedulingClass == "idle" {
+			return nil, errors.New("IOSchedulingPriority can't be used with IOSchedulingClass idle")
+		}
+		add("IOSchedulingPriority", strconv.Itoa(*s.IOSchedulingPriority))
+	}
+	if len(s.CPUAffinity) > 0 {
+		for _, cpus := range s.CPUAffinity {
+			if !cpuAffinityPattern.MatchString(cpus) {
+				return nil, fmt.Errorf("invalid CPUAffinity %q, expected a CPU or a range such as 0-3", cpus)
+			}
+		}
+		add("CPUAffinity", strings.Join(s.CPUAffinity, " "))
+	}
+	return opts, nil
+}
+
+type UserDataUser struct {
+	Name              string
+	Groups            []string
+	Shell             string
+	SshAuthorizedKeys []string
+}
+
+func (u *UserDataUser) Home() string {
+	if u.Name == "root" {
+		return "/root"
+	}
+	return "/home/" + u.Name
+}
+
+type UserDataFile struct {
+	Path        string
+	Content     string
+	Owner       string
+	Permissions os.FileMode
+}
+
+type UserData struct {
+	Users      []*UserDataUser
+	WriteFiles []*UserDataFile
+	RunCmd     [][]string
+}
+
+// copyContent writes content to dst inside the machine, replacing the file if it exists
+func copyContent(env *CommandEnv, content string, dst string) error {
+	f, err := os.CreateTemp("", "machineutil-userdata-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	slog.Debug("Copying user-data", "machine", env.Machine.Name, "destination", dst)
+	err = env.Machine.CopyToReplace(f.Name(), dst)
+	if !errors.Is(err, machineutil.ErrNoCopyReplace) {
+		return err
+	}
+	// older machined only copy to new paths, the copy is moved over dst inside the machine
+	defer func(ran int) { env.Ran = ran }(env.Ran)
+	tmp := dst + ".machineutil-new"
+	rm := &CommandDescription{Command: []string{"rm", "-f", tmp}}
+	if err := rm.Run(env); err != nil {
+		return err
+	}
+	if err := env.Machine.CopyTo(f.Name(), tmp); err != nil {
+		return err
+	}
+	mv := &CommandDescription{Command: []string{"mv", "-f", tmp, dst}}
+	return mv.Run(env)
+}
+
+func installAuthorizedKeys(env *CommandEnv, user *UserDataUser, keys []string) error {
+	run := func(args ...string) error {
+		cmd := &CommandDescription{Command: args}
+		return cmd.Run(env)
+	}
+	ssh_dir := user.Home() + "/.ssh"
+	if err := run("install", "-d", "-m", "0700", "-o", user.Name, "-g", user.Name, ssh_dir); err != nil {
+		return err
+	}
+	// keys are appended unless already present, so UserData and AuthorizedKeys for the same user add up
+	// and keys installed by hand are kept
+	script := `f=$1; shift; touch "$f"; for k; do grep -qxF -- "$k" "$f" || printf '%s\n' "$k" >>"$f"; done`
+	if err := run(append([]string{"sh", "-c", script, "sh", ssh_dir + "/authorized_keys"}, keys...)...); err != nil {
+		return err
+	}
+	if err := run("chown", user.Name+":"+user.Name, ssh_dir+"/authorized_keys"); err != nil {
+		return err
+	}
+	return run("chmod", "0600", ssh_dir+"/authorized_keys")
+}
+
+// readAuthorizedKeys resolves entries that are paths to key files, anything else is taken as an inline key
+func readAuthorizedKeys(entries []string) ([]string, error) {
+	keys := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, "/") && !strings.HasPrefix(entry, "~/") && !strings.HasPrefix(entry, "./") {
+			keys = append(keys, strings.TrimSpace(entry))
+			continue
+		}
+		file := entry
+		if strings.HasPrefix(file, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			file = filepath.Join(home, file[2:])
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading authorized keys: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (u *UserData) Apply(env *CommandEnv) error {
+	run := func(args ...string) error {
+		cmd := &CommandDescription{Command: args}
+		return cmd.Run(env)
+	}
+	for _, user := range u.Users {
+		if user.Name != "root" {
+			args := []string{"useradd", "-m"}
+			if user.Shell != "" {
+				args = append(args, "-s", user.Shell)
+			}
+			if len(user.Groups) > 0 {
+				args = append(args, "-G", strings.Join(user.Groups, ","))
+			}
+			args = append(args, user.Name)
+			if err := run(args...); err != nil {
+				return fmt.Errorf("creating user %s: %w", user.Name, err)
+			}
+		}
+		if len(user.SshAuthorizedKeys) == 0 {
+			continue
+		}
+		if err := installAuthorizedKeys(env, user, user.SshAuthorizedKeys); err != nil {
+			return err
+		}
+	}
+	for _, file := range u.WriteFiles {
+		if err := run("mkdir", "-p", path.Dir(file.Path)); err != nil {
+			return err
+		}
+		if err := copyContent(env, file.Content, file.Path); err != nil {
+			return err
+		}
+		mode := file.Permissions
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := run("chmod", strconv.FormatUint(uint64(mode), 8), file.Path); err != nil {
+			return err
+		}
+		if file.Owner != "" {
+			if err := run("chown", file.Owner, file.Path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, args := range u.RunCmd {
+		if len(args) == 0 {
+			continue
+		}
+		if err := run(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Machine struct {
+	Group         string
+	Labels        map[string]string
+	InventoryVars map[string]interface{}
+	// Vars fill placeholders in commands, files and unit settings, they are merged with the group and global Vars
+	Vars     map[string]string
+	Template string
+	// Architecture selects templates built for it, e.g. arm64 for name-template-arm64_<version>, instead of
+	// those for the host. Templates without an architecture suffix are used for every architecture.
+	Architecture     string
+	Fqdn             string
+	Class            string
+	VM               *VirtualMachine
+	Options          []*unit.UnitOption
+	Overrides        []*unit.UnitOption
+	Mounts           []*MountPoint
+	Resources        *Resources
+	Zone             string
+	Ports            []*PortForward
+	ProxySockets     []*ProxySocket
+	OnDemand         bool
+	Capabilities     []string
+	DropCapabilities []string
+	SystemCalls      *SystemCalls
+	Delegate         *Delegation
+	Scheduling       *Scheduling
+	Devices          []*Device
+	GPU              *GPU
+	USBDevices       []*USBDevice
+	EnableOnBoot     bool
+	Runtime          bool
+	ResetFailed      bool
+	Boot             *bool
+	Parameters       []string
+	AddressTimeout   time.Duration
+	AddressOrder     string
+	Ready            []*ReadyProbe
+	ReadyTimeout     time.Duration
+	Address          string
+	LinkJournal      string
+	Journal          *JournalLimits
+	Timezone         string
+	Locale           string
+	Restart          string
+	RestartSec       string
+	After            []string
+	Before           []string
+	Requires         []string
+	Wants            []string
+	UserData         *UserData
+	Transport        string
+	AuthorizedKeys   []string
+	AuthorizedUser   string
+	Files            []*MachineFile
+	Sync             []*DirectorySync
+	Creation         []*CommandDescription
+	CreationPost     []*CommandDescription
+	Startup          []*CommandDescription
+	CommandsPre      []*CommandDescription
+	Commands         []*CommandDescription
+	// Slice places the machine unit in a slice, machines sharing one share the limits it has in Config.Slices
+	Slice string
+	// ZFS keeps the image in its own dataset mounted at /var/lib/machines/<Fqdn> instead of the machined pool
+	ZFS *ZFSDataset
+	// Channel follows the version promoted to stable or testing instead of the newest one, promoting a new
+	// version upgrades the machine by cloning it again, so its state must live in Mounts
+	Channel     string
+	runCreation bool
+	runStartup  bool
+	runUpgrade  bool
+	outdated    string
+	dryRun      bool
+	starting    bool
+	template    *machineutil.Template
+	address     netip.Prefix
+	pool        netip.Prefix
+	gateway     string
+	dns         []string
+	ssh         *SSHConfig
+}
+
+// ReadyProbe describes one readiness check, exactly one of TCP, HTTP, DNS, File and Command is set.
+// Placeholders are expanded, File is looked up inside the machine.
+type ReadyProbe struct {
+	TCP     string
+	HTTP    string
+	Status  int
+	DNS     string
+	Server  string
+	File    string
+	Command *CommandDescription
+	// Interval between attempts, unset polls like machineutil.Poll
+	Interval time.Duration
+	// MaxInterval lets Interval double after every failed attempt
+	MaxInterval time.Duration
+}
+
+// pollOptions paces a probe like the machine waits unless the config sets its own interval
+func pollOptions(interval, maxInterval time.Duration) probe.Options {
+	if interval > 0 {
+		return probe.Options{Interval: interval, MaxInterval: maxInterval, Jitter: machineutil.Poll.Jitter}
+	}
+	poll := machineutil.Poll
+	return probe.Options{Interval: poll.Interval, MaxInterval: max(poll.Max, maxInterval), Backoff: poll.Factor, Jitter: poll.Jitter}
+}
+
+func (r *ReadyProbe) Probe(env *CommandEnv) (probe.Probe, error) {
+	set := 0
+	for _, ok := range []bool{r.TCP != "", r.HTTP != "", r.DNS != "", r.File != "", r.Command != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("ready probe needs exactly one of TCP, HTTP, DNS, File and Command")
+	}
+	switch {
+	case r.TCP != "":
+		return &probe.TCP{Address: env.Expand(r.TCP)}, nil
+	case r.HTTP != "":
+		return &probe.HTTP{URL: env.Expand(r.HTTP), Status: r.Status}, nil
+	case r.DNS != "":
+		return &probe.DNS{Name: env.Expand(r.DNS), Server: env.Expand(r.Server)}, nil
+	case r.File != "":
+		root, err := env.Machine.RootPath()
+		if err != nil {
+			return nil, err
+		}
+		return &probe.File{Path: root + env.Expand(r.File)}, nil
+	}
+	return &probe.Func{
+		Name: fmt.Sprint("command ", r.Command.Command),
+		Fn: func(ctx context.Context) error {
+			probeEnv := *env
+			probeEnv.Context = ctx
+			return r.Command.Run(&probeEnv)
+		},
+	}, nil
+}
+
+// WaitReady blocks until every Ready probe passes, later machines are only reconciled once this one is usable
+func (m *Machine) WaitReady(machine *machineutil.Machine, addr []netip.Addr) error {
+	env := &CommandEnv{
+		Machine:   machine,
+		Addrs:     addr,
+		Template:  m.template,
+		Transport: m.Transport,
+		SSH:       m.ssh,
+		NoInit:    !m.Booted(),
+		Vars:      m.Vars,
+	}
+	timeout := m.ReadyTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	if m.dryRun && len(m.Ready) > 0 {
+		slog.Info("Skipping Ready probes in dry run", "machine", m.Fqdn, "probes", len(m.Ready))
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, r := range m.Ready {
+		p, err := r.Probe(env)
+		if err != nil {
+			return err
+		}
+		slog.Info("Waiting for probe", "machine", m.Fqdn, "probe", p.String())
+		opts := pollOptions(r.Interval, r.MaxInterval)
+		if r.Command != nil {
+			// a command may well take longer than the interval, only ReadyTimeout bounds it
+			opts.AttemptTimeout = timeout
+		}
+		if err := probe.Wait(ctx, p, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForAddress polls the machine addresses through the probe framework, bounded by AddressTimeout or five minutes
+func (m *Machine) waitForAddress(machine *machineutil.Machine) (addr []netip.Addr, err error) {
+	// the host only sees the address of a VM once it talked to the host, a static one is known upfront
+	if m.IsVM() && m.address.IsValid() {
+		return []netip.Addr{m.address.Addr()}, nil
+	}
+	p := &probe.Func{
+		Name: "address",
+		Fn: func(context.Context) error {
+			addr, err = machine.UsableAddresses()
+			if err == nil && len(addr) == 0 {
+				err = probe.ErrNotReady
+			}
+			return err
+		},
+	}
+	opts := pollOptions(0, 0)
+	opts.Timeout = m.AddressTimeout
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Minute
+	}
+	err = probe.Wait(context.Background(), p, opts)
+	return
+}
+
+// validateAddress checks an explicit Address against the AddressPool it shares the network with,
+// AssignAddresses already kept the pool from handing it out a second time
+func (m *Machine) validateAddress() error {
+	if m.Address == "" || !m.pool.IsValid() {
+		return nil
+	}
+	addr := m.address.Addr()
+	if m.address.Bits() != m.pool.Bits() || !m.pool.Contains(addr) {
+		return fmt.Errorf("machine %s: Address %s is outside of AddressPool %s", m.Fqdn, m.address, m.pool)
+	}
+	if addr == m.pool.Addr() || isBroadcast(m.pool, addr) {
+		return fmt.Errorf("machine %s: Address %s is the network or broadcast address of AddressPool %s", m.Fqdn, addr, m.pool)
+	}
+	return nil
+}
+
+// StaticAddress is the address assigned from the config, invalid when the machine uses DHCP
+func (m *Machine) StaticAddress() netip.Prefix {
+	return m.address
+}
+
+// Booted reports whether the machine runs a full init, the default, or just Parameters as its only process
+func (m *Machine) Booted() bool {
+	return m.Boot == nil || *m.Boot
+}
+
+// running also checks the unit for application containers, their command may have exited while the machine is being torn down
+func (m *Machine) running(machine *machineutil.Machine) bool {
+	if m.Booted() {
+		return machine.Running()
+	}
+	return machine.Running() && machine.UnitActive()
+}
+
+func (m *Machine) Normalize() error {
+	switch m.Class {
+	case "":
+		m.Class = machineutil.ClassContainer
+	case machineutil.ClassContainer:
+	case machineutil.ClassVM:
+		if err := m.validateVM(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("machine %s: invalid Class %q, expected %s or %s", m.Fqdn, m.Class, machineutil.ClassContainer, machineutil.ClassVM)
+	}
+	if err := m.normalizeRegion(); err != nil {
+		return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+	}
+	for _, f := range m.Files {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+	}
+	for _, s := range m.Sync {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+	}
+	for key, value := range m.Labels {
+		if key == "" || strings.ContainsAny(key, "=\n") || strings.Contains(value, "\n") {
+			return fmt.Errorf("machine %s: invalid label %q, keys can't be empty or contain = and neither can contain newlines", m.Fqdn, key)
+		}
+	}
+	if m.Channel != "" {
+		if !slices.Contains(TemplateChannels, m.Channel) {
+			return fmt.Errorf("machine %s: invalid Channel %q, expected %s or %s", m.Fqdn, m.Channel, ChannelStable, ChannelTesting)
+		}
+		if _, version, err := ParseTemplateRef(m.Template); err != nil || version >= 0 {
+			return fmt.Errorf("machine %s: Channel %s with a Template pinned to a version", m.Fqdn, m.Channel)
+		}
+	}
+	if m.OnDemand && len(m.ProxySockets) == 0 {
+		return fmt.Errorf("machine %s: OnDemand without ProxySockets to start it", m.Fqdn)
+	}
+	if m.OnDemand && m.EnableOnBoot {
+		return fmt.Errorf("machine %s: OnDemand and EnableOnBoot both start the machine", m.Fqdn)
+	}
+	if err := m.validateAddress(); err != nil {
+		return err
+	}
+	if m.AddressOrder != "" && !slices.Contains(machineutil.AddressOrders, m.AddressOrder) {
+		return fmt.Errorf("machine %s: invalid AddressOrder %q, expected one of %s", m.Fqdn, m.AddressOrder, strings.Join(machineutil.AddressOrders, ", "))
+	}
+	if !m.Booted() {
+		if len(m.Parameters) == 0 {
+			return fmt.Errorf("machine %s has Boot disabled without Parameters to run", m.Fqdn)
+		}
+		m.Options = append(m.Options,
+			&unit.UnitOption{Section: "Exec", Name: "Boot", Value: "no"},
+			// a stub init reaps zombies and forwards signals, the command itself becomes PID 2
+			&unit.UnitOption{Section: "Exec", Name: "ProcessTwo", Value: "yes"},
+		)
+	}
+	if len(m.Parameters) > 0 {
+		quoted := make([]string, 0, len(m.Parameters))
+		for _, param := range m.Parameters {
+			quoted = append(quoted, systemdQuote(param))
+		}
+		m.Options = append(m.Options, &unit.UnitOption{
+			Section: "Exec",
+			Name:    "Parameters",
+			Value:   strings.Join(quoted, " "),
+		})
+	}
+	if m.ZFS != nil && m.ZFS.Dataset == "" {
+		return fmt.Errorf("machine %s: ZFS requires a Dataset", m.Fqdn)
+	}
+	for _, mnt := range m.Mounts {
+		mnt.runtime = m.Runtime
+		if err := mnt.Normalize(); err != nil {
+			return err
+		}
+		// VMs get their mounts on the command line of vmspawn
+		if !m.IsVM() {
+			m.Options = append(m.Options, mnt.GetNspawn()...)
+		}
+		m.Overrides = append(m.Overrides, mnt.GetOverride()...)
+	}
+	if m.Zone != "" {
+		m.Options = append(m.Options, &unit.UnitOption{
+			Section: "Network",
+			Name:    "Zone",
+			Value:   m.Zone,
+		})
+	}
+	for _, port := range m.Ports {
+		if err := port.Normalize(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Options = append(m.Options, &unit.UnitOption{
+			Section: "Network",
+			Name:    "Port",
+			Value:   port.String(),
+		})
+	}
+	caps, err := capabilityOptions("Capability", m.Capabilities)
+	if err != nil {
+		return err
+	}
+	m.Options = append(m.Options, caps...)
+	caps, err = capabilityOptions("DropCapability", m.DropCapabilities)
+	if err != nil {
+		return err
+	}
+	m.Options = append(m.Options, caps...)
+	m.Overrides = append(m.Overrides, m.dependencyOverrides()...)
+	if m.Slice != "" {
+		if m.Slice, err = sliceName(m.Slice); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Overrides = append(m.Overrides, &unit.UnitOption{
+			Section: "Service",
+			Name:    "Slice",
+			Value:   m.Slice,
+		})
+	}
+	if !slices.Contains(transports, m.Transport) {
+		return fmt.Errorf("invalid Transport %q, expected %s or %s", m.Transport, TransportSystemdRun, TransportSSH)
+	}
+	for _, cmd := range m.AllCommands() {
+		if !slices.Contains(transports, cmd.Transport) {
+			return fmt.Errorf("invalid Transport %q, expected %s or %s", cmd.Transport, TransportSystemdRun, TransportSSH)
+		}
+		if err := cmd.validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		if err := cmd.validatePipe(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+	}
+	if m.LinkJournal != "" {
+		if !slices.Contains(linkJournalModes, m.LinkJournal) {
+			return fmt.Errorf("invalid LinkJournal %q, expected one of %s", m.LinkJournal, strings.Join(linkJournalModes, ", "))
+		}
+		m.Options = append(m.Options, &unit.UnitOption{
+			Section: "Exec",
+			Name:    "LinkJournal",
+			Value:   m.LinkJournal,
+		})
+	}
+	restart, err := m.restartOverrides()
+	if err != nil {
+		return err
+	}
+	m.Overrides = append(m.Overrides, restart...)
+	if m.SystemCalls != nil {
+		opts, err := m.SystemCalls.GetNspawn()
+		if err != nil {
+			return err
+		}
+		m.Options = append(m.Options, opts...)
+		m.Overrides = append(m.Overrides, m.SystemCalls.GetOverride()...)
+	}
+	if m.GPU != nil {
+		devices, err := m.GPU.Devices()
+		if err != nil && m.starting {
+			return fmt.Errorf("machine %s: GPU: %w", m.Fqdn, err)
+		}
+		// stopping or removing the machine doesn't need the nodes of the host
+		if err != nil {
+			slog.Warn("Leaving out the GPU", "machine", m.Fqdn, "error", err)
+		}
+		m.Devices = append(m.Devices, devices...)
+	}
+	for _, usb := range m.USBDevices {
+		if err := usb.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		devices, err := usb.Devices()
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		// a missing source would fail the start, the machine comes up without the device instead
+		if len(devices) == 0 {
+			slog.Warn("USB device not plugged in", "machine", m.Fqdn, "id", usb.ID, "serial", usb.Serial)
+		}
+		m.Devices = append(m.Devices, devices...)
+	}
+	for _, device := range m.Devices {
+		if err := device.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Options = append(m.Options, device.GetNspawn()...)
+		m.Overrides = append(m.Overrides, device.GetOverride()...)
+	}
+	if m.Delegate != nil {
+		opts, err := m.Delegate.GetOverride()
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Overrides = append(m.Overrides, opts...)
+	}
+	if m.Journal != nil {
+		if err := m.Journal.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Overrides = append(m.Overrides, m.Journal.GetOverride(m.Fqdn)...)
+	}
+	if m.Scheduling != nil {
+		opts, err := m.Scheduling.GetOverride()
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", m.Fqdn, err)
+		}
+		m.Overrides = append(m.Overrides, opts...)
+	}
+	if m.IsVM() {
+		m.Options = m.vmUnit()
+	}
+	m.Options = m.expandOptions(m.Options)
+	m.Overrides = m.expandOptions(m.Overrides)
+	// the labels stay with the machine for status, gc and inventory on hosts without the config
+	m.Options = append(m.Options, util.LabelOptions(m.bookkeepingSection(), m.Labels)...)
+	return nil
+}
+
+// bookkeepingSection holds the settings only machineutil reads in the settings file or VM unit
+func (m *Machine) bookkeepingSection() string {
+	if m.IsVM() {
+		return "Unit"
+	}
+	return "Exec"
+}
+
+// recordTemplate adds the template image the machine was cloned from to Options, existing machines keep their record
+func (m *Machine) recordTemplate(machine *machineutil.Machine, template *machineutil.Template) ([]*unit.UnitOption, error) {
+	image := ""
+	if m.runCreation {
+		image = template.Image()
+	} else {
+		var err error
+		if image, err = machine.CreatedFrom(); err != nil {
+			return nil, err
+		}
+	}
+	if image == "" {
+		return m.Options, nil
+	}
+	return append(slices.Clone(m.Options), &unit.UnitOption{Section: m.bookkeepingSection(), Name: util.TemplateOption, Value: image}), nil
+}
+
+// resolveTemplate sets the template the placeholders name to the one machine was cloned from, which is only
+// discovered in create runs and may be older than the newest one there. Machines predating the record keep
+// whatever the run discovered.
+func (m *Machine) resolveTemplate(machine *machineutil.Machine) error {
+	image, err := machine.CreatedFrom()
+	if err != nil {
+		return err
+	}
+	if name, arch, version, ok := machineutil.ParseTemplateImage(image); ok {
+		m.template = &machineutil.Template{Name: name, Arch: arch, Version: version}
+	}
+	return nil
+}
+
+// expandOptions fills Vars and the fqdn into unit settings, placeholders only known at runtime are left alone
+func (m *Machine) expandOptions(opts []*unit.UnitOption) []*unit.UnitOption {
+	values := maps.Clone(m.Vars)
+	if values == nil {
+		values = map[string]string{}
+	}
+	values["fqdn"] = m.Fqdn
+	expand := func(s string) string {
+		return placeholderPattern.ReplaceAllStringFunc(s, func(match string) string {
+			if value, ok := values[placeholderPattern.FindStringSubmatch(match)[1]]; ok {
+				return value
+			}
+			return match
+		})
+	}
+	retval := make([]*unit.UnitOption, len(opts))
+	for i, opt := range opts {
+		retval[i] = opt
+		if value := expand(opt.Value); value != opt.Value {
+			retval[i] = &unit.UnitOption{Section: opt.Section, Name: opt.Name, Value: value}
+		}
+	}
+	return retval
+}
+
+// DependencyUnit maps a dependency to a unit name, plain names refer to other machines
+func DependencyUnit(name string) string {
+	for _, suffix := range []string{".service", ".target", ".mount", ".automount", ".swap", ".socket", ".slice", ".device", ".path", ".timer", ".scope"} {
+		if strings.HasSuffix(name, suffix) {
+			return name
+		}
+	}
+	return "systemd-nspawn@" + name + ".service"
+}
+
+// EnsureNetwork writes the networkd configuration for the statically assigned address into the machine image
+func (m *Machine) EnsureNetwork(log *slog.Logger, manager machineutil.MachineUtil, changes *ChangeSet) (bool, error) {
+	if !m.address.IsValid() {
+		return false, nil
+	}
+	root, err := manager.ImagePath(m.Fqdn)
+	if err != nil {
+		return false, err
+	}
+	// the network interface of a VM is named by udev inside, it is the only ethernet device there
+	match := &unit.UnitOption{Section: "Match", Name: "Name", Value: "host0"}
+	if m.IsVM() {
+		match = &unit.UnitOption{Section: "Match", Name: "Type", Value: "ether"}
+	}
+	opts := []*unit.UnitOption{
+		match,
+		&unit.UnitOption{
+			Section: "Network",
+			Name:    "Address",
+			Value:   m.address.String(),
+		},
+	}
+	if m.gateway != "" {
+		opts = append(opts, &unit.UnitOption{
+			Section: "Network",
+			Name:    "Gateway",
+			Value:   m.gateway,
+		})
+	}
+	for _, dns := range m.dns {
+		opts = append(opts, &unit.UnitOption{
+			Section: "Network",
+			Name:    "DNS",
+			Value:   dns,
+		})
+	}
+	info, err := util.Files.Stat(root)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return m.ensureRawNetwork(log, root, opts)
+	}
+	// the image belongs to the guest, a symlink in it must not send the file anywhere on the host
+	dir, err := util.OpenDirInRoot(root, guestNetworkDir)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	files := util.NewNetworkFiles("/proc/self/fd/" + strconv.Itoa(int(dir.Fd())))
+	if info, err := os.Lstat(files.Path(guestNetworkFile)); err == nil && !info.Mode().IsRegular() {
+		return false, fmt.Errorf("machine %s: %s/%s is not a regular file", m.Fqdn, guestNetworkDir, guestNetworkFile)
+	}
+	// the guest networkd picks the file up when it starts, there is nothing to reload on the host
+	return changes.Track(path.Join(root, guestNetworkDir, guestNetworkFile), func() (bool, error) {
+		return files.Ensure(log, guestNetworkFile, opts)
+	})
+}
+
+const (
+	guestNetworkDir  = "etc/systemd/network"
+	guestNetworkFile = "10-machineutil-host0.network"
+)
+
+// ensureRawNetwork copies the networkd file into a raw image with systemd-dissect, which resolves the path
+// inside the image. Raw images can't be inspected without mounting them and are only written at creation.
+func (m *Machine) ensureRawNetwork(log *slog.Logger, image string, opts []*unit.UnitOption) (bool, error) {
+	if !m.runCreation {
+		return false, nil
+	}
+	data, err := io.ReadAll(unit.Serialize(util.WithMarker(opts)))
+	if err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp("", "machineutil-network-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Info("Writing network configuration into the image", "image", image)
+	var stderr bytes.Buffer
+	cmd := exec.Command("systemd-dissect", "--copy-to", image, f.Name(), "/"+guestNetworkDir+"/"+guestNetworkFile)
+	cmd.Stderr = &stderr
+	if err := Commands.Run(cmd, nil, nil); err != nil {
+		return false, fmt.Errorf("systemd-dissect: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
+
+var linkJournalModes = []string{"no", "host", "try-host", "guest", "try-guest", "auto"}
+
+var machineIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// EnsureJournalDir creates the host side journal directory host linking binds into the machine.
+// The machine-id is only generated on first boot, so it is read from the running machine, which also covers
+// raw images. The directory is used from the next start on, nspawn falls back for try-host until then.
+func (m *Machine) EnsureJournalDir(log *slog.Logger, machine *machineutil.Machine) error {
+	if m.LinkJournal != "host" && m.LinkJournal != "try-host" {
+		return nil
+	}
+	if m.dryRun {
+		log.Info("Skipping journal directory in dry run", "linkjournal", m.LinkJournal)
+		return nil
+	}
+	root, err := machine.RootPath()
+	if err != nil {
+		return err
+	}
+	// the guest controls the file, a symlink must not read host files and the id becomes a host path
+	data, err := util.ReadFileInRoot(root, "etc/machine-id")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	id := strings.TrimSpace(string(data))
+	if !machineIDPattern.MatchString(id) {
+		// application containers without an init never generate one
+		log.Warn("Machine has no valid machine-id, skipping journal directory", "linkjournal", m.LinkJournal)
+		return nil
+	}
+	dir := "/var/log/journal/" + id
+	if _, err := util.Files.Stat(dir); err == nil {
+		return nil
+	}
+	log.Info("Creating journal directory", "directory", dir)
+	return util.Files.MkdirAll(dir, 0755)
+}
+
+var restartPolicies = []string{"no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always"}
+
+func (m *Machine) restartOverrides() ([]*unit.UnitOption, error) {
+	opts := []*unit.UnitOption{}
+	if m.Restart != "" {
+		if !slices.Contains(restartPolicies, m.Restart) {
+			return nil, fmt.Errorf("invalid restart policy %q, expected one of %s", m.Restart, strings.Join(restartPolicies, ", "))
+		}
+		opts = append(opts, &unit.UnitOption{
+			Section: "Service",
+			Name:    "Restart",
+			Value:   m.Restart,
+		})
+	}
+	if m.RestartSec != "" {
+		opts = append(opts, &unit.UnitOption{
+			Section: "Service",
+			Name:    "RestartSec",
+			Value:   m.RestartSec,
+		})
+	}
+	return opts, nil
+}
+
+func (m *Machine) dependencyOverrides() []*unit.UnitOption {
+	opts := []*unit.UnitOption{}
+	add := func(name string, deps []string) {
+		for _, dep := range deps {
+			opts = append(opts, &unit.UnitOption{
+				Section: "Unit",
+				Name:    name,
+				Value:   DependencyUnit(dep),
+			})
+		}
+	}
+	add("Requires", m.Requires)
+	add("Wants", m.Wants)
+	// ordering is implied for hard and soft requirements so databases really come up first
+	after := slices.Clone(m.After)
+	for _, dep := range append(slices.Clone(m.Requires), m.Wants...) {
+		if !slices.Contains(after, dep) {
+			after = append(after, dep)
+		}
+	}
+	add("After", after)
+	add("Before", m.Before)
+	return opts
+}
+
+func capabilityOptions(name string, caps []string) ([]*unit.UnitOption, error) {
+	if len(caps) == 0 {
+		return nil, nil
+	}
+	values := make([]string, 0, len(caps))
+	for _, c := range caps {
+		canonical, err := util.NormalizeCapability(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values = append(values, canonical)
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Exec",
+			Name:    name,
+			Value:   strings.Join(values, " "),
+		},
+	}, nil
+}
+
+// AllCommands lists every command of the machine including the ones others pipe into
+func (m *Machine) AllCommands() []*CommandDescription {
+	cmds := []*CommandDescription{}
+	for _, list := range [][]*CommandDescription{m.CommandsPre, m.Creation, m.Startup, m.CreationPost, m.Commands} {
+		for _, cmd := range list {
+			cmds = append(cmds, cmd.stages()...)
+		}
+	}
+	return cmds
+}
+
+func (m *Machine) EnsureMounts(log *slog.Logger, changes *ChangeSet) (changed bool, err error) {
+	changed = false
+	var c bool
+	for _, mnt := range m.Mounts {
+		if mnt.Encryption != nil {
+			c, err = changes.Track(mnt.CryptsetupPath(), func() (bool, error) { return mnt.EnsureCryptsetup(log) })
+			if err != nil {
+				return
+			}
+			if c {
+				changed = true
+			}
+		}
+		c, err = changes.Track(mnt.UnitPath(), func() (bool, error) { return mnt.CreateMount(log) })
+		if err != nil {
+			return
+		}
+		if c {
+			changed = true
+		}
+		c, err = changes.Track(mnt.AutomountPath(), func() (bool, error) { return mnt.EnsureAutomount(log) })
+		if err != nil {
+			return
+		}
+		if c {
+			changed = true
+		}
+	}
+	return
+}
+
+// UnitFile is a generated host file and the content a run gives it, nil Options removes the file
+type UnitFile struct {
+	Path    string
+	Options []*unit.UnitOption
+	// Restart is set when changing the file requires restarting the machine
+	Restart bool
+	// Kept files are left behind when the machine is destroyed
+	Kept bool
+}
+
+// UnitFiles lists the host files written for m in the order EnsureMachine writes them, m must be normalized
+func (m *Machine) UnitFiles() ([]*UnitFile, error) {
+	machine := &machineutil.Machine{Name: m.Fqdn, Class: m.Class, Runtime: m.Runtime}
+	files := []*UnitFile{
+		{Path: machine.OptionsPath(), Options: m.Options, Restart: true},
+		{Path: machine.OverridePath(), Options: m.Overrides, Restart: true, Kept: true},
+	}
+	// limits that can't be applied to the running machine fall back to a restart
+	_, err := m.Resources.RuntimeProperties()
+	files = append(files, &UnitFile{Path: machine.ResourcesPath(), Options: m.Resources.GetOverride(), Restart: err != nil, Kept: true})
+	for _, mnt := range m.Mounts {
+		if mnt.Encryption != nil {
+			files = append(files, &UnitFile{Path: mnt.CryptsetupPath(), Options: mnt.Encryption.unitOptions(), Restart: true})
+		}
+		if mnt.ZFS == nil {
+			files = append(files, &UnitFile{Path: mnt.UnitPath(), Options: mnt.mountOptions(), Restart: true})
+		}
+		files = append(files, &UnitFile{Path: mnt.AutomountPath(), Options: mnt.automountOptions(), Restart: true})
+	}
+	files = append(files, &UnitFile{Path: m.JournalConfPath(), Options: m.Journal.namespaceOptions()})
+	for i, p := range m.ProxySockets {
+		socket, service, err := p.units(m, i)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files,
+			&UnitFile{Path: filepath.Join(m.unitDir(), m.proxyUnit(i, ".socket")), Options: socket},
+			&UnitFile{Path: filepath.Join(m.unitDir(), m.proxyUnit(i, ".service")), Options: service},
+		)
+	}
+	return files, nil
+}
+
+// otherPlacement is where path goes with the opposite Runtime setting, empty for files outside /etc and /run
+func otherPlacement(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/run/systemd/"); ok {
+		return "/etc/systemd/" + rest
+	}
+	if rest, ok := strings.CutPrefix(path, "/etc/systemd/"); ok {
+		return "/run/systemd/" + rest
+	}
+	return ""
+}
+
+// EnsurePlacement removes the generated copies of the files of m left in /etc by a persistent run when m is
+// written to /run and the other way around. A copy in /etc outranks the one in /run, one left in /run would
+// stay in effect until the next reboot. Hand-written files are left alone.
+func (m *Machine) EnsurePlacement(log *slog.Logger, changes *ChangeSet) (bool, error) {
+	files, err := m.UnitFiles()
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, file := range files {
+		other := otherPlacement(file.Path)
+		if other == "" {
+			continue
+		}
+		opts, err := util.ReadUnit(other, false)
+		if err != nil {
+			return removed, err
+		}
+		if opts == nil || !util.IsGenerated(opts) {
+			continue
+		}
+		log.Info("Removing copy from the other placement", "unit", other)
+		ok, err := changes.Track(other, func() (bool, error) { return util.EnsureUnit(log, other, nil) })
+		if err != nil {
+			return removed, err
+		}
+		removed = removed || ok
+	}
+	return removed, nil
+}
+
+func (m *Machine) RunCommands(machine *machineutil.Machine, addr []netip.Addr, changes *ChangeSet, timings *Timings, registry *Registry) error {
+	env := &CommandEnv{
+		Machine:   machine,
+		Addrs:     addr,
+		Template:  m.template,
+		Transport: m.Transport,
+		SSH:       m.ssh,
+		NoInit:    !m.Booted(),
+		Vars:      m.Vars,
+		Registry:  registry,
+	}
+	defer func() { changes.CommandsRun += env.Ran }()
+	run := func(cmd *CommandDescription) error {
+		defer timings.Command(cmd, time.Now())
+		return cmd.Run(env)
+	}
+	for _, cmd := range m.CommandsPre {
+		err := run(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	if m.runCreation && m.UserData != nil {
+		slog.Info("Applying user-data", "machine", m.Fqdn)
+		err := m.UserData.Apply(env)
+		if err != nil {
+			return err
+		}
+	}
+	if m.runCreation && len(m.AuthorizedKeys) > 0 {
+		keys, err := readAuthorizedKeys(m.AuthorizedKeys)
+		if err != nil {
+			return err
+		}
+		user := &UserDataUser{Name: m.AuthorizedUser}
+		if user.Name == "" {
+			user.Name = "root"
+		}
+		slog.Info("Installing authorized keys", "machine", m.Fqdn, "user", user.Name, "keys", len(keys))
+		if err := installAuthorizedKeys(env, user, keys); err != nil {
+			return err
+		}
+	}
+	if err := m.ApplyFiles(env, changes); err != nil {
+		return err
+	}
+	if err := m.ApplySync(env, changes); err != nil {
+		return err
+	}
+	cmds := []*CommandDescription{}
+	if m.runCreation {
+		cmds = append(cmds, m.Creation...)
+	}
+	if m.runStartup {
+		cmds = append(cmds, m.Startup...)
+	}
+	if m.runCreation {
+		cmds = append(cmds, m.CreationPost...)
+	}
+	cmds = append(cmds, m.Commands...)
+	for _, cmd := range cmds {
+		err := run(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) RemoveMounts(log *slog.Logger, changes *ChangeSet) (changed bool, err error) {
+	for _, mnt := range m.Mounts {
+		if mnt.Volume != "" {
+			continue
+		}
+		var c bool
+		if mnt.Encryption != nil {
+			c, err = changes.Track(mnt.CryptsetupPath(), func() (bool, error) { return util.EnsureUnit(log, mnt.CryptsetupPath(), nil) })
+			if err != nil {
+				return
+			}
+			if c {
+				changed = true
+			}
+		}
+		c, err = changes.Track(mnt.UnitPath(), func() (bool, error) { return mnt.RemoveMount(log) })
+		if err != nil {
+			return
+		}
+		if c {
+			changed = true
+		}
+		c, err = changes.Track(mnt.AutomountPath(), func() (bool, error) { return util.EnsureUnit(log, mnt.AutomountPath(), nil) })
+		if err != nil {
+			return
+		}
+		if c {
+			changed = true
+		}
+	}
+	return
+}
+
+func (m *Machine) EnsureOwnership(log *slog.Logger, machine *machineutil.Machine) error {
+	root := ""
+	shift := 0
+	for _, mnt := range m.Mounts {
+		if mnt.Owner == "" && mnt.Group == "" {
+			continue
+		}
+		var err error
+		root, err = machine.RootPath()
+		if err != nil {
+			return err
+		}
+		shift, err = machine.UIDShift()
+		if err != nil {
+			return err
+		}
+		break
+	}
+	for _, mnt := range m.Mounts {
+		if _, err := mnt.EnsureOwnership(log, root, shift); err != nil {
+			return fmt.Errorf("mount %s: %w", mnt.Name, err)
+		}
+	}
+	if m.GPU != nil {
+		if err := m.GPU.GrantAccess(log, machine); err != nil {
+			return fmt.Errorf("GPU: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *Machine) Unmount(manager machineutil.MachineUtil) error {
+	for _, mnt := range m.Mounts {
+		// ZFS datasets stay mounted, nothing would mount them again on the next start,
+		// volumes may still be in use by other machines
+		if mnt.ZFS != nil || mnt.Volume != "" {
+			continue
+		}
+		units := []string{}
+		if mnt.Automount {
+			units = append(units, mnt.AutomountUnit())
+		}
+		units = append(units, mnt.Unit())
+		// the volume is closed again so the data stays encrypted at rest while the machine is down
+		if mnt.Encryption != nil {
+			units = append(units, mnt.Encryption.Unit())
+		}
+		for _, u := range units {
+			job, err := manager.Stop(u)
+			if err != nil {
+				return err
+			}
+			err = job.Wait()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,640 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+type MountPoint struct {
+	Volume        string
+	Name          string
+	Device        string
+	Target        string
+	MountPoint    string
+	FS            string
+	AutoFs        bool
+	Options       string
+	Passno        int
+	NoFail        bool
+	DeviceTimeout string
+	Requires      []string
+	After         []string
+	MountOptions  []*unit.UnitOption
+	Automount     bool
+	IdleTimeout   string
+	Image         string
+	Size          string
+	Encryption    *Encryption
+	ZFS           *ZFSDataset
+	Owner         string
+	Group         string
+	Mode          *os.FileMode
+	IdMap         string
+	NoIdMap       bool
+	ReadOnly      bool
+	Shared        bool
+	runtime       bool
+}
+
+var errNoSuchID error = errors.New("no such user or group")
+
+// lookupID resolves a user or group name against the passwd or group file below root, numeric ids are taken as is
+func lookupID(root, file, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	data, err := os.ReadFile(filepath.Join(root, "etc", file))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return 0, fmt.Errorf("%w: %s not found in /etc/%s of the machine", errNoSuchID, name, file)
+}
+
+// EnsureOwnership applies Owner, Group and Mode to the root of the mounted directory.
+// Names are resolved inside the machine, an idmapped bind shows host ids unchanged to the guest,
+// otherwise shift is added to land on the ids the machine sees through its user namespace.
+func (m *MountPoint) EnsureOwnership(log *slog.Logger, root string, shift int) (bool, error) {
+	if m.Owner == "" && m.Group == "" && m.Mode == nil {
+		return false, nil
+	}
+	info, err := util.Files.Stat(m.MountPoint)
+	if err != nil {
+		return false, err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	uid, gid := int(stat.Uid), int(stat.Gid)
+	if m.Idmapped() {
+		shift = 0
+	}
+	if m.Owner != "" {
+		if uid, err = lookupID(root, "passwd", m.Owner); err != nil {
+			return false, err
+		}
+		uid += shift
+	}
+	if m.Group != "" {
+		if gid, err = lookupID(root, "group", m.Group); err != nil {
+			return false, err
+		}
+		gid += shift
+	}
+	changed := false
+	if uid != int(stat.Uid) || gid != int(stat.Gid) {
+		log.Info("Changing mount ownership", "mount", m.MountPoint, "uid", uid, "gid", gid)
+		if err := util.Files.Chown(m.MountPoint, uid, gid); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if m.Mode != nil && info.Mode().Perm() != m.Mode.Perm() {
+		log.Info("Changing mount mode", "mount", m.MountPoint, "mode", m.Mode.Perm())
+		if err := util.Files.Chmod(m.MountPoint, m.Mode.Perm()); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// ZFSDataset backs a mount with a dataset instead of a block device, ZFS mounts it itself so no .mount unit is written
+type ZFSDataset struct {
+	Dataset     string
+	Quota       string
+	Compression string
+	RecordSize  string
+	Properties  map[string]string
+}
+
+func (z *ZFSDataset) properties(mountpoint string) map[string]string {
+	props := map[string]string{"mountpoint": mountpoint}
+	for name, value := range z.Properties {
+		props[name] = value
+	}
+	if z.Quota != "" {
+		props["quota"] = z.Quota
+	}
+	if z.Compression != "" {
+		props["compression"] = z.Compression
+	}
+	if z.RecordSize != "" {
+		props["recordsize"] = z.RecordSize
+	}
+	return props
+}
+
+func zfs(args ...string) (string, error) {
+	slog.Debug("Running zfs", "args", args)
+	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	cmd := exec.Command("zfs", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := Commands.Run(cmd, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("zfs %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// Ensure creates the dataset or brings its properties in line, reporting if anything changed
+func (z *ZFSDataset) Ensure(log *slog.Logger, mountpoint string) (bool, error) {
+	props := z.properties(mountpoint)
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out, err := zfs("get", "-H", "-o", "property,value", "-s", "local,received", strings.Join(names, ","), z.Dataset)
+	if err != nil {
+		if _, lerr := zfs("list", "-H", "-o", "name", z.Dataset); lerr == nil {
+			return false, err
+		}
+		log.Info("Creating dataset", "dataset", z.Dataset)
+		args := []string{"create", "-p"}
+		for _, name := range names {
+			args = append(args, "-o", name+"="+props[name])
+		}
+		_, err = zfs(append(args, z.Dataset)...)
+		return err == nil, err
+	}
+	current := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if name, value, ok := strings.Cut(line, "\t"); ok {
+			current[name] = value
+		}
+	}
+	changed := false
+	for _, name := range names {
+		// zfs prints sizes the way they are usually written, 10G stays 10G
+		if strings.EqualFold(current[name], props[name]) {
+			continue
+		}
+		log.Info("Setting dataset property", "dataset", z.Dataset, "property", name, "value", props[name])
+		if _, err := zfs("set", name+"="+props[name], z.Dataset); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// Destroy removes the dataset with everything below it
+func (z *ZFSDataset) Destroy(log *slog.Logger) (bool, error) {
+	if _, err := zfs("list", "-H", "-o", "name", z.Dataset); err != nil {
+		return false, nil
+	}
+	log.Info("Destroying dataset", "dataset", z.Dataset)
+	_, err := zfs("destroy", "-r", z.Dataset)
+	return err == nil, err
+}
+
+// imagePath is where the image of m lives when it has its own dataset
+func (m *Machine) imagePath() string {
+	return "/var/lib/machines/" + m.Fqdn
+}
+
+// cloneToDataset creates the image of m on its own dataset. machined only clones into a new directory,
+// so the template is copied into the mounted dataset, which requires a directory template.
+func (m *Machine) cloneToDataset(log *slog.Logger, manager machineutil.MachineUtil, template *machineutil.Template) (*machineutil.Machine, error) {
+	source, err := manager.ImagePath(template.Image())
+	if err != nil {
+		return nil, err
+	}
+	if info, err := util.Files.Stat(source); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("machine %s: ZFS requires a directory template, %s is not one", m.Fqdn, template.Image())
+	}
+	if _, err := m.ZFS.Ensure(log, m.imagePath()); err != nil {
+		return nil, err
+	}
+	if m.dryRun {
+		// the copy is only recorded, the manager has to know the machine for the rest of the run
+		return template.Create(m.Fqdn)
+	}
+	log.Info("Copying template into dataset", "template", template.Image(), "dataset", m.ZFS.Dataset)
+	var stderr bytes.Buffer
+	cmd := exec.Command("cp", "-a", "--reflink=auto", source+"/.", m.imagePath())
+	cmd.Stderr = &stderr
+	if err := Commands.Run(cmd, nil, nil); err != nil {
+		return nil, fmt.Errorf("cp: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return manager.GetMachine(m.Fqdn)
+}
+
+// Encryption opens Device as a LUKS volume before it is mounted, the same way a crypttab entry would
+type Encryption struct {
+	// Name of the /dev/mapper device, defaults to machineutil-<mount name>
+	Name    string
+	KeyFile string
+	Options string
+	device  string
+}
+
+func (e *Encryption) Unit() string {
+	return "systemd-cryptsetup@" + unit.UnitNameEscape(e.Name) + ".service"
+}
+
+// systemdCryptsetup is the helper the crypttab generator points its units at
+const systemdCryptsetup = "/usr/lib/systemd/systemd-cryptsetup"
+
+// checkKeyFile refuses key files others could read, the key is as good as the data otherwise
+func (e *Encryption) checkKeyFile() error {
+	if e.KeyFile == "" || e.KeyFile == "-" || e.KeyFile == "none" {
+		return nil
+	}
+	info, err := os.Stat(e.KeyFile)
+	if err != nil {
+		return fmt.Errorf("key file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("key file %s is accessible by group or others (mode %o)", e.KeyFile, info.Mode().Perm())
+	}
+	return nil
+}
+
+func (e *Encryption) unitOptions() []*unit.UnitOption {
+	keyFile := e.KeyFile
+	if keyFile == "" {
+		keyFile = "-"
+	}
+	opts := e.Options
+	if opts == "" {
+		opts = "luks"
+	}
+	mapper := "blockdev@" + unit.UnitNamePathEscape("/dev/mapper/"+e.Name) + ".target"
+	return []*unit.UnitOption{
+		&unit.UnitOption{Section: "Unit", Name: "Description", Value: "Machineutil cryptography setup for " + e.Name},
+		&unit.UnitOption{Section: "Unit", Name: "DefaultDependencies", Value: "no"},
+		&unit.UnitOption{Section: "Unit", Name: "IgnoreOnIsolate", Value: "true"},
+		&unit.UnitOption{Section: "Unit", Name: "After", Value: "cryptsetup-pre.target"},
+		&unit.UnitOption{Section: "Unit", Name: "After", Value: "blockdev@" + unit.UnitNamePathEscape(e.device) + ".target"},
+		&unit.UnitOption{Section: "Unit", Name: "Before", Value: mapper},
+		&unit.UnitOption{Section: "Unit", Name: "Wants", Value: mapper},
+		&unit.UnitOption{Section: "Unit", Name: "Conflicts", Value: "umount.target"},
+		&unit.UnitOption{Section: "Unit", Name: "Before", Value: "umount.target"},
+		&unit.UnitOption{Section: "Service", Name: "Type", Value: "oneshot"},
+		&unit.UnitOption{Section: "Service", Name: "RemainAfterExit", Value: "yes"},
+		&unit.UnitOption{Section: "Service", Name: "TimeoutSec", Value: "0"},
+		&unit.UnitOption{Section: "Service", Name: "KeyringMode", Value: "shared"},
+		&unit.UnitOption{Section: "Service", Name: "ExecStart", Value: strings.Join([]string{systemdCryptsetup, "attach", execQuote(e.Name), execQuote(e.device), execQuote(keyFile), execQuote(opts)}, " ")},
+		&unit.UnitOption{Section: "Service", Name: "ExecStop", Value: systemdCryptsetup + " detach " + execQuote(e.Name)},
+	}
+}
+
+func (m *MountPoint) CryptsetupPath() string {
+	return filepath.Join(filepath.Dir(m.UnitPath()), m.Encryption.Unit())
+}
+
+// EnsureCryptsetup writes the systemd-cryptsetup@ unit of an encrypted mount
+func (m *MountPoint) EnsureCryptsetup(log *slog.Logger) (bool, error) {
+	if err := m.Encryption.checkKeyFile(); err != nil {
+		return false, fmt.Errorf("mount %s: %w", m.Name, err)
+	}
+	return util.EnsureUnit(log, m.CryptsetupPath(), m.Encryption.unitOptions())
+}
+
+func (m *MountPoint) UnitPath() string {
+	if m.runtime {
+		return "/run/systemd/system/" + m.Unit()
+	}
+	return "/etc/systemd/system/" + m.Unit()
+}
+
+func (m *MountPoint) addOption(option string) {
+	if m.Options != "" {
+		m.Options += "," + option
+	} else {
+		m.Options = option
+	}
+}
+
+// applyInstance gives the mount its own name, host path, image, dataset and mapper device in an instance,
+// the .mount and .automount units follow from the path. A block device exists only once and can't be renamed.
+func (m *MountPoint) applyInstance(instance string) error {
+	if m.Device != "" && m.Image == "" {
+		return fmt.Errorf("mount %s: a Device can't be used with an instance, use an Image or ZFS", m.Name)
+	}
+	m.Name += "-" + instance
+	if m.MountPoint != "" {
+		m.MountPoint = instancePath(m.MountPoint, instance)
+	}
+	if m.Image != "" {
+		m.Image = instancePath(m.Image, instance)
+	}
+	if m.ZFS != nil {
+		m.ZFS.Dataset += "-" + instance
+	}
+	if m.Encryption != nil && m.Encryption.Name != "" {
+		m.Encryption.Name += "-" + instance
+	}
+	return nil
+}
+
+func (m *MountPoint) Normalize() error {
+	if m.IdMap != "" && !slices.Contains(idmapModes, m.IdMap) {
+		return fmt.Errorf("mount %s: invalid IdMap %q, expected one of %s", m.Name, m.IdMap, strings.Join(idmapModes, ", "))
+	}
+	if m.IdMap != "" && m.NoIdMap {
+		return fmt.Errorf("mount %s: IdMap and NoIdMap are mutually exclusive", m.Name)
+	}
+	if m.ZFS != nil && (m.Image != "" || m.Encryption != nil || m.Automount) {
+		return fmt.Errorf("mount %s: ZFS datasets can't be combined with Image, Encryption or Automount", m.Name)
+	}
+	if m.Encryption != nil {
+		if m.Image != "" {
+			return fmt.Errorf("mount %s: encrypted loopback images are not supported", m.Name)
+		}
+		if m.Encryption.Name == "" {
+			m.Encryption.Name = "machineutil-" + m.Name
+		}
+		m.Encryption.device = m.Device
+		m.Device = "/dev/mapper/" + m.Encryption.Name
+		m.Requires = append(m.Requires, m.Encryption.Unit())
+		m.After = append(m.After, m.Encryption.Unit())
+	}
+	if m.Image != "" {
+		m.Device = m.Image
+		if m.FS == "" {
+			m.FS = "ext4"
+		}
+		m.addOption("loop")
+	}
+	if m.MountPoint == "" {
+		m.MountPoint = "/var/lib/machines/" + m.Name
+	}
+	if m.FS != "" {
+		m.MountOptions = append(m.MountOptions, &unit.UnitOption{
+			Section: "Mount",
+			Name:    "Type",
+			Value:   m.FS,
+		})
+	}
+	if m.AutoFs {
+		m.addOption("x-systemd.makefs,x-systemd.growfs")
+	}
+	if m.NoFail {
+		m.addOption("nofail")
+	}
+	if m.DeviceTimeout != "" {
+		m.addOption("x-systemd.device-timeout=" + m.DeviceTimeout)
+	}
+	// images and datasets have no block device of their own to check
+	if m.Passno > 0 && m.Device != "" && m.Image == "" && m.ZFS == nil {
+		// what the fstab generator emits for a non-zero passno
+		fsck := "systemd-fsck@" + unit.UnitNamePathEscape(m.Device) + ".service"
+		m.Requires = append(m.Requires, fsck)
+		m.After = append(m.After, fsck)
+	}
+	for _, dep := range m.Requires {
+		m.MountOptions = append(m.MountOptions, &unit.UnitOption{
+			Section: "Unit",
+			Name:    "Requires",
+			Value:   dep,
+		})
+	}
+	for _, dep := range m.After {
+		m.MountOptions = append(m.MountOptions, &unit.UnitOption{
+			Section: "Unit",
+			Name:    "After",
+			Value:   dep,
+		})
+	}
+	if m.Options != "" {
+		found := false
+		for _, mnt := range m.MountOptions {
+			if mnt.Section != "Mount" {
+				continue
+			}
+			if mnt.Name != "Options" {
+				continue
+			}
+			found = true
+			mnt.Value += "," + m.Options
+			break
+		}
+		if !found {
+			m.MountOptions = append(m.MountOptions, &unit.UnitOption{
+				Section: "Mount",
+				Name:    "Options",
+				Value:   m.Options,
+			})
+		}
+	}
+	return nil
+}
+
+var idmapModes = []string{"idmap", "rootidmap", "owneridmap"}
+
+// Idmapped reports whether the bind into the machine is idmapped, it is unless NoIdMap is set
+func (m *MountPoint) Idmapped() bool {
+	return !m.NoIdMap
+}
+
+func (m *MountPoint) GetNspawn() []*unit.UnitOption {
+	name := "Bind"
+	if m.ReadOnly {
+		name = "BindReadOnly"
+	}
+	mode := "noidmap"
+	if m.Idmapped() {
+		mode = m.IdMap
+		if mode == "" {
+			mode = "idmap"
+		}
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Files",
+			Name:    name,
+			Value:   m.MountPoint + ":" + m.Target + ":" + mode,
+		},
+	}
+}
+
+// vmspawnArgument shares the mount with a VM over virtiofs, there is no user namespace to map ids for
+func (m *MountPoint) vmspawnArgument() string {
+	if m.ReadOnly {
+		return "--bind-ro=" + m.MountPoint + ":" + m.Target
+	}
+	return "--bind=" + m.MountPoint + ":" + m.Target
+}
+
+func (m *MountPoint) Unit() string {
+	return unit.UnitNamePathEscape(m.MountPoint) + ".mount"
+}
+
+// ensureImage creates and formats the sparse backing file of a loopback mount.
+// x-systemd.makefs only works on block devices, so the new file is formatted right away.
+// The file is kept when the machine is destroyed, like any other storage.
+func (m *MountPoint) ensureImage(log *slog.Logger) error {
+	if _, err := util.Files.Stat(m.Image); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	size, err := util.ParseSize(m.Size)
+	if err != nil {
+		return fmt.Errorf("mount %s: %w", m.Name, err)
+	}
+	log.Info("Creating image file", "image", m.Image, "size", util.FormatBytes(size), "fs", m.FS)
+	if err := util.Files.MkdirAll(filepath.Dir(m.Image), 0700); err != nil {
+		return err
+	}
+	if err := util.Files.WriteFile(m.Image, nil, 0600); err != nil {
+		return err
+	}
+	err = util.Files.Truncate(m.Image, int64(size))
+	if err == nil {
+		err = Commands.Run(exec.Command("mkfs."+m.FS, m.Image), nil, nil)
+	}
+	if err != nil {
+		util.Files.Remove(m.Image)
+		return fmt.Errorf("creating image %s: %w", m.Image, err)
+	}
+	return nil
+}
+
+func (m *MountPoint) CreateMount(log *slog.Logger) (bool, error) {
+	if m.ZFS != nil {
+		return m.ZFS.Ensure(log, m.MountPoint)
+	}
+	if m.Image != "" {
+		if err := m.ensureImage(log); err != nil {
+			return false, err
+		}
+	}
+	return util.EnsureUnit(log, m.UnitPath(), m.mountOptions())
+}
+
+// mountOptions is the content of the .mount unit, ZFS datasets are mounted by zfs itself and have none
+func (m *MountPoint) mountOptions() []*unit.UnitOption {
+	if m.ZFS != nil {
+		return nil
+	}
+	opts := []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Unit",
+			Name:    "Description",
+			Value:   "Machineutil mountpoint " + m.Name,
+		},
+	}
+	if m.Image == "" {
+		opts = append(opts, &unit.UnitOption{
+			Section: "Unit",
+			Name:    "After",
+			Value:   "blockdev@" + unit.UnitNamePathEscape(m.Device),
+		})
+	}
+	opts = append(opts,
+		&unit.UnitOption{
+			Section: "Mount",
+			Name:    "What",
+			Value:   m.Device,
+		},
+		&unit.UnitOption{
+			Section: "Mount",
+			Name:    "Where",
+			Value:   m.MountPoint,
+		},
+	)
+	return append(opts, m.MountOptions...)
+}
+
+func (m *MountPoint) AutomountUnit() string {
+	return unit.UnitNamePathEscape(m.MountPoint) + ".automount"
+}
+
+func (m *MountPoint) AutomountPath() string {
+	return filepath.Join(filepath.Dir(m.UnitPath()), m.AutomountUnit())
+}
+
+// defaultIdleTimeout unmounts automounted storage this long after the machine stopped using it
+const defaultIdleTimeout = "5min"
+
+// EnsureAutomount writes the .automount paired with the .mount, or removes it when Automount is off
+func (m *MountPoint) EnsureAutomount(log *slog.Logger) (bool, error) {
+	return util.EnsureUnit(log, m.AutomountPath(), m.automountOptions())
+}
+
+// automountOptions is the content of the .automount unit, nil removes it
+func (m *MountPoint) automountOptions() []*unit.UnitOption {
+	if !m.Automount {
+		return nil
+	}
+	timeout := m.IdleTimeout
+	if timeout == "" {
+		timeout = defaultIdleTimeout
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Unit",
+			Name:    "Description",
+			Value:   "Machineutil automount " + m.Name,
+		},
+		&unit.UnitOption{
+			Section: "Automount",
+			Name:    "Where",
+			Value:   m.MountPoint,
+		},
+		&unit.UnitOption{
+			Section: "Automount",
+			Name:    "TimeoutIdleSec",
+			Value:   timeout,
+		},
+	}
+}
+
+func (m *MountPoint) RemoveMount(log *slog.Logger) (bool, error) {
+	if m.ZFS != nil {
+		return m.ZFS.Destroy(log)
+	}
+	opts := []*unit.UnitOption{}
+	mount_unit := m.UnitPath()
+	return util.EnsureUnit(log, mount_unit, opts)
+}
+
+func (m *MountPoint) GetOverride() []*unit.UnitOption {
+	if m.Automount {
+		// RequiresMountsFor would pull in the .mount directly and defeat the idle timeout
+		return []*unit.UnitOption{
+			&unit.UnitOption{
+				Section: "Unit",
+				Name:    "Requires",
+				Value:   m.AutomountUnit(),
+			},
+			&unit.UnitOption{
+				Section: "Unit",
+				Name:    "After",
+				Value:   m.AutomountUnit(),
+			},
+		}
+	}
+	return []*unit.UnitOption{
+		&unit.UnitOption{
+			Section: "Unit",
+			Name:    "RequiresMountsFor",
+			Value:   m.MountPoint,
+		},
+	}
+}
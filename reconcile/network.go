@@ -0,0 +1,190 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// Firewall keeps an nftables table in sync with the exposed ports of running machines.
+// It gates forwarded traffic to machines with Ports, new connections only reach the listed ports.
+// nftables has every base chain on the forward hook judge a packet and a drop anywhere is final,
+// so another table dropping forwarded traffic, e.g. one of firewalld, still has to allow the ports itself.
+// That also lets every machine have a base chain of its own, configs sharing the table only touch theirs.
+type Firewall struct {
+	Table string
+}
+
+func (f *Firewall) table() string {
+	if f.Table == "" {
+		return "machineutil"
+	}
+	return f.Table
+}
+
+// Ruleset renders the chains of the configured machines from the config and the running machines, each chain
+// is flushed first and removed once its machine stopped or lost its Ports. Chains of other configs stay as they are,
+// machines a failed run never got to keep theirs while they run.
+func (f *Firewall) Ruleset(config *Config, manager machineutil.MachineUtil) (string, error) {
+	var b strings.Builder
+	table := "inet " + f.table()
+	fmt.Fprintf(&b, "add table %s\n", table)
+	// older releases kept every machine in one forward chain, whichever config ran last owned all of it
+	fmt.Fprintf(&b, "add chain %s forward\nflush chain %s forward\ndelete chain %s forward\n", table, table, table)
+	for _, m := range config.Machines {
+		chain := fmt.Sprintf("%s %q", table, m.Fqdn)
+		fmt.Fprintf(&b, "add chain %s { type filter hook forward priority filter; policy accept; }\nflush chain %s\n", chain, chain)
+		var addrs []netip.Addr
+		if len(m.Ports) > 0 {
+			var err error
+			addrs, err = runningAddresses(m, manager)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", m.Fqdn, err)
+			}
+		}
+		if len(addrs) == 0 {
+			fmt.Fprintf(&b, "delete chain %s\n", chain)
+			continue
+		}
+		for _, addr := range addrs {
+			family := "ip"
+			if !addr.Unmap().Is4() {
+				family = "ip6"
+			}
+			for _, port := range m.Ports {
+				fmt.Fprintf(&b, "add rule %s %s daddr %s %s dport %d accept\n", chain, family, addr.Unmap(), port.Protocol, port.MachinePort)
+			}
+			fmt.Fprintf(&b, "add rule %s %s daddr %s ct state new drop\n", chain, family, addr.Unmap())
+		}
+	}
+	return b.String(), nil
+}
+
+// runningAddresses are the addresses of m while it runs, a static address wins over what machined reports
+func runningAddresses(m *Machine, manager machineutil.MachineUtil) ([]netip.Addr, error) {
+	machine, err := manager.GetMachine(m.Fqdn)
+	if errors.Is(err, machineutil.ErrNoSuchImage) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	machine.Class = m.Class
+	if !machine.Running() {
+		return nil, nil
+	}
+	if m.address.IsValid() {
+		return []netip.Addr{m.address.Addr()}, nil
+	}
+	return machine.UsableAddresses()
+}
+
+func (f *Firewall) Apply(log *slog.Logger, config *Config, manager machineutil.MachineUtil) error {
+	ruleset, err := f.Ruleset(config, manager)
+	if err != nil {
+		return err
+	}
+	log.Debug("Applying nftables ruleset", "ruleset", ruleset)
+	return nft(ruleset)
+}
+
+// RemoveChains drops the chains of machines no config has anymore, gc finds those by their orphaned files
+func (f *Firewall) RemoveChains(log *slog.Logger, fqdns []string) error {
+	if len(fqdns) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	table := "inet " + f.table()
+	fmt.Fprintf(&b, "add table %s\n", table)
+	for _, fqdn := range fqdns {
+		chain := fmt.Sprintf("%s %q", table, fqdn)
+		fmt.Fprintf(&b, "add chain %s\nflush chain %s\ndelete chain %s\n", chain, chain, chain)
+	}
+	log.Debug("Removing nftables chains", "ruleset", b.String())
+	return nft(b.String())
+}
+
+func nft(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	var out bytes.Buffer
+	cmd.Stdin = strings.NewReader(ruleset)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := Commands.Run(cmd, nil, nil)
+	if err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// ZoneNetwork configures the host side vz-<zone> bridge systemd-nspawn creates for Zone
+type ZoneNetwork struct {
+	Address      []string
+	DHCPServer   bool
+	IPMasquerade string
+}
+
+const zoneNetworkPrefix = "10-machineutil-vz-"
+
+func (z *ZoneNetwork) options(zone string) []*unit.UnitOption {
+	opts := []*unit.UnitOption{
+		&unit.UnitOption{Section: "Match", Name: "Name", Value: "vz-" + zone},
+		&unit.UnitOption{Section: "Match", Name: "Driver", Value: "bridge"},
+		&unit.UnitOption{Section: "Network", Name: "LinkLocalAddressing", Value: "yes"},
+	}
+	for _, addr := range z.Address {
+		opts = append(opts, &unit.UnitOption{Section: "Network", Name: "Address", Value: addr})
+	}
+	if z.DHCPServer {
+		opts = append(opts, &unit.UnitOption{Section: "Network", Name: "DHCPServer", Value: "yes"})
+	}
+	if z.IPMasquerade != "" {
+		opts = append(opts, &unit.UnitOption{Section: "Network", Name: "IPMasquerade", Value: z.IPMasquerade})
+	}
+	return opts
+}
+
+// zoneNetworkPaths are the host networkd files of zone in the persistent and the runtime placement
+func zoneNetworkPaths(zone string) []string {
+	name := zoneNetworkPrefix + zone + ".network"
+	return []string{util.NewNetworkFiles(util.NetworkdDir).Path(name), util.NewNetworkFiles(util.NetworkdRuntimeDir).Path(name)}
+}
+
+// EnsureZoneNetworks writes the host networkd files of all configured zones and reloads networkd on changes.
+// With runtime the files go to /run and copies of the same zones in /etc, which would outrank them, are removed,
+// and the other way around. Zones no longer configured may belong to another config on the host, gc removes
+// their files once no machine uses them.
+func EnsureZoneNetworks(log *slog.Logger, manager machineutil.MachineUtil, zones map[string]*ZoneNetwork, runtime bool) error {
+	files, other := util.NewNetworkFiles(util.NetworkdDir), util.NewNetworkFiles(util.NetworkdRuntimeDir)
+	if runtime {
+		files, other = other, files
+	}
+	for zone, network := range zones {
+		name := zoneNetworkPrefix + zone + ".network"
+		opts, err := util.ReadUnit(other.Path(name), false)
+		if err != nil {
+			return err
+		}
+		if util.IsGenerated(opts) {
+			if _, err := other.Remove(log, name); err != nil {
+				return err
+			}
+		}
+		if _, err := files.Ensure(log, name, network.options(zone)); err != nil {
+			return err
+		}
+	}
+	if files.Changed() || other.Changed() {
+		log.Info("Reloading systemd-networkd")
+		return manager.NetworkdReload()
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package reconcile
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/eax255/systemd-containers/machineutil"
+)
+
+func TestFirewallRulesetOnlyTouchesConfiguredMachines(t *testing.T) {
+	fake := machineutil.NewFake()
+	fake.AddImage("web.example.com")
+	fake.AddUnit("systemd-nspawn@web.example.com.service", "active")
+	fake.Addresses["web.example.com"] = []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	config := &Config{Machines: []*Machine{
+		{Fqdn: "web.example.com", Ports: []*PortForward{{Protocol: "tcp", HostPort: 8080, MachinePort: 80}}},
+		{Fqdn: "db.example.com", Ports: []*PortForward{{Protocol: "tcp", HostPort: 5432, MachinePort: 5432}}},
+	}}
+	ruleset, err := (&Firewall{}).Ruleset(config, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ruleset, "flush table") {
+		t.Errorf("ruleset flushes the shared table:\n%s", ruleset)
+	}
+	for _, want := range []string{
+		`add rule inet machineutil "web.example.com" ip daddr 192.0.2.1 tcp dport 80 accept`,
+		`add rule inet machineutil "web.example.com" ip daddr 192.0.2.1 ct state new drop`,
+		`delete chain inet machineutil "db.example.com"`,
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// Plan actions, named after the ones terraform uses
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionNoop   = "no-op"
+)
+
+// Resource types that appear in a plan
+const (
+	ResourceMachine  = "machine"
+	ResourceUnitFile = "unit_file"
+)
+
+// AttributeChange is a single attribute of a resource, nil Before or After means it is added or removed.
+// Unit file attributes are named Section.Option and can repeat, so every value is a list.
+type AttributeChange struct {
+	Name   string   `json:"name"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// ResourceChange is what a run does to a single machine or generated file
+type ResourceChange struct {
+	Address string             `json:"address"`
+	Type    string             `json:"type"`
+	Name    string             `json:"name"`
+	Action  string             `json:"action"`
+	Changes []*AttributeChange `json:"changes,omitempty"`
+}
+
+// Plan is the read only preview of a Run
+type Plan struct {
+	Mode      string            `json:"mode"`
+	Resources []*ResourceChange `json:"resource_changes"`
+}
+
+// Counts returns how many resources are added, changed and destroyed
+func (p *Plan) Counts() (add, change, destroy int) {
+	for _, r := range p.Resources {
+		switch r.Action {
+		case ActionCreate:
+			add++
+		case ActionUpdate:
+			change++
+		case ActionDelete:
+			destroy++
+		}
+	}
+	return
+}
+
+// HasChanges reports whether applying the plan would do anything
+func (p *Plan) HasChanges() bool {
+	add, change, destroy := p.Counts()
+	return add+change+destroy > 0
+}
+
+func attributes(opts []*unit.UnitOption) map[string][]string {
+	retval := make(map[string][]string)
+	for _, opt := range opts {
+		// the marker, labels and template are bookkeeping, not configuration
+		if opt.Name == util.Marker || opt.Name == util.LabelsOption || opt.Name == util.TemplateOption {
+			continue
+		}
+		key := opt.Section + "." + opt.Name
+		retval[key] = append(retval[key], opt.Value)
+	}
+	return retval
+}
+
+// diffAttributes compares two attribute sets, the result is sorted by name
+func diffAttributes(before, after map[string][]string) []*AttributeChange {
+	names := []string{}
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := []*AttributeChange{}
+	for _, name := range names {
+		if slices.Equal(before[name], after[name]) {
+			continue
+		}
+		changes = append(changes, &AttributeChange{Name: name, Before: before[name], After: after[name]})
+	}
+	return changes
+}
+
+// resourceAddress uses the index form of terraform addresses, names contain dots and slashes
+func resourceAddress(kind, name string) string {
+	return fmt.Sprintf("%s[%q]", kind, name)
+}
+
+func planUnitFile(file *UnitFile, remove bool) (*ResourceChange, error) {
+	current, err := util.ReadUnit(file.Path, true)
+	if err != nil {
+		return nil, err
+	}
+	// sorted like current and like EnsureUnit writes it, repeated settings would differ in order otherwise
+	desired := slices.Clone(file.Options)
+	slices.SortFunc(desired, util.CompareOptions)
+	if remove {
+		desired = nil
+	}
+	change := &ResourceChange{
+		Address: resourceAddress(ResourceUnitFile, file.Path),
+		Type:    ResourceUnitFile,
+		Name:    file.Path,
+		Changes: diffAttributes(attributes(current), attributes(desired)),
+	}
+	switch {
+	case len(change.Changes) == 0:
+		change.Action = ActionNoop
+	case len(current) == 0:
+		change.Action = ActionCreate
+	case len(desired) == 0:
+		change.Action = ActionDelete
+	default:
+		change.Action = ActionUpdate
+	}
+	return change, nil
+}
+
+// planMachine adds the changes of a single machine to the plan, m is a normalized copy of the configured machine
+func (r *Reconciler) planMachine(plan *Plan, m *Machine, mode string) error {
+	status, err := MachineStatus(r.State.Manager, m.Fqdn)
+	if err != nil {
+		return err
+	}
+	restart := false
+	// start and stop never touch the generated files
+	if mode == ModeCreate || (mode == ModeDestroy && status.State != "missing") {
+		files, err := m.UnitFiles()
+		if err != nil {
+			return err
+		}
+		override := (&machineutil.Machine{Name: m.Fqdn, Class: m.Class, Runtime: m.Runtime}).OverridePath()
+		for _, file := range files {
+			// machined deletes the settings file with the image, the service drop-ins are left behind
+			if mode == ModeDestroy && file.Kept {
+				continue
+			}
+			change, err := planUnitFile(file, mode == ModeDestroy)
+			if err != nil {
+				return err
+			}
+			restartFile := file.Restart && change.Action != ActionNoop
+			if restartFile && file.Path == override {
+				moved, err := movesResources(file.Path, file.Options, m.Resources.GetOverride())
+				if err != nil {
+					return err
+				}
+				restartFile = !moved
+			}
+			restart = restart || restartFile
+			plan.Resources = append(plan.Resources, change)
+		}
+	}
+	machine := &ResourceChange{
+		Address: resourceAddress(ResourceMachine, m.Fqdn),
+		Type:    ResourceMachine,
+		Name:    m.Fqdn,
+		Action:  ActionNoop,
+	}
+	state := func(before, after string) {
+		machine.Action = ActionUpdate
+		machine.Changes = append(machine.Changes, &AttributeChange{Name: "state", Before: []string{before}, After: []string{after}})
+	}
+	switch {
+	case mode == ModeCreate && status.State == "missing":
+		template, err := r.State.DiscoverTemplate(m)
+		if err != nil {
+			return err
+		}
+		machine.Action = ActionCreate
+		machine.Changes = []*AttributeChange{
+			{Name: "state", After: []string{"running"}},
+			{Name: "template", After: []string{template.Image()}},
+		}
+	case mode == ModeDestroy && status.State != "missing":
+		machine.Action = ActionDelete
+		machine.Changes = []*AttributeChange{{Name: "state", Before: []string{status.State}}}
+	case mode == ModeStop && status.State == "running":
+		state("running", "stopped")
+	case (mode == ModeCreate || mode == ModeStart) && m.OnDemand && status.State != "running":
+		// the first connection on its sockets starts it
+	case (mode == ModeCreate || mode == ModeStart) && (status.State == "stopped" || status.State == "failed"):
+		state(status.State, "running")
+	case mode == ModeCreate && status.State == "running" && restart:
+		state("running", "restarted")
+	}
+	if mode == ModeCreate && status.State != "missing" && m.Channel != "" {
+		template, err := r.State.DiscoverTemplate(m)
+		if err != nil {
+			return err
+		}
+		outdated, err := r.State.OutdatedTemplate(m, template)
+		if err != nil {
+			return err
+		}
+		if outdated != "" {
+			machine.Action = ActionUpdate
+			machine.Changes = append(machine.Changes, &AttributeChange{Name: "template", Before: []string{outdated}, After: []string{template.Image()}})
+		}
+	}
+	// listed after its files, they are written before the machine is (re)started
+	plan.Resources = append(plan.Resources, machine)
+	return nil
+}
+
+// Plan inspects the host and reports what Run(mode) would change without changing anything.
+// Commands are not part of the plan, whether they run is only decided while running.
+func (r *Reconciler) Plan(mode string) (*Plan, error) {
+	if !slices.Contains(Modes, mode) {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	plan := &Plan{Mode: mode}
+	for _, configured := range r.Config.Machines {
+		// Normalize appends to the config, Run still needs the original
+		m := util.DeepCopy(configured)
+		if err := m.Normalize(); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Fqdn, err)
+		}
+		if err := r.planMachine(plan, m, mode); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Fqdn, err)
+		}
+	}
+	return plan, nil
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+func quoteValues(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+var actionSymbols = map[string]string{
+	ActionCreate: "+",
+	ActionUpdate: "~",
+	ActionDelete: "-",
+}
+
+var actionColors = map[string]string{
+	ActionCreate: util.ColorGreen,
+	ActionUpdate: util.ColorYellow,
+	ActionDelete: util.ColorRed,
+}
+
+var actionDescriptions = map[string]string{
+	ActionCreate: "will be created",
+	ActionUpdate: "will be updated in-place",
+	ActionDelete: "will be destroyed",
+}
+
+// WriteText renders the plan the way terraform plan does, resources without changes are left out.
+// With util.Color the lines are colored by their action.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+	if !p.HasChanges() {
+		b.WriteString("No changes. The machines match the configuration.\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	b.WriteString("machineutil will perform the following actions:\n")
+	for _, r := range p.Resources {
+		symbol, ok := actionSymbols[r.Action]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "\n  %s\n", util.Colorize(util.ColorBold, fmt.Sprintf("# %s %s", r.Address, actionDescriptions[r.Action])))
+		fmt.Fprintf(&b, "  %s\n", util.Colorize(actionColors[r.Action], fmt.Sprintf("%s %s %q {", symbol, r.Type, r.Name)))
+		width := 0
+		for _, c := range r.Changes {
+			width = max(width, len(c.Name))
+		}
+		for _, c := range r.Changes {
+			var line, color string
+			switch {
+			case c.Before == nil:
+				line, color = fmt.Sprintf("+ %-*s = %s", width, c.Name, quoteValues(c.After)), util.ColorGreen
+			case c.After == nil:
+				line, color = fmt.Sprintf("- %-*s = %s", width, c.Name, quoteValues(c.Before)), util.ColorRed
+			default:
+				line, color = fmt.Sprintf("~ %-*s = %s -> %s", width, c.Name, quoteValues(c.Before), quoteValues(c.After)), util.ColorYellow
+			}
+			fmt.Fprintf(&b, "      %s\n", util.Colorize(color, line))
+		}
+		fmt.Fprintf(&b, "    %s\n", util.Colorize(actionColors[r.Action], "}"))
+	}
+	add, change, destroy := p.Counts()
+	fmt.Fprintf(&b, "\n%s\n", util.Colorize(util.ColorBold, fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy.", add, change, destroy)))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
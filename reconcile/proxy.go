@@ -0,0 +1,203 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// ProxySocket listens on the host and starts the machine on the first connection, forwarding through systemd-socket-proxyd.
+// Target defaults to the static address of the machine when it is only a port. The proxy waits until Target accepts
+// connections, bounded by the start timeout of the service, so the first connections aren't lost while the machine boots.
+// A machine with OnDemand set is left to be started this way, runs only start its sockets. Startup commands and
+// readiness probes then only run when a run starts the machine itself.
+type ProxySocket struct {
+	Listen      string
+	Target      string
+	IdleTimeout string
+}
+
+const systemdSocketProxyd = "/usr/lib/systemd/systemd-socket-proxyd"
+
+func (m *Machine) unitDir() string {
+	if m.Runtime {
+		return "/run/systemd/system"
+	}
+	return "/etc/systemd/system"
+}
+
+func (m *Machine) proxyUnit(i int, suffix string) string {
+	return "machineutil-proxy-" + unit.UnitNameEscape(m.Fqdn) + "-" + strconv.Itoa(i) + suffix
+}
+
+func (p *ProxySocket) target(m *Machine) (string, error) {
+	if _, _, err := net.SplitHostPort(p.Target); err == nil {
+		return p.Target, nil
+	}
+	if !m.address.IsValid() {
+		return "", fmt.Errorf("proxy socket %s needs a full Target without a static address", p.Listen)
+	}
+	return net.JoinHostPort(m.address.Addr().String(), p.Target), nil
+}
+
+func (p *ProxySocket) units(m *Machine, i int) (socket, service []*unit.UnitOption, err error) {
+	target, err := p.target(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	description := "Machineutil proxy " + p.Listen + " to " + m.Fqdn
+	socket = []*unit.UnitOption{
+		&unit.UnitOption{Section: "Unit", Name: "Description", Value: description},
+		&unit.UnitOption{Section: "Socket", Name: "ListenStream", Value: p.Listen},
+		&unit.UnitOption{Section: "Install", Name: "WantedBy", Value: "sockets.target"},
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	// bash can connect on its own, an accepted connection is closed again right away
+	ready := "/bin/bash -c 'until : 2>/dev/null 3<>/dev/tcp/" + host + "/" + port + "; do sleep 0.2; done'"
+	execStart := systemdSocketProxyd
+	if p.IdleTimeout != "" {
+		execStart += " " + execQuote("--exit-idle-time="+p.IdleTimeout)
+	}
+	service = []*unit.UnitOption{
+		&unit.UnitOption{Section: "Unit", Name: "Description", Value: description},
+		&unit.UnitOption{Section: "Unit", Name: "Requires", Value: m.proxyUnit(i, ".socket")},
+		&unit.UnitOption{Section: "Unit", Name: "After", Value: m.proxyUnit(i, ".socket")},
+		&unit.UnitOption{Section: "Unit", Name: "BindsTo", Value: DependencyUnit(m.Fqdn)},
+		&unit.UnitOption{Section: "Unit", Name: "After", Value: DependencyUnit(m.Fqdn)},
+		&unit.UnitOption{Section: "Service", Name: "ExecStartPre", Value: ready},
+		&unit.UnitOption{Section: "Service", Name: "ExecStart", Value: execStart + " " + execQuote(target)},
+		&unit.UnitOption{Section: "Service", Name: "PrivateTmp", Value: "yes"},
+	}
+	return socket, service, nil
+}
+
+// EnsureProxySockets writes the socket and proxy service units, stale ones from removed entries are stopped,
+// disabled and removed
+func (m *Machine) EnsureProxySockets(log *slog.Logger, manager machineutil.MachineUtil, changes *ChangeSet) (bool, error) {
+	changed := false
+	ensure := func(name string, opts []*unit.UnitOption) error {
+		file := filepath.Join(m.unitDir(), name)
+		c, err := changes.Track(file, func() (bool, error) { return util.EnsureUnit(log, file, opts) })
+		changed = changed || c
+		return err
+	}
+	for i, p := range m.ProxySockets {
+		socket, service, err := p.units(m, i)
+		if err != nil {
+			return changed, err
+		}
+		if err := ensure(m.proxyUnit(i, ".socket"), socket); err != nil {
+			return changed, err
+		}
+		if err := ensure(m.proxyUnit(i, ".service"), service); err != nil {
+			return changed, err
+		}
+	}
+	// escaped names carry backslashes, which a glob pattern would take for escapes
+	prefix := "machineutil-proxy-" + unit.UnitNameEscape(m.Fqdn) + "-"
+	names, err := util.Files.ReadDir(m.unitDir())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return changed, err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		keep := false
+		for i := range m.ProxySockets {
+			keep = keep || name == m.proxyUnit(i, ".socket") || name == m.proxyUnit(i, ".service")
+		}
+		if !keep {
+			log.Info("Removing stale proxy unit", "unit", name)
+			if err := stopUnit(manager, name); err != nil {
+				return changed, err
+			}
+			if strings.HasSuffix(name, ".socket") {
+				if _, err := manager.DisableUnit(name, m.Runtime); err != nil {
+					return changed, err
+				}
+			}
+			if err := ensure(name, nil); err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// StartProxySockets enables and starts the sockets, stop pairs them with StopProxySockets.
+// For OnDemand machines this is all that is started, the first connection starts the machine.
+func (m *Machine) StartProxySockets(manager machineutil.MachineUtil) error {
+	for i := range m.ProxySockets {
+		if _, err := manager.EnableUnit(m.proxyUnit(i, ".socket"), m.Runtime); err != nil {
+			return err
+		}
+		job, err := manager.Start(m.proxyUnit(i, ".socket"))
+		if err != nil {
+			return err
+		}
+		if err := job.Wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopProxySockets stops the sockets so a stopped machine isn't started again by the next connection
+func (m *Machine) StopProxySockets(manager machineutil.MachineUtil) error {
+	for i := range m.ProxySockets {
+		for _, name := range []string{m.proxyUnit(i, ".socket"), m.proxyUnit(i, ".service")} {
+			if err := stopUnit(manager, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func stopUnit(manager machineutil.MachineUtil, name string) error {
+	job, err := manager.Stop(name)
+	if err != nil {
+		return err
+	}
+	return job.Wait()
+}
+
+// PortForward is forwarded from the host by systemd-nspawn, MachinePort defaults to HostPort
+type PortForward struct {
+	Protocol    string
+	HostPort    uint16
+	MachinePort uint16
+}
+
+func (p *PortForward) Normalize() error {
+	if p.Protocol == "" {
+		p.Protocol = "tcp"
+	}
+	if p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("invalid port protocol %q, expected tcp or udp", p.Protocol)
+	}
+	if p.HostPort == 0 {
+		return fmt.Errorf("port forward without HostPort")
+	}
+	if p.MachinePort == 0 {
+		p.MachinePort = p.HostPort
+	}
+	return nil
+}
+
+func (p *PortForward) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Protocol, p.HostPort, p.MachinePort)
+}
@@ -0,0 +1,423 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// Lifecycle modes understood by Reconciler.Run
+const (
+	ModeCreate  = "create"
+	ModeStart   = "start"
+	ModeStop    = "stop"
+	ModeDestroy = "destroy"
+)
+
+var Modes = []string{ModeCreate, ModeStart, ModeStop, ModeDestroy}
+
+// Options tune a Reconciler, the zero value is what the apply subcommand does without flags
+type Options struct {
+	// SkipChecks skips the host prerequisite checks
+	SkipChecks bool
+	// Runtime writes generated units and zone networks under /run so they vanish on reboot
+	Runtime bool
+	// ResetFailed clears the failed state of machine units before starting them
+	ResetFailed bool
+	// Summary receives a table of what changed per machine, nil skips it
+	Summary io.Writer
+	// Rollback restores files, image and running state of a machine whose create run failed midway.
+	// Every changed machine gets an image snapshot first, a full copy unless the images live on btrfs.
+	Rollback bool
+	// Manager replaces the connection to machined and systemd, e.g. with a machineutil.Fake
+	Manager machineutil.MachineUtil
+	// Progress is told about every machine as the run goes, nil skips it
+	Progress Progress
+	// DryRun skips the Ready probes, they would reach out to machines that only exist in Manager.
+	// It goes with a machineutil.Fake Manager, a util.MemFileSystem and a RecordingRunner.
+	DryRun bool
+}
+
+// Reconciler drives the machines of a Config towards one of the lifecycle modes
+type Reconciler struct {
+	Config  *Config
+	Options Options
+	State   *State
+	// ownsManager is set when New connected itself and Close has to disconnect
+	ownsManager bool
+}
+
+// New connects to the host services, config should come from LoadConfig
+func New(config *Config, opts Options) (*Reconciler, error) {
+	for _, m := range config.Machines {
+		m.Runtime = m.Runtime || opts.Runtime
+		m.ResetFailed = m.ResetFailed || opts.ResetFailed
+		m.dryRun = opts.DryRun
+	}
+	slog.Info("Creating state")
+	var state *State
+	var err error
+	if opts.Manager != nil {
+		state, err = NewStateWith(config, opts.Manager)
+	} else {
+		state, err = NewState(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	state.Progress = opts.Progress
+	return &Reconciler{Config: config, Options: opts, State: state, ownsManager: opts.Manager == nil}, nil
+}
+
+// Close disconnects from the host services, a Manager passed in Options is left to its owner
+func (r *Reconciler) Close() error {
+	if !r.ownsManager {
+		return nil
+	}
+	return r.State.Manager.Close()
+}
+
+// Apply creates, configures and starts every machine
+func (r *Reconciler) Apply() (*Report, error) { return r.Run(ModeCreate) }
+
+// Destroy removes every machine and its mounts
+func (r *Reconciler) Destroy() (*Report, error) { return r.Run(ModeDestroy) }
+
+// Run reconciles every machine in order and stops at the first failing one.
+// The report is returned whenever the run got past the prerequisite checks, also on failure.
+func (r *Reconciler) Run(mode string) (*Report, error) {
+	span := util.Trace("machineutil "+mode, "mode", mode, "config.hash", r.Config.Hash())
+	report, err := r.run(mode)
+	span.End(err)
+	return report, err
+}
+
+func (r *Reconciler) run(mode string) (*Report, error) {
+	if !slices.Contains(Modes, mode) {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	config, state := r.Config, r.State
+	if !r.Options.SkipChecks {
+		slog.Info("Checking host prerequisites")
+		err := state.CheckPrerequisites(config, mode)
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				slog.Error("Prerequisite check failed", "error", e)
+			}
+			return nil, err
+		}
+	}
+	base_log := slog.Default().With("mode", mode)
+	base_log.Info("Starting execution")
+	report := NewReport(mode)
+	if err := runHooks(base_log, config.PreRun, report, &CommandEnv{Mode: mode, Vars: config.Vars, Registry: state.Registry}); err != nil {
+		base_log.Error("PreRun hook failed", "error", err)
+		return report, fmt.Errorf("PreRun hook: %w", err)
+	}
+	// zone bridges and slices are shared by machines, they are left in place by stop and destroy
+	if mode == ModeCreate {
+		if r.Options.Rollback {
+			if err := state.SaveShared(config); err != nil {
+				base_log.Error("Saving slices and zone networks for rollback", "error", err)
+				return report, fmt.Errorf("saving slices and zone networks: %w", err)
+			}
+		}
+		if err := EnsureZoneNetworks(base_log, state.Manager, config.Zones, r.Options.Runtime); err != nil {
+			base_log.Error("Configuring zone networks", "error", err)
+			return report, fmt.Errorf("configuring zone networks: %w", err)
+		}
+		if err := EnsureSlices(base_log, state.Manager, config.Slices, r.Options.Runtime); err != nil {
+			base_log.Error("Configuring slices", "error", err)
+			return report, fmt.Errorf("configuring slices: %w", err)
+		}
+	}
+	var failed error
+	for i, m := range config.Machines {
+		log := base_log.With("machine", m.Fqdn)
+		machineReport := report.Machine(m.Fqdn)
+		if r.Options.Progress != nil {
+			r.Options.Progress.Start(i+1, len(config.Machines), m.Fqdn)
+		}
+		unlock := state.Lock(m.Fqdn)
+		start := time.Now()
+		span := util.Trace("machine "+m.Fqdn, "machine", m.Fqdn, "mode", mode)
+		err := reconcileMachine(log, state, m, mode, machineReport, r.Options.Rollback)
+		span.End(err)
+		machineReport.Duration = time.Since(start)
+		unlock()
+		machineReport.Changes = state.ChangeSet(m.Fqdn)
+		machineReport.Timings = *state.Timings(m.Fqdn)
+		if err != nil {
+			machineReport.Error = err.Error()
+			machineReport.Events = append(machineReport.Events, EventFailed)
+		}
+		if r.Options.Progress != nil {
+			r.Options.Progress.Done(machineReport)
+		}
+		if config.Notifications != nil {
+			for _, event := range machineReport.Events {
+				config.Notifications.Notify(log, &Notification{
+					Event:   event,
+					Machine: m.Fqdn,
+					Mode:    mode,
+					Error:   machineReport.Error,
+					Time:    time.Now(),
+				})
+			}
+		}
+		if err != nil {
+			failed = fmt.Errorf("%s: %w", m.Fqdn, err)
+			break
+		}
+	}
+	if r.Options.Summary != nil {
+		PrintSummary(r.Options.Summary, report)
+	}
+	// PostRun also runs after a failure, undoing what PreRun did usually matters most then
+	if err := runHooks(base_log, config.PostRun, report, &CommandEnv{Mode: mode, Vars: config.Vars, Registry: state.Registry}); err != nil {
+		base_log.Error("PostRun hook failed", "error", err)
+		return report, fmt.Errorf("PostRun hook: %w", err)
+	}
+	if config.Firewall != nil {
+		base_log.Info("Updating firewall rules", "table", config.Firewall.table())
+		if err := config.Firewall.Apply(base_log, config, state.Manager); err != nil {
+			base_log.Error("Updating firewall rules", "error", err)
+			return report, fmt.Errorf("updating firewall rules: %w", err)
+		}
+	}
+	if failed != nil {
+		return report, failed
+	}
+	if config.SSH != nil && (mode == ModeCreate || mode == ModeStart) {
+		base_log.Info("Writing SSH configuration", "config", config.SSH.ConfigFile, "knownhosts", config.SSH.KnownHostsFile)
+		if err := config.SSH.Write(report.Machines); err != nil {
+			base_log.Error("Writing SSH configuration", "error", err)
+			return report, fmt.Errorf("writing SSH configuration: %w", err)
+		}
+	}
+	base_log.Info("Done.")
+	return report, nil
+}
+
+// runHooks runs PreRun or PostRun on the host in env, {{report}} names a snapshot of the report so far.
+// Outputs registered by PreRun are available to every machine, PostRun sees those of the machines.
+func runHooks(log *slog.Logger, hooks []*CommandDescription, report *Report, env *CommandEnv) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	snapshot, err := report.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(snapshot)
+	env.Report = snapshot
+	for _, cmd := range hooks {
+		log.Info("Running hook", "command", cmd.Command)
+		if err := cmd.Run(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcileMachine(log *slog.Logger, state *State, m *Machine, mode string, machineReport *MachineReport, rollback bool) error {
+	var backup *Backup
+	fail := func(msg string, err error) error {
+		log.Error(msg, "error", err)
+		err = fmt.Errorf("%s: %w", msg, err)
+		if uerr := state.AbortUpgrade(log, m); uerr != nil {
+			log.Error("Putting back the outdated image failed", "error", uerr)
+			err = errors.Join(err, fmt.Errorf("abort upgrade: %w", uerr))
+		}
+		if backup != nil {
+			log.Warn("Rolling back")
+			if rerr := backup.Restore(log, state, m); rerr != nil {
+				log.Error("Rollback failed", "error", rerr)
+				return errors.Join(err, fmt.Errorf("rollback: %w", rerr))
+			}
+			machineReport.Events = append(machineReport.Events, EventRolledBack)
+		}
+		return err
+	}
+	m.starting = mode == ModeCreate || mode == ModeStart
+	err := m.Normalize()
+	if err != nil {
+		return fail("Normalizing config", err)
+	}
+	if mode == "destroy" {
+		log.Info("Removing")
+		removed, err := state.RemoveMachine(log, m)
+		if err != nil {
+			return fail("Removing", err)
+		}
+		if removed {
+			machineReport.Events = append(machineReport.Events, EventDestroyed)
+		}
+		return nil
+	}
+	timings := state.Timings(m.Fqdn)
+	var template *machineutil.Template
+	if mode == "create" {
+		done := state.phase(m.Fqdn, PhaseTemplate)
+		template, err = state.DiscoverTemplate(m)
+		done()
+		if err != nil {
+			return fail("Discovering template", err)
+		}
+		m.template = template
+		outdated, err := state.OutdatedTemplate(m, template)
+		if err != nil {
+			return fail("Checking channel", err)
+		}
+		m.runUpgrade = outdated != ""
+		if rollback {
+			backup, err = state.Backup(log, m)
+			if err != nil {
+				return fail("Backing up for rollback", err)
+			}
+		}
+		if m.runUpgrade {
+			log.Info("Upgrading", "from", outdated, "to", template.Image(), "channel", m.Channel)
+			if err := state.Upgrade(log, m, template); err != nil {
+				return fail("Upgrading", err)
+			}
+			machineReport.Events = append(machineReport.Events, EventUpgraded)
+		}
+	}
+	log.Info("Detecting machine")
+	machine, _, reload, err := state.EnsureMachine(log, m, template)
+	if mode == "stop" {
+		if errors.Is(err, machineutil.ErrNoSuchImage) {
+			log.Warn("Missing")
+			return nil
+		}
+	}
+	if err != nil {
+		return fail("Detecting", err)
+	}
+	log.Info("Found")
+	if err := m.resolveTemplate(machine); err != nil {
+		return fail("Reading template record", err)
+	}
+	if mode == "stop" {
+		err = m.StopProxySockets(state.Manager)
+		if err != nil {
+			return fail("Stopping proxy sockets", err)
+		}
+		if m.GPU != nil {
+			if err := m.GPU.RevokeAccess(log, machine); err != nil {
+				return fail("Revoking GPU access", err)
+			}
+		}
+		log.Info("Stopping")
+		running := machine.Running()
+		err = machine.Stop()
+		if err != nil {
+			return fail("Stopping", err)
+		}
+		if running {
+			machineReport.Events = append(machineReport.Events, EventStopped)
+		}
+		err = m.Unmount(state.Manager)
+		if err != nil {
+			return fail("Unmounting failed", err)
+		}
+		return nil
+	}
+	if reload {
+		done := state.phase(m.Fqdn, PhaseReload)
+		err := state.Manager.DaemonReload()
+		done()
+		if err != nil {
+			return fail("Failed to reload daemon", err)
+		}
+	}
+	if m.runCreation {
+		machineReport.Events = append(machineReport.Events, EventCreated)
+	}
+	if m.OnDemand && !m.running(machine) {
+		log.Info("Waiting for a connection to start")
+		if err := m.StartProxySockets(state.Manager); err != nil {
+			return fail("Starting proxy sockets", err)
+		}
+		machineReport.State = "stopped"
+		return nil
+	}
+	if !m.running(machine) {
+		log.Info("Starting")
+		done := state.phase(m.Fqdn, PhaseStart)
+		err = machine.Start()
+		done()
+		m.runStartup = true
+		if err != nil {
+			return fail("Starting", err)
+		}
+		machineReport.Events = append(machineReport.Events, EventStarted)
+	}
+	var addr []netip.Addr
+	done := state.phase(m.Fqdn, PhaseAddress)
+	if m.Booted() {
+		log.Info("Waiting for address")
+		addr, err = m.waitForAddress(machine)
+	} else {
+		// nothing inside configures the network, take whatever the host side already assigned
+		addr, err = machine.UsableAddresses()
+	}
+	done()
+	if err != nil {
+		return fail("Wait address", err)
+	}
+	// mounts are only active once the machine started
+	if err := m.EnsureOwnership(log, machine); err != nil {
+		return fail("Mount ownership", err)
+	}
+	if err := m.EnsureJournalDir(log, machine); err != nil {
+		return fail("Journal directory", err)
+	}
+	if err := m.StartProxySockets(state.Manager); err != nil {
+		return fail("Starting proxy sockets", err)
+	}
+	machineReport.Addresses = addr
+	if len(m.Ready) > 0 {
+		log.Info("Waiting for readiness")
+		done := state.phase(m.Fqdn, PhaseReady)
+		err = m.WaitReady(machine, addr)
+		done()
+		if err != nil {
+			return fail("Readiness", err)
+		}
+	}
+	if state.Progress != nil {
+		state.Progress.Phase(m.Fqdn, PhaseCommand)
+	}
+	err = m.RunCommands(machine, addr, state.ChangeSet(m.Fqdn), timings, state.Registry)
+	if err != nil {
+		return fail("Startup commands failed", err)
+	}
+	machineReport.State = "running"
+	machineReport.Usage, err = machine.ResourceUsage()
+	if err != nil {
+		log.Warn("Reading resource usage", "error", err)
+	}
+	machineReport.HostKeys, err = machine.HostKeys()
+	if err != nil {
+		log.Warn("Reading SSH host keys", "error", err)
+	}
+	if err := state.FinishUpgrade(log, m); err != nil {
+		log.Warn("Removing outdated image", "error", err)
+	}
+	if backup != nil {
+		if err := backup.Discard(state); err != nil {
+			log.Warn("Removing rollback snapshot", "snapshot", backup.Snapshot, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package reconcile
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+const testConfig = `
+defaulttemplate: base
+machines:
+- fqdn: web.example.com
+`
+
+// newTestReconciler runs against a Fake with a base template, files and commands stay in memory
+func newTestReconciler(t *testing.T) (*Reconciler, *machineutil.Fake, *util.MemFileSystem, *RecordingRunner) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig([]string{file}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := machineutil.NewFake()
+	fake.AddImage("base-template_1")
+	fake.Addresses["web.example.com"] = []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	mem, runner := util.NewMemFileSystem(), &RecordingRunner{}
+	files, commands := util.Files, Commands
+	util.Files, Commands = mem, runner
+	t.Cleanup(func() { util.Files, Commands = files, commands })
+	r, err := New(config, Options{SkipChecks: true, Manager: fake, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, fake, mem, runner
+}
+
+func TestRunCreateRerunDestroy(t *testing.T) {
+	r, fake, mem, _ := newTestReconciler(t)
+	unitFile := "/etc/systemd/nspawn/web.example.com.nspawn"
+
+	if _, err := r.Run(ModeCreate); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !slices.Contains(fake.Images(), "web.example.com") {
+		t.Fatalf("create didn't clone the machine, images %v", fake.Images())
+	}
+	if !slices.Contains(fake.Calls, "StartUnit systemd-nspawn@web.example.com.service") {
+		t.Fatalf("create didn't start the machine, calls %v", fake.Calls)
+	}
+	if !slices.Contains(mem.Names(), unitFile) {
+		t.Fatalf("create didn't write %s, wrote %v", unitFile, mem.Names())
+	}
+
+	fake.Calls = nil
+	plan, err := r.Plan(ModeCreate)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if add, change, destroy := plan.Counts(); add+change+destroy != 0 {
+		t.Fatalf("plan after create isn't empty: %d to add, %d to change, %d to destroy", add, change, destroy)
+	}
+	written := mem.Names()
+	if _, err := r.Run(ModeCreate); err != nil {
+		t.Fatalf("re-run: %v", err)
+	}
+	for _, call := range fake.Calls {
+		if !strings.HasPrefix(call, "DaemonReload") && !strings.HasPrefix(call, "NetworkdReload") {
+			t.Errorf("re-run changed the machine: %s", call)
+		}
+	}
+	if !slices.Equal(mem.Names(), written) {
+		t.Errorf("re-run wrote %v, had %v", mem.Names(), written)
+	}
+
+	if _, err := r.Run(ModeDestroy); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	if slices.Contains(fake.Images(), "web.example.com") {
+		t.Errorf("destroy left the image")
+	}
+	if state, _ := fake.UnitState("systemd-nspawn@web.example.com.service"); state.ActiveState != "inactive" {
+		t.Errorf("destroy left the unit %s", state.ActiveState)
+	}
+	if _, err := util.Files.Stat(unitFile); !os.IsNotExist(err) {
+		t.Errorf("destroy left %s", unitFile)
+	}
+	orphans, err := r.Orphans()
+	if err != nil {
+		t.Fatalf("orphans: %v", err)
+	}
+	for _, orphan := range orphans {
+		t.Errorf("destroy left %s for gc", orphan.Path)
+	}
+}
@@ -0,0 +1,227 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+type MachineReport struct {
+	Fqdn      string
+	State     string
+	Unit      string
+	Labels    map[string]string `json:",omitempty"`
+	Restarts  uint32
+	Started   time.Time
+	Addresses []netip.Addr
+	HostKeys  []string
+	Usage     *machineutil.ResourceUsage
+	Events    []string
+	Changes   *ChangeSet
+	Error     string
+	// DiskUsage and DiskLimit are the size of the image and its limit, 0 when unknown or unlimited
+	DiskUsage uint64 `json:",omitempty"`
+	DiskLimit uint64 `json:",omitempty"`
+	// Duration is how long the machine took in this run, Timings break it down by phase
+	Duration time.Duration `json:",omitempty"`
+	Timings  Timings       `json:",omitempty"`
+}
+
+type Report struct {
+	Build    machineutil.BuildInfo
+	Mode     string
+	Started  time.Time
+	Finished time.Time
+	Machines []*MachineReport
+}
+
+func NewReport(mode string) *Report {
+	return &Report{
+		Build:   machineutil.GetBuildInfo(),
+		Mode:    mode,
+		Started: time.Now(),
+	}
+}
+
+// Find returns the report of fqdn, nil if it wasn't part of the run
+func (r *Report) Find(fqdn string) *MachineReport {
+	for _, m := range r.Machines {
+		if m.Fqdn == fqdn {
+			return m
+		}
+	}
+	return nil
+}
+
+func (r *Report) Machine(fqdn string) *MachineReport {
+	retval := &MachineReport{Fqdn: fqdn}
+	r.Machines = append(r.Machines, retval)
+	return retval
+}
+
+// redacted returns a copy of r with secrets in the errors replaced
+func (r *Report) redacted() *Report {
+	retval := *r
+	retval.Machines = make([]*MachineReport, len(r.Machines))
+	for i, m := range r.Machines {
+		machine := *m
+		machine.Error = util.Redact(m.Error)
+		retval.Machines[i] = &machine
+	}
+	return &retval
+}
+
+func (r *Report) encode(f *os.File) error {
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.redacted())
+}
+
+func (r *Report) Write(file string) error {
+	if file == "" {
+		return nil
+	}
+	r.Finished = time.Now()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.encode(f)
+}
+
+// Snapshot writes the report as it currently stands to a temporary file for hooks to read
+func (r *Report) Snapshot() (string, error) {
+	f, err := os.CreateTemp("", "machineutil-report-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := r.encode(f); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Result is failed, changed or unchanged
+func (m *MachineReport) Result() string {
+	switch {
+	case m.Error != "":
+		return "failed"
+	case m.Changes != nil && m.Changes.Changed():
+		return "changed"
+	}
+	return "unchanged"
+}
+
+// resultColors color the summary rows, unchanged machines stay plain
+var resultColors = map[string]string{
+	"failed":  util.ColorRed,
+	"changed": util.ColorYellow,
+}
+
+// PrintSummary writes a table of what changed per machine, the files each machine changed and the timings.
+// With util.Color rows and files are colored, they are aligned before the colors are added.
+func PrintSummary(w io.Writer, report *Report) {
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE\tRESULT\tCLONED\tRESTARTED\tADDED\tMODIFIED\tREMOVED\tCOMMANDS\tFILES")
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	for _, m := range report.Machines {
+		c := m.Changes
+		if c == nil {
+			c = &ChangeSet{}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", m.Fqdn, m.Result(), yesNo[c.Cloned], yesNo[c.Restarted],
+			len(c.UnitsAdded), len(c.UnitsModified), len(c.UnitsRemoved), c.CommandsRun, len(c.FilesWritten))
+	}
+	tw.Flush()
+	lines := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+	fmt.Fprintln(w, util.Colorize(util.ColorBold, lines[0]))
+	for i, line := range lines[1:] {
+		fmt.Fprintln(w, util.Colorize(resultColors[report.Machines[i].Result()], line))
+	}
+	PrintChanges(w, report)
+	fmt.Fprintln(w)
+	PrintTimings(w, report)
+}
+
+// PrintChanges lists the files every machine added (+), modified or wrote (~) and removed (-)
+func PrintChanges(w io.Writer, report *Report) {
+	for _, m := range report.Machines {
+		c := m.Changes
+		if c == nil || len(c.UnitsAdded)+len(c.UnitsModified)+len(c.UnitsRemoved)+len(c.FilesWritten) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n", util.Colorize(util.ColorBold, m.Fqdn+":"))
+		for _, file := range c.UnitsAdded {
+			fmt.Fprintf(w, "  %s\n", util.Colorize(util.ColorGreen, "+ "+file))
+		}
+		for _, file := range c.UnitsModified {
+			fmt.Fprintf(w, "  %s\n", util.Colorize(util.ColorYellow, "~ "+file))
+		}
+		for _, file := range c.FilesWritten {
+			fmt.Fprintf(w, "  %s\n", util.Colorize(util.ColorYellow, "~ "+file))
+		}
+		for _, file := range c.UnitsRemoved {
+			fmt.Fprintf(w, "  %s\n", util.Colorize(util.ColorRed, "- "+file))
+		}
+	}
+}
+
+// MachineStatus inspects the current state of a configured machine without changing anything.
+// Only failing to look the machine up is an error, details that can't be read are left out and their
+// errors are recorded in Error of the report.
+func MachineStatus(manager machineutil.MachineUtil, fqdn string) (*MachineReport, error) {
+	retval := &MachineReport{Fqdn: fqdn, State: "missing"}
+	machine, err := manager.GetMachine(fqdn)
+	if errors.Is(err, machineutil.ErrNoSuchImage) {
+		return retval, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	retval.State = "stopped"
+	if retval.Labels, err = machine.Labels(); err != nil {
+		errs = append(errs, fmt.Errorf("labels: %w", err))
+	}
+	if state, err := machine.UnitState(); err == nil {
+		retval.Unit = state.String()
+		if state.Failed() {
+			retval.State = "failed"
+		}
+	}
+	if n, err := machine.Restarts(); err == nil {
+		retval.Restarts = n
+	}
+	if retval.DiskUsage, retval.DiskLimit, err = machine.DiskUsage(); err != nil {
+		errs = append(errs, fmt.Errorf("disk usage: %w", err))
+	}
+	if machine.Running() {
+		retval.State = "running"
+		if retval.Started, err = machine.Started(); err != nil {
+			errs = append(errs, fmt.Errorf("start time: %w", err))
+		}
+		if retval.Addresses, err = machine.Addresses(); err != nil {
+			errs = append(errs, fmt.Errorf("addresses: %w", err))
+		}
+		if retval.Usage, err = machine.ResourceUsage(); err != nil {
+			errs = append(errs, fmt.Errorf("resource usage: %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		retval.Error = strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+	return retval, nil
+}
@@ -0,0 +1,326 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// rollbackSuffix names the image snapshot taken before an existing machine is changed
+const rollbackSuffix = ".rollback"
+
+// rollbackSnapshot names the ZFS snapshots taken next to the image snapshot
+const rollbackSnapshot = "@machineutil-rollback"
+
+// Backup is what a machine looked like before a run started changing it
+type Backup struct {
+	Fqdn    string
+	Existed bool
+	Running bool
+	// Snapshot is the image holding the previous root file system, empty when the machine didn't exist
+	// or the run doesn't change it
+	Snapshot string
+	// Files maps every generated file to its previous content, nil when it didn't exist.
+	// The slice and zone network the machine uses are included as they were before the run.
+	Files map[string][]byte
+	// Datasets maps the ZFS datasets of the machine and its mounts to whether they existed, those that did have a snapshot
+	Datasets map[string]bool
+	// ACLs are the access control lists of the GPU nodes in the format of getfacl
+	ACLs []byte
+}
+
+// SaveShared keeps the configured slices and zone networks as they are before a create run rewrites them,
+// Backup hands each machine the ones it uses
+func (s *State) SaveShared(config *Config) error {
+	s.shared = make(map[string][]byte)
+	paths := []string{}
+	for name := range config.Slices {
+		name, err := sliceName(name)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, slicePaths(name)...)
+	}
+	for zone := range config.Zones {
+		paths = append(paths, zoneNetworkPaths(zone)...)
+	}
+	for _, path := range paths {
+		data, err := util.Files.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		s.shared[path] = data
+	}
+	return nil
+}
+
+// sharedFiles returns the paths of the shared files m uses that SaveShared kept
+func (s *State) sharedFiles(m *Machine) []string {
+	paths := []string{}
+	if m.Slice != "" {
+		paths = append(paths, slicePaths(m.Slice)...)
+	}
+	if m.Zone != "" {
+		paths = append(paths, zoneNetworkPaths(m.Zone)...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []string{}
+	for _, path := range paths {
+		if _, ok := s.shared[path]; ok {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
+
+// Backup saves the generated files of m and snapshots its image and datasets when the run is going to change
+// them, m must be normalized. A running machine is frozen while the snapshots are taken so they are consistent.
+// The image snapshot is a full copy unless the image lives on btrfs.
+// Nil is returned for a running machine the run won't change.
+func (s *State) Backup(log *slog.Logger, m *Machine) (*Backup, error) {
+	backup := &Backup{Fqdn: m.Fqdn, Files: make(map[string][]byte), Datasets: make(map[string]bool)}
+	files, err := m.UnitFiles()
+	if err != nil {
+		return nil, err
+	}
+	// an upgrade replaces the image even when no file changes
+	changing := m.runUpgrade
+	for _, file := range files {
+		data, err := util.Files.ReadFile(file.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		backup.Files[file.Path] = data
+		// EnsurePlacement removes a copy from the other placement
+		if other := otherPlacement(file.Path); other != "" {
+			data, err := util.Files.ReadFile(other)
+			if err == nil {
+				backup.Files[other] = data
+				changing = true
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		change, err := planUnitFile(file, false)
+		if err != nil {
+			return nil, err
+		}
+		changing = changing || change.Action != ActionNoop
+	}
+	for _, path := range s.sharedFiles(m) {
+		data, err := util.Files.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		s.mu.Lock()
+		backup.Files[path] = s.shared[path]
+		s.mu.Unlock()
+		changing = changing || !bytes.Equal(data, backup.Files[path])
+	}
+	if m.GPU != nil && m.GPU.Enabled() {
+		if backup.ACLs, err = gpuACLs(m.GPU); err != nil {
+			return nil, err
+		}
+	}
+	machine, err := s.Manager.GetMachine(m.Fqdn)
+	if errors.Is(err, machineutil.ErrNoSuchImage) {
+		return backup, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backup.Existed = true
+	backup.Running = machine.Running()
+	if !changing {
+		if backup.Running {
+			// nothing gets rewritten or restarted, startup commands only run after a start
+			return nil, nil
+		}
+		// the machine is only started, there is nothing to snapshot
+		return backup, nil
+	}
+	if backup.Running {
+		log.Info("Freezing machine for the snapshots")
+		if err := machine.Freeze(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := machine.Thaw(); err != nil {
+				log.Error("Thawing machine after the snapshots", "error", err)
+			}
+		}()
+	}
+	for _, mnt := range m.Mounts {
+		if mnt.ZFS == nil {
+			continue
+		}
+		existed, err := snapshotDataset(log, mnt.ZFS.Dataset)
+		if err != nil {
+			return nil, err
+		}
+		backup.Datasets[mnt.ZFS.Dataset] = existed
+	}
+	if m.ZFS != nil {
+		// the image is rolled back with its dataset
+		existed, err := snapshotDataset(log, m.ZFS.Dataset)
+		if err != nil {
+			return nil, err
+		}
+		backup.Datasets[m.ZFS.Dataset] = existed
+		return backup, nil
+	}
+	backup.Snapshot = m.Fqdn + rollbackSuffix
+	// a snapshot left over by an interrupted run is older than the current state
+	if _, err := s.Manager.GetImage(backup.Snapshot); err == nil {
+		if err := s.Manager.Remove(backup.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+	log.Info("Snapshotting image for rollback", "snapshot", backup.Snapshot)
+	if _, err := s.Manager.Clone(m.Fqdn, backup.Snapshot); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// snapshotDataset replaces the rollback snapshot of dataset, reporting whether the dataset exists
+func snapshotDataset(log *slog.Logger, dataset string) (bool, error) {
+	if _, err := zfs("list", "-H", "-o", "name", dataset); err != nil {
+		return false, nil
+	}
+	if _, err := zfs("list", "-H", "-o", "name", dataset+rollbackSnapshot); err == nil {
+		if _, err := zfs("destroy", dataset+rollbackSnapshot); err != nil {
+			return true, err
+		}
+	}
+	log.Info("Snapshotting dataset for rollback", "dataset", dataset)
+	_, err := zfs("snapshot", dataset+rollbackSnapshot)
+	return true, err
+}
+
+// gpuACLs reads the access control lists of the GPU nodes, GrantAccess adds to them
+func gpuACLs(g *GPU) ([]byte, error) {
+	paths, err := g.Paths()
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("getfacl", append([]string{"--absolute-names"}, paths...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := Commands.Run(cmd, nil, nil); err != nil {
+		return nil, fmt.Errorf("getfacl: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// restoreACLs puts back what gpuACLs read
+func restoreACLs(acls []byte) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("setfacl", "--restore=-")
+	cmd.Stdin = bytes.NewReader(acls)
+	cmd.Stderr = &stderr
+	if err := Commands.Run(cmd, nil, nil); err != nil {
+		return fmt.Errorf("setfacl: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Restore puts the machine back the way it was when the backup was taken, a machine created by the run is removed
+func (b *Backup) Restore(log *slog.Logger, s *State, m *Machine) error {
+	var errs []error
+	s.Forget(b.Fqdn)
+	if machine, err := s.Manager.GetMachine(b.Fqdn); err == nil {
+		errs = append(errs, machine.Stop())
+		errs = append(errs, m.Unmount(s.Manager))
+	}
+	switch {
+	case !b.Existed:
+		log.Info("Removing machine created by the failed run")
+		if m.ZFS != nil {
+			_, err := m.ZFS.Destroy(log)
+			errs = append(errs, err)
+		}
+		if _, err := s.Manager.GetImage(b.Fqdn); err == nil {
+			errs = append(errs, s.Manager.Remove(b.Fqdn))
+		}
+	case b.Snapshot != "":
+		log.Info("Restoring image snapshot", "snapshot", b.Snapshot)
+		if err := s.Manager.Remove(b.Fqdn); err != nil {
+			// without the old image gone the snapshot can't take its name, keep it for manual recovery
+			return errors.Join(append(errs, err)...)
+		}
+		errs = append(errs, s.Manager.Rename(b.Snapshot, b.Fqdn))
+	}
+	for dataset, existed := range b.Datasets {
+		if !existed {
+			z := &ZFSDataset{Dataset: dataset}
+			_, err := z.Destroy(log)
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("Rolling back dataset", "dataset", dataset)
+		if _, err := zfs("rollback", "-r", dataset+rollbackSnapshot); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_, err := zfs("destroy", dataset+rollbackSnapshot)
+		errs = append(errs, err)
+	}
+	if b.ACLs != nil {
+		errs = append(errs, restoreACLs(b.ACLs))
+	}
+	networkd := false
+	for file, data := range b.Files {
+		networkd = networkd || strings.HasPrefix(file, util.NetworkdDir+"/") || strings.HasPrefix(file, util.NetworkdRuntimeDir+"/")
+		log.Info("Restoring file", "file", file)
+		if data == nil {
+			if err := util.Files.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := util.Files.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, util.Files.WriteFile(file, data, 0644))
+	}
+	errs = append(errs, s.Manager.DaemonReload())
+	if networkd {
+		errs = append(errs, s.Manager.NetworkdReload())
+	}
+	if b.Running {
+		log.Info("Starting previous configuration")
+		machine, err := s.Manager.GetMachine(b.Fqdn)
+		if err == nil {
+			err = machine.Start()
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Discard drops the snapshots once the run succeeded
+func (b *Backup) Discard(s *State) error {
+	var errs []error
+	for dataset, existed := range b.Datasets {
+		if existed {
+			_, err := zfs("destroy", dataset+rollbackSnapshot)
+			errs = append(errs, err)
+		}
+	}
+	if b.Snapshot != "" {
+		errs = append(errs, s.Manager.Remove(b.Snapshot))
+	}
+	return errors.Join(errs...)
+}
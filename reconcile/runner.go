@@ -0,0 +1,128 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// Runner starts every process a run needs, configured commands as well as helpers like zfs, mkfs and nft
+type Runner interface {
+	// Run runs cmd to completion, inside the namespaces of machine unless it is nil.
+	// A non nil umask only applies to the new process.
+	Run(cmd *exec.Cmd, machine *machineutil.Machine, umask *os.FileMode) error
+	// Exec runs argv as a transient service inside machine, see machineutil.Machine.Exec
+	Exec(ctx context.Context, machine *machineutil.Machine, argv []string, stdin io.Reader) (*machineutil.ExecResult, error)
+}
+
+// Commands is the Runner used by the package, tests and dry runs swap in a RecordingRunner
+var Commands Runner = ExecRunner{}
+
+// ExecRunner really runs the commands
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd *exec.Cmd, machine *machineutil.Machine, umask *os.FileMode) error {
+	if umask != nil {
+		// umask is process wide, the shell sets it for the child only
+		mask := "umask " + strconv.FormatUint(uint64(*umask), 8) + "; exec \"$@\""
+		cmd.Args = append([]string{"sh", "-c", mask, "sh", cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+	}
+	if machine != nil {
+		return machine.Nsenter(cmd)
+	}
+	return cmd.Run()
+}
+
+func (ExecRunner) Exec(ctx context.Context, machine *machineutil.Machine, argv []string, stdin io.Reader) (*machineutil.ExecResult, error) {
+	return machine.Exec(ctx, argv, stdin)
+}
+
+// RecordedCommand is a command seen by RecordingRunner, Machine is empty for commands on the host
+type RecordedCommand struct {
+	Machine string
+	Args    []string
+	Native  bool
+}
+
+// RecordingRunner records commands instead of running them, every command succeeds with no output unless Handler says otherwise
+type RecordingRunner struct {
+	// Handler, when set, decides the outcome of each command and may write its output
+	Handler  func(c *RecordedCommand, stdin io.Reader, stdout io.Writer) error
+	mu       sync.Mutex
+	commands []*RecordedCommand
+}
+
+func (r *RecordingRunner) record(c *RecordedCommand, stdin io.Reader, stdout io.Writer) error {
+	r.mu.Lock()
+	r.commands = append(r.commands, c)
+	r.mu.Unlock()
+	if r.Handler == nil {
+		return nil
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	return r.Handler(c, stdin, stdout)
+}
+
+func (r *RecordingRunner) Run(cmd *exec.Cmd, machine *machineutil.Machine, umask *os.FileMode) error {
+	c := &RecordedCommand{Args: cmd.Args}
+	if machine != nil {
+		c.Machine = machine.Name
+	}
+	return r.record(c, cmd.Stdin, cmd.Stdout)
+}
+
+func (r *RecordingRunner) Exec(ctx context.Context, machine *machineutil.Machine, argv []string, stdin io.Reader) (*machineutil.ExecResult, error) {
+	result := &machineutil.ExecResult{Result: "success"}
+	var stdout bytes.Buffer
+	err := r.record(&RecordedCommand{Machine: machine.Name, Args: argv, Native: true}, stdin, &stdout)
+	if err != nil {
+		return nil, err
+	}
+	result.Stdout = stdout.Bytes()
+	return result, nil
+}
+
+// Commands returns everything run so far in order
+func (r *RecordingRunner) Commands() []*RecordedCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*RecordedCommand(nil), r.commands...)
+}
+
+// AuditedRunner passes everything on to Runner and records every command in the audit log
+type AuditedRunner struct {
+	Runner
+}
+
+func (a AuditedRunner) Run(cmd *exec.Cmd, machine *machineutil.Machine, umask *os.FileMode) error {
+	// the runner may wrap cmd, the entry shows what was asked for
+	command := strings.Join(cmd.Args, " ")
+	err := a.Runner.Run(cmd, machine, umask)
+	target := "host"
+	if machine != nil {
+		target = machine.Name
+	}
+	util.Record("command.run", target, err, "command", command)
+	return err
+}
+
+func (a AuditedRunner) Exec(ctx context.Context, machine *machineutil.Machine, argv []string, stdin io.Reader) (*machineutil.ExecResult, error) {
+	result, err := a.Runner.Exec(ctx, machine, argv, stdin)
+	recorded := err
+	if err == nil {
+		recorded = result.Err()
+	}
+	util.Record("command.exec", machine.Name, recorded, "command", strings.Join(argv, " "))
+	return result, err
+}
@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"encoding"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil"
+)
+
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaEnums lists the accepted values of string fields validated in Normalize and LoadConfig
+var schemaEnums = map[string][]string{
+	"Machine.Class":                  {machineutil.ClassContainer, machineutil.ClassVM},
+	"Machine.AddressOrder":           machineutil.AddressOrders,
+	"Machine.Channel":                TemplateChannels,
+	"Machine.Transport":              transports,
+	"CommandDescription.Transport":   transports,
+	"MachineFile.When":               fileWhens,
+	"DirectorySync.When":             fileWhens,
+	"Scheduling.CPUSchedulingPolicy": cpuSchedulingPolicies,
+	"Scheduling.IOSchedulingClass":   ioSchedulingClasses,
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+	gpuType             = reflect.TypeOf(GPU{})
+)
+
+// schemaBuilder collects the definitions of the structs reachable from Config
+type schemaBuilder struct {
+	yaml bool
+	defs map[string]interface{}
+}
+
+// Schema returns a JSON Schema of the config files, with the lowercase keys the YAML decoder expects
+// or with the field names of JSON config files
+func Schema(yaml bool) map[string]interface{} {
+	b := &schemaBuilder{yaml: yaml, defs: make(map[string]interface{})}
+	root := b.ref(reflect.TypeOf(Config{}))
+	return map[string]interface{}{
+		"$schema": schemaDialect,
+		"title":   "machineutil config",
+		"$ref":    root["$ref"],
+		"$defs":   b.defs,
+	}
+}
+
+func (b *schemaBuilder) key(field reflect.StructField) string {
+	if b.yaml {
+		return strings.ToLower(field.Name)
+	}
+	return field.Name
+}
+
+// ref adds the definition of the struct t and refers to it, definitions are shared and may be recursive
+func (b *schemaBuilder) ref(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if t.PkgPath() != reflect.TypeOf(Config{}).PkgPath() {
+		// e.g. unit.UnitOption, qualified to keep it apart from our own types
+		name = t.String()
+	}
+	retval := map[string]interface{}{"$ref": "#/$defs/" + name}
+	if _, ok := b.defs[name]; ok {
+		return retval
+	}
+	properties := make(map[string]interface{})
+	def := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	b.defs[name] = def
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		schema := b.schema(field.Type)
+		if values, ok := schemaEnums[t.Name()+"."+field.Name]; ok {
+			schema["enum"] = values
+		}
+		properties[b.key(field)] = schema
+	}
+	// unknown fields are errors unless -strict=false
+	def["additionalProperties"] = false
+	return retval
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == durationType:
+		if b.yaml {
+			// the YAML decoder takes durations such as 1m30s, JSON only nanoseconds
+			return map[string]interface{}{"type": []string{"string", "integer"}}
+		}
+		return map[string]interface{}{"type": "integer"}
+	case t == gpuType:
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "boolean"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			b.ref(reflect.TypeOf(gpuSettings{})),
+		}}
+	case reflect.PointerTo(t).Implements(textUnmarshalerType):
+		// netip addresses and prefixes
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Struct:
+		return b.ref(t)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	}
+	// interfaces take anything, e.g. InventoryVars
+	return map[string]interface{}{}
+}
@@ -0,0 +1,103 @@
+package reconcile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultInterpreter stops scripts at the first failing command, a provisioning step shouldn't carry on half done
+var defaultInterpreter = []string{"/bin/sh", "-e"}
+
+func (cmd *CommandDescription) interpreter() []string {
+	if len(cmd.Interpreter) > 0 {
+		return cmd.Interpreter
+	}
+	return defaultInterpreter
+}
+
+func chownToUser(f *os.File, name string) error {
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return err
+	}
+	return f.Chown(uid, gid)
+}
+
+// scriptCommand is cmd running the script at path with Command as its arguments
+func (cmd *CommandDescription) scriptCommand(path string) *CommandDescription {
+	script := *cmd
+	script.Script = ""
+	script.Interpreter = nil
+	script.Command = append(append(slices.Clone(cmd.interpreter()), path), cmd.Command...)
+	return &script
+}
+
+// runScript writes Script to a file where the command runs and executes it with Interpreter. Inside the machine
+// the file is written through the transport of the command, which also reaches VMs and guests without machined support.
+func (cmd *CommandDescription) runScript(env *CommandEnv, pipeIn io.Reader, pipeOut io.Writer) error {
+	if cmd.Local {
+		f, err := os.CreateTemp("", "machineutil-script-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(env.Expand(cmd.Script))
+		if err == nil && cmd.User != "" {
+			// the file is private, only the user running the script can read it
+			err = chownToUser(f, cmd.User)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return cmd.scriptCommand(f.Name()).run(env, pipeIn, pipeOut)
+	}
+	if env.Machine == nil {
+		return fmt.Errorf("script has no machine to run in, it must be Local")
+	}
+	helper := func(args []string, stdin string, stdout io.Writer) error {
+		// shipping and removing the script don't count as commands that ran
+		defer func(ran int) { env.Ran = ran }(env.Ran)
+		c := &CommandDescription{
+			Command:           args,
+			WrapperParameters: cmd.WrapperParameters,
+			Stdin:             stdin,
+			Native:            cmd.Native,
+			Transport:         cmd.Transport,
+		}
+		return c.run(env, nil, stdout)
+	}
+	// mktemp picks a directory the user the transport logs in as can write to, the file is private to it
+	var out bytes.Buffer
+	if err := helper([]string{"sh", "-c", `f=$(mktemp -t machineutil-script-XXXXXXXX) && cat > "$f" && echo "$f"`}, cmd.Script, &out); err != nil {
+		return fmt.Errorf("writing script: %w", err)
+	}
+	path := strings.TrimSpace(out.String())
+	if path == "" {
+		return fmt.Errorf("writing script: mktemp printed no path")
+	}
+	slog.Debug("Shipped script", "machine", env.Machine.Name, "path", path)
+	defer func() {
+		if err := helper([]string{"rm", "-f", path}, "", nil); err != nil {
+			slog.Warn("Removing script", "machine", env.Machine.Name, "path", path, "error", err)
+		}
+	}()
+	return cmd.scriptCommand(path).run(env, pipeIn, pipeOut)
+}
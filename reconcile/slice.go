@@ -0,0 +1,78 @@
+package reconcile
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// slicePaths are the slice unit name in the persistent and the runtime placement, the slices of Config.Slices
+// are shared by machines and outlive them
+func slicePaths(name string) []string {
+	return []string{filepath.Join("/etc/systemd/system", name), filepath.Join("/run/systemd/system", name)}
+}
+
+var slicePattern = regexp.MustCompile(`^[A-Za-z0-9:_.\\]+(-[A-Za-z0-9:_.\\]+)*\.slice$`)
+
+// sliceName completes name to a slice unit name, nested slices are spelled parent-child like systemd does
+func sliceName(name string) (string, error) {
+	if !strings.HasSuffix(name, ".slice") {
+		name += ".slice"
+	}
+	if !slicePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid Slice %q, expected a unit name such as machines-web.slice", name)
+	}
+	return name, nil
+}
+
+func sliceOptions(name string, resources *Resources) []*unit.UnitOption {
+	opts := []*unit.UnitOption{
+		{Section: "Unit", Name: "Description", Value: "Machineutil slice " + strings.TrimSuffix(name, ".slice")},
+	}
+	return append(opts, resources.options("Slice")...)
+}
+
+// EnsureSlices writes the slice units with their limits and reloads systemd on changes. Running machines pick
+// up new limits of their slice with the reload. With runtime the units go to /run and copies of the same slices
+// in /etc, which would outrank them, are removed, and the other way around. Slices no longer configured may
+// belong to another config on the host, gc removes them once nothing uses them.
+func EnsureSlices(log *slog.Logger, manager machineutil.MachineUtil, slices map[string]*Resources, runtime bool) error {
+	changed := false
+	for name, resources := range slices {
+		name, err := sliceName(name)
+		if err != nil {
+			return err
+		}
+		paths := slicePaths(name)
+		file, other := paths[0], paths[1]
+		if runtime {
+			file, other = other, file
+		}
+		opts, err := util.ReadUnit(other, false)
+		if err != nil {
+			return err
+		}
+		if util.IsGenerated(opts) {
+			if _, err := util.EnsureUnit(log, other, nil); err != nil {
+				return err
+			}
+			changed = true
+		}
+		ok, err := util.EnsureUnit(log, file, sliceOptions(name, resources))
+		if err != nil {
+			return err
+		}
+		changed = changed || ok
+	}
+	if changed {
+		log.Info("Reloading systemd for slices")
+		return manager.DaemonReload()
+	}
+	return nil
+}
@@ -0,0 +1,686 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// ChangeSet records what a run changed for a single machine
+type ChangeSet struct {
+	UnitsAdded    []string
+	UnitsModified []string
+	UnitsRemoved  []string
+	Cloned        bool
+	Restarted     bool
+	CommandsRun   int
+	FilesWritten  []string
+}
+
+// Track runs ensure for the unit file at path and classifies the change by whether the file existed before and after
+func (c *ChangeSet) Track(path string, ensure func() (bool, error)) (bool, error) {
+	_, err := util.Files.ReadFile(path)
+	existed := err == nil
+	changed, err := ensure()
+	if err != nil || !changed || c == nil {
+		return changed, err
+	}
+	_, statErr := util.Files.ReadFile(path)
+	exists := statErr == nil
+	switch {
+	case !existed && exists:
+		c.UnitsAdded = append(c.UnitsAdded, path)
+	case existed && !exists:
+		c.UnitsRemoved = append(c.UnitsRemoved, path)
+	default:
+		c.UnitsModified = append(c.UnitsModified, path)
+	}
+	return changed, nil
+}
+
+func (c *ChangeSet) Changed() bool {
+	return c.Cloned || c.Restarted || c.CommandsRun > 0 || len(c.UnitsAdded)+len(c.UnitsModified)+len(c.UnitsRemoved)+len(c.FilesWritten) > 0
+}
+
+// State is shared by everything working on the machines, Machines and Changes are only accessed through its methods.
+// Work on a single machine is serialized with Lock, different machines can be reconciled concurrently.
+type State struct {
+	Manager         machineutil.MachineUtil
+	Machines        map[string]*machineutil.Machine
+	Changes         map[string]*ChangeSet
+	Templates       machineutil.TemplateCollection
+	DefaultTemplate string
+	TemplateAliases map[string]string
+	// Channels are the promoted template versions, loaded from ChannelsFile
+	Channels Channels
+	// Registry holds the command outputs registered so far, commands of later machines can use them
+	Registry *Registry
+	// Durations are the phases timed per machine, only accessed through Timings
+	Durations map[string]*Timings
+	// Progress is told about the phases of the machines, nil skips it
+	Progress Progress
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// shared holds the slices and zone networks from before the run, see SaveShared
+	shared map[string][]byte
+}
+
+// Lock serializes work on fqdn, the returned function releases it
+func (s *State) Lock(fqdn string) func() {
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := s.locks[fqdn]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[fqdn] = lock
+	}
+	s.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Machine returns the machine cached for fqdn during this run
+func (s *State) Machine(fqdn string) (*machineutil.Machine, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	machine, ok := s.Machines[fqdn]
+	return machine, ok
+}
+
+func (s *State) setMachine(fqdn string, machine *machineutil.Machine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Machines[fqdn] = machine
+}
+
+// Forget drops the cached machine, it is looked up again the next time
+func (s *State) Forget(fqdn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Machines, fqdn)
+}
+
+func NewState(config *Config) (*State, error) {
+	manager, err := machineutil.NewMachineUtil()
+	if err != nil {
+		return nil, err
+	}
+	state, err := NewStateWith(config, manager)
+	if err != nil {
+		manager.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+// NewStateWith builds the state on top of an existing manager, such as a machineutil.Fake
+func NewStateWith(config *Config, manager machineutil.MachineUtil) (retval *State, err error) {
+	retval = &State{
+		Machines:        make(map[string]*machineutil.Machine),
+		Changes:         make(map[string]*ChangeSet),
+		DefaultTemplate: config.DefaultTemplate,
+		TemplateAliases: config.TemplateAliases,
+		Manager:         manager,
+		Registry:        &Registry{Secrets: config.Secrets},
+		Durations:       make(map[string]*Timings),
+	}
+	defaultName, _, err := retval.ResolveTemplate("")
+	if err != nil {
+		return
+	}
+	if retval.Channels, err = LoadChannels(); err != nil {
+		return
+	}
+	retval.Templates, err = retval.Manager.ListTemplates(defaultName)
+	return
+}
+
+// ResolveTemplate maps a configured template reference through the aliases, "" is the default template
+func (s *State) ResolveTemplate(ref string) (string, int, error) {
+	if ref == "" {
+		ref = s.DefaultTemplate
+	}
+	name, version, err := ParseTemplateRef(ref)
+	if err != nil {
+		return "", 0, err
+	}
+	alias, ok := s.TemplateAliases[name]
+	if !ok {
+		return name, version, nil
+	}
+	aliasName, aliasVersion, err := ParseTemplateRef(alias)
+	if err != nil {
+		return "", 0, fmt.Errorf("template alias %s: %w", name, err)
+	}
+	// a version pinned on the machine beats the one pinned by the alias
+	if version < 0 {
+		version = aliasVersion
+	}
+	return aliasName, version, nil
+}
+
+// idmapped binds were added in systemd 249
+const idmapSystemdVersion = machineutil.MinimumSystemdVersion
+
+const defaultMinFreeSpace = 1 << 30
+
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if errors.Is(err, os.ErrNotExist) {
+		// machined creates the pool lazily, the parent is where it will end up
+		return freeSpace(path.Dir(dir))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// CheckPrerequisites verifies the host can run the given config, all problems are reported at once
+func (s *State) CheckPrerequisites(config *Config, mode string) error {
+	var errs []error
+	if err := s.Manager.Ping(); err != nil {
+		errs = append(errs, fmt.Errorf("systemd-machined is not available: %w", err))
+	}
+	needsIdmap := false
+	needsSystemdRun := false
+	needsNsenter := false
+	needsSSH := false
+	needsZFS := false
+	needsVM := false
+	needsFirstboot := false
+	for _, m := range config.Machines {
+		transport := m.Transport
+		if m.IsVM() {
+			needsVM = true
+			transport = TransportSSH
+		}
+		for _, mnt := range m.Mounts {
+			if mnt.Idmapped() {
+				needsIdmap = true
+			}
+		}
+		if m.ZFS != nil {
+			needsZFS = true
+		}
+		for _, mnt := range m.Mounts {
+			if mnt.ZFS != nil {
+				needsZFS = true
+			}
+		}
+		if m.Locale != "" || m.timezoneZone() != "" {
+			needsFirstboot = true
+		}
+		env := &CommandEnv{Transport: transport}
+		for _, cmd := range m.AllCommands() {
+			if cmd.Local || cmd.Native {
+				continue
+			}
+			if cmd.transport(env) == TransportSSH {
+				needsSSH = true
+			} else if !m.Booted() {
+				needsNsenter = true
+			} else {
+				needsSystemdRun = true
+			}
+		}
+		if m.UserData != nil || len(m.AuthorizedKeys) > 0 {
+			if transport == TransportSSH {
+				needsSSH = true
+			} else {
+				needsSystemdRun = true
+			}
+		}
+	}
+	version, err := s.Manager.SystemdVersion()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to detect systemd version: %w", err))
+	} else if needsIdmap && version < idmapSystemdVersion {
+		errs = append(errs, fmt.Errorf("systemd %d is too old for idmapped mounts, %d is required", version, idmapSystemdVersion))
+	} else if needsVM && version < vmspawnSystemdVersion {
+		errs = append(errs, fmt.Errorf("systemd %d is too old for VMs, %d is required", version, vmspawnSystemdVersion))
+	}
+	if needsVM && mode != "destroy" && mode != "stop" {
+		if _, err := exec.LookPath("systemd-vmspawn"); err != nil {
+			errs = append(errs, fmt.Errorf("systemd-vmspawn is required for VMs: %w", err))
+		}
+		if _, err := os.Stat("/dev/kvm"); err != nil {
+			errs = append(errs, fmt.Errorf("VMs need KVM: %w", err))
+		}
+	}
+	if needsSystemdRun && mode != "destroy" && mode != "stop" {
+		if _, err := exec.LookPath("systemd-run"); err != nil {
+			errs = append(errs, fmt.Errorf("systemd-run is required for in-machine commands: %w", err))
+		}
+	}
+	if needsNsenter && mode != "destroy" && mode != "stop" {
+		if _, err := exec.LookPath("nsenter"); err != nil {
+			errs = append(errs, fmt.Errorf("nsenter is required for commands in machines without Boot: %w", err))
+		}
+	}
+	if needsFirstboot && mode == "create" {
+		if _, err := exec.LookPath("systemd-firstboot"); err != nil {
+			errs = append(errs, fmt.Errorf("systemd-firstboot is required for Timezone and Locale: %w", err))
+		}
+	}
+	if config.Firewall != nil {
+		if _, err := exec.LookPath("nft"); err != nil {
+			errs = append(errs, fmt.Errorf("nft is required for firewall rules: %w", err))
+		}
+	}
+	if needsZFS && (mode == "create" || mode == "destroy") {
+		if _, err := exec.LookPath("zfs"); err != nil {
+			errs = append(errs, fmt.Errorf("zfs is required for ZFS backed machines and mounts: %w", err))
+		}
+	}
+	if needsSSH && mode != "destroy" && mode != "stop" {
+		if _, err := exec.LookPath("ssh"); err != nil {
+			errs = append(errs, fmt.Errorf("ssh is required for the ssh transport: %w", err))
+		}
+	}
+	if mode == "create" {
+		minFree := config.MinFreeSpace
+		if minFree == 0 {
+			minFree = defaultMinFreeSpace
+		}
+		free, err := freeSpace("/var/lib/machines")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to check free space: %w", err))
+		} else if free < minFree {
+			errs = append(errs, fmt.Errorf("/var/lib/machines has %d bytes free, %d required", free, minFree))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *State) DiscoverTemplate(config *Machine) (*machineutil.Template, error) {
+	name, version, err := s.ResolveTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	if config.Channel != "" {
+		if version, err = s.Channels.Version(name, config.Channel); err != nil {
+			return nil, err
+		}
+	}
+	templates := s.Templates
+	if all, ok := templates.(*machineutil.Templates); ok && config.Architecture != "" {
+		templates = all.ForArch(config.Architecture)
+	}
+	var template *machineutil.Template
+	if version >= 0 {
+		template = templates.GetVersion(name, version)
+	} else {
+		template = templates.Get(name)
+	}
+	if template == nil {
+		return nil, fmt.Errorf("Missing template(%s) creating %s", config.Template, config.Fqdn)
+	}
+	return template, nil
+}
+
+// OutdatedTemplate returns the template image an existing machine following a Channel was cloned from
+// when the channel moved on to template since, empty if it is up to date or isn't tracked
+func (s *State) OutdatedTemplate(config *Machine, template *machineutil.Template) (string, error) {
+	if config.Channel == "" {
+		return "", nil
+	}
+	machine, err := s.Manager.GetMachine(config.Fqdn)
+	if errors.Is(err, machineutil.ErrNoSuchImage) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	machine.Class = config.Class
+	machine.Runtime = config.Runtime
+	created, err := machine.CreatedFrom()
+	if err != nil {
+		return "", err
+	}
+	if created == "" {
+		slog.Warn("Not upgrading machine cloned before templates were recorded", "machine", config.Fqdn, "channel", config.Channel)
+		return "", nil
+	}
+	if created == template.Image() {
+		return "", nil
+	}
+	return created, nil
+}
+
+// Images next to a machine during an upgrade, the new one while it is cloned and the old one until the new one is up
+const (
+	upgradeSuffix  = ".upgrade"
+	outdatedSuffix = ".outdated"
+)
+
+// removeLeftover removes an image an interrupted upgrade left behind
+func (s *State) removeLeftover(log *slog.Logger, image string) error {
+	if _, err := s.Manager.GetImage(image); err != nil {
+		return nil
+	}
+	log.Info("Removing leftover image", "image", image)
+	return s.Manager.Remove(image)
+}
+
+// Upgrade clones the current template next to the machine and swaps it in, the old image is kept until
+// FinishUpgrade or put back by AbortUpgrade. A failed clone leaves the machine as it was.
+func (s *State) Upgrade(log *slog.Logger, config *Machine, template *machineutil.Template) error {
+	staging := config.Fqdn + upgradeSuffix
+	previous := config.Fqdn + outdatedSuffix
+	if err := s.removeLeftover(log, staging); err != nil {
+		return err
+	}
+	if err := s.removeLeftover(log, previous); err != nil {
+		return err
+	}
+	log.Info("Cloning new image", "image", staging)
+	done := s.phase(config.Fqdn, PhaseClone)
+	_, err := template.Create(staging)
+	done()
+	if err != nil {
+		return err
+	}
+	machine, err := s.Manager.GetMachine(config.Fqdn)
+	if err == nil {
+		s.Forget(config.Fqdn)
+		log.Info("Swapping in new image")
+		err = machine.Stop()
+	}
+	if err == nil {
+		err = s.Manager.Rename(config.Fqdn, previous)
+	}
+	if err != nil {
+		return errors.Join(err, s.Manager.Remove(staging))
+	}
+	if err := s.Manager.Rename(staging, config.Fqdn); err != nil {
+		return errors.Join(err, s.Manager.Rename(previous, config.Fqdn))
+	}
+	config.outdated = previous
+	config.runCreation = true
+	s.ChangeSet(config.Fqdn).Cloned = true
+	return nil
+}
+
+// FinishUpgrade removes the old image, kept as Machine.outdated, once the upgraded machine is up
+func (s *State) FinishUpgrade(log *slog.Logger, config *Machine) error {
+	if config.outdated == "" {
+		return nil
+	}
+	log.Info("Removing outdated image", "image", config.outdated)
+	err := s.Manager.Remove(config.outdated)
+	config.outdated = ""
+	return err
+}
+
+// AbortUpgrade puts the old image back after the upgraded machine failed to come up
+func (s *State) AbortUpgrade(log *slog.Logger, config *Machine) error {
+	if config.outdated == "" {
+		return nil
+	}
+	log.Warn("Putting back the outdated image", "image", config.outdated)
+	s.Forget(config.Fqdn)
+	if machine, err := s.Manager.GetMachine(config.Fqdn); err == nil {
+		if err := machine.Stop(); err != nil {
+			return err
+		}
+		if err := s.Manager.Remove(config.Fqdn); err != nil {
+			return err
+		}
+	}
+	if err := s.Manager.Rename(config.outdated, config.Fqdn); err != nil {
+		return err
+	}
+	config.outdated = ""
+	return nil
+}
+
+func (s *State) EnsureMachine(log *slog.Logger, config *Machine, template *machineutil.Template) (machine *machineutil.Machine, changed bool, reload bool, err error) {
+	changed = false
+	reload = false
+	var ok bool
+	machine, ok = s.Machine(config.Fqdn)
+	if ok {
+		log.Debug("Already found")
+		return
+	}
+	log.Debug("Fetching machine")
+	machine, err = s.Manager.GetMachine(config.Fqdn)
+	if err != nil && !errors.Is(err, machineutil.ErrNoSuchImage) {
+		return
+	}
+	changes := s.ChangeSet(config.Fqdn)
+	if errors.Is(err, machineutil.ErrNoSuchImage) && template != nil {
+		log.Info("Creating machine")
+		done := s.phase(config.Fqdn, PhaseClone)
+		if config.ZFS != nil {
+			machine, err = config.cloneToDataset(log, s.Manager, template)
+		} else {
+			machine, err = template.Create(config.Fqdn)
+		}
+		done()
+		config.runCreation = true
+		changed = true
+		changes.Cloned = true
+	}
+	if err != nil {
+		return
+	}
+	machine.Class = config.Class
+	machine.Runtime = config.Runtime
+	machine.ResetFailed = config.ResetFailed
+	machine.AddressOrder = config.AddressOrder
+	s.setMachine(config.Fqdn, machine)
+	if template != nil {
+		defer s.phase(config.Fqdn, PhaseUnits)()
+		log.Info("Checking machine config")
+		var options []*unit.UnitOption
+		options, err = config.recordTemplate(machine, template)
+		if err != nil {
+			return
+		}
+		ok, err = changes.Track(machine.OptionsPath(), func() (bool, error) { return machine.EnsureOptions(log, options) })
+		if err != nil {
+			return
+		}
+		changed = changed || ok
+		// the settings file of a container is read on start, the unit of a VM needs a reload
+		reload = reload || (ok && config.IsVM())
+		var moved bool
+		moved, err = movesResources(machine.OverridePath(), config.Overrides, config.Resources.GetOverride())
+		if err != nil {
+			return
+		}
+		ok, err = changes.Track(machine.OverridePath(), func() (bool, error) { return machine.EnsureOverride(log, config.Overrides) })
+		if err != nil {
+			return
+		}
+		// the limits leaving the override land in the resources drop-in below, applied without a restart
+		changed = changed || (ok && !moved)
+		reload = reload || ok
+		var resources bool
+		resources, err = changes.Track(machine.ResourcesPath(), func() (bool, error) {
+			return machine.EnsureResources(log, config.Resources.GetOverride())
+		})
+		if err != nil {
+			return
+		}
+		reload = reload || resources
+		if config.ZFS != nil {
+			// quota and the like apply to the mounted dataset right away
+			_, err = config.ZFS.Ensure(log, config.imagePath())
+			if err != nil {
+				return
+			}
+		}
+		var mounts_changed bool
+		mounts_changed, err = config.EnsureMounts(log, changes)
+		if err != nil {
+			return
+		}
+		changed = changed || mounts_changed
+		reload = reload || mounts_changed
+		_, err = config.EnsureRegion(log, s.Manager)
+		if err != nil {
+			return
+		}
+		ok, err = config.EnsureNetwork(log, s.Manager, changes)
+		if err != nil {
+			return
+		}
+		changed = changed || ok
+		// the proxies only depend on the machine, writing them doesn't require a restart
+		ok, err = config.EnsureProxySockets(log, s.Manager, changes)
+		if err != nil {
+			return
+		}
+		reload = reload || ok
+		_, err = config.EnsureJournalNamespace(log, s.Manager, changes)
+		if err != nil {
+			return
+		}
+		ok, err = config.EnsurePlacement(log, changes)
+		if err != nil {
+			return
+		}
+		// the machine was running with the copy that is gone now
+		changed = changed || ok
+		reload = reload || ok
+		if config.EnableOnBoot {
+			ok, err = machine.Enable()
+			if err != nil {
+				return
+			}
+			if ok {
+				log.Info("Enabled on boot")
+			}
+			reload = reload || ok
+		}
+		if resources && !changed && machine.Running() {
+			// the drop-in takes over on the next start, until then the limits are set on the running unit
+			props, convErr := config.Resources.RuntimeProperties()
+			if convErr == nil {
+				log.Info("Applying resource limits to the running machine")
+				err = machine.SetRuntimeProperties(props)
+				if err != nil {
+					return
+				}
+			} else {
+				log.Info("Restarting for resource limits", "reason", convErr)
+				changed = true
+			}
+		}
+		// the runtime drop-ins outrank the resources drop-in, the limits are in there now
+		ok, err = machine.ClearRuntimeProperties(resourceSettings)
+		if err != nil {
+			return
+		}
+		reload = reload || ok
+		if changed {
+			// picked up again by the start in reconcileMachine
+			changes.Restarted = !changes.Cloned && machine.Running()
+			err = machine.Stop()
+			if err != nil {
+				return
+			}
+		}
+		if mounts_changed {
+			err = config.Unmount(s.Manager)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if err == nil {
+		s.setMachine(config.Fqdn, machine)
+		return
+	}
+	return
+}
+
+// ChangeSet returns the changes recorded for fqdn during this run
+func (s *State) ChangeSet(fqdn string) *ChangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, ok := s.Changes[fqdn]
+	if !ok {
+		changes = &ChangeSet{}
+		s.Changes[fqdn] = changes
+	}
+	return changes
+}
+
+// RemoveMachine removes the image of the machine and everything generated for it, reporting whether there was an image
+func (s *State) RemoveMachine(log *slog.Logger, config *Machine) (bool, error) {
+	machine, _, _, err := s.EnsureMachine(log, config, nil)
+	if errors.Is(err, machineutil.ErrNoSuchImage) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.Forget(config.Fqdn)
+	disabled, err := machine.Disable()
+	if err != nil {
+		return false, err
+	}
+	if disabled {
+		log.Info("Disabled on boot")
+	}
+	if config.GPU != nil {
+		if err := config.GPU.RevokeAccess(log, machine); err != nil {
+			return false, fmt.Errorf("GPU: %w", err)
+		}
+	}
+	if config.ZFS != nil {
+		// machined can't remove the directory the dataset is mounted on, only what is left once it is gone
+		err = machine.Stop()
+		if err != nil {
+			return false, err
+		}
+		_, err = config.ZFS.Destroy(log)
+		if err != nil {
+			return false, err
+		}
+	}
+	if _, imgErr := s.Manager.GetImage(config.Fqdn); config.ZFS == nil || imgErr == nil {
+		err = machine.Remove()
+	}
+	if err != nil {
+		return false, err
+	}
+	err = config.Unmount(s.Manager)
+	if err != nil {
+		return true, err
+	}
+	c, err := config.RemoveMounts(log, s.ChangeSet(config.Fqdn))
+	if err != nil {
+		return true, err
+	}
+	config.ProxySockets = nil
+	proxies, err := config.EnsureProxySockets(log, s.Manager, s.ChangeSet(config.Fqdn))
+	if err != nil {
+		return true, err
+	}
+	config.Journal = nil
+	if _, err := config.EnsureJournalNamespace(log, s.Manager, s.ChangeSet(config.Fqdn)); err != nil {
+		return true, err
+	}
+	if c || disabled || proxies {
+		return true, s.Manager.DaemonReload()
+	}
+	return true, nil
+}
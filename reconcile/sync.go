@@ -0,0 +1,303 @@
+package reconcile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// syncStampDir keeps a hash of what was synced last inside the machine, unchanged sources aren't copied again
+const syncStampDir = "/var/lib/machineutil/sync"
+
+// DirectorySync mirrors a host directory into the machine, the tree is streamed with tar over the command transport
+type DirectorySync struct {
+	Source string
+	Target string
+	// Delete removes what Source doesn't have from Target, excluded paths are kept
+	Delete bool
+	// Exclude patterns are matched against names and paths relative to Source, e.g. .git or build/*.o
+	Exclude []string
+	// Owner is user or user:group as known inside the machine, the tree is owned by root otherwise
+	Owner string
+	// When is creation, the default, to sync into new machines only or always to sync whenever Source changed
+	When string
+}
+
+func (s *DirectorySync) Validate() error {
+	switch {
+	case s.Source == "":
+		return fmt.Errorf("sync to %s without Source", s.Target)
+	case !path.IsAbs(s.Target) || path.Clean(s.Target) == "/":
+		return fmt.Errorf("sync %s: Target must be an absolute path below /", s.Source)
+	case !slices.Contains(fileWhens, s.When):
+		return fmt.Errorf("sync %s: invalid When %q, expected %s or %s", s.Source, s.When, FileWhenCreation, FileWhenAlways)
+	}
+	for _, pattern := range s.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("sync %s: invalid Exclude %q: %w", s.Source, pattern, err)
+		}
+	}
+	return nil
+}
+
+func (s *DirectorySync) excluded(rel string) bool {
+	for _, pattern := range s.Exclude {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceTree lists the paths below Source that are synced, parents before their children, and hashes them
+func (s *DirectorySync) sourceTree() ([]string, string, error) {
+	paths := []string{}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%v\x00%s\x00", s.Target, s.Delete, s.Owner)
+	err := filepath.WalkDir(s.Source, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Source, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.excluded(rel) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		fmt.Fprintf(hash, "%s\x00%v\x00", rel, info.Mode())
+		switch {
+		case info.Mode().IsRegular():
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(hash, f)
+			return err
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, link)
+		}
+		return nil
+	})
+	return paths, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// targetTree lists what Target inside the machine at root has below it except excluded paths,
+// symlinks are resolved as the machine would
+func (s *DirectorySync) targetTree(root string) ([]string, error) {
+	paths := []string{}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		dir, err := util.OpenInRoot(root, path.Join(s.Target, rel))
+		if err != nil {
+			return err
+		}
+		entries, err := dir.ReadDir(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := path.Join(rel, entry.Name())
+			if s.excluded(child) {
+				continue
+			}
+			paths = append(paths, child)
+			if entry.IsDir() {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return paths, err
+}
+
+// extraneous returns the paths of Target that Source doesn't have, children of removed directories are left out
+func (s *DirectorySync) extraneous(source, target []string) []string {
+	wanted := make(map[string]bool, len(source))
+	for _, rel := range source {
+		wanted[rel] = true
+	}
+	retval := []string{}
+	for _, rel := range target {
+		if wanted[rel] {
+			continue
+		}
+		if len(retval) > 0 && strings.HasPrefix(rel, retval[len(retval)-1]+"/") {
+			continue
+		}
+		retval = append(retval, rel)
+	}
+	return retval
+}
+
+func (s *DirectorySync) stampPath() string {
+	sum := sha256.Sum256([]byte(path.Clean(s.Target)))
+	return syncStampDir + "/" + hex.EncodeToString(sum[:8])
+}
+
+// synced reports whether the stamp inside the machine at root matches hash
+func (s *DirectorySync) synced(root, hash string) (bool, error) {
+	f, err := util.OpenInRoot(root, s.stampPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	stamp, err := io.ReadAll(f)
+	return strings.TrimSpace(string(stamp)) == hash, err
+}
+
+// writeList stores NUL separated paths in a temporary file, tar and xargs read them from there
+func writeList(paths []string) (string, error) {
+	f, err := os.CreateTemp("", "machineutil-sync-")
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range paths {
+		if _, err := io.WriteString(f, rel+"\x00"); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// pipeList streams the paths in list into command running inside the machine
+func pipeList(env *CommandEnv, list string, command ...string) error {
+	cmd := &CommandDescription{
+		Command: []string{"cat", list},
+		Local:   true,
+		Pipe:    &CommandDescription{Command: command},
+	}
+	return cmd.Run(env)
+}
+
+// apply mirrors the source paths into the machine at root, the machine side only needs sh, tar and xargs
+func (s *DirectorySync) apply(env *CommandEnv, root string, source []string, hash string) error {
+	// the helpers don't count as commands that ran, the target is reported as written instead
+	defer func(ran int) { env.Ran = ran }(env.Ran)
+	if s.Delete {
+		target, err := s.targetTree(root)
+		if err != nil {
+			return err
+		}
+		if remove := s.extraneous(source, target); len(remove) > 0 {
+			slog.Debug("Removing extraneous paths", "machine", env.Machine.Name, "target", s.Target, "count", len(remove))
+			list, err := writeList(remove)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(list)
+			if err := pipeList(env, list, "sh", "-c", `cd "$1" && xargs -0 rm -rf --`, "sh", s.Target); err != nil {
+				return fmt.Errorf("removing extraneous paths: %w", err)
+			}
+		}
+	}
+	list, err := writeList(source)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	cmd := &CommandDescription{
+		Command: []string{"tar", "--create", "--file=-", "--directory=" + s.Source, "--null", "--no-recursion", "--files-from=" + list},
+		Local:   true,
+		Pipe: &CommandDescription{
+			Command: []string{"sh", "-c", `mkdir -p "$1" && tar --extract --file=- --directory="$1" --no-same-owner`, "sh", s.Target},
+		},
+	}
+	if err := cmd.Run(env); err != nil {
+		return fmt.Errorf("copying %s: %w", s.Source, err)
+	}
+	run := func(args ...string) error {
+		cmd := &CommandDescription{Command: args}
+		return cmd.Run(env)
+	}
+	if s.Owner != "" {
+		if err := run("chown", "-R", s.Owner, s.Target); err != nil {
+			return err
+		}
+	}
+	return run("sh", "-c", `mkdir -p "${1%/*}" && echo "$2" > "$1"`, "sh", s.stampPath(), hash)
+}
+
+// Apply mirrors Source into the machine unless it is unchanged since the last sync and force isn't set
+func (s *DirectorySync) Apply(env *CommandEnv, force bool) (bool, error) {
+	source, hash, err := s.sourceTree()
+	if err != nil {
+		return false, err
+	}
+	// the root is only needed to look inside the machine
+	root := ""
+	if s.Delete || !force {
+		if root, err = env.Machine.RootPath(); err != nil {
+			return false, err
+		}
+	}
+	if !force {
+		synced, err := s.synced(root, hash)
+		if err != nil || synced {
+			return false, err
+		}
+	}
+	slog.Info("Syncing directory", "machine", env.Machine.Name, "source", s.Source, "target", s.Target)
+	return true, s.apply(env, root, source, hash)
+}
+
+// ApplySync mirrors the Sync directories due in this run, always ones only when their source changed
+func (m *Machine) ApplySync(env *CommandEnv, changes *ChangeSet) error {
+	for _, s := range m.Sync {
+		if s.When != FileWhenAlways && !m.runCreation {
+			continue
+		}
+		synced, err := s.Apply(env, m.runCreation)
+		if err != nil {
+			return fmt.Errorf("sync %s: %w", s.Source, err)
+		}
+		if synced {
+			changes.FilesWritten = append(changes.FilesWritten, s.Target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+const (
+	BuilderDebootstrap = "debootstrap"
+	BuilderDnf         = "dnf"
+)
+
+// TemplateSource produces a template from scratch, either from a container image or bootstrapped by a Builder
+type TemplateSource struct {
+	OCI *OCISource
+	// Builder bootstraps a distribution from its mirrors on the host, debootstrap or dnf
+	Builder string
+	// Suite is the debootstrap suite, e.g. bookworm
+	Suite string
+	// Release is the dnf releasever, e.g. 40
+	Release string
+	// Mirror replaces the default mirror of debootstrap or the repositories configured for dnf
+	Mirror string
+	// Packages are installed on top of systemd, dnf always adds fedora-release as the image needs an os-release to boot
+	Packages []string
+}
+
+func (s *TemplateSource) Validate() error {
+	switch {
+	case s.OCI != nil && s.Builder != "":
+		return fmt.Errorf("both OCI and Builder configured")
+	case s.OCI != nil:
+		return s.OCI.Validate()
+	case s.Builder == BuilderDebootstrap && s.Suite == "":
+		return fmt.Errorf("debootstrap needs a Suite")
+	case s.Builder == BuilderDnf && s.Release == "":
+		return fmt.Errorf("dnf needs a Release")
+	case s.Builder == BuilderDebootstrap || s.Builder == BuilderDnf:
+		return nil
+	case s.Builder != "":
+		return fmt.Errorf("unknown Builder %q, expected %s or %s", s.Builder, BuilderDebootstrap, BuilderDnf)
+	}
+	return fmt.Errorf("no source configured")
+}
+
+// bootstrapCommand is the host command filling root for Builder
+func (s *TemplateSource) bootstrapCommand(root string) []string {
+	if s.Builder == BuilderDebootstrap {
+		packages := append([]string{"systemd", "systemd-sysv", "dbus"}, s.Packages...)
+		args := []string{"debootstrap", "--variant=minbase", "--include=" + strings.Join(packages, ","), s.Suite, root}
+		if s.Mirror != "" {
+			args = append(args, s.Mirror)
+		}
+		return args
+	}
+	args := []string{"dnf", "--installroot=" + root, "--releasever=" + s.Release, "--setopt=install_weak_deps=False", "-y"}
+	if s.Mirror != "" {
+		args = append(args, "--repofrompath=machineutil,"+s.Mirror, "--repo=machineutil")
+	}
+	return append(append(args, "install", "systemd", "passwd", "dnf", "fedora-release"), s.Packages...)
+}
+
+// Build fills the empty directory root with the root filesystem of the template
+func (s *TemplateSource) Build(log *slog.Logger, root string) error {
+	if s.OCI != nil {
+		return s.OCI.Build(log, root)
+	}
+	args := s.bootstrapCommand(root)
+	log.Info("Bootstrapping", "builder", s.Builder)
+	if _, err := runTool(args[0], args[1:]...); err != nil {
+		return err
+	}
+	// every clone has to generate a machine id of its own on first boot
+	return util.Files.WriteFile(filepath.Join(root, "etc/machine-id"), nil, 0444)
+}
+
+// OCISource pulls a container image with skopeo and unpacks its layers
+type OCISource struct {
+	// Image is any skopeo source, references without a transport like debian:bookworm are pulled from a registry
+	Image string
+	// Systemd installs systemd with the package manager of the image, container images rarely ship an init
+	Systemd bool
+}
+
+func (o *OCISource) Validate() error {
+	if o.Image == "" {
+		return fmt.Errorf("OCI source without Image")
+	}
+	return nil
+}
+
+var skopeoTransports = []string{"docker", "oci", "oci-archive", "docker-archive", "docker-daemon", "containers-storage", "dir"}
+
+// reference adds the docker transport to bare image references
+func (o *OCISource) reference() string {
+	transport, _, found := strings.Cut(o.Image, ":")
+	if found && slices.Contains(skopeoTransports, transport) {
+		return o.Image
+	}
+	return "docker://" + o.Image
+}
+
+// ociDescriptor is the part of an OCI descriptor needed to find blobs
+type ociDescriptor struct {
+	Digest string
+}
+
+// blobPath resolves a descriptor digest within the OCI layout at layout
+func blobPath(layout, digest string) (string, error) {
+	algorithm, hash, found := strings.Cut(digest, ":")
+	if !found || strings.ContainsAny(algorithm+hash, "/.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(layout, "blobs", algorithm, hash), nil
+}
+
+func readJSON(file string, v interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// layers returns the layer blobs of the single image in the OCI layout at layout, bottom layer first
+func layers(layout string) ([]string, error) {
+	var index struct{ Manifests []ociDescriptor }
+	if err := readJSON(filepath.Join(layout, "index.json"), &index); err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("expected a single manifest, found %d", len(index.Manifests))
+	}
+	file, err := blobPath(layout, index.Manifests[0].Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct{ Layers []ociDescriptor }
+	if err := readJSON(file, &manifest); err != nil {
+		return nil, err
+	}
+	retval := []string{}
+	for _, layer := range manifest.Layers {
+		file, err := blobPath(layout, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, file)
+	}
+	return retval, nil
+}
+
+// runTool runs a host tool and adds its stderr to the error
+func runTool(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := Commands.Run(cmd, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// lowerDir resolves dir within root, a symlink on the way means nothing below it can be hidden
+func lowerDir(root, dir string) (string, bool) {
+	path := root
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		path = filepath.Join(path, name)
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			return "", false
+		}
+	}
+	return path, true
+}
+
+// applyWhiteouts removes what the whiteout entries of a layer hide in the layers below it
+func applyWhiteouts(root string, entries []string) error {
+	for _, entry := range entries {
+		dir, name := filepath.Split(filepath.Clean("/" + entry))
+		if !strings.HasPrefix(name, whiteoutPrefix) {
+			continue
+		}
+		target, ok := lowerDir(root, dir)
+		if !ok {
+			continue
+		}
+		if name == whiteoutOpaque {
+			children, err := os.ReadDir(target)
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if err := os.RemoveAll(filepath.Join(target, child.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(target, strings.TrimPrefix(name, whiteoutPrefix))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapesRoot reports whether the parent directory of entry resolves outside of root on the host,
+// following the symlinks already extracted. Dangling symlinks count as escaping, tar would create their target.
+func escapesRoot(root, entry string) (bool, error) {
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	path := real
+	for _, name := range strings.Split(strings.Trim(filepath.Dir(filepath.Clean("/"+entry)), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		path = filepath.Join(path, name)
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// nothing below a missing directory can be a symlink yet
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || (resolved != real && !strings.HasPrefix(resolved, real+"/")) {
+			return true, nil
+		}
+		path = resolved
+	}
+	return false, nil
+}
+
+// unpackLayer extracts a layer over root, tar picks the compression and keeps ownership, devices and xattrs intact
+func unpackLayer(root, layer string) error {
+	listing, err := runTool("tar", "--list", "--quoting-style=literal", "--file", layer)
+	if err != nil {
+		return err
+	}
+	entries := strings.Split(strings.TrimSpace(listing), "\n")
+	// tar itself defers unsafe symlinks within one archive, but follows those left by the layers below
+	for _, entry := range entries {
+		escaped, err := escapesRoot(root, entry)
+		if err != nil {
+			return err
+		}
+		if escaped {
+			return fmt.Errorf("layer %s: %s would be written through a symlink leading out of the image", filepath.Base(layer), entry)
+		}
+	}
+	// whiteouts only hide lower layers, they are applied before the layer itself is extracted
+	if err := applyWhiteouts(root, entries); err != nil {
+		return err
+	}
+	_, err = runTool("tar", "--extract", "--file", layer, "--directory", root,
+		"--same-owner", "--preserve-permissions", "--numeric-owner", "--xattrs", "--xattrs-include=*",
+		"--exclude="+whiteoutPrefix+"*")
+	return err
+}
+
+// systemdInstalls install systemd with the package manager found in the image, in order of preference
+var systemdInstalls = []struct {
+	tool    string
+	command []string
+}{
+	{"apt-get", []string{"sh", "-c", "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends systemd systemd-sysv dbus && apt-get clean"}},
+	{"dnf", []string{"dnf", "install", "-y", "systemd"}},
+	{"microdnf", []string{"microdnf", "install", "-y", "systemd"}},
+	{"zypper", []string{"zypper", "--non-interactive", "install", "systemd"}},
+	{"pacman", []string{"pacman", "-Sy", "--noconfirm", "systemd"}},
+}
+
+// hasSystemd reports whether root already has systemd as its init
+func hasSystemd(root string) bool {
+	for _, path := range []string{"/usr/lib/systemd/systemd", "/lib/systemd/systemd"} {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// installSystemd runs the package manager of root inside an unbooted nspawn container
+func installSystemd(log *slog.Logger, root string) error {
+	if hasSystemd(root) {
+		return nil
+	}
+	for _, install := range systemdInstalls {
+		found := false
+		for _, dir := range []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin"} {
+			if _, err := os.Stat(filepath.Join(root, dir, install.tool)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		log.Info("Installing systemd", "with", install.tool)
+		args := append([]string{"--quiet", "--directory", root, "--resolv-conf=replace-host", "--pipe", "--"}, install.command...)
+		_, err := runTool("systemd-nspawn", args...)
+		if err != nil {
+			return err
+		}
+		if !hasSystemd(root) {
+			return fmt.Errorf("%s didn't install systemd", install.tool)
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported package manager found to install systemd")
+}
+
+func (o *OCISource) Build(log *slog.Logger, root string) error {
+	// next to root, images easily outgrow a tmpfs /tmp
+	layout, err := os.MkdirTemp(filepath.Dir(root), ".oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layout)
+	log.Info("Pulling image", "image", o.reference())
+	if _, err := runTool("skopeo", "copy", "--quiet", o.reference(), "oci:"+layout+":image"); err != nil {
+		return err
+	}
+	blobs, err := layers(layout)
+	if err != nil {
+		return fmt.Errorf("reading pulled image: %w", err)
+	}
+	for i, blob := range blobs {
+		log.Debug("Unpacking layer", "layer", i, "blob", filepath.Base(blob))
+		if err := unpackLayer(root, blob); err != nil {
+			return fmt.Errorf("unpacking layer %d: %w", i, err)
+		}
+	}
+	if o.Systemd {
+		return installSystemd(log, root)
+	}
+	return nil
+}
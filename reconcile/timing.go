@@ -0,0 +1,120 @@
+package reconcile
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+// Phases timed for every machine, commands are timed one by one
+const (
+	PhaseTemplate = "template"
+	PhaseClone    = "clone"
+	PhaseUnits    = "units"
+	PhaseReload   = "reload"
+	PhaseStart    = "start"
+	PhaseAddress  = "address"
+	PhaseReady    = "ready"
+	PhaseCommand  = "command"
+)
+
+// summaryPhases are the columns of the timing summary
+var summaryPhases = []string{PhaseTemplate, PhaseClone, PhaseUnits, PhaseReload, PhaseStart, PhaseAddress, PhaseReady, PhaseCommand}
+
+// Timing is how long a phase of a machine took
+type Timing struct {
+	Phase string
+	// Command is the command as configured, before placeholders are expanded
+	Command  []string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// Timings are the phases of a machine in the order they finished
+type Timings []*Timing
+
+// Start times phase until the returned function is called, the phase is traced as a span of the machine
+func (t *Timings) Start(phase string) func() {
+	start := time.Now()
+	span := util.Trace(phase)
+	return func() {
+		span.End(nil)
+		*t = append(*t, &Timing{Phase: phase, Duration: time.Since(start)})
+	}
+}
+
+// Command records how long cmd took to run from start
+func (t *Timings) Command(cmd *CommandDescription, start time.Time) {
+	timing := &Timing{Phase: PhaseCommand, Command: cmd.Command, Duration: time.Since(start)}
+	slog.Debug("Command finished", "command", cmd.Command, "duration", timing.Duration)
+	*t = append(*t, timing)
+}
+
+// Total adds up the durations of phase
+func (t Timings) Total(phase string) time.Duration {
+	var retval time.Duration
+	for _, timing := range t {
+		if timing.Phase == phase {
+			retval += timing.Duration
+		}
+	}
+	return retval
+}
+
+// Progress is told how the run goes machine by machine, e.g. to draw a progress line
+type Progress interface {
+	// Start is called before machine number i, counting from 1, out of total is reconciled
+	Start(i, total int, fqdn string)
+	// Phase is called when fqdn enters one of the timed phases
+	Phase(fqdn, phase string)
+	// Done is called once the machine is finished, report holds the outcome
+	Done(report *MachineReport)
+}
+
+// phase starts timing phase of fqdn and tells Progress about it, the returned function ends it
+func (s *State) phase(fqdn, phase string) func() {
+	if s.Progress != nil {
+		s.Progress.Phase(fqdn, phase)
+	}
+	return s.Timings(fqdn).Start(phase)
+}
+
+// Timings returns the phases recorded for fqdn during this run
+func (s *State) Timings(fqdn string) *Timings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timings, ok := s.Durations[fqdn]
+	if !ok {
+		timings = &Timings{}
+		s.Durations[fqdn] = timings
+	}
+	return timings
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(10 * time.Millisecond).String()
+}
+
+// PrintTimings writes the time every machine spent in each phase, COMMANDS adds up all of its commands
+func PrintTimings(w io.Writer, report *Report) {
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE\tTEMPLATE\tCLONE\tUNITS\tRELOAD\tSTART\tADDRESS\tREADY\tCOMMANDS\tTOTAL")
+	for _, m := range report.Machines {
+		fmt.Fprint(tw, m.Fqdn)
+		for _, phase := range summaryPhases {
+			fmt.Fprintf(tw, "\t%s", formatDuration(m.Timings.Total(phase)))
+		}
+		fmt.Fprintf(tw, "\t%s\n", formatDuration(m.Duration))
+	}
+	tw.Flush()
+	header, rows, _ := strings.Cut(table.String(), "\n")
+	fmt.Fprintf(w, "%s\n%s", util.Colorize(util.ColorBold, header), rows)
+}
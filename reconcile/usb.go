@@ -0,0 +1,104 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// usbDevicesDir lists the USB devices the kernel knows with their ids and bus position
+const usbDevicesDir = "/sys/bus/usb/devices"
+
+var usbIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+// USBDevice passes a USB device to the machine by its ids. The node below /dev/bus/usb is numbered anew
+// on every replug, it is looked up whenever the machine is normalized and a changed node restarts the machine.
+type USBDevice struct {
+	// ID is vendor:product in hex as lsusb prints it, e.g. 10c4:ea60
+	ID string
+	// Serial picks one of several devices with the same ID, all of them are passed otherwise
+	Serial string
+	// Permissions as for Devices, rw when unset
+	Permissions string
+}
+
+// USBIDs returns the vendor:product IDs of the USBDevices of all machines, lowercased and sorted without duplicates
+func (c *Config) USBIDs() []string {
+	ids := []string{}
+	for _, m := range c.Machines {
+		for _, usb := range m.USBDevices {
+			ids = append(ids, strings.ToLower(usb.ID))
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func (u *USBDevice) Validate() error {
+	if !usbIDPattern.MatchString(u.ID) {
+		return fmt.Errorf("USB device %q: ID must be vendor:product in hex, e.g. 10c4:ea60", u.ID)
+	}
+	return nil
+}
+
+func readAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Resolve returns the current nodes of the device, none when it isn't plugged in
+func (u *USBDevice) Resolve() ([]string, error) {
+	entries, err := os.ReadDir(usbDevicesDir)
+	// hosts without a USB controller have no bus at all
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vendor, product, _ := strings.Cut(strings.ToLower(u.ID), ":")
+	paths := []string{}
+	for _, entry := range entries {
+		dir := filepath.Join(usbDevicesDir, entry.Name())
+		// interfaces such as 1-1:1.0 have no ids of their own
+		if readAttr(dir, "idVendor") != vendor || readAttr(dir, "idProduct") != product {
+			continue
+		}
+		if u.Serial != "" && readAttr(dir, "serial") != u.Serial {
+			continue
+		}
+		bus, err := strconv.Atoi(readAttr(dir, "busnum"))
+		if err != nil {
+			return nil, fmt.Errorf("USB device %s at %s: busnum: %w", u.ID, entry.Name(), err)
+		}
+		dev, err := strconv.Atoi(readAttr(dir, "devnum"))
+		if err != nil {
+			return nil, fmt.Errorf("USB device %s at %s: devnum: %w", u.ID, entry.Name(), err)
+		}
+		paths = append(paths, fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, dev))
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// Devices binds and allows the current nodes of the device
+func (u *USBDevice) Devices() ([]*Device, error) {
+	paths, err := u.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*Device, 0, len(paths))
+	for _, node := range paths {
+		devices = append(devices, &Device{Path: node, Permissions: u.Permissions, Bind: true})
+	}
+	return devices, nil
+}
@@ -0,0 +1,136 @@
+package reconcile
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/eax255/systemd-containers/machineutil"
+)
+
+const (
+	NetworkTap  = "tap"
+	NetworkUser = "user"
+	NetworkNone = "none"
+)
+
+var vmNetworks = []string{"", NetworkTap, NetworkUser, NetworkNone}
+
+// vmspawnSystemdVersion added --directory to systemd-vmspawn
+const vmspawnSystemdVersion = 256
+
+// VirtualMachine tunes systemd-vmspawn for machines of Class vm
+type VirtualMachine struct {
+	// CPUs defaults to what vmspawn picks, a single one
+	CPUs int
+	// Memory is the RAM of the VM, e.g. 2G
+	Memory string
+	// Network is tap, the default, user for user mode networking without a host interface or none
+	Network string
+	// Arguments are passed on to systemd-vmspawn as is
+	Arguments []string
+}
+
+// IsVM reports whether the machine runs under systemd-vmspawn instead of systemd-nspawn
+func (m *Machine) IsVM() bool {
+	return m.Class == machineutil.ClassVM
+}
+
+// validateVM rejects the settings only systemd-nspawn understands, they would be silently ignored otherwise
+func (m *Machine) validateVM() error {
+	unsupported := map[string]bool{
+		"Boot":             !m.Booted(),
+		"Parameters":       len(m.Parameters) > 0,
+		"Zone":             m.Zone != "",
+		"Ports":            len(m.Ports) > 0,
+		"Capabilities":     len(m.Capabilities) > 0,
+		"DropCapabilities": len(m.DropCapabilities) > 0,
+		"SystemCalls":      m.SystemCalls != nil,
+		"LinkJournal":      m.LinkJournal != "",
+		"Timezone":         m.Timezone != "",
+		"Devices":          len(m.Devices) > 0,
+		"GPU":              m.GPU != nil && m.GPU.Enabled(),
+		"USBDevices":       len(m.USBDevices) > 0,
+		// machined can't copy files into VMs
+		"UserData":       m.UserData != nil,
+		"AuthorizedKeys": len(m.AuthorizedKeys) > 0,
+		"Files":          len(m.Files) > 0,
+		"Locale":         m.Locale != "",
+	}
+	names := []string{}
+	for name, set := range unsupported {
+		if set {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		slices.Sort(names)
+		return fmt.Errorf("machine %s: %s not supported for VMs", m.Fqdn, strings.Join(names, ", "))
+	}
+	// systemd-vmspawn only runs guests of the host architecture, there is no emulation
+	if m.Architecture != "" && machineutil.NormalizeArch(m.Architecture) != machineutil.HostArch() {
+		return fmt.Errorf("machine %s: VMs can't run Architecture %s on %s hosts", m.Fqdn, m.Architecture, machineutil.HostArch())
+	}
+	// systemd-run can't reach into a VM
+	if m.Transport == TransportSystemdRun {
+		return fmt.Errorf("machine %s: VMs need Transport %s", m.Fqdn, TransportSSH)
+	}
+	m.Transport = TransportSSH
+	for _, cmd := range m.AllCommands() {
+		if cmd.Transport == TransportSystemdRun && !cmd.Local && !cmd.Native {
+			return fmt.Errorf("machine %s: VMs need Transport %s", m.Fqdn, TransportSSH)
+		}
+	}
+	if m.VM != nil && !slices.Contains(vmNetworks, m.VM.Network) {
+		return fmt.Errorf("machine %s: invalid Network %q, expected %s, %s or %s", m.Fqdn, m.VM.Network, NetworkTap, NetworkUser, NetworkNone)
+	}
+	return nil
+}
+
+// vmspawnCommand is the ExecStart of the unit of a VM, the image directory is shared with the VM over virtiofs
+func (m *Machine) vmspawnCommand() string {
+	vm := m.VM
+	if vm == nil {
+		vm = &VirtualMachine{}
+	}
+	args := []string{"systemd-vmspawn", "--quiet", "--keep-unit", "--register=yes", "--machine=%i", "--directory=/var/lib/machines/%i"}
+	switch vm.Network {
+	case "", NetworkTap:
+		args = append(args, "--network-tap")
+	case NetworkUser:
+		args = append(args, "--network-user-mode")
+	}
+	if vm.CPUs > 0 {
+		args = append(args, "--cpus="+strconv.Itoa(vm.CPUs))
+	}
+	if vm.Memory != "" {
+		args = append(args, "--ram="+vm.Memory)
+	}
+	for _, mnt := range m.Mounts {
+		args = append(args, mnt.vmspawnArgument())
+	}
+	args = append(args, vm.Arguments...)
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, execQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// vmUnit is the unit of a VM, the counterpart of the systemd-nspawn@ template that ships with systemd.
+// Options of the config are added to it, a VM has no settings file they could go to.
+func (m *Machine) vmUnit() []*unit.UnitOption {
+	return append([]*unit.UnitOption{
+		{Section: "Unit", Name: "Description", Value: "Machineutil virtual machine %i"},
+		{Section: "Unit", Name: "PartOf", Value: "machines.target"},
+		{Section: "Unit", Name: "Before", Value: "machines.target"},
+		{Section: "Unit", Name: "After", Value: "network.target modprobe@tun.service modprobe@vhost_vsock.service"},
+		{Section: "Unit", Name: "RequiresMountsFor", Value: "/var/lib/machines/%i"},
+		{Section: "Service", Name: "ExecStart", Value: m.vmspawnCommand()},
+		{Section: "Service", Name: "KillMode", Value: "mixed"},
+		{Section: "Service", Name: "Slice", Value: "machine.slice"},
+		{Section: "Install", Name: "WantedBy", Value: "machines.target"},
+	}, m.Options...)
+}
@@ -1,7 +1,10 @@
 package machineutil
 
 import (
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 )
@@ -9,21 +12,87 @@ import (
 type TemplateCollection interface {
 	Template() *Template
 	Get(string) *Template
+	GetVersion(string, int) *Template
 	Remove() error
 }
 
 type Template struct {
 	Name    string
 	Version int
+	// Arch is the architecture suffix as found in the image name, empty templates are used on any host
+	Arch string
+	// Created and Usage are as of the last listing
+	Created time.Time
+	Usage   uint64
 	object  dbus.BusObject
 	manager MachineUtil
 }
 
 var _ TemplateCollection = (*Template)(nil)
 
-func (t *Template) Image() string { return t.Name + "-template_" + strconv.Itoa(t.Version) }
+func TemplateImage(name string, version int) string {
+	return name + "-template_" + strconv.Itoa(version)
+}
+
+// archAliases maps the names uname and distributions use to the GOARCH style names in image suffixes
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"i386":    "386",
+	"i686":    "386",
+	"armv7l":  "arm",
+	"ppc64el": "ppc64le",
+}
+
+// NormalizeArch turns architecture aliases such as x86_64 or aarch64 into the name used in image suffixes
+func NormalizeArch(arch string) string {
+	if alias, ok := archAliases[arch]; ok {
+		return alias
+	}
+	return arch
+}
 
+// HostArch is the architecture templates are selected for unless a machine asks for another one
+func HostArch() string { return runtime.GOARCH }
+
+// ParseTemplateImage splits template image names, name-template_<version> or name-template-<arch>_<version>
+func ParseTemplateImage(image string) (name, arch string, version int, ok bool) {
+	i := strings.LastIndex(image, "-template")
+	if i < 0 {
+		return "", "", 0, false
+	}
+	name, rest := image[:i], image[i+len("-template"):]
+	j := strings.LastIndex(rest, "_")
+	if j < 0 {
+		return "", "", 0, false
+	}
+	version, err := strconv.Atoi(rest[j+1:])
+	if err != nil || version < 0 {
+		return "", "", 0, false
+	}
+	switch {
+	case j == 0:
+	case rest[0] == '-' && j > 1:
+		arch = rest[1:j]
+	default:
+		return "", "", 0, false
+	}
+	return name, arch, version, true
+}
+
+func (t *Template) Image() string {
+	if t.Arch == "" {
+		return TemplateImage(t.Name, t.Version)
+	}
+	return t.Name + "-template-" + t.Arch + "_" + strconv.Itoa(t.Version)
+}
+
+// Create clones the template into a new machine fqdn, unless the pool is too full to hold the copy
 func (t *Template) Create(fqdn string) (*Machine, error) {
+	if err := t.checkSpace(); err != nil {
+		return nil, err
+	}
 	return t.manager.Clone(t.Image(), fqdn)
 }
 func (t *Template) Remove() error {
@@ -38,6 +107,12 @@ func (t *Template) Get(name string) *Template {
 	}
 	return t
 }
+func (t *Template) GetVersion(name string, version int) *Template {
+	if t.Get(name) == nil || version != t.Version {
+		return nil
+	}
+	return t
+}
 
 type TemplateVersions []*Template
 
@@ -52,7 +127,11 @@ func (t TemplateVersions) Less(i, j int) bool {
 	if t[i].Name > t[j].Name {
 		return false
 	}
-	return t[i].Version < t[j].Version
+	if t[i].Version != t[j].Version {
+		return t[i].Version < t[j].Version
+	}
+	// a template built for the architecture wins over a generic one of the same version
+	return t[i].Arch < t[j].Arch
 }
 func (t TemplateVersions) Template() *Template {
 	if t.Len() == 0 {
@@ -60,6 +139,23 @@ func (t TemplateVersions) Template() *Template {
 	}
 	return t[t.Len()-1]
 }
+
+// ForArch keeps the templates usable on arch, those built for it and those without an architecture.
+// An empty arch keeps everything.
+func (t TemplateVersions) ForArch(arch string) TemplateVersions {
+	arch = NormalizeArch(arch)
+	if arch == "" {
+		return t
+	}
+	retval := TemplateVersions{}
+	for _, template := range t {
+		if template.Arch == "" || NormalizeArch(template.Arch) == arch {
+			retval = append(retval, template)
+		}
+	}
+	return retval
+}
+
 func (t TemplateVersions) Remove() error {
 	for _, template := range t {
 		if err := template.Remove(); err != nil {
@@ -76,9 +172,19 @@ func (t TemplateVersions) Get(name string) *Template {
 	}
 	return nil
 }
+func (t TemplateVersions) GetVersion(name string, version int) *Template {
+	for i := t.Len(); i > 0; i-- {
+		if img := t[i-1].GetVersion(name, version); img != nil {
+			return img
+		}
+	}
+	return nil
+}
 
 type Templates struct {
-	Default   string
+	Default string
+	// Arch selects between templates built for different architectures, empty ignores the architecture
+	Arch      string
 	Templates map[string]TemplateVersions
 }
 
@@ -88,11 +194,32 @@ func (t *Templates) Get(name string) *Template {
 	if name == "" {
 		name = t.Default
 	}
-	return t.Templates[name].Get(name)
+	return t.Templates[name].ForArch(t.Arch).Get(name)
+}
+
+func (t *Templates) GetVersion(name string, version int) *Template {
+	if name == "" {
+		name = t.Default
+	}
+	return t.Templates[name].ForArch(t.Arch).GetVersion(name, version)
+}
+
+// ForArch is the same collection selecting templates for arch instead
+func (t *Templates) ForArch(arch string) *Templates {
+	return &Templates{Default: t.Default, Arch: arch, Templates: t.Templates}
+}
+
+// NextVersion returns the version a newly added template called name should use
+func (t *Templates) NextVersion(name string) int {
+	latest := t.Templates[name].Template()
+	if latest == nil {
+		return 0
+	}
+	return latest.Version + 1
 }
 
 func (t *Templates) Template() *Template {
-	return t.Templates[t.Default].Template()
+	return t.Templates[t.Default].ForArch(t.Arch).Template()
 }
 
 func (t *Templates) Remove() error {
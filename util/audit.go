@@ -0,0 +1,214 @@
+package util
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditJournal selects the journal instead of a file as the audit log target
+const AuditJournal = "journal"
+
+// AuditIdentifier is the SYSLOG_IDENTIFIER of audit entries in the journal
+const AuditIdentifier = "machineutil-audit"
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// AuditEntry is a single mutation, written as one JSON line to audit files
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	User       string            `json:"user"`
+	SudoUser   string            `json:"sudo_user,omitempty"`
+	ConfigHash string            `json:"config_hash,omitempty"`
+	Action     string            `json:"action"`
+	Target     string            `json:"target"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditLog appends an entry for every mutation, it is never rewritten or truncated
+type AuditLog struct {
+	ConfigHash string
+	user       string
+	sudoUser   string
+	mu         sync.Mutex
+	file       *os.File
+	journal    net.Conn
+}
+
+// Audit receives the entries of Record, nil disables auditing
+var Audit *AuditLog
+
+// OpenAuditLog opens target for appending, AuditJournal sends the entries to the journal instead
+func OpenAuditLog(target, configHash string) (*AuditLog, error) {
+	a := &AuditLog{ConfigHash: configHash, sudoUser: os.Getenv("SUDO_USER")}
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	} else {
+		a.user = fmt.Sprint(os.Getuid())
+	}
+	var err error
+	if target == AuditJournal {
+		a.journal, err = net.Dial("unixgram", journalSocket)
+	} else {
+		a.file, err = os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log %s: %w", target, err)
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a.journal != nil {
+		return a.journal.Close()
+	}
+	return a.file.Close()
+}
+
+// Record writes an entry to Audit once the mutation was attempted, a failure is recorded with its error.
+// details are key value pairs, secrets in their values are redacted.
+func Record(action, target string, err error, details ...string) {
+	if Audit == nil {
+		return
+	}
+	if err != nil {
+		details = append(details, "error", err.Error())
+	}
+	entry := &AuditEntry{
+		Time:       time.Now(),
+		User:       Audit.user,
+		SudoUser:   Audit.sudoUser,
+		ConfigHash: Audit.ConfigHash,
+		Action:     action,
+		Target:     target,
+	}
+	for i := 0; i+1 < len(details); i += 2 {
+		if entry.Details == nil {
+			entry.Details = make(map[string]string)
+		}
+		entry.Details[details[i]] = Redact(details[i+1])
+	}
+	// an audit log that silently misses entries is worse than a noisy one
+	if err := Audit.Write(entry); err != nil {
+		fmt.Fprintln(os.Stderr, "audit log:", err)
+	}
+}
+
+func (a *AuditLog) Write(entry *AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.journal != nil {
+		_, err := a.journal.Write(journalEntry(entry))
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// a single write keeps lines from concurrent runs intact with O_APPEND
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// journalFieldName turns a detail key into the uppercase letters, digits and underscores the journal accepts in field names
+func journalFieldName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+}
+
+// journalEntry serializes entry in the native journal protocol, every value is sent length prefixed so newlines survive
+func journalEntry(entry *AuditEntry) []byte {
+	fields := map[string]string{
+		"MESSAGE":           entry.Action + " " + entry.Target,
+		"PRIORITY":          "5",
+		"SYSLOG_IDENTIFIER": AuditIdentifier,
+		"AUDIT_ACTION":      entry.Action,
+		"AUDIT_TARGET":      entry.Target,
+		"AUDIT_USER":        entry.User,
+	}
+	if entry.SudoUser != "" {
+		fields["AUDIT_SUDO_USER"] = entry.SudoUser
+	}
+	if entry.ConfigHash != "" {
+		fields["AUDIT_CONFIG_HASH"] = entry.ConfigHash
+	}
+	for k, v := range entry.Details {
+		fields["AUDIT_"+journalFieldName(k)] = v
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		b = append(b, k...)
+		b = append(b, '\n')
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(fields[k])))
+		b = append(b, fields[k]...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// AuditedFileSystem passes everything on and records every change to files, reads go unrecorded
+type AuditedFileSystem struct {
+	FileSystem
+}
+
+func (a AuditedFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	err := a.FileSystem.WriteFile(name, data, perm)
+	Record("file.write", name, err, "size", fmt.Sprint(len(data)))
+	return err
+}
+
+func (a AuditedFileSystem) Remove(name string) error {
+	err := a.FileSystem.Remove(name)
+	Record("file.remove", name, err)
+	return err
+}
+
+func (a AuditedFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	f, err := a.FileSystem.OpenFile(name, flag, perm)
+	Record("file.open", name, err, "append", fmt.Sprint(flag&os.O_APPEND != 0))
+	return f, err
+}
+
+func (a AuditedFileSystem) Rename(oldpath, newpath string) error {
+	err := a.FileSystem.Rename(oldpath, newpath)
+	Record("file.rename", newpath, err, "from", oldpath)
+	return err
+}
+
+func (a AuditedFileSystem) Chown(name string, uid, gid int) error {
+	err := a.FileSystem.Chown(name, uid, gid)
+	Record("file.chown", name, err, "uid", fmt.Sprint(uid), "gid", fmt.Sprint(gid))
+	return err
+}
+
+func (a AuditedFileSystem) Chmod(name string, mode os.FileMode) error {
+	err := a.FileSystem.Chmod(name, mode)
+	Record("file.chmod", name, err, "mode", fmt.Sprintf("%04o", mode.Perm()))
+	return err
+}
+
+func (a AuditedFileSystem) Truncate(name string, size int64) error {
+	err := a.FileSystem.Truncate(name, size)
+	Record("file.truncate", name, err, "size", fmt.Sprint(size))
+	return err
+}
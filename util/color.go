@@ -0,0 +1,52 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Color modes of the -color flag
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+var ColorModes = []string{ColorAuto, ColorAlways, ColorNever}
+
+// ANSI colors of added, changed and removed things
+const (
+	ColorRed    = "31"
+	ColorGreen  = "32"
+	ColorYellow = "33"
+	ColorBold   = "1"
+)
+
+// Color enables ANSI colors in human readable output such as plans and summaries
+var Color bool
+
+// ColorEnabled resolves mode for output to f, auto colors terminals unless NO_COLOR is set or TERM is dumb
+func ColorEnabled(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case ColorAlways:
+		return true, nil
+	case ColorNever:
+		return false, nil
+	case ColorAuto, "":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		return IsTerminal(int(f.Fd())), nil
+	}
+	return false, fmt.Errorf("invalid color mode %q, expected %s", mode, strings.Join(ColorModes, ", "))
+}
+
+// Colorize wraps s in the escape sequences of color when Color is set.
+// Aligned output has to be padded before, the escape sequences take no room on the terminal.
+func Colorize(color, s string) string {
+	if !Color || color == "" || s == "" {
+		return s
+	}
+	return "\033[" + color + "m" + s + "\033[0m"
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses sizes like "512M" or "10G", suffixes are binary
+func ParseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing size")
+	}
+	num := strings.TrimRight(strings.ToUpper(s), "IB")
+	if num == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mult := uint64(1)
+	if i := strings.IndexAny("KMGTPE", num[len(num)-1:]); i >= 0 {
+		num = num[:len(num)-1]
+		mult = 1 << (10 * (i + 1))
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxUint64/mult {
+		return 0, fmt.Errorf("size %q out of range", s)
+	}
+	return n * mult, nil
+}
+
+// FormatBytes renders n with a binary suffix, the inverse of ParseSize
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// FormatAddresses joins addrs with commas
+func FormatAddresses(addrs []netip.Addr) string {
+	parts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		parts = append(parts, addr.String())
+	}
+	return strings.Join(parts, ",")
+}
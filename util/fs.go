@@ -0,0 +1,375 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileSystem is everything the unit helpers need from the host file system
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// OpenFile opens name for writing, flag takes the os.O_* flags
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the names of the entries in dir in lexical order
+	ReadDir(dir string) ([]string, error)
+	Stat(name string) (fs.FileInfo, error)
+	Chown(name string, uid, gid int) error
+	Chmod(name string, mode os.FileMode) error
+	// Truncate changes the size of name, growing it leaves a sparse file.
+	// A MemFileSystem only reports the new size, the content isn't padded.
+	Truncate(name string, size int64) error
+}
+
+// Files is used by ReadUnit, WriteUnit and everything built on them, tests and dry runs swap in a MemFileSystem
+var Files FileSystem = OSFileSystem{}
+
+// OSFileSystem passes everything through to the os package
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+func (OSFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFileSystem) Remove(name string) error                     { return os.Remove(name) }
+func (OSFileSystem) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (OSFileSystem) Chown(name string, uid, gid int) error        { return os.Chown(name, uid, gid) }
+func (OSFileSystem) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (OSFileSystem) Truncate(name string, size int64) error       { return os.Truncate(name, size) }
+
+func (OSFileSystem) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, err
+}
+
+// MemFileSystem keeps files in memory, directories are implied by the files in them.
+// With Lower set it is an overlay: whatever wasn't written or removed in memory is read from Lower,
+// which is never changed. Dry runs put it over the host file system.
+type MemFileSystem struct {
+	Lower FileSystem
+
+	mu      sync.Mutex
+	files   map[string]*memFile
+	removed map[string]bool
+}
+
+type memFile struct {
+	data     []byte
+	size     int64
+	mode     os.FileMode
+	uid, gid int
+}
+
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{files: make(map[string]*memFile), removed: make(map[string]bool)}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// lower reports whether name is still visible from Lower
+func (m *MemFileSystem) lower(name string) bool {
+	return m.Lower != nil && !m.removed[name]
+}
+
+// hasChildren reports whether dir is implied by a file in memory
+func (m *MemFileSystem) hasChildren(dir string) bool {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUp returns the in memory entry of name, taking it over from Lower on first use
+func (m *MemFileSystem) copyUp(op, name string) (*memFile, error) {
+	if f, ok := m.files[name]; ok {
+		return f, nil
+	}
+	if !m.lower(name) {
+		if m.hasChildren(name) {
+			f := &memFile{mode: fs.ModeDir | 0755}
+			m.files[name] = f
+			return f, nil
+		}
+		return nil, notExist(op, name)
+	}
+	info, err := m.Lower.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &memFile{size: info.Size(), mode: info.Mode()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		f.uid, f.gid = int(stat.Uid), int(stat.Gid)
+	}
+	if info.Mode().IsRegular() {
+		if f.data, err = m.Lower.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+	m.files[name] = f
+	return f, nil
+}
+
+func (m *MemFileSystem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		if m.lower(name) {
+			return m.Lower.ReadFile(name)
+		}
+		return nil, notExist("open", name)
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *MemFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.write(name, data, perm)
+	return nil
+}
+
+// write replaces the content of name, an existing file keeps its mode and owner like with os.WriteFile
+func (m *MemFileSystem) write(name string, data []byte, perm os.FileMode) {
+	f, err := m.copyUp("open", name)
+	if err != nil {
+		f = &memFile{mode: perm}
+		m.files[name] = f
+	}
+	f.data = append([]byte(nil), data...)
+	f.size = int64(len(data))
+	delete(m.removed, name)
+}
+
+// memWriter collects what is written and stores it on Close
+type memWriter struct {
+	fs   *MemFileSystem
+	name string
+	perm os.FileMode
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	return w.fs.WriteFile(w.name, w.buf.Bytes(), w.perm)
+}
+
+func (m *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	w := &memWriter{fs: m, name: name, perm: perm}
+	if flag&os.O_TRUNC != 0 {
+		return w, nil
+	}
+	data, err := m.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0 {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_APPEND != 0 {
+		w.buf.Write(data)
+	}
+	return w, nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remove(name)
+}
+
+func (m *MemFileSystem) remove(name string) error {
+	_, ok := m.files[name]
+	inLower := false
+	if m.lower(name) {
+		_, err := m.Lower.Stat(name)
+		inLower = err == nil
+	}
+	if !ok && !inLower {
+		return notExist("remove", name)
+	}
+	delete(m.files, name)
+	if inLower {
+		m.removed[name] = true
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.copyUp("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if err := m.remove(oldpath); err != nil {
+		return err
+	}
+	m.files[newpath] = f
+	delete(m.removed, newpath)
+	return nil
+}
+
+func (m *MemFileSystem) MkdirAll(path string, perm os.FileMode) error { return nil }
+
+func (m *MemFileSystem) ReadDir(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	seen := make(map[string]bool)
+	names := []string{}
+	add := func(entry string) {
+		if !seen[entry] {
+			seen[entry] = true
+			names = append(names, entry)
+		}
+	}
+	for name := range m.files {
+		rest, found := strings.CutPrefix(name, prefix)
+		if !found {
+			continue
+		}
+		entry, _, _ := strings.Cut(rest, "/")
+		add(entry)
+	}
+	if m.lower(dir) {
+		lower, _ := m.Lower.ReadDir(dir)
+		for _, entry := range lower {
+			if !m.removed[prefix+entry] {
+				add(entry)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, notExist("open", dir)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// memInfo describes a file of a MemFileSystem, Sys returns a *syscall.Stat_t carrying the owner
+type memInfo struct {
+	name string
+	file *memFile
+}
+
+func (i memInfo) Name() string       { return filepath.Base(i.name) }
+func (i memInfo) Size() int64        { return i.file.size }
+func (i memInfo) Mode() os.FileMode  { return i.file.mode }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.file.mode.IsDir() }
+func (i memInfo) Sys() any {
+	return &syscall.Stat_t{Uid: uint32(i.file.uid), Gid: uint32(i.file.gid)}
+}
+
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[name]; ok {
+		return memInfo{name: name, file: f}, nil
+	}
+	if m.lower(name) {
+		if info, err := m.Lower.Stat(name); err == nil || !m.hasChildren(name) {
+			return info, err
+		}
+	}
+	if m.hasChildren(name) {
+		return memInfo{name: name, file: &memFile{mode: fs.ModeDir | 0755}}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (m *MemFileSystem) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.copyUp("chown", name)
+	if err != nil {
+		return err
+	}
+	f.uid, f.gid = uid, gid
+	return nil
+}
+
+func (m *MemFileSystem) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.copyUp("chmod", name)
+	if err != nil {
+		return err
+	}
+	f.mode = f.mode&^fs.ModePerm | mode.Perm()
+	return nil
+}
+
+func (m *MemFileSystem) Truncate(name string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.copyUp("truncate", name)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	}
+	f.size = size
+	return nil
+}
+
+// Names returns the paths of all files written in memory in lexical order
+func (m *MemFileSystem) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name, f := range m.files {
+		if !f.mode.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Removed returns the paths of the Lower files removed in memory in lexical order
+func (m *MemFileSystem) Removed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.removed))
+	for name := range m.removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
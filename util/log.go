@@ -0,0 +1,44 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+)
+
+// LogWriter is an io.Writer emitting every complete line written to it as a log record
+type LogWriter struct {
+	Log   *slog.Logger
+	Level slog.Level
+	Msg   string
+	buf   []byte
+}
+
+func NewLogWriter(log *slog.Logger, level slog.Level, msg string) *LogWriter {
+	return &LogWriter{Log: log, Level: level, Msg: msg}
+}
+
+func (w *LogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any trailing partial line
+func (w *LogWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *LogWriter) emit(line []byte) {
+	w.Log.Log(context.Background(), w.Level, w.Msg, "line", string(bytes.TrimSuffix(line, []byte{'\r'})))
+}
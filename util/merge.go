@@ -0,0 +1,106 @@
+package util
+
+import (
+	"reflect"
+)
+
+// Merge layers src on top of dst, both must be pointers to the same struct type.
+// Non-zero scalars in src replace the ones in dst, slices are appended, maps and
+// nested structs are merged recursively. Unexported fields are left alone and dst
+// never shares memory with src afterwards.
+func Merge(dst, src any) {
+	mergeValue(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem())
+}
+
+// DeepCopy returns a copy of v not sharing any pointers, slices or maps with it
+func DeepCopy[T any](v T) T {
+	return deepCopy(reflect.ValueOf(&v).Elem()).Interface().(T)
+}
+
+func mergeValue(dst, src reflect.Value) {
+	switch dst.Kind() {
+	case reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			if !dst.Type().Field(i).IsExported() {
+				continue
+			}
+			mergeValue(dst.Field(i), src.Field(i))
+		}
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		if dst.IsNil() || dst.Elem().Kind() != reflect.Struct {
+			dst.Set(deepCopy(src))
+			return
+		}
+		mergeValue(dst.Elem(), src.Elem())
+	case reflect.Slice:
+		if src.Len() == 0 {
+			return
+		}
+		merged := reflect.MakeSlice(dst.Type(), 0, dst.Len()+src.Len())
+		merged = reflect.AppendSlice(merged, dst)
+		merged = reflect.AppendSlice(merged, deepCopy(src))
+		dst.Set(merged)
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), src.Len()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+func deepCopy(src reflect.Value) reflect.Value {
+	switch src.Kind() {
+	case reflect.Pointer:
+		if src.IsNil() {
+			return src
+		}
+		retval := reflect.New(src.Elem().Type())
+		retval.Elem().Set(deepCopy(src.Elem()))
+		return retval
+	case reflect.Slice:
+		if src.IsNil() {
+			return src
+		}
+		retval := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			retval.Index(i).Set(deepCopy(src.Index(i)))
+		}
+		return retval
+	case reflect.Map:
+		if src.IsNil() {
+			return src
+		}
+		retval := reflect.MakeMapWithSize(src.Type(), src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			retval.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return retval
+	case reflect.Struct:
+		// copying the whole value first keeps unexported fields intact
+		retval := reflect.New(src.Type()).Elem()
+		retval.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if !src.Type().Field(i).IsExported() {
+				continue
+			}
+			retval.Field(i).Set(deepCopy(src.Field(i)))
+		}
+		return retval
+	default:
+		return src
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/coreos/go-systemd/unit"
+)
+
+// NetworkdDir is where host side networkd configuration is written
+const NetworkdDir = "/etc/systemd/network"
+
+// NetworkdRuntimeDir is NetworkdDir for configuration that vanishes on reboot
+const NetworkdRuntimeDir = "/run/systemd/network"
+
+// NetworkFiles manages .network, .netdev and .link files in Dir with the same diff semantics as EnsureUnit,
+// remembering whether anything changed so networkd is reloaded once at the end
+type NetworkFiles struct {
+	Dir     string
+	changed bool
+}
+
+func NewNetworkFiles(dir string) *NetworkFiles {
+	return &NetworkFiles{Dir: dir}
+}
+
+func (n *NetworkFiles) Path(name string) string {
+	return filepath.Join(n.Dir, name)
+}
+
+// Ensure writes name with opts, an empty opts removes the file
+func (n *NetworkFiles) Ensure(log *slog.Logger, name string, opts []*unit.UnitOption) (bool, error) {
+	changed, err := EnsureUnit(log, n.Path(name), opts)
+	if changed {
+		n.changed = true
+	}
+	return changed, err
+}
+
+func (n *NetworkFiles) Remove(log *slog.Logger, name string) (bool, error) {
+	return n.Ensure(log, name, nil)
+}
+
+// Changed reports whether any file was written or removed, networkd needs a reload then
+func (n *NetworkFiles) Changed() bool {
+	return n.changed
+}
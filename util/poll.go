@@ -0,0 +1,61 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff paces a polling loop, the wait starts at Interval and grows by Factor up to Max
+type Backoff struct {
+	// Interval is the first wait
+	Interval time.Duration
+	// Max caps the wait, the wait stays at Interval when it isn't above it
+	Max time.Duration
+	// Factor the wait grows by after every attempt, 1 or less keeps it constant
+	Factor float64
+	// Jitter randomizes every wait by up to this fraction in either direction so parallel loops spread out
+	Jitter float64
+}
+
+// Poller hands out the waits of a single loop
+type Poller struct {
+	backoff Backoff
+	next    time.Duration
+}
+
+// Poller starts a loop, a zero Interval polls every second
+func (b Backoff) Poller() *Poller {
+	if b.Interval <= 0 {
+		b.Interval = time.Second
+	}
+	return &Poller{backoff: b, next: b.Interval}
+}
+
+// Next returns the wait before the next attempt
+func (p *Poller) Next() time.Duration {
+	wait := p.next
+	if p.backoff.Factor > 1 && p.backoff.Max > p.next {
+		p.next = min(time.Duration(float64(p.next)*p.backoff.Factor), p.backoff.Max)
+	}
+	if jitter := min(p.backoff.Jitter, 1); jitter > 0 {
+		wait += time.Duration(float64(wait) * jitter * (2*rand.Float64() - 1))
+	}
+	return wait
+}
+
+func (p *Poller) Sleep() {
+	time.Sleep(p.Next())
+}
+
+// Wait sleeps for the next wait unless ctx is done first
+func (p *Poller) Wait(ctx context.Context) error {
+	timer := time.NewTimer(p.Next())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// openat2InRoot opens name inside root with flags, symlinks are resolved as the machine would so nothing outside
+// of root is reached even when the guest plants absolute ones
+func openat2InRoot(root, name string, flags, resolve uint64) (int, error) {
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat2(dir, name, &unix.OpenHow{Flags: flags | unix.O_CLOEXEC, Resolve: unix.RESOLVE_IN_ROOT | resolve})
+	if err != nil {
+		return -1, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return fd, nil
+}
+
+// OpenInRoot opens name read only inside the root directory of a machine, /proc/<leader>/root or an image
+func OpenInRoot(root, name string) (*os.File, error) {
+	fd, err := openat2InRoot(root, name, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// ReadFileInRoot is os.ReadFile for a file inside the root directory of a machine
+func ReadFileInRoot(root, name string) ([]byte, error) {
+	f, err := OpenInRoot(root, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// RemoveInRoot unlinks name inside the root directory of a machine. The parent is resolved in root and the last
+// component is removed as is, a symlink there is removed instead of what it points to.
+func RemoveInRoot(root, name string) error {
+	dir, err := openat2InRoot(root, path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := unix.Unlinkat(dir, path.Base(name), 0); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// OpenDirInRoot opens the directory name inside the root directory of a machine, files are then written through
+// /proc/self/fd so a symlink the guest swaps in later can't redirect them. Symlinks on the way are refused and
+// a missing last component is created.
+func OpenDirInRoot(root, name string) (*os.File, error) {
+	const flags = unix.O_PATH | unix.O_DIRECTORY
+	fd, err := openat2InRoot(root, name, flags, unix.RESOLVE_NO_SYMLINKS)
+	if errors.Is(err, fs.ErrNotExist) {
+		parent, perr := openat2InRoot(root, path.Dir(name), flags, unix.RESOLVE_NO_SYMLINKS)
+		if perr != nil {
+			return nil, perr
+		}
+		err = unix.Mkdirat(parent, path.Base(name), 0755)
+		unix.Close(parent)
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return nil, &fs.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		fd, err = openat2InRoot(root, name, flags, unix.RESOLVE_NO_SYMLINKS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
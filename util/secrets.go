@@ -0,0 +1,88 @@
+package util
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in logs, the audit log and reports
+const Redacted = "<redacted>"
+
+// ShowSecrets turns Redact into a no-op, for debugging what commands actually received
+var ShowSecrets bool
+
+var secrets struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// AddSecret makes Redact hide every occurrence of the values from now on, empty values are ignored
+func AddSecret(values ...string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	if secrets.values == nil {
+		secrets.values = make(map[string]bool)
+	}
+	added := false
+	for _, value := range values {
+		if value != "" && !secrets.values[value] {
+			secrets.values[value] = true
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	// longest first, a secret containing another one is hidden as a whole
+	sorted := make([]string, 0, len(secrets.values))
+	for value := range secrets.values {
+		sorted = append(sorted, value)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, value := range sorted {
+		pairs = append(pairs, value, Redacted)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces the secrets inside s unless ShowSecrets is set
+func Redact(s string) string {
+	if ShowSecrets {
+		return s
+	}
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// RedactAll returns a copy of args with the secrets replaced
+func RedactAll(args []string) []string {
+	retval := make([]string, len(args))
+	for i, arg := range args {
+		retval[i] = Redact(arg)
+	}
+	return retval
+}
+
+// RedactAttr is a slog ReplaceAttr function hiding secrets in string, string slice and error values
+func RedactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case []string:
+			return slog.Any(a.Key, RedactAll(v))
+		case error:
+			return slog.String(a.Key, Redact(v.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctlTermios(fd int, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IsTerminal reports whether fd refers to a terminal
+func IsTerminal(fd int) bool {
+	var t syscall.Termios
+	return ioctlTermios(fd, syscall.TCGETS, &t) == nil
+}
+
+// MakeRaw puts the terminal into raw mode, the returned function restores the previous state
+func MakeRaw(fd int) (func() error, error) {
+	var old syscall.Termios
+	if err := ioctlTermios(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	// same flags as cfmakeraw(3)
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return ioctlTermios(fd, syscall.TCSETS, &old)
+	}, nil
+}
@@ -0,0 +1,268 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing receives the spans of Trace, nil disables tracing
+var Tracing *Tracer
+
+// TraceFlushTimeout bounds sending the spans to the collector, a missing collector never fails a run
+var TraceFlushTimeout = 10 * time.Second
+
+// Tracer collects spans and exports them to an OTLP/HTTP collector with the JSON encoding.
+// Spans nest under the innermost open span, the run works on one machine at a time.
+type Tracer struct {
+	// Endpoint is the full traces URL, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	Headers  map[string]string
+	Service  string
+	Version  string
+	traceID  [16]byte
+	// parent of the outermost spans, set when TRACEPARENT names the span of a pipeline step running machineutil
+	parent [8]byte
+	mu     sync.Mutex
+	open   []*Span
+	done   []*Span
+}
+
+// Span is a single timed operation, the methods of a nil Span do nothing
+type Span struct {
+	tracer *Tracer
+	id     [8]byte
+	parent [8]byte
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	err    string
+}
+
+// OTLPEndpoint returns the traces endpoint the standard OpenTelemetry environment variables configure, if any
+func OTLPEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// NewTracer starts a trace exported to endpoint. It joins the trace of TRACEPARENT and takes the headers
+// and service name from OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME.
+func NewTracer(endpoint, version string) (*Tracer, error) {
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	t := &Tracer{Endpoint: endpoint, Headers: make(map[string]string), Service: "machineutil", Version: version}
+	if service := os.Getenv("OTEL_SERVICE_NAME"); service != "" {
+		t.Service = service
+	}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok {
+			continue
+		}
+		key, _ = url.QueryUnescape(strings.TrimSpace(key))
+		value, _ = url.QueryUnescape(strings.TrimSpace(value))
+		t.Headers[key] = value
+	}
+	if traceparent := os.Getenv("TRACEPARENT"); traceparent != "" {
+		if err := t.join(traceparent); err != nil {
+			return nil, fmt.Errorf("TRACEPARENT: %w", err)
+		}
+		return t, nil
+	}
+	_, err := rand.Read(t.traceID[:])
+	return t, err
+}
+
+// join continues the trace of a W3C traceparent, version-traceid-parentid-flags
+func (t *Tracer) join(traceparent string) error {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	if _, err := hex.Decode(t.traceID[:], []byte(parts[1])); err != nil {
+		return err
+	}
+	_, err := hex.Decode(t.parent[:], []byte(parts[2]))
+	return err
+}
+
+// Trace starts a span below the innermost open span, attrs are key value pairs
+func Trace(name string, attrs ...string) *Span {
+	t := Tracing
+	if t == nil {
+		return nil
+	}
+	s := t.span(name, attrs)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open = append(t.open, s)
+	return s
+}
+
+func (t *Tracer) span(name string, attrs []string) *Span {
+	s := &Span{tracer: t, name: name, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(s.id[:])
+	t.mu.Lock()
+	s.parent = t.parent
+	if len(t.open) > 0 {
+		s.parent = t.open[len(t.open)-1].id
+	}
+	t.mu.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Set(attrs[i], attrs[i+1])
+	}
+	return s
+}
+
+// Set adds an attribute, secrets in value are redacted
+func (s *Span) Set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = Redact(value)
+}
+
+// End finishes the span, a non-nil err marks it failed
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = Redact(err.Error())
+	}
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i := slices.Index(t.open, s); i >= 0 {
+		t.open = slices.Delete(t.open, i, i+1)
+	}
+	t.done = append(t.done, s)
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        uint64          `json:"startTimeUnixNano,string"`
+	End          uint64          `json:"endTimeUnixNano,string"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// OTLP span kind and status codes
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+func attributes(attrs map[string]string) []otlpAttribute {
+	retval := make([]otlpAttribute, 0, len(attrs))
+	for key, value := range attrs {
+		retval = append(retval, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i].Key < retval[j].Key })
+	return retval
+}
+
+// payload encodes spans as an OTLP ExportTraceServiceRequest
+func (t *Tracer) payload(spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(t.traceID[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       otlpKindInternal,
+			Start:      uint64(s.start.UnixNano()),
+			End:        uint64(s.end.UnixNano()),
+			Attributes: attributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		encoded = append(encoded, span)
+	}
+	resource := map[string]string{"service.name": t.Service}
+	if t.Version != "" {
+		resource["service.version"] = t.Version
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": attributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "machineutil"},
+				"spans": encoded,
+			}},
+		}},
+	})
+}
+
+// Flush sends the finished spans to the collector, spans still open are sent by a later Flush
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans := t.done
+	t.done = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	data, err := t.payload(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.Headers {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: TraceFlushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting %d spans: %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("exporting %d spans: %s", len(spans), resp.Status)
+	}
+	return nil
+}
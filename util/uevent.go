@@ -0,0 +1,94 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelUevents is the netlink group of the kernel's uevents, udev rebroadcasts them on group 2 once
+// its rules ran but with a header of its own. Callers wait for udev to settle before looking at the nodes.
+const kernelUevents = 1
+
+// WatchUSB emits the action and vendor:product of the USB devices with one of ids that are plugged in or removed,
+// e.g. "add 10c4:ea60". ids are vendor:product in hex as lsusb prints them.
+func WatchUSB(ctx context.Context, ids []string) (<-chan string, error) {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[strings.ToLower(id)] = true
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: kernelUevents}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		defer unix.Close(fd)
+		buf := make([]byte, 64*1024)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for ctx.Err() == nil {
+			// poll with a timeout so cancellation is noticed
+			n, err := unix.Poll(fds, 500)
+			if err == unix.EINTR || n == 0 {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			n, err = unix.Read(fd, buf)
+			if err != nil {
+				continue
+			}
+			action, id, ok := usbEvent(buf[:n])
+			if !ok || !wanted[id] {
+				continue
+			}
+			select {
+			case events <- action + " " + id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// usbEvent parses a kernel uevent, action@devpath followed by KEY=value pairs, all separated by NUL.
+// PRODUCT carries vendor/product/release in hex without leading zeros, id is turned into vendor:product.
+func usbEvent(msg []byte) (action, id string, ok bool) {
+	fields := strings.Split(string(msg), "\x00")
+	env := make(map[string]string, len(fields))
+	for _, field := range fields[1:] {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			env[key] = value
+		}
+	}
+	// the interfaces of a device come with events of their own
+	if env["SUBSYSTEM"] != "usb" || env["DEVTYPE"] != "usb_device" {
+		return "", "", false
+	}
+	if env["ACTION"] != "add" && env["ACTION"] != "remove" {
+		return "", "", false
+	}
+	product := strings.Split(env["PRODUCT"], "/")
+	if len(product) < 2 {
+		return "", "", false
+	}
+	vendor, err := strconv.ParseUint(product[0], 16, 16)
+	if err != nil {
+		return "", "", false
+	}
+	model, err := strconv.ParseUint(product[1], 16, 16)
+	if err != nil {
+		return "", "", false
+	}
+	return env["ACTION"], fmt.Sprintf("%04x:%04x", vendor, model), true
+}
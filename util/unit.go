@@ -1,12 +1,16 @@
 package util
 
 import (
+	"bytes"
 	"cmp"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 
 	"github.com/coreos/go-systemd/unit"
 )
@@ -24,18 +28,14 @@ func CompareOptions(a, b *unit.UnitOption) int {
 }
 
 func ReadUnit(file_path string, sorted bool) ([]*unit.UnitOption, error) {
+	data, err := Files.ReadFile(file_path)
 	// Non-existant file can be "wanted empty" -> just handle the error here
-	if _, err := os.Stat(file_path); os.IsNotExist(err) {
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(file_path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	opts, err := unit.Deserialize(f)
+	opts, err := unit.Deserialize(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -45,9 +45,11 @@ func ReadUnit(file_path string, sorted bool) ([]*unit.UnitOption, error) {
 	return opts, nil
 }
 
-func WriteUnit(file_path string, opts []*unit.UnitOption) error {
+func WriteUnit(file_path string, opts []*unit.UnitOption) (err error) {
+	span := Trace("write unit", "file.path", file_path)
+	defer func() { span.End(err) }()
 	exists := true
-	if _, err := os.Stat(file_path); os.IsNotExist(err) {
+	if _, err := Files.ReadFile(file_path); errors.Is(err, fs.ErrNotExist) {
 		exists = false
 	} else if err != nil {
 		return err
@@ -55,31 +57,143 @@ func WriteUnit(file_path string, opts []*unit.UnitOption) error {
 	// empty unit files can cause problems
 	if len(opts) == 0 {
 		if exists {
-			return os.Remove(file_path)
+			return Files.Remove(file_path)
 		}
 		return nil
 	}
 	// *usually* we are writing overrides or more obscure things and we really need to ensure directory creation
-	if err := os.MkdirAll(filepath.Dir(file_path), 0755); err != nil {
+	if err := Files.MkdirAll(filepath.Dir(file_path), 0755); err != nil {
 		return err
 	}
-	f, err := os.Create(file_path)
+	data, err := io.ReadAll(unit.Serialize(opts))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, unit.Serialize(opts))
-	return err
+	return Files.WriteFile(file_path, data, 0644)
+}
+
+// Marker is added to every generated file, files without it are managed by hand and left alone.
+// The value is fixed, anything changing with the config would rewrite every file and restart every machine.
+const Marker = "X-MachineUtil"
+
+const markerValue = "generated"
+
+var ErrNotGenerated error = errors.New("not generated by machineutil")
+
+// LabelsOption carries one key=value label of the machine in its settings file, systemd ignores X- settings
+const LabelsOption = "X-Labels"
+
+// TemplateOption records the template image a machine was cloned from in its settings file
+const TemplateOption = "X-Template"
+
+// LabelOptions turns labels into LabelsOption settings of section, sorted to keep the file stable
+func LabelOptions(section string, labels map[string]string) []*unit.UnitOption {
+	retval := make([]*unit.UnitOption, 0, len(labels))
+	for key, value := range labels {
+		retval = append(retval, &unit.UnitOption{Section: section, Name: LabelsOption, Value: key + "=" + value})
+	}
+	slices.SortFunc(retval, CompareOptions)
+	return retval
+}
+
+// ParseLabels collects the labels from the LabelsOption settings in opts
+func ParseLabels(opts []*unit.UnitOption) map[string]string {
+	retval := map[string]string{}
+	for _, opt := range opts {
+		if opt.Name != LabelsOption {
+			continue
+		}
+		if key, value, found := strings.Cut(opt.Value, "="); found {
+			retval[key] = value
+		}
+	}
+	return retval
 }
 
+// configuration reports whether systemd looks at opt, the Marker, labels and template are only read by machineutil
+func configuration(opt *unit.UnitOption) bool {
+	return opt.Name != Marker && opt.Name != LabelsOption && opt.Name != TemplateOption
+}
+
+// Force lets EnsureUnit take over files without the Marker
+var Force bool
+
+// WithMarker adds the Marker to the section of the first option, nothing is added to empty files as they are removed
+func WithMarker(opts []*unit.UnitOption) []*unit.UnitOption {
+	if len(opts) == 0 {
+		return opts
+	}
+	return append(slices.Clone(opts), &unit.UnitOption{Section: opts[0].Section, Name: Marker, Value: markerValue})
+}
+
+// IsGenerated reports whether the existing file with opts was written by machineutil, which is known by the Marker alone.
+// Files without it are hand written as far as machineutil is concerned, Force takes them over.
+func IsGenerated(opts []*unit.UnitOption) bool {
+	for _, opt := range opts {
+		if opt.Name == Marker {
+			return true
+		}
+	}
+	return false
+}
+
+// adoption says which files without the Marker are taken over without Force, releases before it wrote none
+type adoption int
+
+const (
+	adoptNone adoption = iota
+	// adoptMatching takes over files already saying what would be written
+	adoptMatching
+	// adoptAny takes over every file, for paths nothing but machineutil writes to
+	adoptAny
+)
+
+// EnsureUnit writes opts to file_path unless they are there already and reports whether anything changed.
+// Existing files without the Marker are only replaced with Force.
 func EnsureUnit(log *slog.Logger, file_path string, in_opts []*unit.UnitOption) (bool, error) {
+	return ensureUnit(log, file_path, in_opts, adoptNone)
+}
+
+// EnsureOwnedUnit is EnsureUnit for a path only machineutil writes to, a file there without the Marker is
+// from an older release and taken over whatever it says
+func EnsureOwnedUnit(log *slog.Logger, file_path string, in_opts []*unit.UnitOption) (bool, error) {
+	return ensureUnit(log, file_path, in_opts, adoptAny)
+}
+
+// EnsureMatchingUnit is EnsureUnit for a path that may be written by hand as well, a file there without the Marker
+// is only taken over when systemd would see no difference
+func EnsureMatchingUnit(log *slog.Logger, file_path string, in_opts []*unit.UnitOption) (bool, error) {
+	return ensureUnit(log, file_path, in_opts, adoptMatching)
+}
+
+func ensureUnit(log *slog.Logger, file_path string, in_opts []*unit.UnitOption, adopting adoption) (bool, error) {
 	unit_opts, err := ReadUnit(file_path, true)
 	if err != nil {
 		return false, err
 	}
-	opts := slices.Clone(in_opts)
+	opts := WithMarker(in_opts)
 	slices.SortFunc(opts, CompareOptions)
 	add, keep, remove := SliceDiffFunc(opts, unit_opts, CompareOptions)
+	// adding the marker to an older file or changing bookkeeping changes nothing systemd looks at
+	adopt := len(add)+len(remove) > 0 && !slices.ContainsFunc(append(add, remove...), configuration)
+	if unit_opts != nil && !IsGenerated(unit_opts) {
+		switch {
+		case adopting == adoptAny || (adopting == adoptMatching && adopt):
+			if log != nil {
+				log.Info("Adopting file written before the marker", "unit", file_path)
+			}
+		case !Force:
+			return false, fmt.Errorf("refusing to replace %s: %w, force to take it over", file_path, ErrNotGenerated)
+		case log != nil:
+			log.Warn("Taking over file without marker", "unit", file_path)
+		}
+	}
+	if adopt {
+		if log != nil {
+			log.Debug("Updating bookkeeping", "unit", file_path)
+		}
+		return false, WriteUnit(file_path, opts)
+	}
 	if log != nil {
 		unit_log := log.With("unit", file_path)
 		for _, opt := range add {
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-systemd/unit"
+)
+
+func TestEnsureUnitAdoption(t *testing.T) {
+	files := Files
+	t.Cleanup(func() { Files = files })
+	opts := []*unit.UnitOption{{Section: "Exec", Name: "Boot", Value: "yes"}}
+	older := []byte("[Exec]\nBoot=yes\n")
+	changed := []byte("[Exec]\nBoot=no\n")
+	for _, tc := range []struct {
+		name    string
+		ensure  func(string, []*unit.UnitOption) (bool, error)
+		data    []byte
+		refused bool
+	}{
+		{"plain", func(p string, o []*unit.UnitOption) (bool, error) { return EnsureUnit(nil, p, o) }, older, true},
+		{"matching", func(p string, o []*unit.UnitOption) (bool, error) { return EnsureMatchingUnit(nil, p, o) }, older, false},
+		{"matching changed", func(p string, o []*unit.UnitOption) (bool, error) { return EnsureMatchingUnit(nil, p, o) }, changed, true},
+		{"owned changed", func(p string, o []*unit.UnitOption) (bool, error) { return EnsureOwnedUnit(nil, p, o) }, changed, false},
+	} {
+		Files = NewMemFileSystem()
+		if err := Files.WriteFile("/etc/systemd/nspawn/web.nspawn", tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := tc.ensure("/etc/systemd/nspawn/web.nspawn", opts)
+		if refused := errors.Is(err, ErrNotGenerated); refused != tc.refused {
+			t.Errorf("%s: refused %v, want %v (%v)", tc.name, refused, tc.refused, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		written, err := ReadUnit("/etc/systemd/nspawn/web.nspawn", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsGenerated(written) {
+			t.Errorf("%s: adopted file has no marker", tc.name)
+		}
+	}
+}
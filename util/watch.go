@@ -0,0 +1,72 @@
+package util
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchFiles emits the path of a file in files whenever it is written, replaced or removed.
+// The parent directories are watched since editors usually replace files instead of writing them in place.
+func WatchFiles(ctx context.Context, files []string) (<-chan string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	dirs := map[int]string{}
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		wanted[abs] = true
+		dir := filepath.Dir(abs)
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE|unix.IN_DELETE)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		dirs[wd] = dir
+	}
+	changes := make(chan string, 16)
+	go func() {
+		defer close(changes)
+		defer unix.Close(fd)
+		buf := make([]byte, 64*1024)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for ctx.Err() == nil {
+			// poll with a timeout so cancellation is noticed
+			n, err := unix.Poll(fds, 500)
+			if err == unix.EINTR || n == 0 {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			n, err = unix.Read(fd, buf)
+			if err != nil {
+				continue
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				offset += unix.SizeofInotifyEvent + int(event.Len)
+				path := filepath.Join(dirs[int(event.Wd)], strings.TrimRight(string(nameBytes), "\x00"))
+				if !wanted[path] {
+					continue
+				}
+				select {
+				case changes <- path:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
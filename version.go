@@ -0,0 +1,60 @@
+package machineutil
+
+import (
+	"runtime/debug"
+)
+
+// MinimumSystemdVersion is the oldest systemd release machineutil is known to work with
+const MinimumSystemdVersion = 249
+
+type BuildInfo struct {
+	Version               string
+	Commit                string
+	CommitTime            string
+	Modified              bool
+	GoVersion             string
+	MinimumSystemdVersion int
+}
+
+func GetBuildInfo() BuildInfo {
+	retval := BuildInfo{
+		Version:               "(devel)",
+		MinimumSystemdVersion: MinimumSystemdVersion,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return retval
+	}
+	retval.GoVersion = info.GoVersion
+	if info.Main.Version != "" {
+		retval.Version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			retval.Commit = setting.Value
+		case "vcs.time":
+			retval.CommitTime = setting.Value
+		case "vcs.modified":
+			retval.Modified = setting.Value == "true"
+		}
+	}
+	return retval
+}
+
+func (b BuildInfo) String() string {
+	retval := "machineutil " + b.Version
+	if b.Commit != "" {
+		retval += " commit " + b.Commit
+		if b.Modified {
+			retval += "-dirty"
+		}
+	}
+	if b.CommitTime != "" {
+		retval += " (" + b.CommitTime + ")"
+	}
+	if b.GoVersion != "" {
+		retval += " " + b.GoVersion
+	}
+	return retval
+}
@@ -0,0 +1,135 @@
+package machineutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/eax255/systemd-containers/machineutil/util"
+)
+
+const (
+	ClassContainer = "container"
+	ClassVM        = "vm"
+)
+
+// ProcArp lists the IPv4 neighbours of the host, VMs are found there by their tap interface
+var ProcArp = "/proc/net/arp"
+
+// MachineUnit is the unit running machine name of class, systemd-nspawn@ for containers and systemd-vmspawn@ for VMs
+func MachineUnit(class, name string) string {
+	if class == ClassVM {
+		return "systemd-vmspawn@" + name + ".service"
+	}
+	return "systemd-nspawn@" + name + ".service"
+}
+
+// class returns Class, machines looked up without a config are VMs when a generated vmspawn unit exists for them
+func (m *Machine) class() string {
+	if m.Class != "" {
+		return m.Class
+	}
+	for _, dir := range []string{"/etc/systemd", "/run/systemd"} {
+		if _, err := util.Files.ReadFile(dir + "/system/" + MachineUnit(ClassVM, m.Name)); err == nil {
+			return ClassVM
+		}
+	}
+	return ClassContainer
+}
+
+// IsVM reports whether the machine runs under systemd-vmspawn
+func (m *Machine) IsVM() bool {
+	return m.class() == ClassVM
+}
+
+// shortenIfnameKey is SHORTEN_IFNAME_HASH_KEY of systemd, the names have to hash alike
+var shortenIfnameKey = [16]byte{0xe1, 0x90, 0xa4, 0x04, 0xa8, 0xef, 0x4b, 0x51, 0x8c, 0xcc, 0xc3, 0x3a, 0x9f, 0x11, 0xfc, 0xa2}
+
+// TapInterface is the host side of the network of a VM, named by vmspawn through net_shorten_ifname()
+func (m *Machine) TapInterface() string {
+	return shortenIfname("vt-" + m.Name)
+}
+
+// shortenIfname fits a name into the 15 characters the kernel allows the way systemd does: the first 11 are
+// kept and the lower 24 bits of the siphash of the whole name follow in url-safe base64
+func shortenIfname(name string) string {
+	if len(name) < 16 {
+		return name
+	}
+	const base64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	h := siphash24([]byte(name), shortenIfnameKey)
+	return name[:11] + string([]byte{base64[h>>18&63], base64[h>>12&63], base64[h>>6&63], base64[h&63]})
+}
+
+// siphash24 is SipHash-2-4 as systemd uses it for stable names
+func siphash24(data []byte, key [16]byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	n := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		compress(binary.LittleEndian.Uint64(data))
+	}
+	// the tail is padded with zeroes and the length goes into the top byte
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(n)
+	compress(binary.LittleEndian.Uint64(last[:]))
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// neighbourAddresses reads the addresses the host has seen on the tap interface of a VM, machined only knows
+// the addresses of containers. Only IPv4 is covered, a VM shows up once it talked to the host.
+func (m *Machine) neighbourAddresses() ([]netip.Addr, error) {
+	data, err := util.Files.ReadFile(ProcArp)
+	if err != nil {
+		return nil, err
+	}
+	retval := []netip.Addr{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	// IP address, HW type, Flags, HW address, Mask, Device after a header line
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != m.TapInterface() {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		// ATF_COM, the entry is complete
+		if err != nil || flags&0x2 == 0 {
+			continue
+		}
+		if addr, err := netip.ParseAddr(fields[0]); err == nil {
+			retval = append(retval, addr)
+		}
+	}
+	return retval, nil
+}
@@ -0,0 +1,89 @@
+package machineutil
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+var machineRemovedMatch = []dbus.MatchOption{
+	dbus.WithMatchInterface(machinedDbusInterface),
+	dbus.WithMatchMember("MachineRemoved"),
+}
+
+// watchRemoved subscribes to MachineRemoved on conn, release undoes it
+func watchRemoved(conn *dbus.Conn) (chan *dbus.Signal, func(), error) {
+	err := conn.AddMatchSignal(machineRemovedMatch...)
+	if err != nil {
+		return nil, nil, err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	return signals, func() {
+		conn.RemoveSignal(signals)
+		conn.RemoveMatchSignal(machineRemovedMatch...)
+	}, nil
+}
+
+// WatchMachines emits the name of every machine machined unregisters until ctx is done.
+// The subscription moves to a new connection when the bus goes away.
+func (c *machineUtil) WatchMachines(ctx context.Context) (<-chan string, error) {
+	conn := c.bus()
+	signals, release, err := watchRemoved(conn)
+	if err != nil {
+		return nil, err
+	}
+	names := make(chan string, 16)
+	go func() {
+		defer close(names)
+		defer func() { release() }()
+		delay := ReconnectDelay
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case signal, ok := <-signals:
+				if !ok {
+					if c.isClosed() {
+						return
+					}
+					slog.Warn("Lost the system bus connection, resubscribing to machined")
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
+					if !conn.Connected() {
+						if err := c.reconnect(conn); err != nil {
+							slog.Warn("Reconnecting to the system bus", "error", err)
+							delay = min(2*delay, time.Minute)
+							continue
+						}
+					}
+					conn = c.bus()
+					resubscribed, resubscribedRelease, err := watchRemoved(conn)
+					if err != nil {
+						slog.Warn("Resubscribing to machined", "error", err)
+						delay = min(2*delay, time.Minute)
+						continue
+					}
+					signals, release, delay = resubscribed, resubscribedRelease, ReconnectDelay
+					continue
+				}
+				if signal.Name != machinedDbusInterface+".MachineRemoved" || len(signal.Body) < 1 {
+					continue
+				}
+				if name, ok := signal.Body[0].(string); ok {
+					select {
+					case names <- name:
+					default:
+						// the consumer only needs to know something happened
+					}
+				}
+			}
+		}
+	}()
+	return names, nil
+}